@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/datadog/threatest/pkg/threatest"
+	"github.com/datadog/threatest/pkg/threatest/matchers"
+	"github.com/datadog/threatest/pkg/threatest/matchers/datadog"
+	"github.com/datadog/threatest/pkg/threatest/matchers/elastic"
+	"github.com/datadog/threatest/pkg/threatest/parser"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CleanupCommand implements the command cleaning up the alerts of the detonations persisted by previous runs,
+// e.g. when a run crashed before cleaning them up itself
+type CleanupCommand struct {
+	StateFile string
+	// Since only cleans up the detonations more recent than this duration, zero meaning all of them
+	Since time.Duration
+}
+
+func NewCleanupCommand() *cobra.Command {
+	var stateFile string
+	var since time.Duration
+
+	cleanupCmd := &cobra.Command{
+		Use:          "cleanup",
+		Short:        "Clean up the alerts of detonations persisted by previous runs",
+		SilenceUsage: true,
+		Example:      "cleanup --state .threatest-state.json --since 24h",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			command := CleanupCommand{
+				StateFile: stateFile,
+				Since:     since,
+			}
+			return command.Do()
+		},
+	}
+
+	cleanupCmd.Flags().StringVarP(&stateFile, "state", "", getDefaultStateFile(), "State file the detonations were persisted to by 'threatest run'. Can also be set through THREATEST_STATE_FILE")
+	cleanupCmd.Flags().DurationVarP(&since, "since", "", 0, "Only clean up the detonations more recent than this duration, e.g. 24h")
+
+	return cleanupCmd
+}
+
+func (m *CleanupCommand) Do() error {
+	if m.StateFile == "" {
+		return errors.New("please provide a state file")
+	}
+	if m.Since < 0 {
+		return errors.New("--since cannot be negative")
+	}
+	state, err := threatest.LoadRunState(m.StateFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := interruptibleContext()
+	defer stop()
+
+	var cleanedUp []string
+	var numFailed int
+	for _, run := range state.Runs {
+		detonations := m.selectDetonations(run)
+		if len(detonations) == 0 || ctx.Err() != nil {
+			continue
+		}
+		log.Infof("Cleaning up the alerts of %d detonations of run %s, started at %s", len(detonations), run.RunId, run.StartTime.Format(time.RFC3339))
+		scenarios := resolveScenarios(run)
+		for _, detonation := range detonations {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := cleanupRecordedDetonation(ctx, detonation, scenarios[detonation.Scenario]); err != nil {
+				numFailed++
+				log.Errorf("Unable to clean up the alerts of detonation %s of scenario '%s': %v", detonation.DetonationUuid, detonation.Scenario, err)
+				continue
+			}
+			cleanedUp = append(cleanedUp, detonation.DetonationUuid)
+		}
+	}
+
+	// Forget the detonations cleaned up, keeping the ones that failed to be retried later on
+	if err := threatest.UpdateRunState(m.StateFile, func(state *threatest.RunState) {
+		state.RemoveDetonations(cleanedUp)
+	}); err != nil {
+		return err
+	}
+	log.Infof("Cleaned up the alerts of %d detonations", len(cleanedUp))
+
+	if ctx.Err() != nil {
+		return errors.New("interrupted before all detonations were cleaned up")
+	}
+	if numFailed > 0 {
+		return fmt.Errorf("unable to clean up the alerts of %d detonations", numFailed)
+	}
+	return nil
+}
+
+// selectDetonations returns the detonations of a run to clean up
+func (m *CleanupCommand) selectDetonations(run *threatest.RunRecord) []*threatest.DetonationRecord {
+	if m.Since == 0 {
+		return run.Detonations
+	}
+	since := time.Now().Add(-m.Since)
+	var detonations []*threatest.DetonationRecord
+	for _, detonation := range run.Detonations {
+		if detonationTime(detonation).After(since) {
+			detonations = append(detonations, detonation)
+		}
+	}
+	return detonations
+}
+
+// detonationTime returns when a detonation started, or ended if its start is unknown
+func detonationTime(detonation *threatest.DetonationRecord) time.Time {
+	if detonation.StartTime.IsZero() {
+		return detonation.EndTime
+	}
+	return detonation.StartTime
+}
+
+// resolveScenarios parses the input files of a run again, to retrieve the matchers of its scenarios by name
+func resolveScenarios(run *threatest.RunRecord) map[string][]*threatest.Scenario {
+	scenarios := map[string][]*threatest.Scenario{}
+	for _, inputFile := range run.InputFiles {
+		rawScenario, err := os.ReadFile(inputFile)
+		if err != nil {
+			log.Warnf("unable to read input file %s, falling back to the backends recorded in the state file: %v", inputFile, err)
+			continue
+		}
+		// Detonators are not used, hence a placeholder SSH host
+		parsedScenarios, err := parser.Parse(rawScenario, "unused", "", "")
+		if err != nil {
+			log.Warnf("unable to parse input file %s, falling back to the backends recorded in the state file: %v", inputFile, err)
+			continue
+		}
+		for _, scenario := range parsedScenarios {
+			scenarios[scenario.Name] = append(scenarios[scenario.Name], scenario)
+		}
+	}
+	return scenarios
+}
+
+// cleanupRecordedDetonation closes the alerts of a detonation on every backend its scenario used
+func cleanupRecordedDetonation(ctx context.Context, detonation *threatest.DetonationRecord, scenarios []*threatest.Scenario) error {
+	if len(scenarios) == 0 {
+		scenarios = []*threatest.Scenario{fallbackScenario(detonation)}
+	}
+
+	var allMatchers []matchers.AlertGeneratedMatcher
+	for _, scenario := range scenarios {
+		for _, assertion := range scenario.Assertions {
+			allMatchers = append(allMatchers, assertion.AlertGeneratedMatcher)
+		}
+	}
+	// A backend is missing when its credentials changed, in which case the detonation is kept in the state file
+	var errs []error
+	resolvedBackends := matchers.Backends(allMatchers)
+	for _, backend := range detonation.Backends {
+		if !slices.Contains(resolvedBackends, backend) {
+			errs = append(errs, fmt.Errorf("backend '%s' is not configured anymore", backend))
+		}
+	}
+
+	// Alerts may be older than the window matchers search in by default
+	searchWindow := time.Since(detonationTime(detonation)) + time.Hour
+	ctx = matchers.WithSearchWindow(matchers.WithDetonation(ctx, detonation.Detonation()), searchWindow)
+
+	// Scenarios with the same name can't be told apart, so each of them cleans up the detonation
+	runner := threatest.Threatest()
+	for _, scenario := range scenarios {
+		if err := runner.SweepDetonations(ctx, scenario, []string{detonation.DetonationUuid}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fallbackScenario returns a scenario matching any alert on the backends recorded for a detonation, with
+// the credentials from the environment, for when the scenario it was detonated by is not available anymore
+func fallbackScenario(detonation *threatest.DetonationRecord) *threatest.Scenario {
+	scenario := &threatest.Scenario{Name: detonation.Scenario}
+	var backendTypes []string
+	for _, backend := range detonation.Backends {
+		backendType, _, _ := strings.Cut(backend, " ")
+		if slices.Contains(backendTypes, backendType) {
+			continue
+		}
+		backendTypes = append(backendTypes, backendType)
+		switch backendType {
+		case "datadog":
+			scenario.Assertions = append(scenario.Assertions, threatest.Assertion{AlertGeneratedMatcher: datadog.DatadogSecuritySignal("")})
+		case "elastic":
+			scenario.Assertions = append(scenario.Assertions, threatest.Assertion{AlertGeneratedMatcher: elastic.ElasticSecurityAlert("")})
+		}
+	}
+	return scenario
+}
@@ -13,6 +13,7 @@ var rootCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(NewRunCommand())
 	rootCmd.AddCommand(NewLintCommand())
+	rootCmd.AddCommand(NewCleanupCommand())
 }
 
 func main() {
@@ -1,48 +1,130 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/datadog/threatest/pkg/threatest"
+	"github.com/datadog/threatest/pkg/threatest/detonators"
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/datadog/threatest/pkg/threatest/parser"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"math"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 )
 
 // RunCommand implements the command to run Threatest test scenarios
 type RunCommand struct {
-	SSHConfig      *SSHConfiguration
-	InputFiles     []string
-	Parallelism    int
-	JsonOutputFile string
+	SSHConfig         *SSHConfiguration
+	InputFiles        []string
+	Parallelism       int
+	JsonOutputFile    string
+	CleanupDelay      time.Duration
+	FinalCleanupSweep bool
+	// StateFile is where detonations are persisted for "threatest cleanup", empty to disable it
+	StateFile string
+	// RecordCassette and ReplayCassette are files to record the exchanges of matchers with their backend to,
+	// or to replay them from
+	RecordCassette string
+	ReplayCassette string
+
+	stateListener *threatest.StateListener
+	cassette      *matchers.Cassette
 }
 
 type SSHConfiguration struct {
 	SSHHost     string
 	SSHUsername string
 	SSHKey      string
+	// InsecureIgnoreHostKey disables the verification of the host key of the SSH server
+	InsecureIgnoreHostKey bool
+	// TrustOnFirstUse adds the host key of an unknown SSH server to known_hosts instead of rejecting it
+	TrustOnFirstUse bool
+}
+
+// options returns the options of the SSH connections of remote detonators
+func (m *SSHConfiguration) options() parser.SSHOptions {
+	options := parser.SSHOptions{Hostname: m.SSHHost, Username: m.SSHUsername, KeyFile: m.SSHKey}
+	if m.InsecureIgnoreHostKey {
+		options.HostKeyPolicy = detonators.HostKeyPolicyInsecure
+	} else if m.TrustOnFirstUse {
+		options.HostKeyPolicy = detonators.HostKeyPolicyTrustOnFirstUse
+	}
+	return options
 }
 
 type ScenarioRunResult struct {
-	Description     string    `json:"description"`
-	Success         bool      `json:"isSuccess"`
-	ErrorMessage    string    `json:"errorMessage"`
-	DurationSeconds float64   `json:"durationSeconds"`
-	TimeDetonated   time.Time `json:"timeDetonated"`
+	Description         string               `json:"description"`
+	Success             bool                 `json:"isSuccess"`
+	ErrorMessage        string               `json:"errorMessage"`
+	ErrorKind           threatest.ErrorKind  `json:"errorKind,omitempty"`
+	DurationSeconds     float64              `json:"durationSeconds"`
+	TimeDetonated       time.Time            `json:"timeDetonated"`
+	TimeDetonationEnded time.Time            `json:"timeDetonationEnded"`
+	DetonationUuid      string               `json:"detonationUuid"`
+	Detonation          *DetonationRunResult `json:"detonation,omitempty"`
+	Assertions          []AssertionRunResult `json:"assertions"`
+	Flaky               bool                 `json:"isFlaky"`
+	Interrupted         bool                 `json:"isInterrupted,omitempty"`
+	Attempts            []AttemptRunResult   `json:"attempts,omitempty"`
 	//TODO: We possibly want to add some metadata about the kind of detonation
+
+	// scenario is the scenario the result is about, whose matchers clean up its detonations
+	scenario *threatest.Scenario
+	// result holds the detonations of the scenario, whose targets and timing are used to correlate their alerts
+	result *threatest.ScenarioResult
+}
+
+type AttemptRunResult struct {
+	Success        bool                 `json:"isSuccess"`
+	ErrorMessage   string               `json:"errorMessage"`
+	ErrorKind      threatest.ErrorKind  `json:"errorKind,omitempty"`
+	TimeDetonated  time.Time            `json:"timeDetonated"`
+	DetonationUuid string               `json:"detonationUuid"`
+	Detonation     *DetonationRunResult `json:"detonation,omitempty"`
+	Assertions     []AssertionRunResult `json:"assertions"`
+}
+
+// DetonationRunResult describes how the attack of a scenario was detonated, to troubleshoot failing scenarios
+type DetonationRunResult struct {
+	Target        string                `json:"target,omitempty"`
+	ExitCode      *int                  `json:"exitCode,omitempty"`
+	Stdout        string                `json:"stdout,omitempty"`
+	Stderr        string                `json:"stderr,omitempty"`
+	AWSRequestIds []string              `json:"awsRequestIds,omitempty"`
+	Steps         []DetonationRunResult `json:"steps,omitempty"`
+	Warnings      []string              `json:"warnings,omitempty"`
+}
+
+type AssertionRunResult struct {
+	Description         string                    `json:"description"`
+	Status              threatest.AssertionStatus `json:"status"`
+	TimeToDetectSeconds float64                   `json:"timeToDetectSeconds,omitempty"`
+	// AlertCount is only set for assertions expecting a number of alerts
+	AlertCount   *int   `json:"alertCount,omitempty"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
 }
 
 func NewRunCommand() *cobra.Command {
 	var sshHost string
 	var sshUsername string
 	var sshKey string
+	var sshInsecureIgnoreHostKey bool
+	var sshTrustOnFirstUse bool
 	var parallelism int
 	var jsonOutputFile string
+	var cleanupDelay time.Duration
+	var finalCleanupSweep bool
+	var stateFile string
+	var recordCassette string
+	var replayCassette string
 
 	runCmd := &cobra.Command{
 		Use:          "run",
@@ -51,13 +133,20 @@ func NewRunCommand() *cobra.Command {
 		Example:      "run /path/to/scenario/1 [/path/to/scenario/2]...",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			command := RunCommand{
-				InputFiles:     args,
-				Parallelism:    parallelism,
-				JsonOutputFile: jsonOutputFile,
+				InputFiles:        args,
+				Parallelism:       parallelism,
+				JsonOutputFile:    jsonOutputFile,
+				CleanupDelay:      cleanupDelay,
+				FinalCleanupSweep: finalCleanupSweep,
+				StateFile:         stateFile,
+				RecordCassette:    recordCassette,
+				ReplayCassette:    replayCassette,
 				SSHConfig: &SSHConfiguration{
-					SSHHost:     sshHost,
-					SSHUsername: sshUsername,
-					SSHKey:      sshKey,
+					SSHHost:               sshHost,
+					SSHUsername:           sshUsername,
+					SSHKey:                sshKey,
+					InsecureIgnoreHostKey: sshInsecureIgnoreHostKey,
+					TrustOnFirstUse:       sshTrustOnFirstUse,
 				},
 			}
 
@@ -68,7 +157,14 @@ func NewRunCommand() *cobra.Command {
 	runCmd.Flags().StringVarP(&sshHost, "ssh-host", "", os.Getenv("THREATEST_SSH_HOST"), "SSH host to connect to for remote command detonation. Can also be specified through THREATEST_SSH_HOST")
 	runCmd.Flags().StringVarP(&sshUsername, "ssh-username", "", os.Getenv("THREATEST_SSH_USERNAME"), "SSH username to use for remote command detonation  (leave empty to use system configuration). Can also be specified through THREATEST_SSH_USERNAME")
 	runCmd.Flags().StringVarP(&sshKey, "ssh-key", "", os.Getenv("THREATEST_SSH_KEY"), "SSH keypair to use for remote command detonation (leave empty to use system configuration). Can also be specified through THREATEST_SSH_KEY. Only unencrypted keys are currently supported")
+	runCmd.Flags().BoolVarP(&sshInsecureIgnoreHostKey, "ssh-insecure-ignore-host-key", "", false, "Don't verify the host key of the SSH server, leaving remote command detonation open to man-in-the-middle attacks. By default, host keys are verified against known_hosts, honoring StrictHostKeyChecking and UserKnownHostsFile from the SSH configuration")
+	runCmd.Flags().BoolVarP(&sshTrustOnFirstUse, "ssh-trust-on-first-use", "", false, "Add the host key of an unknown SSH server to known_hosts instead of failing, like StrictHostKeyChecking=accept-new. Host keys that differ from the known ones are still rejected")
 	runCmd.Flags().StringVarP(&jsonOutputFile, "output", "o", "", "Write JSON test results to the specified file")
+	runCmd.Flags().DurationVarP(&cleanupDelay, "cleanup-delay", "", 0, "Time to wait after the assertions of a scenario completed before cleaning up its alerts, to also clean up alerts generated late")
+	runCmd.Flags().BoolVarP(&finalCleanupSweep, "final-cleanup-sweep", "", false, "Clean up again the alerts of every detonation once all scenarios completed")
+	runCmd.Flags().StringVarP(&stateFile, "state", "", getDefaultStateFile(), "File to persist detonations to, so that their alerts can be cleaned up with 'threatest cleanup' if the run doesn't complete. Set to an empty value to disable. Can also be set through THREATEST_STATE_FILE")
+	runCmd.Flags().StringVarP(&recordCassette, "record", "", "", "Record the requests to Datadog and Elastic and their responses to a cassette file, without credentials")
+	runCmd.Flags().StringVarP(&replayCassette, "replay", "", "", "Replay the responses of Datadog and Elastic from a cassette file recorded with --record, instead of querying them")
 	runCmd.Flags().IntVarP(&parallelism, "max-parallelism", "", getDefaultParallelism(), "Maximal parallelism to run the scenarios with. Can also be set through THREATEST_MAX_PARALLELISM")
 
 	return runCmd
@@ -86,11 +182,25 @@ func getDefaultParallelism() int {
 	return DefaultParallelism
 }
 
+func getDefaultStateFile() string {
+	const DefaultStateFile = ".threatest-state.json"
+	if stateFile, isSet := os.LookupEnv("THREATEST_STATE_FILE"); isSet {
+		return stateFile
+	}
+	return DefaultStateFile
+}
+
 func (m *RunCommand) Do() error {
 	if err := m.Validate(); err != nil {
 		return err
 	}
 
+	// Matchers use the cassette when they are created, hence before parsing scenarios
+	if err := m.loadCassette(); err != nil {
+		return err
+	}
+	defer func() { matchers.DefaultCassette = nil }()
+
 	var allScenarios []*threatest.Scenario
 
 	for _, inputFile := range m.InputFiles {
@@ -98,17 +208,32 @@ func (m *RunCommand) Do() error {
 		if err != nil {
 			return fmt.Errorf("unable to read input file %s: %v", inputFile, err)
 		}
-		scenario, err := parser.Parse(rawScenario, m.SSHConfig.SSHHost, m.SSHConfig.SSHUsername, m.SSHConfig.SSHKey)
+		scenario, err := parser.ParseWithSSHOptions(rawScenario, m.SSHConfig.options())
 		if err != nil {
 			return fmt.Errorf("unable to parse input file %s: %v", inputFile, err)
 		}
 		allScenarios = append(allScenarios, scenario...)
 	}
 
+	if m.StateFile != "" {
+		if err := m.startPersistingState(); err != nil {
+			return err
+		}
+		defer m.stopPersistingState()
+	}
+
+	ctx, stop := interruptibleContext()
+	defer stop()
+
 	var hasError = false
-	results := m.runScenariosParallel(allScenarios, func(result *ScenarioRunResult) {
+	results := m.runScenariosParallel(ctx, allScenarios, func(result *ScenarioRunResult) {
 		roundedDuration := math.Round(result.DurationSeconds*100) / 100
-		if result.Success {
+		if result.Interrupted {
+			hasError = true
+			log.Warnf("Scenario '%s' was interrupted after %.2f seconds", result.Description, roundedDuration)
+		} else if result.Flaky {
+			log.Warnf("Scenario '%s' passed in %.2f seconds, but only after %d attempts", result.Description, roundedDuration, len(result.Attempts))
+		} else if result.Success {
 			log.Infof("Scenario '%s' passed in %.2f seconds", result.Description, roundedDuration)
 		} else {
 			hasError = true
@@ -116,6 +241,17 @@ func (m *RunCommand) Do() error {
 		}
 	})
 
+	if m.FinalCleanupSweep {
+		m.sweepDetonations(results)
+	}
+
+	if m.RecordCassette != "" {
+		if err := m.cassette.Save(); err != nil {
+			return err
+		}
+		log.Infof("Recorded the exchanges with detection backends to %s", m.RecordCassette)
+	}
+
 	// Handle output file
 	if m.JsonOutputFile != "" {
 		if err := m.writeJsonOutput(results); err != nil {
@@ -125,6 +261,9 @@ func (m *RunCommand) Do() error {
 	}
 
 	// Return an error to exit with a non-zero status code if at least one test failed
+	if ctx.Err() != nil {
+		return errors.New("interrupted before all scenarios completed")
+	}
 	if hasError {
 		return fmt.Errorf("at least 1 scenario failed")
 	} else {
@@ -137,6 +276,14 @@ func (m *RunCommand) Validate() error {
 		return errors.New("please provide at least 1 scenario")
 	}
 
+	if m.RecordCassette != "" && m.ReplayCassette != "" {
+		return errors.New("--record and --replay cannot be used together")
+	}
+
+	if m.SSHConfig.InsecureIgnoreHostKey && m.SSHConfig.TrustOnFirstUse {
+		return errors.New("--ssh-insecure-ignore-host-key and --ssh-trust-on-first-use cannot be used together")
+	}
+
 	// If an SSH key is provided, check it exists
 	if sshKey := m.SSHConfig.SSHKey; sshKey != "" {
 		if _, err := os.Stat(sshKey); err != nil && sshKey != "" {
@@ -147,9 +294,84 @@ func (m *RunCommand) Validate() error {
 	return nil
 }
 
+// loadCassette makes matchers record their exchanges with their backend, or replay them, if requested
+func (m *RunCommand) loadCassette() error {
+	path, mode := m.RecordCassette, matchers.CassetteRecord
+	if m.ReplayCassette != "" {
+		path, mode = m.ReplayCassette, matchers.CassetteReplay
+	}
+	if path == "" {
+		return nil
+	}
+	cassette, err := matchers.NewCassette(path, mode)
+	if err != nil {
+		return err
+	}
+	m.cassette = cassette
+	matchers.DefaultCassette = cassette
+	return nil
+}
+
+// startPersistingState records the run in the state file, so that its detonations are persisted as they happen
+func (m *RunCommand) startPersistingState() error {
+	var inputFiles []string
+	for _, inputFile := range m.InputFiles {
+		// Scenarios are parsed again when cleaning up, possibly from another directory
+		absoluteInputFile, err := filepath.Abs(inputFile)
+		if err != nil {
+			return fmt.Errorf("unable to resolve input file %s: %v", inputFile, err)
+		}
+		inputFiles = append(inputFiles, absoluteInputFile)
+	}
+	stateListener, err := threatest.NewStateListener(m.StateFile, inputFiles)
+	if err != nil {
+		return fmt.Errorf("unable to persist the state of the run: %w", err)
+	}
+	log.Debugf("Persisting the state of run %s to %s", stateListener.RunId(), m.StateFile)
+	m.stateListener = stateListener
+	return nil
+}
+
+func (m *RunCommand) stopPersistingState() {
+	if err := m.stateListener.Close(); err != nil {
+		log.Warnf("unable to persist the state of the run: %v", err)
+	}
+}
+
+// interruptibleContext returns a context cancelled on SIGINT or SIGTERM, so that running scenarios are interrupted
+// and cleaned up, and scenarios not started yet are skipped. A second signal exits right away.
+func interruptibleContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case _, received := <-signals:
+			if !received {
+				// The channel is closed once the command completed, which isn't an interruption
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		log.Warn("Interrupted, cleaning up running scenarios. Interrupt again to exit right away")
+		cancel()
+		if _, received := <-signals; received {
+			log.Error("Interrupted again, exiting without waiting for cleanup to complete")
+			os.Exit(130)
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+		close(signals)
+	}
+}
+
 // runScenariosParallel runs all the provided scenarios in parallel, honoring the maximum parallelism
-// every time a test completes, the callback function is invoked
-func (m *RunCommand) runScenariosParallel(allScenarios []*threatest.Scenario, callback func(result *ScenarioRunResult)) []ScenarioRunResult {
+// every time a test completes, the callback function is invoked. Once the context is cancelled, scenarios
+// that didn't start yet are reported as interrupted without being run.
+func (m *RunCommand) runScenariosParallel(ctx context.Context, allScenarios []*threatest.Scenario, callback func(result *ScenarioRunResult)) []ScenarioRunResult {
 	numWorkers := m.Parallelism
 	// No point in having more workers than scenarios to run
 	if numScenarios := len(allScenarios); numScenarios < numWorkers {
@@ -165,13 +387,16 @@ func (m *RunCommand) runScenariosParallel(allScenarios []*threatest.Scenario, ca
 
 	// Create 1 worker by desired parallelism unit
 	for worker := 0; worker < numWorkers; worker++ {
-		go m.runSingleScenario(scenarioChan, resultsChan)
+		go m.runSingleScenario(ctx, scenarioChan, resultsChan)
 	}
 
 	// Submit each scenario
-	for _, scenario := range allScenarios {
-		scenarioChan <- scenario
-	}
+	go func() {
+		for _, scenario := range allScenarios {
+			scenarioChan <- scenario
+		}
+		close(scenarioChan)
+	}()
 
 	// Retrieve results as they are produced
 	var allResults []ScenarioRunResult
@@ -185,27 +410,134 @@ func (m *RunCommand) runScenariosParallel(allScenarios []*threatest.Scenario, ca
 }
 
 // runSingleScenario runs inside a goroutine and uses Threatest to run one scenario
-func (m *RunCommand) runSingleScenario(scenarios <-chan *threatest.Scenario, results chan<- *ScenarioRunResult) {
+func (m *RunCommand) runSingleScenario(ctx context.Context, scenarios <-chan *threatest.Scenario, results chan<- *ScenarioRunResult) {
 	for scenario := range scenarios {
+		if ctx.Err() != nil {
+			results <- &ScenarioRunResult{
+				Description:  scenario.Name,
+				ErrorMessage: "not run: interrupted",
+				ErrorKind:    threatest.ErrorKindCancelled,
+				Interrupted:  true,
+				Assertions:   []AssertionRunResult{},
+				scenario:     scenario,
+			}
+			continue
+		}
 		runner := threatest.Threatest()
 		runner.Scenarios = append(runner.Scenarios, scenario)
 		runner.Interval = 2 * time.Second
+		runner.CleanupDelay = m.CleanupDelay
+		if m.stateListener != nil {
+			runner.AddListener(m.stateListener)
+		}
+		if m.cassette != nil {
+			runner.AddListener(&threatest.CassetteListener{Cassette: m.cassette})
+		}
 
 		start := time.Now()
-		err := runner.Run()
+		runResult, _ := runner.RunWithResults(ctx)
 		end := time.Now()
 
-		var errorMessage = ""
-		if err != nil {
-			errorMessage = err.Error()
+		result := newScenarioRunResult(runResult.Scenarios[0], end.Sub(start))
+		result.scenario = scenario
+		result.result = runResult.Scenarios[0]
+		results <- result
+	}
+}
+
+// newScenarioRunResult converts the result of a scenario to its JSON output representation
+func newScenarioRunResult(scenarioResult *threatest.ScenarioResult, duration time.Duration) *ScenarioRunResult {
+	// Only report attempts when the scenario was retried
+	var attempts []AttemptRunResult
+	if len(scenarioResult.Attempts) > 1 {
+		for _, attempt := range scenarioResult.Attempts {
+			attempts = append(attempts, AttemptRunResult{
+				Success:        attempt.Success(),
+				ErrorMessage:   errorMessage(attempt.Error),
+				ErrorKind:      attempt.ErrorKind,
+				TimeDetonated:  attempt.DetonationStart,
+				DetonationUuid: attempt.DetonationUuid,
+				Detonation:     newDetonationRunResult(attempt.Detonation),
+				Assertions:     newAssertionRunResults(attempt.Assertions),
+			})
+		}
+	}
+
+	return &ScenarioRunResult{
+		Description:         scenarioResult.Name,
+		ErrorMessage:        errorMessage(scenarioResult.Error),
+		ErrorKind:           scenarioResult.ErrorKind,
+		Success:             scenarioResult.Success(),
+		DurationSeconds:     duration.Seconds(),
+		TimeDetonated:       scenarioResult.DetonationStart,
+		TimeDetonationEnded: scenarioResult.DetonationEnd,
+		DetonationUuid:      scenarioResult.DetonationUuid,
+		Detonation:          newDetonationRunResult(scenarioResult.Detonation),
+		Assertions:          newAssertionRunResults(scenarioResult.Assertions),
+		Flaky:               scenarioResult.Flaky(),
+		Interrupted:         scenarioResult.ErrorKind == threatest.ErrorKindCancelled,
+		Attempts:            attempts,
+	}
+}
+
+func newDetonationRunResult(detonation *detonators.DetonationResult) *DetonationRunResult {
+	if detonation == nil {
+		return nil
+	}
+	result := &DetonationRunResult{
+		Target:        detonation.Target,
+		ExitCode:      detonation.ExitCode,
+		Stdout:        detonation.Stdout,
+		Stderr:        detonation.Stderr,
+		AWSRequestIds: detonation.AWSRequestIds,
+		Warnings:      detonation.Warnings,
+	}
+	for _, step := range detonation.Steps {
+		result.Steps = append(result.Steps, *newDetonationRunResult(step))
+	}
+	return result
+}
+
+func newAssertionRunResults(assertionResults []*threatest.AssertionResult) []AssertionRunResult {
+	assertions := []AssertionRunResult{}
+	for _, assertionResult := range assertionResults {
+		assertionRunResult := AssertionRunResult{
+			Description:         assertionResult.Assertion.String(),
+			Status:              assertionResult.Status,
+			TimeToDetectSeconds: assertionResult.TimeToDetect.Seconds(),
+			ErrorMessage:        errorMessage(assertionResult.Error),
+		}
+		if counting, ok := assertionResult.Assertion.AlertGeneratedMatcher.(matchers.CountingMatcher); ok && counting.ExpectedCount() != nil {
+			alertCount := assertionResult.AlertCount
+			assertionRunResult.AlertCount = &alertCount
+		}
+		assertions = append(assertions, assertionRunResult)
+	}
+	return assertions
+}
+
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// sweepDetonations cleans up the alerts of every detonation, on every backend used by the scenario that detonated it
+func (m *RunCommand) sweepDetonations(results []ScenarioRunResult) {
+	runner := threatest.Threatest()
+	for _, result := range results {
+		if result.scenario == nil || result.result == nil {
+			continue
+		}
+		detonationUuids := result.result.DetonationUuids()
+		if len(detonationUuids) == 0 {
+			continue
 		}
 
-		results <- &ScenarioRunResult{
-			Description:     scenario.Name,
-			ErrorMessage:    errorMessage,
-			Success:         err == nil,
-			DurationSeconds: end.Sub(start).Seconds(),
-			TimeDetonated:   start,
+		log.Infof("Cleaning up alerts of %d detonations of scenario '%s'", len(detonationUuids), result.Description)
+		if err := runner.SweepScenarioResult(context.Background(), result.scenario, result.result); err != nil {
+			log.Warnf("warning: failed to clean up generated signals: %s", err.Error())
 		}
 	}
 }
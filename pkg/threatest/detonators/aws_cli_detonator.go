@@ -4,10 +4,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"os"
-	"os/exec"
+	"time"
 )
 
 /*
@@ -16,34 +15,67 @@ in the user-agent.
 */
 type AWSCLIDetonator struct {
 	Script string
+	// Checks verifies that the script ran as expected. By default, the detonation fails if the script exits with a non-zero code.
+	Checks DetonationChecks
 }
 
 func NewAWSCLIDetonator(script string) *AWSCLIDetonator {
 	return &AWSCLIDetonator{Script: script}
 }
 
+// WithChecks verifies that the script ran as expected, e.g. to tolerate commands that are expected to be denied
+func (m *AWSCLIDetonator) WithChecks(checks DetonationChecks) *AWSCLIDetonator {
+	m.Checks = checks
+	return m
+}
+
 func (m *AWSCLIDetonator) Detonate() (string, error) {
-	detonationUuid := uuid.New()
+	return detonationUuid(m.DetonateContext(context.Background()))
+}
+
+func (m *AWSCLIDetonator) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	correlationId, err := newDetonationUuid(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// Sanity check: are we authenticated to AWS?
-	awsConfig, err := config.LoadDefaultConfig(context.Background())
+	awsConfig, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
-		return "", fmt.Errorf("unable to load AWS configuration: %v", err)
+		return nil, fmt.Errorf("unable to load AWS configuration: %v", err)
 	}
-	_, err = awsConfig.Credentials.Retrieve(context.Background())
+	_, err = awsConfig.Credentials.Retrieve(ctx)
 	if err != nil {
-		return "", fmt.Errorf("you are not authenticated to AWS")
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("you are not authenticated to AWS")
 	}
 
-	cmd := exec.Command("bash", "-c", m.Script)
+	result := &DetonationResult{DetonationUuid: correlationId.String(), Target: awsAccountId(ctx, awsConfig)}
+	var stdout, stderr cappedBuffer
+	cmd := bashCommand(ctx, m.Script)
 	cmd.Env = os.Environ() // inherit environment
-	cmd.Env = append(cmd.Env, "AWS_EXECUTION_ENV=threatest_"+detonationUuid.String())
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("AWS CLI script failed. Output shown below:\n%s", output)
+	cmd.Env = append(cmd.Env, "AWS_EXECUTION_ENV=threatest_"+correlationId.String())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	result.StartTime = time.Now()
+	err = cmd.Run()
+	result.EndTime = time.Now()
+	result.ExitCode = exitCode(err)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("AWS CLI script interrupted: %w", ctx.Err())
+	}
+	if err != nil && result.ExitCode == nil {
+		return result, fmt.Errorf("unable to run AWS CLI script: %v", err)
+	}
+	if err := m.Checks.verify(result, FailurePolicyFail); err != nil {
+		return result, fmt.Errorf("AWS CLI script failed: %v. Output shown below:\n%s%s", err, result.Stdout, result.Stderr)
 	}
 
-	log.Infof("Execution ID: %s", detonationUuid)
+	log.Infof("Execution ID: %s", correlationId)
 
-	return detonationUuid.String(), nil
+	return result, nil
 }
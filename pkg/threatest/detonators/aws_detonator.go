@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/aws/smithy-go/middleware"
 	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"slices"
+	"sync"
+	"time"
 )
 
 /*
@@ -23,17 +29,100 @@ func NewAWSDetonator(DetonationFunc func(aws.Config, uuid.UUID) error) *AWSDeton
 }
 
 func (m *AWSDetonator) Detonate() (string, error) {
-	detonationUuid := uuid.New()
-	awsConfig, err := config.LoadDefaultConfig(context.Background(), customUserAgentApiOptions(detonationUuid))
+	return detonationUuid(m.DetonateContext(context.Background()))
+}
+
+// DetonateContext runs the detonation function with an AWS configuration bound to the context: once it is cancelled,
+// pending and subsequent AWS API calls fail, so that the detonation function returns early
+func (m *AWSDetonator) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	correlationId, err := newDetonationUuid(ctx)
 	if err != nil {
-		return "", fmt.Errorf("unable to authenticate to AWS: %v", err)
+		return nil, err
+	}
+	requestIds := &requestIdRecorder{}
+	awsConfig, err := config.LoadDefaultConfig(ctx,
+		customUserAgentApiOptions(correlationId),
+		cancellationApiOptions(ctx),
+		config.WithAPIOptions([]func(*middleware.Stack) error{requestIds.register}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to authenticate to AWS: %v", err)
 	}
 
-	if err := m.DetonationFunc(awsConfig, detonationUuid); err != nil {
-		return "", err
+	result := &DetonationResult{DetonationUuid: correlationId.String(), Target: awsAccountId(ctx, awsConfig)}
+	result.StartTime = time.Now()
+	err = m.DetonationFunc(awsConfig, correlationId)
+	result.EndTime = time.Now()
+	result.AWSRequestIds = requestIds.get()
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("AWS detonation interrupted: %w", ctx.Err())
+	}
+	if err != nil {
+		return result, err
 	}
 
-	return detonationUuid.String(), nil
+	return result, nil
+}
+
+// awsAccountId returns the ID of the AWS account the configuration is authenticated against, or an empty string
+// if it cannot be determined
+func awsAccountId(ctx context.Context, awsConfig aws.Config) string {
+	// Don't attribute this call to the detonation
+	plainConfig := awsConfig.Copy()
+	plainConfig.APIOptions = nil
+	identity, err := sts.NewFromConfig(plainConfig).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil || identity.Account == nil {
+		log.Debugf("unable to retrieve the current AWS account ID: %v", err)
+		return ""
+	}
+	return *identity.Account
+}
+
+// requestIdRecorder records the request IDs of the AWS API calls made with a configuration
+type requestIdRecorder struct {
+	lock       sync.Mutex
+	requestIds []string
+}
+
+func (m *requestIdRecorder) register(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RecordRequestId", func(
+		ctx context.Context, input middleware.InitializeInput, next middleware.InitializeHandler,
+	) (out middleware.InitializeOutput, metadata middleware.Metadata, err error) {
+		out, metadata, err = next.HandleInitialize(ctx, input)
+		if requestId, ok := awsmiddleware.GetRequestIDMetadata(metadata); ok {
+			m.lock.Lock()
+			m.requestIds = append(m.requestIds, requestId)
+			m.lock.Unlock()
+		}
+		return out, metadata, err
+	}), middleware.After)
+}
+
+func (m *requestIdRecorder) get() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return slices.Clone(m.requestIds)
+}
+
+// cancellationApiOptions makes every AWS API call fail once the detonation context is cancelled,
+// regardless of the context the detonation function uses for its calls
+func cancellationApiOptions(detonationCtx context.Context) config.LoadOptionsFunc {
+	return config.WithAPIOptions([]func(stack *middleware.Stack) error{
+		func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("DetonationCancellation", func(
+				ctx context.Context, input middleware.InitializeInput, next middleware.InitializeHandler,
+			) (out middleware.InitializeOutput, metadata middleware.Metadata, err error) {
+				if err := detonationCtx.Err(); err != nil {
+					return out, metadata, err
+				}
+				callCtx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				stop := context.AfterFunc(detonationCtx, cancel)
+				defer stop()
+				return next.HandleInitialize(callCtx, input)
+			}), middleware.Before)
+		},
+	})
 }
 
 // Functions below are related to customization of the user-agent header
@@ -0,0 +1,123 @@
+package detonators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DetonationStep is a step of a multi-step attack
+type DetonationStep struct {
+	Detonator Detonator
+	// Delay is how long to wait before running the step
+	Delay time.Duration
+}
+
+// ChainDetonator detonates the steps of a multi-step attack in sequence, e.g. reconnaissance followed by
+// credential access and exfiltration. All steps inject the same detonation UUID, so that alerts triggered
+// by any of them (or by their combination) are correlated with the chain.
+type ChainDetonator struct {
+	Steps []DetonationStep
+}
+
+func NewChainDetonator(steps ...DetonationStep) *ChainDetonator {
+	return &ChainDetonator{Steps: steps}
+}
+
+// fixedUuidDetonator is implemented by detonators that always inject the same UUID, such as Stratus Red Team
+type fixedUuidDetonator interface {
+	fixedDetonationUuid() string
+}
+
+func (m *ChainDetonator) Detonate() (string, error) {
+	return detonationUuid(m.DetonateContext(context.Background()))
+}
+
+// DetonateContext runs every step, stopping at the first one that fails. The result describes the whole chain,
+// while the result of each step is available in DetonationResult.Steps.
+func (m *ChainDetonator) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	if len(m.Steps) == 0 {
+		return nil, errors.New("attack chain has no steps")
+	}
+	// Only context-aware detonators can be given the UUID to inject
+	for i, step := range m.Steps {
+		if _, ok := step.Detonator.(ContextDetonator); !ok {
+			return nil, fmt.Errorf("step %d of the attack chain (%T) does not support shared detonation UUIDs", i+1, step.Detonator)
+		}
+	}
+	chainUuid, err := m.chainUuid(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = WithDetonationUuid(ctx, chainUuid)
+
+	result := &DetonationResult{DetonationUuid: chainUuid, StartTime: time.Now()}
+	defer func() {
+		result.EndTime = time.Now()
+		result.Target = strings.Join(stepTargets(result.Steps), ", ")
+	}()
+	for i, step := range m.Steps {
+		if step.Delay > 0 {
+			log.Infof("Waiting %s before step %d of the attack chain", step.Delay, i+1)
+			select {
+			case <-ctx.Done():
+				return result, fmt.Errorf("attack chain interrupted before step %d: %w", i+1, ctx.Err())
+			case <-time.After(step.Delay):
+			}
+		}
+
+		stepResult, err := WithContext(step.Detonator).DetonateContext(ctx)
+		if stepResult != nil {
+			result.Steps = append(result.Steps, stepResult)
+			result.AWSRequestIds = append(result.AWSRequestIds, stepResult.AWSRequestIds...)
+			for _, warning := range stepResult.Warnings {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("step %d: %s", i+1, warning))
+			}
+		}
+		if err != nil {
+			return result, fmt.Errorf("step %d of %d of the attack chain failed: %w", i+1, len(m.Steps), err)
+		}
+		if stepResult == nil || stepResult.DetonationUuid != chainUuid {
+			return result, fmt.Errorf("step %d of the attack chain (%T) does not support shared detonation UUIDs", i+1, step.Detonator)
+		}
+	}
+	return result, nil
+}
+
+// chainUuid returns the UUID shared by all steps of the chain
+func (m *ChainDetonator) chainUuid(ctx context.Context) (string, error) {
+	var fixedUuid string
+	for _, step := range m.Steps {
+		detonator, ok := step.Detonator.(fixedUuidDetonator)
+		if !ok {
+			continue
+		}
+		if fixedUuid != "" && detonator.fixedDetonationUuid() != fixedUuid {
+			return "", fmt.Errorf("steps of the attack chain inject different detonation UUIDs %s and %s", fixedUuid, detonator.fixedDetonationUuid())
+		}
+		fixedUuid = detonator.fixedDetonationUuid()
+	}
+	if fixedUuid != "" {
+		return fixedUuid, nil
+	}
+	detonationUuid, err := newDetonationUuid(ctx)
+	if err != nil {
+		return "", err
+	}
+	return detonationUuid.String(), nil
+}
+
+// stepTargets returns the distinct targets of the steps of a chain
+func stepTargets(steps []*DetonationResult) []string {
+	var targets []string
+	for _, step := range steps {
+		if step.Target != "" && !slices.Contains(targets, step.Target) {
+			targets = append(targets, step.Target)
+		}
+	}
+	return targets
+}
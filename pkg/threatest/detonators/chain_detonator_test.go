@@ -0,0 +1,106 @@
+package detonators
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingDetonator records the detonation UUID it is given, and reports it
+type recordingDetonator struct {
+	target         string
+	err            error
+	detonationUuid string
+	detonatedAt    time.Time
+}
+
+func (m *recordingDetonator) Detonate() (string, error) {
+	return detonationUuid(m.DetonateContext(context.Background()))
+}
+
+func (m *recordingDetonator) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	m.detonatedAt = time.Now()
+	id, err := newDetonationUuid(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.detonationUuid = id.String()
+	return &DetonationResult{DetonationUuid: m.detonationUuid, Target: m.target}, m.err
+}
+
+func TestChainDetonatorSharesDetonationUuid(t *testing.T) {
+	recon := &recordingDetonator{target: "host-1"}
+	credentialAccess := &recordingDetonator{target: "host-2"}
+	exfiltration := &recordingDetonator{target: "host-1"}
+	chain := NewChainDetonator(
+		DetonationStep{Detonator: recon},
+		DetonationStep{Detonator: credentialAccess, Delay: 100 * time.Millisecond},
+		DetonationStep{Detonator: exfiltration},
+	)
+
+	result, err := chain.DetonateContext(context.Background())
+	require.NoError(t, err)
+	assert.NotEmpty(t, result.DetonationUuid)
+	assert.Equal(t, result.DetonationUuid, recon.detonationUuid)
+	assert.Equal(t, result.DetonationUuid, credentialAccess.detonationUuid)
+	assert.Equal(t, result.DetonationUuid, exfiltration.detonationUuid)
+	assert.GreaterOrEqual(t, credentialAccess.detonatedAt.Sub(recon.detonatedAt), 100*time.Millisecond)
+	assert.Len(t, result.Steps, 3)
+	assert.Equal(t, "host-1, host-2", result.Target)
+}
+
+func TestChainDetonatorUsesDetonationUuidFromContext(t *testing.T) {
+	step := &recordingDetonator{}
+	detonationUuid := "9a4fc6a5-3a8f-4a5e-a1e4-2f7a1a2b5c3d"
+	result, err := NewChainDetonator(DetonationStep{Detonator: step}).DetonateContext(WithDetonationUuid(context.Background(), detonationUuid))
+	require.NoError(t, err)
+	assert.Equal(t, detonationUuid, result.DetonationUuid)
+	assert.Equal(t, detonationUuid, step.detonationUuid)
+}
+
+func TestChainDetonatorStopsAtFailingStep(t *testing.T) {
+	failing := &recordingDetonator{err: errors.New("access denied")}
+	next := &recordingDetonator{}
+	result, err := NewChainDetonator(DetonationStep{Detonator: failing}, DetonationStep{Detonator: next}).DetonateContext(context.Background())
+	assert.EqualError(t, err, "step 1 of 2 of the attack chain failed: access denied")
+	assert.Len(t, result.Steps, 1)
+	assert.Empty(t, next.detonationUuid, "the next step should not run")
+}
+
+func TestChainDetonatorRejectsStepsNotSupportingSharedUuids(t *testing.T) {
+	legacy := &blockingDetonator{release: make(chan struct{})}
+	close(legacy.release)
+	first := &recordingDetonator{}
+	_, err := NewChainDetonator(DetonationStep{Detonator: first}, DetonationStep{Detonator: legacy}).DetonateContext(context.Background())
+	assert.ErrorContains(t, err, "step 2 of the attack chain (*detonators.blockingDetonator) does not support shared detonation UUIDs")
+	assert.Empty(t, first.detonationUuid, "no step should run")
+}
+
+func TestChainDetonatorUsesStratusRedTeamExecutionId(t *testing.T) {
+	stratus := &StratusRedTeamDetonator{}
+	chain := NewChainDetonator(DetonationStep{Detonator: &recordingDetonator{}}, DetonationStep{Detonator: stratus})
+	chainUuid, err := chain.chainUuid(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, stratus.fixedDetonationUuid(), chainUuid)
+
+	_, err = stratus.DetonateContext(WithDetonationUuid(context.Background(), "9a4fc6a5-3a8f-4a5e-a1e4-2f7a1a2b5c3d"))
+	assert.ErrorContains(t, err, "Stratus Red Team detonations can only use the execution ID")
+}
+
+func TestChainDetonatorIsInterruptedDuringDelays(t *testing.T) {
+	next := &recordingDetonator{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := NewChainDetonator(DetonationStep{Detonator: next, Delay: 1 * time.Hour}).DetonateContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, next.detonationUuid)
+}
+
+func TestInvalidDetonationUuidIsRejected(t *testing.T) {
+	_, err := newDetonationUuid(WithDetonationUuid(context.Background(), "; rm -rf /"))
+	assert.ErrorContains(t, err, "invalid detonation UUID")
+}
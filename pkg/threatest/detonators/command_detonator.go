@@ -1,5 +1,12 @@
 package detonators
 
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
 //TODO probably not a full struct needed
 type OSLayerAttackTechnique struct {
 	Command string
@@ -9,9 +16,20 @@ type CommandDetonator interface {
 	RunCommand(command string) (string, error)
 }
 
+// ContextCommandDetonator is a CommandDetonator that kills the command and cleans up after it when the context
+// is cancelled, and describes how the command ran
+type ContextCommandDetonator interface {
+	CommandDetonator
+	RunCommandContext(ctx context.Context, command string) (*DetonationResult, error)
+}
+
 type CommandDetonatorImpl struct {
 	Detonator CommandDetonator
 	Technique *OSLayerAttackTechnique
+	// Checks verifies that the command ran as expected. By default, the exit code of the command is ignored.
+	Checks DetonationChecks
+	// Correlation defines how the detonation UUID is injected into the command, defaulting to RenamedInterpreterCorrelation
+	Correlation CorrelationStrategy
 }
 
 func NewCommandDetonator(detonator CommandDetonator, command string) *CommandDetonatorImpl {
@@ -21,6 +39,44 @@ func NewCommandDetonator(detonator CommandDetonator, command string) *CommandDet
 	}
 }
 
+// WithChecks verifies that the command ran as expected, e.g. to report a typo in the command as a detonation failure
+func (m *CommandDetonatorImpl) WithChecks(checks DetonationChecks) *CommandDetonatorImpl {
+	m.Checks = checks
+	return m
+}
+
+// WithCorrelationStrategy defines how the detonation UUID is injected into the command, e.g. when the security
+// product doesn't report the path of the parent process of the command
+func (m *CommandDetonatorImpl) WithCorrelationStrategy(strategy CorrelationStrategy) *CommandDetonatorImpl {
+	m.Correlation = strategy
+	return m
+}
+
 func (m *CommandDetonatorImpl) Detonate() (string, error) {
-	return m.Detonator.RunCommand(m.Technique.Command)
+	return detonationUuid(m.DetonateContext(context.Background()))
+}
+
+func (m *CommandDetonatorImpl) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	if detonator, ok := m.Detonator.(ContextCommandDetonator); ok {
+		if m.Correlation != nil {
+			if err := m.Correlation.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid correlation strategy: %v", err)
+			}
+			ctx = WithCorrelationStrategy(ctx, m.Correlation)
+		}
+		result, err := detonator.RunCommandContext(ctx, m.Technique.Command)
+		if err != nil {
+			return result, err
+		}
+		return result, m.Checks.verify(result, FailurePolicyIgnore)
+	}
+	if m.Checks.policy(FailurePolicyIgnore) != FailurePolicyIgnore {
+		log.Warnf("%T does not report how commands ran, detonation checks are skipped", m.Detonator)
+	}
+	if m.Correlation != nil {
+		log.Warnf("%T does not support correlation strategies, the correlation strategy is ignored", m.Detonator)
+	}
+	return runWithContext(ctx, func() (string, error) {
+		return m.Detonator.RunCommand(m.Technique.Command)
+	})
 }
@@ -0,0 +1,269 @@
+package detonators
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DetonationUuidLabel is the label holding the detonation UUID on the ephemeral containers and pods created to run
+// commands
+const DetonationUuidLabel = "threatest.detonation-uuid"
+
+// ContainerCommandExecutor runs commands in a Docker container through the Docker Engine API, either in an existing
+// container, or in an ephemeral container created from an image for each command and removed afterwards.
+// The default correlation strategy requires bash in the container.
+type ContainerCommandExecutor struct {
+	// Container is the name or ID of a running container to execute commands in
+	Container string
+	// Image is the image of the ephemeral containers commands are run in, pulled if missing
+	Image string
+	// Socket is the Unix socket of the Docker Engine API, defaulting to DOCKER_HOST or DefaultDockerSocket
+	Socket string
+
+	lock   sync.Mutex
+	docker *dockerClient
+}
+
+// NewContainerCommandExecutor creates an executor running commands in an existing container
+func NewContainerCommandExecutor(container string) *ContainerCommandExecutor {
+	return &ContainerCommandExecutor{Container: container}
+}
+
+// NewEphemeralContainerCommandExecutor creates an executor running each command in a new container created from
+// the given image
+func NewEphemeralContainerCommandExecutor(image string) *ContainerCommandExecutor {
+	return &ContainerCommandExecutor{Image: image}
+}
+
+func (m *ContainerCommandExecutor) RunCommand(command string) (string, error) {
+	return detonationUuid(m.RunCommandContext(context.Background(), command))
+}
+
+// RunCommandContext runs a command in the container. When the context is cancelled, the ephemeral container is
+// removed, or the remaining processes of the command are killed in the existing container.
+func (m *ContainerCommandExecutor) RunCommandContext(ctx context.Context, command string) (*DetonationResult, error) {
+	log.Infof("Executing %s", command)
+	if (m.Container == "") == (m.Image == "") {
+		return nil, errors.New("container command executor requires exactly one of a container or an image")
+	}
+	if err := m.init(); err != nil {
+		return nil, err
+	}
+	correlationId, err := newDetonationUuid(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := correlationId.String()
+
+	strategy := CorrelationStrategyFromContext(ctx)
+	finalCommand, err := strategy.WrapCommand(command, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to inject detonation UUID in command: %v", err)
+	}
+
+	if m.Image != "" {
+		return m.runInEphemeralContainer(ctx, id, finalCommand)
+	}
+	return m.runInExistingContainer(ctx, strategy, id, finalCommand)
+}
+
+func (m *ContainerCommandExecutor) init() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.docker != nil {
+		return nil
+	}
+	socket, err := dockerSocket(m.Socket)
+	if err != nil {
+		return err
+	}
+	m.docker = newDockerClient(socket)
+	return nil
+}
+
+func (m *ContainerCommandExecutor) runInExistingContainer(ctx context.Context, strategy CorrelationStrategy, id string, script string) (*DetonationResult, error) {
+	var container struct {
+		Id    string
+		State struct {
+			Running bool
+		}
+	}
+	if err := m.docker.do(ctx, "GET", "/containers/"+url.PathEscape(m.Container)+"/json", nil, &container); err != nil {
+		return nil, fmt.Errorf("unable to inspect container %s: %w", m.Container, err)
+	}
+	if !container.State.Running {
+		return nil, fmt.Errorf("container %s is not running", m.Container)
+	}
+
+	result := &DetonationResult{DetonationUuid: id, Target: container.Id}
+	var stdout, stderr cappedBuffer
+	result.StartTime = time.Now()
+	exitCode, err := m.exec(ctx, container.Id, script, &stdout, &stderr)
+	result.EndTime = time.Now()
+	result.ExitCode = exitCode
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	if ctx.Err() != nil {
+		// Processes started through the Docker Engine API keep running when the request is aborted
+		if err := m.cleanupContainerCommand(strategy, container.Id, id); err != nil {
+			log.Warnf("unable to clean up interrupted container command %s: %v", id, err)
+		}
+		return result, fmt.Errorf("container command interrupted: %w", ctx.Err())
+	}
+	// A command exiting with a non-zero code is not an error, its exit code is checked by the detonator running it
+	return result, err
+}
+
+// exec runs a script in a running container, and returns its exit code
+func (m *ContainerCommandExecutor) exec(ctx context.Context, containerId string, script string, stdout io.Writer, stderr io.Writer) (*int, error) {
+	var created struct {
+		Id string
+	}
+	execConfig := map[string]any{"AttachStdout": true, "AttachStderr": true, "Cmd": shellCommand(script)}
+	if err := m.docker.do(ctx, "POST", "/containers/"+containerId+"/exec", execConfig, &created); err != nil {
+		return nil, fmt.Errorf("unable to create exec in container %s: %w", containerId, err)
+	}
+	output, err := m.docker.stream(ctx, "POST", "/exec/"+created.Id+"/start", map[string]bool{"Detach": false, "Tty": false})
+	if err != nil {
+		return nil, fmt.Errorf("unable to start exec in container %s: %w", containerId, err)
+	}
+	defer output.Close()
+	// The output ends once the command exits
+	if err := demultiplexStream(output, stdout, stderr); err != nil {
+		return nil, fmt.Errorf("unable to read output of command in container %s: %w", containerId, err)
+	}
+	var status struct {
+		Running  bool
+		ExitCode int
+	}
+	if err := m.docker.do(ctx, "GET", "/exec/"+created.Id+"/json", nil, &status); err != nil {
+		return nil, fmt.Errorf("unable to retrieve exit code of command in container %s: %w", containerId, err)
+	}
+	if status.Running {
+		return nil, fmt.Errorf("output of command in container %s ended before it exited", containerId)
+	}
+	return &status.ExitCode, nil
+}
+
+// cleanupContainerCommand kills the remaining processes of an interrupted command, and removes the files it created
+func (m *ContainerCommandExecutor) cleanupContainerCommand(strategy CorrelationStrategy, containerId string, id string) error {
+	cleanupCommand, err := strategy.CleanupCommand(id)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = m.exec(ctx, containerId, cleanupCommand, io.Discard, io.Discard)
+	return err
+}
+
+func (m *ContainerCommandExecutor) runInEphemeralContainer(ctx context.Context, id string, script string) (*DetonationResult, error) {
+	containerId, err := m.createContainer(ctx, id, script)
+	if err != nil {
+		return nil, err
+	}
+	// Removing the container kills the command if it is still running, e.g. when the context was cancelled
+	defer func() {
+		removeCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := m.docker.do(removeCtx, "DELETE", "/containers/"+containerId+"?force=true", nil, nil); err != nil {
+			log.Warnf("unable to remove container %s: %v", containerId, err)
+		}
+	}()
+
+	result := &DetonationResult{DetonationUuid: id, Target: containerId}
+	result.StartTime = time.Now()
+	if err := m.docker.do(ctx, "POST", "/containers/"+containerId+"/start", nil, nil); err != nil {
+		return nil, fmt.Errorf("unable to start container %s: %w", containerId, err)
+	}
+	var status struct {
+		StatusCode int
+	}
+	err = m.docker.do(ctx, "POST", "/containers/"+containerId+"/wait", nil, &status)
+	result.EndTime = time.Now()
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("container command interrupted: %w", ctx.Err())
+	}
+	if err != nil {
+		return result, fmt.Errorf("unable to wait for container %s: %w", containerId, err)
+	}
+	result.ExitCode = &status.StatusCode
+
+	var stdout, stderr cappedBuffer
+	logs, err := m.docker.stream(ctx, "GET", "/containers/"+containerId+"/logs?stdout=true&stderr=true", nil)
+	if err != nil {
+		return result, fmt.Errorf("unable to retrieve logs of container %s: %w", containerId, err)
+	}
+	defer logs.Close()
+	err = demultiplexStream(logs, &stdout, &stderr)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	if err != nil {
+		return result, fmt.Errorf("unable to read logs of container %s: %w", containerId, err)
+	}
+	return result, nil
+}
+
+// createContainer creates a container running a script from the image of the executor, pulling the image if missing
+func (m *ContainerCommandExecutor) createContainer(ctx context.Context, id string, script string) (string, error) {
+	// The entrypoint of the image is replaced, so that the script runs the same way as in existing containers
+	containerConfig := map[string]any{
+		"Image":      m.Image,
+		"Entrypoint": []string{"/bin/sh", "-c"},
+		"Cmd":        []string{script},
+		"Labels":     map[string]string{DetonationUuidLabel: id},
+	}
+	path := "/containers/create?name=" + url.QueryEscape("threatest-"+id)
+	var created struct {
+		Id string
+	}
+	err := m.docker.do(ctx, "POST", path, containerConfig, &created)
+	if isDockerNotFound(err) {
+		if err := m.pullImage(ctx); err != nil {
+			return "", err
+		}
+		err = m.docker.do(ctx, "POST", path, containerConfig, &created)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to create container from image %s: %w", m.Image, err)
+	}
+	return created.Id, nil
+}
+
+func (m *ContainerCommandExecutor) pullImage(ctx context.Context) error {
+	log.Infof("Pulling image %s", m.Image)
+	progress, err := m.docker.stream(ctx, "POST", "/images/create?fromImage="+url.QueryEscape(m.Image), nil)
+	if err != nil {
+		return fmt.Errorf("unable to pull image %s: %w", m.Image, err)
+	}
+	defer progress.Close()
+	// Failures are reported in the progress messages, after the response status was sent
+	decoder := json.NewDecoder(progress)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to pull image %s: %w", m.Image, err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("unable to pull image %s: %s", m.Image, message.Error)
+		}
+	}
+}
+
+// shellCommand returns the command line running a script in a container
+func shellCommand(script string) []string {
+	return []string{"/bin/sh", "-c", script}
+}
@@ -0,0 +1,324 @@
+package detonators
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDocker is a fake Docker Engine API, running scripts with a function rather than in containers
+type fakeDocker struct {
+	Socket string
+
+	lock       sync.Mutex
+	containers map[string]*fakeContainer
+	images     []string
+	execs      map[string][]string
+	// scripts holds the scripts run, in order
+	scripts []string
+	pulled  []string
+	removed []string
+	// run simulates running a script, blocking until the request is cancelled if it returns block
+	run func(script string) (stdout string, stderr string, exitCode int, block bool)
+}
+
+type fakeContainer struct {
+	Id      string
+	Name    string
+	Running bool
+	Cmd     []string
+	output  []byte
+	exit    int
+}
+
+func newFakeDocker(t *testing.T) *fakeDocker {
+	// Unix socket paths are limited in length, which temporary directories of tests may exceed
+	directory, err := os.MkdirTemp("", "docker")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	docker := &fakeDocker{
+		Socket:     filepath.Join(directory, "docker.sock"),
+		containers: map[string]*fakeContainer{},
+		execs:      map[string][]string{},
+		run: func(script string) (string, string, int, bool) {
+			return "", "", 0, false
+		},
+	}
+	listener, err := net.Listen("unix", docker.Socket)
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(docker.handler())
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return docker
+}
+
+func (m *fakeDocker) addContainer(name string, running bool) *fakeContainer {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	container := &fakeContainer{Id: fmt.Sprintf("%064d", len(m.containers)+1), Name: name, Running: running}
+	m.containers[container.Id] = container
+	return container
+}
+
+func (m *fakeDocker) findContainer(nameOrId string) *fakeContainer {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, container := range m.containers {
+		if container.Id == nameOrId || container.Name == nameOrId {
+			return container
+		}
+	}
+	return nil
+}
+
+func (m *fakeDocker) executed() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string{}, m.scripts...)
+}
+
+// runScript simulates running a script, and returns its multiplexed output and exit code
+func (m *fakeDocker) runScript(ctx context.Context, script string) ([]byte, int) {
+	m.lock.Lock()
+	m.scripts = append(m.scripts, script)
+	m.lock.Unlock()
+	stdout, stderr, exitCode, block := m.run(script)
+	if block {
+		<-ctx.Done()
+	}
+	return append(multiplexFrame(1, stdout), multiplexFrame(2, stderr)...), exitCode
+}
+
+func multiplexFrame(stream byte, data string) []byte {
+	if data == "" {
+		return nil
+	}
+	header := []byte{stream, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	return append(header, data...)
+}
+
+func writeDockerError(w http.ResponseWriter, statusCode int, message string) {
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func (m *fakeDocker) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1.41/containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		container := m.findContainer(r.PathValue("id"))
+		if container == nil {
+			writeDockerError(w, http.StatusNotFound, "No such container: "+r.PathValue("id"))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"Id": container.Id, "State": map[string]bool{"Running": container.Running}})
+	})
+	mux.HandleFunc("POST /v1.41/containers/{id}/exec", func(w http.ResponseWriter, r *http.Request) {
+		var config struct {
+			Cmd []string
+		}
+		_ = json.NewDecoder(r.Body).Decode(&config)
+		m.lock.Lock()
+		execId := fmt.Sprintf("exec-%d", len(m.execs)+1)
+		m.execs[execId] = config.Cmd
+		m.lock.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{"Id": execId})
+	})
+	var exitCodes sync.Map
+	mux.HandleFunc("POST /v1.41/exec/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		// The request is cancelled when the client disconnects only once its body was read
+		_, _ = io.Copy(io.Discard, r.Body)
+		m.lock.Lock()
+		cmd := m.execs[r.PathValue("id")]
+		m.lock.Unlock()
+		output, exitCode := m.runScript(r.Context(), strings.Join(cmd[2:], " "))
+		exitCodes.Store(r.PathValue("id"), exitCode)
+		w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+		_, _ = w.Write(output)
+	})
+	mux.HandleFunc("GET /v1.41/exec/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		exitCode, _ := exitCodes.Load(r.PathValue("id"))
+		_ = json.NewEncoder(w).Encode(map[string]any{"Running": false, "ExitCode": exitCode})
+	})
+	mux.HandleFunc("POST /v1.41/images/create", func(w http.ResponseWriter, r *http.Request) {
+		image := r.URL.Query().Get("fromImage")
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.pulled = append(m.pulled, image)
+		if image == "missing:latest" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "manifest unknown"})
+			return
+		}
+		m.images = append(m.images, image)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "Downloaded newer image for " + image})
+	})
+	mux.HandleFunc("POST /v1.41/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		var config struct {
+			Image      string
+			Entrypoint []string
+			Cmd        []string
+		}
+		_ = json.NewDecoder(r.Body).Decode(&config)
+		m.lock.Lock()
+		found := false
+		for _, image := range m.images {
+			found = found || image == config.Image
+		}
+		m.lock.Unlock()
+		if !found {
+			writeDockerError(w, http.StatusNotFound, "No such image: "+config.Image)
+			return
+		}
+		container := m.addContainer(r.URL.Query().Get("name"), false)
+		container.Cmd = append(config.Entrypoint, config.Cmd...)
+		_ = json.NewEncoder(w).Encode(map[string]string{"Id": container.Id})
+	})
+	mux.HandleFunc("POST /v1.41/containers/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		container := m.findContainer(r.PathValue("id"))
+		container.Running = true
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /v1.41/containers/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		container := m.findContainer(r.PathValue("id"))
+		container.output, container.exit = m.runScript(r.Context(), container.Cmd[2])
+		_ = json.NewEncoder(w).Encode(map[string]int{"StatusCode": container.exit})
+	})
+	mux.HandleFunc("GET /v1.41/containers/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(m.findContainer(r.PathValue("id")).output)
+	})
+	mux.HandleFunc("DELETE /v1.41/containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if r.URL.Query().Get("force") != "true" {
+			writeDockerError(w, http.StatusConflict, "container is running")
+			return
+		}
+		delete(m.containers, r.PathValue("id"))
+		m.removed = append(m.removed, r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func TestContainerCommandInExistingContainer(t *testing.T) {
+	docker := newFakeDocker(t)
+	container := docker.addContainer("my-container", true)
+	docker.run = func(script string) (string, string, int, bool) {
+		return "hello", "oops", 3, false
+	}
+
+	executor := NewContainerCommandExecutor("my-container")
+	executor.Socket = docker.Socket
+	result, err := executor.RunCommandContext(context.Background(), "whoami")
+	require.NoError(t, err, "a non-zero exit code should not be an error")
+
+	assert.Equal(t, container.Id, result.Target)
+	require.NotNil(t, result.ExitCode)
+	assert.Equal(t, 3, *result.ExitCode)
+	assert.Equal(t, "hello", result.Stdout)
+	assert.Equal(t, "oops", result.Stderr)
+	assert.False(t, result.StartTime.IsZero())
+	assert.False(t, result.EndTime.Before(result.StartTime))
+	assert.Equal(t, []string{FormatCommand("whoami", result.DetonationUuid)}, docker.executed(), "the detonation UUID should be in the process tree")
+}
+
+func TestContainerCommandInEphemeralContainer(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.run = func(script string) (string, string, int, bool) {
+		return "hello", "", 0, false
+	}
+
+	executor := NewEphemeralContainerCommandExecutor("alpine:3.19")
+	executor.Socket = docker.Socket
+	detonator := NewCommandDetonator(executor, "whoami")
+	result, err := detonator.DetonateContext(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"alpine:3.19"}, docker.pulled, "the missing image should be pulled")
+	assert.Equal(t, []string{FormatCommand("whoami", result.DetonationUuid)}, docker.executed())
+	assert.Equal(t, []string{result.Target}, docker.removed, "the container should be removed")
+	assert.Equal(t, "hello", result.Stdout)
+	require.NotNil(t, result.ExitCode)
+	assert.Equal(t, 0, *result.ExitCode)
+
+	// The image is pulled only once
+	_, err = detonator.DetonateContext(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, docker.pulled, 1)
+	assert.Len(t, docker.removed, 2)
+}
+
+func TestContainerCommandIsCleanedUpWhenCancelled(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer("my-container", true)
+	docker.run = func(script string) (string, string, int, bool) {
+		return "", "", 0, !strings.Contains(script, "pgrep")
+	}
+
+	executor := NewContainerCommandExecutor("my-container")
+	executor.Socket = docker.Socket
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err := executor.RunCommandContext(ctx, "sleep 600")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "container command interrupted")
+
+	cleanupCommand, err := CorrelationStrategyFromContext(ctx).CleanupCommand(result.DetonationUuid)
+	require.NoError(t, err)
+	assert.Equal(t, []string{FormatCommand("sleep 600", result.DetonationUuid), cleanupCommand}, docker.executed(), "the remaining processes should be killed")
+}
+
+func TestEphemeralContainerIsRemovedWhenCancelled(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.images = []string{"alpine:3.19"}
+	docker.run = func(script string) (string, string, int, bool) {
+		return "", "", 0, true
+	}
+
+	executor := NewEphemeralContainerCommandExecutor("alpine:3.19")
+	executor.Socket = docker.Socket
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err := executor.RunCommandContext(ctx, "sleep 600")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, []string{result.Target}, docker.removed)
+	assert.Empty(t, docker.pulled)
+}
+
+func TestContainerCommandErrors(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer("stopped-container", false)
+
+	run := func(executor *ContainerCommandExecutor) error {
+		if executor.Socket == "" {
+			executor.Socket = docker.Socket
+		}
+		_, err := executor.RunCommand("whoami")
+		return err
+	}
+	assert.ErrorContains(t, run(NewContainerCommandExecutor("stopped-container")), "container stopped-container is not running")
+	assert.ErrorContains(t, run(NewContainerCommandExecutor("missing-container")), "Docker API returned 404: No such container: missing-container")
+	assert.ErrorContains(t, run(NewEphemeralContainerCommandExecutor("missing:latest")), "unable to pull image missing:latest: manifest unknown")
+	assert.ErrorContains(t, run(&ContainerCommandExecutor{Container: "my-container", Image: "alpine"}), "exactly one of a container or an image")
+	assert.Empty(t, docker.executed())
+
+	t.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2375")
+	_, err := NewContainerCommandExecutor("my-container").RunCommand("whoami")
+	assert.EqualError(t, err, "unsupported DOCKER_HOST 'tcp://127.0.0.1:2375', only Unix sockets are supported")
+}
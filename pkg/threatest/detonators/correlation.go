@@ -0,0 +1,363 @@
+package detonators
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/alessio/shellescape.v1"
+)
+
+// CorrelationStrategy defines how the detonation UUID is injected into a command, so that the alerts it triggers
+// can be correlated with the detonation. Matchers look for the UUID anywhere in an alert, so a strategy must make
+// the UUID appear in the telemetry that the security product attaches to its alerts.
+//
+// Paths and templates used by strategies are Go templates, where {{.DetonationUuid}} is the detonation UUID and
+// {{.Command}} is the command to run, quoted for the shell.
+type CorrelationStrategy interface {
+	// WrapCommand returns a script running the command with the detonation UUID injected. The script must exit
+	// with the exit code of the command.
+	WrapCommand(command string, detonationUuid string) (string, error)
+	// CleanupCommand returns a script killing the remaining processes of an interrupted command and removing
+	// the files it created
+	CleanupCommand(detonationUuid string) (string, error)
+	// Validate returns an error if the strategy is misconfigured
+	Validate() error
+}
+
+const (
+	// DefaultCorrelationEnvironmentVariable is the environment variable set by EnvironmentVariableCorrelation by default
+	DefaultCorrelationEnvironmentVariable = "THREATEST_DETONATION_UUID"
+	// DefaultCorrelationMarker is the argument added by ArgvMarkerCorrelation by default
+	DefaultCorrelationMarker = "threatest-{{.DetonationUuid}}"
+	// DefaultCorrelationDirectory is the working directory used by WorkingDirectoryCorrelation by default
+	DefaultCorrelationDirectory = "/tmp/threatest-{{.DetonationUuid}}"
+	// DefaultCorrelationMarkerFile is the file created by MarkerFileCorrelation by default
+	DefaultCorrelationMarkerFile = "/tmp/threatest-{{.DetonationUuid}}"
+)
+
+// sampleDetonationUuid and sampleCommand are used to validate the templates of correlation strategies
+const (
+	sampleDetonationUuid = "00000000-0000-0000-0000-000000000000"
+	sampleCommand        = "threatest-sample-command"
+)
+
+// RenamedInterpreterCorrelation runs the command with a copy of bash named after the detonation UUID, so that the
+// UUID appears in the path of the process running the command and in the parent process of the processes it spawns.
+// This is the default strategy.
+type RenamedInterpreterCorrelation struct {
+	// Path of the copy of bash, defaulting to /tmp/{{.DetonationUuid}}. Its parent directory is created if it
+	// contains the detonation UUID.
+	Path string
+}
+
+func (m *RenamedInterpreterCorrelation) WrapCommand(command string, detonationUuid string) (string, error) {
+	if m.Path == "" {
+		return FormatCommand(command, detonationUuid), nil
+	}
+	interpreter, err := renderCorrelationTemplate(m.Path, command, detonationUuid)
+	if err != nil {
+		return "", err
+	}
+	quotedInterpreter := shellescape.Quote(interpreter)
+	return fmt.Sprintf(
+		`%[1]scp /bin/bash %[2]s; %[2]s -c %[3]s; exit_code=$?; rm -f %[2]s%[4]s; exit $exit_code`,
+		createParentDirectory(interpreter, detonationUuid), quotedInterpreter, shellescape.Quote(command),
+		removeParentDirectory(interpreter, detonationUuid),
+	), nil
+}
+
+func (m *RenamedInterpreterCorrelation) CleanupCommand(detonationUuid string) (string, error) {
+	interpreter := "/tmp/" + detonationUuid
+	if m.Path != "" {
+		var err error
+		if interpreter, err = renderCorrelationTemplate(m.Path, "", detonationUuid); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf(
+		"rm -f %s%s; %s",
+		shellescape.Quote(interpreter), removeParentDirectory(interpreter, detonationUuid), killMatchingProcesses(detonationUuid),
+	), nil
+}
+
+func (m *RenamedInterpreterCorrelation) Validate() error {
+	if m.Path == "" {
+		return nil
+	}
+	return validateCorrelationTemplate("interpreter path", m.Path)
+}
+
+// EnvironmentVariableCorrelation runs the command with an environment variable set to the detonation UUID, which
+// is inherited by every process it spawns
+type EnvironmentVariableCorrelation struct {
+	// Variable is the name of the environment variable, defaulting to THREATEST_DETONATION_UUID
+	Variable string
+}
+
+var environmentVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (m *EnvironmentVariableCorrelation) variable() string {
+	if m.Variable == "" {
+		return DefaultCorrelationEnvironmentVariable
+	}
+	return m.Variable
+}
+
+func (m *EnvironmentVariableCorrelation) WrapCommand(command string, detonationUuid string) (string, error) {
+	if err := m.Validate(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s=%s bash -c %s", m.variable(), detonationUuid, shellescape.Quote(command)), nil
+}
+
+func (m *EnvironmentVariableCorrelation) CleanupCommand(detonationUuid string) (string, error) {
+	if err := m.Validate(); err != nil {
+		return "", err
+	}
+	// The processes of the command are the only ones with the variable in their environment
+	return fmt.Sprintf(
+		`grep -lsxz %s /proc/[0-9]*/environ | cut -d/ -f3 | xargs -r kill -KILL`,
+		shellescape.Quote(m.variable()+"="+detonationUuid),
+	), nil
+}
+
+func (m *EnvironmentVariableCorrelation) Validate() error {
+	if !environmentVariableName.MatchString(m.variable()) {
+		return fmt.Errorf("invalid environment variable name '%s'", m.variable())
+	}
+	return nil
+}
+
+// ArgvMarkerCorrelation runs the command with a marker containing the detonation UUID as the name of the shell
+// running it ($0), so that the UUID appears in the command line of that shell
+type ArgvMarkerCorrelation struct {
+	// Marker is the argument added to the command line, defaulting to threatest-{{.DetonationUuid}}
+	Marker string
+}
+
+func (m *ArgvMarkerCorrelation) marker() string {
+	if m.Marker == "" {
+		return DefaultCorrelationMarker
+	}
+	return m.Marker
+}
+
+func (m *ArgvMarkerCorrelation) WrapCommand(command string, detonationUuid string) (string, error) {
+	marker, err := renderCorrelationTemplate(m.marker(), command, detonationUuid)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("bash -c %s %s", shellescape.Quote(command), shellescape.Quote(marker)), nil
+}
+
+func (m *ArgvMarkerCorrelation) CleanupCommand(detonationUuid string) (string, error) {
+	return killMatchingProcesses(detonationUuid), nil
+}
+
+func (m *ArgvMarkerCorrelation) Validate() error {
+	return validateCorrelationTemplate("argv marker", m.marker())
+}
+
+// WorkingDirectoryCorrelation runs the command from a directory named after the detonation UUID, which is
+// removed once the command completed
+type WorkingDirectoryCorrelation struct {
+	// Directory is the working directory of the command, defaulting to /tmp/threatest-{{.DetonationUuid}}
+	Directory string
+}
+
+func (m *WorkingDirectoryCorrelation) directory(command string, detonationUuid string) (string, error) {
+	if m.Directory == "" {
+		return renderCorrelationTemplate(DefaultCorrelationDirectory, command, detonationUuid)
+	}
+	return renderCorrelationTemplate(m.Directory, command, detonationUuid)
+}
+
+func (m *WorkingDirectoryCorrelation) WrapCommand(command string, detonationUuid string) (string, error) {
+	directory, err := m.directory(command, detonationUuid)
+	if err != nil {
+		return "", err
+	}
+	quotedDirectory := shellescape.Quote(directory)
+	return fmt.Sprintf(
+		`mkdir -p %[1]s && cd %[1]s && bash -c %[2]s; exit_code=$?; cd / && rm -rf %[1]s; exit $exit_code`,
+		quotedDirectory, shellescape.Quote(command),
+	), nil
+}
+
+func (m *WorkingDirectoryCorrelation) CleanupCommand(detonationUuid string) (string, error) {
+	directory, err := m.directory("", detonationUuid)
+	if err != nil {
+		return "", err
+	}
+	quotedDirectory := shellescape.Quote(directory)
+	return fmt.Sprintf(
+		`find /proc/[0-9]*/cwd -maxdepth 0 -lname %[1]s 2>/dev/null | cut -d/ -f3 | xargs -r kill -KILL; rm -rf %[1]s`,
+		quotedDirectory,
+	), nil
+}
+
+func (m *WorkingDirectoryCorrelation) Validate() error {
+	if m.Directory == "" {
+		return nil
+	}
+	return validateCorrelationTemplate("working directory", m.Directory)
+}
+
+// MarkerFileCorrelation creates a file named after the detonation UUID before running the command, for security
+// products correlating file events with the processes of the command. The file is removed once the command completed.
+type MarkerFileCorrelation struct {
+	// Path of the marker file, defaulting to /tmp/threatest-{{.DetonationUuid}}. Its parent directory is created if
+	// it contains the detonation UUID.
+	Path string
+}
+
+func (m *MarkerFileCorrelation) path(command string, detonationUuid string) (string, error) {
+	if m.Path == "" {
+		return renderCorrelationTemplate(DefaultCorrelationMarkerFile, command, detonationUuid)
+	}
+	return renderCorrelationTemplate(m.Path, command, detonationUuid)
+}
+
+func (m *MarkerFileCorrelation) WrapCommand(command string, detonationUuid string) (string, error) {
+	markerFile, err := m.path(command, detonationUuid)
+	if err != nil {
+		return "", err
+	}
+	quotedMarkerFile := shellescape.Quote(markerFile)
+	return fmt.Sprintf(
+		`%[1]secho %[2]s > %[3]s; bash -c %[4]s; exit_code=$?; rm -f %[3]s%[5]s; exit $exit_code`,
+		createParentDirectory(markerFile, detonationUuid), detonationUuid, quotedMarkerFile, shellescape.Quote(command),
+		removeParentDirectory(markerFile, detonationUuid),
+	), nil
+}
+
+func (m *MarkerFileCorrelation) CleanupCommand(detonationUuid string) (string, error) {
+	markerFile, err := m.path("", detonationUuid)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("rm -f %s%s", shellescape.Quote(markerFile), removeParentDirectory(markerFile, detonationUuid)), nil
+}
+
+func (m *MarkerFileCorrelation) Validate() error {
+	if m.Path == "" {
+		return nil
+	}
+	return validateCorrelationTemplate("marker file path", m.Path)
+}
+
+// TemplateCorrelation runs a custom script, e.g. to run the command with an interpreter named after the binary
+// a detection rule expects. The script must reference both {{.DetonationUuid}} and {{.Command}}.
+type TemplateCorrelation struct {
+	Template string
+	// Cleanup is an optional script removing the files created by the template. Processes whose command line
+	// contains the detonation UUID are killed regardless.
+	Cleanup string
+}
+
+func (m *TemplateCorrelation) WrapCommand(command string, detonationUuid string) (string, error) {
+	return renderCorrelationTemplate(m.Template, shellescape.Quote(command), detonationUuid)
+}
+
+func (m *TemplateCorrelation) CleanupCommand(detonationUuid string) (string, error) {
+	if m.Cleanup == "" {
+		return killMatchingProcesses(detonationUuid), nil
+	}
+	cleanup, err := renderCorrelationTemplate(m.Cleanup, "", detonationUuid)
+	if err != nil {
+		return "", err
+	}
+	return cleanup + "; " + killMatchingProcesses(detonationUuid), nil
+}
+
+func (m *TemplateCorrelation) Validate() error {
+	if err := validateCorrelationTemplate("correlation template", m.Template); err != nil {
+		return err
+	}
+	if wrapped, _ := renderCorrelationTemplate(m.Template, sampleCommand, sampleDetonationUuid); !strings.Contains(wrapped, sampleCommand) {
+		return fmt.Errorf("invalid correlation template: template '%s' does not reference {{.Command}}", m.Template)
+	}
+	if m.Cleanup != "" {
+		return validateCorrelationTemplate("cleanup template", m.Cleanup)
+	}
+	return nil
+}
+
+type correlationStrategyKey struct{}
+
+// WithCorrelationStrategy makes the built-in command executors inject the detonation UUID using the given strategy
+func WithCorrelationStrategy(ctx context.Context, strategy CorrelationStrategy) context.Context {
+	return context.WithValue(ctx, correlationStrategyKey{}, strategy)
+}
+
+// CorrelationStrategyFromContext returns the strategy set with WithCorrelationStrategy, defaulting to
+// RenamedInterpreterCorrelation
+func CorrelationStrategyFromContext(ctx context.Context) CorrelationStrategy {
+	if strategy, ok := ctx.Value(correlationStrategyKey{}).(CorrelationStrategy); ok && strategy != nil {
+		return strategy
+	}
+	return &RenamedInterpreterCorrelation{}
+}
+
+type correlationTemplateData struct {
+	DetonationUuid string
+	Command        string
+}
+
+func parseCorrelationTemplate(text string) (*template.Template, error) {
+	return template.New("correlation").Option("missingkey=error").Parse(text)
+}
+
+func renderCorrelationTemplate(text string, command string, detonationUuid string) (string, error) {
+	tmpl, err := parseCorrelationTemplate(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template '%s': %v", text, err)
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, correlationTemplateData{DetonationUuid: detonationUuid, Command: command}); err != nil {
+		return "", fmt.Errorf("unable to render template '%s': %v", text, err)
+	}
+	if !strings.Contains(rendered.String(), detonationUuid) {
+		return "", errors.New("template '" + text + "' does not reference {{.DetonationUuid}}")
+	}
+	return rendered.String(), nil
+}
+
+// validateCorrelationTemplate checks that a template is valid and references the detonation UUID
+func validateCorrelationTemplate(name string, text string) error {
+	if _, err := renderCorrelationTemplate(text, sampleCommand, sampleDetonationUuid); err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
+
+// createParentDirectory returns a script creating the parent directory of a file, if it is specific to the detonation
+func createParentDirectory(file string, detonationUuid string) string {
+	if directory := path.Dir(file); strings.Contains(directory, detonationUuid) {
+		return fmt.Sprintf("mkdir -p %s; ", shellescape.Quote(directory))
+	}
+	return ""
+}
+
+// removeParentDirectory returns a script removing the parent directory of a file, if it is specific to the detonation
+func removeParentDirectory(file string, detonationUuid string) string {
+	if directory := path.Dir(file); strings.Contains(directory, detonationUuid) {
+		return fmt.Sprintf("; rmdir %s 2>/dev/null || true", shellescape.Quote(directory))
+	}
+	return ""
+}
+
+// killMatchingProcesses returns a script killing the processes whose command line contains the detonation UUID.
+// The script excludes the shell running it, whose command line may contain the UUID as well, and doesn't use
+// pipelines, whose subshells would share the command line of the shell.
+func killMatchingProcesses(detonationUuid string) string {
+	// The bracket prevents pgrep from matching its own command line
+	pattern := fmt.Sprintf("[%c]%s", detonationUuid[0], detonationUuid[1:])
+	return fmt.Sprintf(`for pid in $(pgrep -f '%s'); do [ "$pid" = "$$" ] || kill -KILL "$pid"; done`, pattern)
+}
@@ -0,0 +1,114 @@
+package detonators
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrelationStrategies(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("local commands require bash")
+	}
+	scenarios := []struct {
+		Name     string
+		Strategy CorrelationStrategy
+		Command  string
+		// Artifact is a file created during the detonation that must be removed once it completed
+		Artifact string
+	}{
+		{Name: "default", Strategy: nil, Command: `echo "$0"`, Artifact: "/tmp/{{.DetonationUuid}}"},
+		{Name: "renamed interpreter", Strategy: &RenamedInterpreterCorrelation{}, Command: `echo "$0"`, Artifact: "/tmp/{{.DetonationUuid}}"},
+		{
+			Name:     "renamed interpreter with custom path",
+			Strategy: &RenamedInterpreterCorrelation{Path: "/tmp/{{.DetonationUuid}}/sshd"},
+			Command:  `echo "$0"`,
+			Artifact: "/tmp/{{.DetonationUuid}}",
+		},
+		{Name: "environment variable", Strategy: &EnvironmentVariableCorrelation{}, Command: `echo "$THREATEST_DETONATION_UUID"`},
+		{Name: "custom environment variable", Strategy: &EnvironmentVariableCorrelation{Variable: "RUN_ID"}, Command: `echo "$RUN_ID"`},
+		{Name: "argv marker", Strategy: &ArgvMarkerCorrelation{}, Command: `echo "$0"`},
+		{Name: "working directory", Strategy: &WorkingDirectoryCorrelation{}, Command: `pwd`, Artifact: "/tmp/threatest-{{.DetonationUuid}}"},
+		{Name: "marker file", Strategy: &MarkerFileCorrelation{}, Command: `cat /tmp/threatest-*`, Artifact: "/tmp/threatest-{{.DetonationUuid}}"},
+		{
+			Name: "template",
+			Strategy: &TemplateCorrelation{
+				Template: `cp /bin/bash /tmp/curl-{{.DetonationUuid}}; /tmp/curl-{{.DetonationUuid}} -c {{.Command}}; exit_code=$?; rm /tmp/curl-{{.DetonationUuid}}; exit $exit_code`,
+			},
+			Command:  `echo "$0"`,
+			Artifact: "/tmp/curl-{{.DetonationUuid}}",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.Name, func(t *testing.T) {
+			detonator := NewCommandDetonator(&LocalCommandExecutor{}, scenario.Command+"; exit 3")
+			if scenario.Strategy != nil {
+				detonator.WithCorrelationStrategy(scenario.Strategy)
+			}
+			result, err := detonator.DetonateContext(context.Background())
+			require.NoError(t, err)
+			assert.Contains(t, result.Stdout, result.DetonationUuid, "the command should run with the detonation UUID")
+			require.NotNil(t, result.ExitCode)
+			assert.Equal(t, 3, *result.ExitCode, "the exit code of the command should be preserved")
+			if scenario.Artifact != "" {
+				artifact, err := renderCorrelationTemplate(scenario.Artifact, "", result.DetonationUuid)
+				require.NoError(t, err)
+				_, err = os.Stat(artifact)
+				assert.True(t, os.IsNotExist(err), "%s should be removed", artifact)
+			}
+		})
+	}
+}
+
+func TestCorrelationStrategyValidation(t *testing.T) {
+	scenarios := []struct {
+		Strategy      CorrelationStrategy
+		ExpectedError string
+	}{
+		{Strategy: &RenamedInterpreterCorrelation{}},
+		{Strategy: &RenamedInterpreterCorrelation{Path: "/usr/local/bin/bash"}, ExpectedError: "invalid interpreter path: template '/usr/local/bin/bash' does not reference {{.DetonationUuid}}"},
+		{Strategy: &EnvironmentVariableCorrelation{Variable: "RUN-ID"}, ExpectedError: "invalid environment variable name 'RUN-ID'"},
+		{Strategy: &ArgvMarkerCorrelation{Marker: "--run={{.DetonationUuid}}"}},
+		{Strategy: &ArgvMarkerCorrelation{Marker: "{{.Uuid}}"}, ExpectedError: "invalid argv marker: unable to render template"},
+		{Strategy: &WorkingDirectoryCorrelation{Directory: "/tmp"}, ExpectedError: "invalid working directory: template '/tmp' does not reference {{.DetonationUuid}}"},
+		{Strategy: &MarkerFileCorrelation{Path: "/tmp/{{.DetonationUuid"}, ExpectedError: "invalid marker file path: invalid template"},
+		{Strategy: &TemplateCorrelation{Template: "{{.DetonationUuid}} {{.Command}}", Cleanup: "rm -f /tmp/{{.DetonationUuid}}"}},
+		{Strategy: &TemplateCorrelation{Template: "bash -c {{.Command}}"}, ExpectedError: "does not reference {{.DetonationUuid}}"},
+		{Strategy: &TemplateCorrelation{Template: "echo {{.DetonationUuid}}"}, ExpectedError: "does not reference {{.Command}}"},
+	}
+
+	for _, scenario := range scenarios {
+		err := scenario.Strategy.Validate()
+		if scenario.ExpectedError == "" {
+			assert.NoError(t, err, "%#v", scenario.Strategy)
+		} else {
+			assert.ErrorContains(t, err, scenario.ExpectedError, "%#v", scenario.Strategy)
+		}
+	}
+}
+
+func TestInvalidCorrelationStrategyFailsDetonation(t *testing.T) {
+	detonator := NewCommandDetonator(&LocalCommandExecutor{}, "true").
+		WithCorrelationStrategy(&EnvironmentVariableCorrelation{Variable: "1NVALID"})
+	_, err := detonator.DetonateContext(context.Background())
+	assert.EqualError(t, err, "invalid correlation strategy: invalid environment variable name '1NVALID'")
+}
+
+func TestLocalCommandCleanupWithCorrelationStrategy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("local commands require bash")
+	}
+	const id = "11111111-2222-3333-4444-555555555555"
+	directory := "/tmp/threatest-" + id
+	require.NoError(t, os.MkdirAll(directory, 0o755))
+	defer os.RemoveAll(directory)
+
+	assert.NoError(t, cleanupLocalCommand(&WorkingDirectoryCorrelation{}, id))
+	_, err := os.Stat(directory)
+	assert.True(t, os.IsNotExist(err), "the working directory of the command should be removed")
+}
@@ -0,0 +1,94 @@
+package detonators
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"slices"
+	"strings"
+)
+
+// FailurePolicy defines what happens when the command of a detonation does not run as expected
+type FailurePolicy string
+
+const (
+	// FailurePolicyIgnore considers the attack detonated regardless of how its command ran
+	FailurePolicyIgnore FailurePolicy = "ignore"
+	// FailurePolicyWarn considers the attack detonated, but reports a warning
+	FailurePolicyWarn FailurePolicy = "warn"
+	// FailurePolicyFail fails the detonation, so that a broken command is reported as such rather than as a missed detection
+	FailurePolicyFail FailurePolicy = "fail"
+)
+
+// DetonationChecks verifies that the command of a detonation ran as expected
+type DetonationChecks struct {
+	// OnFailure defines what happens when a check fails. When empty, the detonation fails if expectations are set,
+	// and the default policy of the detonator applies otherwise.
+	OnFailure FailurePolicy
+	// ExpectedExitCodes are the exit codes considered successful, defaulting to 0
+	ExpectedExitCodes []int
+	// ExpectedOutputContains are strings that the output of the command (stdout or stderr) must contain
+	ExpectedOutputContains []string
+}
+
+// policy returns the failure policy of the checks. Expectations are not meant to be ignored, so they fail the
+// detonation unless a policy is set, and the default policy of the detonator only applies without them.
+func (m *DetonationChecks) policy(defaultPolicy FailurePolicy) FailurePolicy {
+	switch {
+	case m.OnFailure != "":
+		return m.OnFailure
+	case len(m.ExpectedExitCodes) > 0 || len(m.ExpectedOutputContains) > 0:
+		return FailurePolicyFail
+	default:
+		return defaultPolicy
+	}
+}
+
+// verify checks the result of a detonation, applying the default policy if none is set.
+// Failed checks are recorded as warnings of the detonation, or returned as an error with the "fail" policy.
+func (m *DetonationChecks) verify(result *DetonationResult, defaultPolicy FailurePolicy) error {
+	policy := m.policy(defaultPolicy)
+	if policy == FailurePolicyIgnore {
+		return nil
+	}
+
+	var failures []string
+	expectedExitCodes := m.ExpectedExitCodes
+	if len(expectedExitCodes) == 0 {
+		expectedExitCodes = []int{0}
+	}
+	if result.ExitCode == nil {
+		failures = append(failures, "the exit code of the command is unknown")
+	} else if !slices.Contains(expectedExitCodes, *result.ExitCode) {
+		failures = append(failures, fmt.Sprintf("the command exited with code %d, expected %s", *result.ExitCode, formatExitCodes(expectedExitCodes)))
+	}
+	for _, expectedOutput := range m.ExpectedOutputContains {
+		if !strings.Contains(result.Stdout, expectedOutput) && !strings.Contains(result.Stderr, expectedOutput) {
+			failures = append(failures, fmt.Sprintf("the output of the command does not contain '%s'", expectedOutput))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+
+	switch policy {
+	case FailurePolicyWarn:
+		for _, failure := range failures {
+			log.Warnf("Detonation %s: %s", result.DetonationUuid, failure)
+		}
+		result.Warnings = append(result.Warnings, failures...)
+		return nil
+	case FailurePolicyFail:
+		return errors.New("the attack did not run as expected: " + strings.Join(failures, "; "))
+	default:
+		return fmt.Errorf("unknown failure policy '%s'", policy)
+	}
+}
+
+func formatExitCodes(exitCodes []int) string {
+	formatted := make([]string, len(exitCodes))
+	for i, exitCode := range exitCodes {
+		formatted[i] = fmt.Sprint(exitCode)
+	}
+	return strings.Join(formatted, " or ")
+}
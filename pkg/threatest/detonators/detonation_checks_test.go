@@ -0,0 +1,143 @@
+package detonators
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetonationChecks(t *testing.T) {
+	exitCode := func(code int) *int { return &code }
+	scenarios := []struct {
+		Name             string
+		Checks           DetonationChecks
+		DefaultPolicy    FailurePolicy
+		Result           DetonationResult
+		ExpectedError    string
+		ExpectedWarnings []string
+	}{
+		{
+			Name:          "ignore policy",
+			Checks:        DetonationChecks{OnFailure: FailurePolicyIgnore, ExpectedOutputContains: []string{"foo"}},
+			DefaultPolicy: FailurePolicyFail,
+			Result:        DetonationResult{ExitCode: exitCode(127)},
+		},
+		{
+			Name:          "default policy without expectations",
+			DefaultPolicy: FailurePolicyIgnore,
+			Result:        DetonationResult{ExitCode: exitCode(127)},
+		},
+		{
+			Name:          "expectations without policy",
+			Checks:        DetonationChecks{ExpectedExitCodes: []int{0, 1}},
+			DefaultPolicy: FailurePolicyIgnore,
+			Result:        DetonationResult{ExitCode: exitCode(127)},
+			ExpectedError: "the attack did not run as expected: the command exited with code 127, expected 0 or 1",
+		},
+		{
+			Name:          "successful command",
+			DefaultPolicy: FailurePolicyFail,
+			Result:        DetonationResult{ExitCode: exitCode(0)},
+		},
+		{
+			Name:          "non-zero exit code",
+			DefaultPolicy: FailurePolicyFail,
+			Result:        DetonationResult{ExitCode: exitCode(127)},
+			ExpectedError: "the attack did not run as expected: the command exited with code 127, expected 0",
+		},
+		{
+			Name:          "unknown exit code",
+			DefaultPolicy: FailurePolicyFail,
+			Result:        DetonationResult{},
+			ExpectedError: "the attack did not run as expected: the exit code of the command is unknown",
+		},
+		{
+			Name:          "expected exit codes",
+			Checks:        DetonationChecks{ExpectedExitCodes: []int{0, 254}},
+			DefaultPolicy: FailurePolicyFail,
+			Result:        DetonationResult{ExitCode: exitCode(254)},
+		},
+		{
+			Name:          "unexpected exit code",
+			Checks:        DetonationChecks{ExpectedExitCodes: []int{1, 2}},
+			DefaultPolicy: FailurePolicyFail,
+			Result:        DetonationResult{ExitCode: exitCode(0)},
+			ExpectedError: "the attack did not run as expected: the command exited with code 0, expected 1 or 2",
+		},
+		{
+			Name:          "expected output in stderr",
+			Checks:        DetonationChecks{ExpectedOutputContains: []string{"AccessDenied"}},
+			DefaultPolicy: FailurePolicyFail,
+			Result:        DetonationResult{ExitCode: exitCode(0), Stderr: "An error occurred (AccessDenied)"},
+		},
+		{
+			Name:          "missing output",
+			Checks:        DetonationChecks{OnFailure: FailurePolicyFail, ExpectedOutputContains: []string{"foo", "bar"}},
+			DefaultPolicy: FailurePolicyIgnore,
+			Result:        DetonationResult{ExitCode: exitCode(1), Stdout: "foo"},
+			ExpectedError: "the attack did not run as expected: the command exited with code 1, expected 0; the output of the command does not contain 'bar'",
+		},
+		{
+			Name:             "warn policy",
+			Checks:           DetonationChecks{OnFailure: FailurePolicyWarn},
+			DefaultPolicy:    FailurePolicyFail,
+			Result:           DetonationResult{ExitCode: exitCode(2)},
+			ExpectedWarnings: []string{"the command exited with code 2, expected 0"},
+		},
+		{
+			Name:          "unknown policy",
+			Checks:        DetonationChecks{OnFailure: "explode"},
+			DefaultPolicy: FailurePolicyFail,
+			Result:        DetonationResult{ExitCode: exitCode(2)},
+			ExpectedError: "unknown failure policy 'explode'",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.Name, func(t *testing.T) {
+			err := scenario.Checks.verify(&scenario.Result, scenario.DefaultPolicy)
+			if scenario.ExpectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, scenario.ExpectedError)
+			}
+			assert.Equal(t, scenario.ExpectedWarnings, scenario.Result.Warnings)
+		})
+	}
+}
+
+func TestLocalCommandDetonationChecks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("local commands require bash")
+	}
+
+	// By default, a failing command is still considered detonated
+	result, err := NewCommandDetonator(&LocalCommandExecutor{}, "exit 3").DetonateContext(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, result.ExitCode)
+	assert.Equal(t, 3, *result.ExitCode)
+
+	result, err = NewCommandDetonator(&LocalCommandExecutor{}, "not-a-command").
+		WithChecks(DetonationChecks{OnFailure: FailurePolicyFail}).
+		DetonateContext(context.Background())
+	assert.EqualError(t, err, "the attack did not run as expected: the command exited with code 127, expected 0")
+	require.NotNil(t, result)
+	assert.Contains(t, result.Stderr, "not-a-command")
+
+	_, err = NewCommandDetonator(&LocalCommandExecutor{}, "echo hello").
+		WithChecks(DetonationChecks{ExpectedOutputContains: []string{"world"}}).
+		DetonateContext(context.Background())
+	assert.EqualError(t, err, "the attack did not run as expected: the output of the command does not contain 'world'", "expectations should fail the detonation by default")
+
+	result, err = NewCommandDetonator(&LocalCommandExecutor{}, "echo hello; exit 1").
+		WithChecks(DetonationChecks{OnFailure: FailurePolicyWarn, ExpectedOutputContains: []string{"hello", "world"}}).
+		DetonateContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"the command exited with code 1, expected 0",
+		"the output of the command does not contain 'world'",
+	}, result.Warnings)
+}
@@ -1,5 +1,125 @@
 package detonators
 
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
 type Detonator interface {
 	Detonate() (string, error)
 }
+
+// ContextDetonator is a Detonator that can be cancelled through a context. When the context is cancelled,
+// the detonation is stopped (e.g. by killing the process running the attack) and cleaned up before returning.
+// It describes the detonation in a DetonationResult, which is also returned along with the error when
+// the detonation fails, if available. All built-in detonators implement it.
+type ContextDetonator interface {
+	Detonator
+	DetonateContext(ctx context.Context) (*DetonationResult, error)
+}
+
+// WithContext adapts a detonator to the ContextDetonator interface. Detonators that don't support cancellation
+// are left running in the background when the context is cancelled, but the detonation returns immediately.
+func WithContext(detonator Detonator) ContextDetonator {
+	if contextDetonator, ok := detonator.(ContextDetonator); ok {
+		return contextDetonator
+	}
+	return &contextAdapter{Detonator: detonator}
+}
+
+type contextAdapter struct {
+	Detonator
+}
+
+func (m *contextAdapter) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	return runWithContext(ctx, m.Detonate)
+}
+
+// WithTimeout cancels a detonation that takes longer than the given timeout
+func WithTimeout(detonator Detonator, timeout time.Duration) ContextDetonator {
+	return &timeoutDetonator{ContextDetonator: WithContext(detonator), Timeout: timeout}
+}
+
+type timeoutDetonator struct {
+	ContextDetonator
+	Timeout time.Duration
+}
+
+func (m *timeoutDetonator) Detonate() (string, error) {
+	return detonationUuid(m.DetonateContext(context.Background()))
+}
+
+func (m *timeoutDetonator) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+	result, err := m.ContextDetonator.DetonateContext(timeoutCtx)
+	if err != nil && ctx.Err() == nil && timeoutCtx.Err() != nil {
+		return result, fmt.Errorf("detonation timed out after %s: %w", m.Timeout, err)
+	}
+	return result, err
+}
+
+// detonationUuid implements Detonate on top of DetonateContext
+func detonationUuid(result *DetonationResult, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	return result.DetonationUuid, nil
+}
+
+// runWithContext runs a detonation that doesn't support cancellation, returning early if the context is cancelled
+func runWithContext(ctx context.Context, detonate func() (string, error)) (*DetonationResult, error) {
+	type outcome struct {
+		detonationUuid string
+		err            error
+	}
+	result := &DetonationResult{StartTime: time.Now()}
+	done := make(chan outcome, 1)
+	go func() {
+		detonationUuid, err := detonate()
+		done <- outcome{detonationUuid, err}
+	}()
+
+	select {
+	case outcome := <-done:
+		result.EndTime = time.Now()
+		if outcome.err != nil {
+			return result, outcome.err
+		}
+		result.DetonationUuid = outcome.detonationUuid
+		return result, nil
+	case <-ctx.Done():
+		result.EndTime = time.Now()
+		return result, ctx.Err()
+	}
+}
+
+type detonationUuidKey struct{}
+
+// WithDetonationUuid makes the built-in detonators inject the given UUID instead of generating their own,
+// so that several detonations can be correlated with the same alerts
+func WithDetonationUuid(ctx context.Context, detonationUuid string) context.Context {
+	return context.WithValue(ctx, detonationUuidKey{}, detonationUuid)
+}
+
+// DetonationUuidFromContext returns the UUID set with WithDetonationUuid, if any
+func DetonationUuidFromContext(ctx context.Context) (string, bool) {
+	detonationUuid, ok := ctx.Value(detonationUuidKey{}).(string)
+	return detonationUuid, ok && detonationUuid != ""
+}
+
+// newDetonationUuid returns the UUID set with WithDetonationUuid, or a new random one if none was set
+func newDetonationUuid(ctx context.Context) (uuid.UUID, error) {
+	detonationUuid, ok := DetonationUuidFromContext(ctx)
+	if !ok {
+		return uuid.New(), nil
+	}
+	parsed, err := uuid.Parse(detonationUuid)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid detonation UUID '%s': %v", detonationUuid, err)
+	}
+	return parsed, nil
+}
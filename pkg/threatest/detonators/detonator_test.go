@@ -0,0 +1,113 @@
+package detonators
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type blockingDetonator struct {
+	release chan struct{}
+}
+
+func (m *blockingDetonator) Detonate() (string, error) {
+	<-m.release
+	return "uuid", nil
+}
+
+func TestWithContextReturnsWhenContextIsCancelled(t *testing.T) {
+	detonator := &blockingDetonator{release: make(chan struct{})}
+	defer close(detonator.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := WithContext(detonator).DetonateContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestWithContextKeepsContextDetonators(t *testing.T) {
+	detonator := NewCommandDetonator(&LocalCommandExecutor{}, "true")
+	assert.Same(t, detonator, WithContext(detonator))
+}
+
+func TestWithTimeout(t *testing.T) {
+	detonator := &blockingDetonator{release: make(chan struct{})}
+	defer close(detonator.release)
+
+	uid, err := WithTimeout(detonator, 50*time.Millisecond).Detonate()
+	assert.Empty(t, uid)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "detonation timed out after 50ms")
+
+	// Cancellation of the parent context is not reported as a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = WithTimeout(detonator, 1*time.Hour).DetonateContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotContains(t, err.Error(), "timed out")
+}
+
+func TestLocalCommandIsKilledAndCleanedUpWhenCancelled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("local commands require bash")
+	}
+	marker := t.TempDir() + "/marker"
+	detonator := NewCommandDetonator(&LocalCommandExecutor{}, "sleep 1; touch "+marker)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := detonator.DetonateContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 1*time.Second, "the detonation should return as soon as it is cancelled")
+
+	// The child processes of the command must have been killed as well
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err), "the command should not have completed")
+}
+
+func TestLocalCommandDetonation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("local commands require bash")
+	}
+	result, err := NewCommandDetonator(&LocalCommandExecutor{}, "echo out; echo err >&2").DetonateContext(context.Background())
+	require.NoError(t, err)
+	assert.NotEmpty(t, result.DetonationUuid)
+	assert.Equal(t, "out\n", result.Stdout)
+	assert.Equal(t, "err\n", result.Stderr)
+	require.NotNil(t, result.ExitCode)
+	assert.Equal(t, 0, *result.ExitCode)
+	assert.False(t, result.EndTime.Before(result.StartTime))
+	_, err = os.Stat("/tmp/" + result.DetonationUuid)
+	assert.True(t, os.IsNotExist(err), "the copy of bash used to run the command should be removed")
+}
+
+func TestWithContextDescribesLegacyDetonations(t *testing.T) {
+	detonator := &blockingDetonator{release: make(chan struct{})}
+	close(detonator.release)
+
+	result, err := WithContext(detonator).DetonateContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "uuid", result.DetonationUuid)
+	assert.False(t, result.StartTime.IsZero())
+	assert.False(t, result.EndTime.IsZero())
+	assert.Nil(t, result.ExitCode)
+}
+
+func TestCappedBufferTruncatesOutput(t *testing.T) {
+	var buffer cappedBuffer
+	n, err := buffer.Write(make([]byte, maxCapturedOutput-1))
+	assert.NoError(t, err)
+	assert.Equal(t, maxCapturedOutput-1, n)
+	n, err = buffer.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, maxCapturedOutput, buffer.Len())
+	assert.Equal(t, byte('a'), buffer.Bytes()[maxCapturedOutput-1])
+}
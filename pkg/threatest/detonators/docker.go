@@ -0,0 +1,147 @@
+package detonators
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultDockerSocket is the Unix socket of the Docker Engine API, unless DOCKER_HOST points to another one
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// dockerAPIVersion is the version of the Docker Engine API used, supported by Docker 20.10 and later
+const dockerAPIVersion = "v1.41"
+
+// dockerClient is a minimal client of the Docker Engine API, listening on a Unix socket
+type dockerClient struct {
+	http *http.Client
+}
+
+// dockerAPIError is an error returned by the Docker Engine API
+type dockerAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (m *dockerAPIError) Error() string {
+	return fmt.Sprintf("Docker API returned %d: %s", m.StatusCode, m.Message)
+}
+
+// dockerSocket returns the path of the Unix socket of the Docker Engine API, honoring DOCKER_HOST
+func dockerSocket(socket string) (string, error) {
+	if socket != "" {
+		return socket, nil
+	}
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		return DefaultDockerSocket, nil
+	}
+	if path, found := strings.CutPrefix(host, "unix://"); found {
+		return path, nil
+	}
+	return "", fmt.Errorf("unsupported DOCKER_HOST '%s', only Unix sockets are supported", host)
+}
+
+func newDockerClient(socket string) *dockerClient {
+	dialer := net.Dialer{}
+	return &dockerClient{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+// do sends a request with a JSON body to the Docker Engine API, and decodes its JSON response into out, if not nil
+func (m *dockerClient) do(ctx context.Context, method string, path string, body any, out any) error {
+	response, err := m.stream(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, response)
+		return err
+	}
+	if err := json.NewDecoder(response).Decode(out); err != nil {
+		return fmt.Errorf("unable to parse response of Docker API: %w", err)
+	}
+	return nil
+}
+
+// stream sends a request with a JSON body to the Docker Engine API, and returns the body of its response
+func (m *dockerClient) stream(ctx context.Context, method string, path string, body any) (io.ReadCloser, error) {
+	var requestBody io.Reader
+	if body != nil {
+		rawBody, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		requestBody = bytes.NewReader(rawBody)
+	}
+	// The host is ignored, since requests are sent to the Unix socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker/"+dockerAPIVersion+path, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	response, err := m.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		apiError := &dockerAPIError{StatusCode: response.StatusCode}
+		rawError, _ := io.ReadAll(response.Body)
+		var decodedError struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(rawError, &decodedError) == nil && decodedError.Message != "" {
+			apiError.Message = decodedError.Message
+		} else {
+			apiError.Message = strings.TrimSpace(string(rawError))
+		}
+		return nil, apiError
+	}
+	return response.Body, nil
+}
+
+// isDockerNotFound returns true if the Docker Engine API didn't find an object, e.g. an image
+func isDockerNotFound(err error) bool {
+	var apiError *dockerAPIError
+	return errors.As(err, &apiError) && apiError.StatusCode == http.StatusNotFound
+}
+
+// demultiplexStream copies the output of a command run without a TTY to stdout and stderr. The Docker Engine API
+// prefixes each frame of the output with a header holding the stream it was written to, and its size.
+func demultiplexStream(stream io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(stream, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var destination io.Writer
+		switch header[0] {
+		case 0, 1:
+			destination = stdout
+		case 2:
+			destination = stderr
+		default:
+			return fmt.Errorf("unexpected stream %d in command output", header[0])
+		}
+		if _, err := io.CopyN(destination, stream, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package detonators
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// DetonationUuidAnnotation is the annotation holding the detonation UUID on the objects created by
+// KubernetesAPIDetonator
+const DetonationUuidAnnotation = "threatest.detonation-uuid"
+
+// Verbs of the Kubernetes API calls made by KubernetesAPIDetonator
+const (
+	KubernetesVerbGet    = "get"
+	KubernetesVerbList   = "list"
+	KubernetesVerbCreate = "create"
+	KubernetesVerbDelete = "delete"
+)
+
+/*
+KubernetesAPIDetonator calls the Kubernetes API, e.g. to test detections based on audit logs, with the detonation
+UUID in the user-agent, and in an annotation of the objects it creates. Calls are either declarative actions, or made
+by a function from a pre-configured client configuration. The objects created are deleted once the detonation ends.
+*/
+type KubernetesAPIDetonator struct {
+	// Kubeconfig is the path of the kubeconfig file, defaulting to KUBECONFIG or ~/.kube/config
+	Kubeconfig string
+	// Context is the kubeconfig context to use, defaulting to the current context
+	Context string
+	// Namespace of the objects of actions not specifying one, defaulting to the namespace of the kubeconfig context
+	Namespace string
+	// Actions are the API calls to make, in order, before calling DetonationFunc
+	Actions []KubernetesAction
+	// DetonationFunc makes API calls with clients created from the given configuration
+	DetonationFunc func(config *rest.Config, detonationUuid uuid.UUID) error
+}
+
+// KubernetesAction is a Kubernetes API call made by KubernetesAPIDetonator
+type KubernetesAction struct {
+	// Verb is one of get, list, create and delete
+	Verb string
+	// APIVersion and Resource identify the type of the objects, e.g. "v1" and "secrets". They are optional when
+	// creating an object, whose apiVersion and kind are used instead.
+	APIVersion string
+	Resource   string
+	// Namespace of the objects, defaulting to the namespace of the detonator for namespaced resources
+	Namespace string
+	// Name of the object to get or delete
+	Name string
+	// Object is the object to create
+	Object map[string]interface{}
+}
+
+func NewKubernetesAPIDetonator(detonationFunc func(*rest.Config, uuid.UUID) error) *KubernetesAPIDetonator {
+	return &KubernetesAPIDetonator{DetonationFunc: detonationFunc}
+}
+
+// NewDeclarativeKubernetesAPIDetonator creates a detonator making the given API calls
+func NewDeclarativeKubernetesAPIDetonator(actions ...KubernetesAction) *KubernetesAPIDetonator {
+	return &KubernetesAPIDetonator{Actions: actions}
+}
+
+func (m *KubernetesAPIDetonator) Detonate() (string, error) {
+	return detonationUuid(m.DetonateContext(context.Background()))
+}
+
+// DetonateContext makes the API calls with a client configuration bound to the context: once it is cancelled,
+// pending and subsequent calls fail, so that the detonation function returns early
+func (m *KubernetesAPIDetonator) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	correlationId, err := newDetonationUuid(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := correlationId.String()
+	baseConfig, namespace, err := newKubernetesConfig(m.Kubeconfig, m.Context)
+	if err != nil {
+		return nil, err
+	}
+	if m.Namespace != "" {
+		namespace = m.Namespace
+	}
+
+	tracker := &kubernetesObjectTracker{detonationCtx: ctx, detonationUuid: id}
+	config := rest.CopyConfig(baseConfig)
+	config.UserAgent = "threatest_" + id
+	config.Wrap(tracker.wrap)
+
+	result := &DetonationResult{DetonationUuid: id, Target: baseConfig.Host}
+	result.StartTime = time.Now()
+	err = m.detonate(ctx, config, namespace, correlationId)
+	result.EndTime = time.Now()
+	// Objects are deleted even if the detonation failed or was interrupted, without attributing the calls to it
+	if err := tracker.deleteCreatedObjects(baseConfig); err != nil {
+		log.Warnf("unable to delete the Kubernetes objects created by detonation %s: %v", id, err)
+	}
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("Kubernetes API detonation interrupted: %w", ctx.Err())
+	}
+	if err != nil {
+		return result, err
+	}
+
+	log.Infof("Execution ID: %s", id)
+	return result, nil
+}
+
+func (m *KubernetesAPIDetonator) detonate(ctx context.Context, config *rest.Config, namespace string, correlationId uuid.UUID) error {
+	if len(m.Actions) > 0 {
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return fmt.Errorf("unable to create Kubernetes client: %w", err)
+		}
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+		if err != nil {
+			return fmt.Errorf("unable to create Kubernetes client: %w", err)
+		}
+		mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+		for i, action := range m.Actions {
+			if err := action.run(ctx, client, mapper, namespace); err != nil {
+				return fmt.Errorf("Kubernetes API call %d (%s) failed: %w", i+1, action.Verb, err)
+			}
+		}
+	}
+	if m.DetonationFunc != nil {
+		return m.DetonationFunc(config, correlationId)
+	}
+	return nil
+}
+
+func (m *KubernetesAction) run(ctx context.Context, client dynamic.Interface, mapper meta.RESTMapper, namespace string) error {
+	var object *unstructured.Unstructured
+	if m.Object != nil {
+		object = &unstructured.Unstructured{Object: m.Object}
+	}
+	mapping, err := m.restMapping(mapper, object)
+	if err != nil {
+		return err
+	}
+	var resource dynamic.ResourceInterface = client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if m.Namespace != "" {
+			namespace = m.Namespace
+		} else if object != nil && object.GetNamespace() != "" {
+			namespace = object.GetNamespace()
+		}
+		resource = client.Resource(mapping.Resource).Namespace(namespace)
+	}
+
+	switch m.Verb {
+	case KubernetesVerbGet:
+		_, err = resource.Get(ctx, m.Name, metav1.GetOptions{})
+	case KubernetesVerbList:
+		_, err = resource.List(ctx, metav1.ListOptions{})
+	case KubernetesVerbCreate:
+		if object == nil {
+			return errors.New("no object to create")
+		}
+		_, err = resource.Create(ctx, object, metav1.CreateOptions{})
+	case KubernetesVerbDelete:
+		err = resource.Delete(ctx, m.Name, metav1.DeleteOptions{})
+	default:
+		return fmt.Errorf("unsupported verb '%s'", m.Verb)
+	}
+	return err
+}
+
+// restMapping returns the resource an action is about, based on its resource or on the kind of its object
+func (m *KubernetesAction) restMapping(mapper meta.RESTMapper, object *unstructured.Unstructured) (*meta.RESTMapping, error) {
+	apiVersion := m.APIVersion
+	if apiVersion == "" && object != nil {
+		apiVersion = object.GetAPIVersion()
+	}
+	if apiVersion == "" {
+		apiVersion = "v1"
+	}
+	groupVersion, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	var kind schema.GroupVersionKind
+	switch {
+	case m.Resource != "":
+		if kind, err = mapper.KindFor(groupVersion.WithResource(m.Resource)); err != nil {
+			return nil, fmt.Errorf("unknown resource %s in %s: %w", m.Resource, apiVersion, err)
+		}
+	case object != nil && object.GetKind() != "":
+		kind = groupVersion.WithKind(object.GetKind())
+	default:
+		return nil, errors.New("no resource defined")
+	}
+	mapping, err := mapper.RESTMapping(kind.GroupKind(), kind.Version)
+	if err != nil {
+		return nil, fmt.Errorf("unknown kind %s in %s: %w", kind.Kind, apiVersion, err)
+	}
+	return mapping, nil
+}
+
+// kubernetesObjectTracker annotates the objects created by a detonation with its UUID, records them to delete them
+// afterwards, and makes API calls fail once the detonation context is cancelled
+type kubernetesObjectTracker struct {
+	detonationCtx  context.Context
+	detonationUuid string
+
+	lock sync.Mutex
+	// created holds the URLs of the objects created, in order
+	created []string
+}
+
+func (m *kubernetesObjectTracker) wrap(base http.RoundTripper) http.RoundTripper {
+	return &kubernetesTrackingTransport{kubernetesObjectTracker: m, base: base}
+}
+
+// kubernetesTrackingTransport is the transport of the clients of a detonation
+type kubernetesTrackingTransport struct {
+	*kubernetesObjectTracker
+	base http.RoundTripper
+}
+
+func (m *kubernetesTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := m.detonationCtx.Err(); err != nil {
+		return nil, err
+	}
+	isCreation := req.Method == http.MethodPost && req.Body != nil && strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+	if isCreation {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = annotateObject(body, m.detonationUuid)
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+		req.ContentLength = int64(len(body))
+	}
+
+	// Calls are cancelled along with the detonation, regardless of the context they were made with
+	callCtx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(m.detonationCtx, cancel)
+	response, err := m.base.RoundTrip(req.WithContext(callCtx))
+	if err != nil {
+		stop()
+		cancel()
+		return nil, err
+	}
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: func() { stop(); cancel() }}
+
+	if isCreation && response.StatusCode == http.StatusCreated {
+		if err := m.recordCreatedObject(req, response); err != nil {
+			response.Body.Close()
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// recordCreatedObject records the URL of a created object, and makes the body of the response readable again
+func (m *kubernetesObjectTracker) recordCreatedObject(req *http.Request, response *http.Response) error {
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	var object struct {
+		Metadata struct {
+			Name string `json:"name"`
+			Uid  string `json:"uid"`
+		} `json:"metadata"`
+	}
+	// Objects without a UID, such as access reviews, are not persisted
+	if json.Unmarshal(body, &object) != nil || object.Metadata.Name == "" || object.Metadata.Uid == "" {
+		return nil
+	}
+	objectURL := *req.URL
+	objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + object.Metadata.Name
+	objectURL.RawPath = ""
+	objectURL.RawQuery = ""
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.created = append(m.created, objectURL.String())
+	return nil
+}
+
+// deleteCreatedObjects deletes the objects created by the detonation, in reverse order
+func (m *kubernetesObjectTracker) deleteCreatedObjects(config *rest.Config) error {
+	m.lock.Lock()
+	created := m.created
+	m.lock.Unlock()
+	if len(created) == 0 {
+		return nil
+	}
+	httpClient, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var errs []error
+	for i := len(created) - 1; i >= 0; i-- {
+		log.Debugf("Deleting Kubernetes object %s", created[i])
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, created[i]+"?propagationPolicy=Background", nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		response, err := httpClient.Do(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 && response.StatusCode != http.StatusNotFound {
+			errs = append(errs, fmt.Errorf("unable to delete %s: %s", created[i], response.Status))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// annotateObject adds the detonation UUID to the annotations of an object in JSON, leaving other bodies unchanged
+func annotateObject(body []byte, detonationUuid string) []byte {
+	var object map[string]interface{}
+	if json.Unmarshal(body, &object) != nil || object["kind"] == nil {
+		return body
+	}
+	metadata, ok := object["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		object["metadata"] = metadata
+	}
+	annotations, ok := metadata["annotations"].(map[string]interface{})
+	if !ok {
+		annotations = map[string]interface{}{}
+		metadata["annotations"] = annotations
+	}
+	annotations[DetonationUuidAnnotation] = detonationUuid
+	annotated, err := json.Marshal(object)
+	if err != nil {
+		return body
+	}
+	return annotated
+}
+
+// cancelOnClose releases the context of a call once its response was read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (m *cancelOnClose) Close() error {
+	defer m.cancel()
+	return m.ReadCloser.Close()
+}
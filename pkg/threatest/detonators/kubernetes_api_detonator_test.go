@@ -0,0 +1,276 @@
+package detonators
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeKubernetesAPI is a minimal Kubernetes API server, storing pods, secrets and cluster role bindings
+type fakeKubernetesAPI struct {
+	*httptest.Server
+	lock     sync.Mutex
+	objects  map[string]map[string]interface{}
+	requests []kubernetesAPIRequest
+	// block makes the requests to the given path hang until they are cancelled
+	block string
+}
+
+type kubernetesAPIRequest struct {
+	Method    string
+	Path      string
+	UserAgent string
+}
+
+func newFakeKubernetesAPI(t *testing.T) *fakeKubernetesAPI {
+	api := &fakeKubernetesAPI{objects: map[string]map[string]interface{}{}}
+	resource := func(name string, kind string, namespaced bool) map[string]interface{} {
+		return map[string]interface{}{"name": name, "singularName": "", "kind": kind, "namespaced": namespaced, "verbs": []string{"create", "delete", "get", "list"}}
+	}
+	discovery := map[string]interface{}{
+		"/api": map[string]interface{}{"kind": "APIVersions", "versions": []string{"v1"}},
+		"/apis": map[string]interface{}{"kind": "APIGroupList", "apiVersion": "v1", "groups": []interface{}{map[string]interface{}{
+			"name":             "rbac.authorization.k8s.io",
+			"versions":         []interface{}{map[string]string{"groupVersion": "rbac.authorization.k8s.io/v1", "version": "v1"}},
+			"preferredVersion": map[string]string{"groupVersion": "rbac.authorization.k8s.io/v1", "version": "v1"},
+		}}},
+		"/api/v1": map[string]interface{}{"kind": "APIResourceList", "groupVersion": "v1", "resources": []interface{}{
+			resource("pods", "Pod", true), resource("secrets", "Secret", true),
+		}},
+		"/apis/rbac.authorization.k8s.io/v1": map[string]interface{}{"kind": "APIResourceList", "groupVersion": "rbac.authorization.k8s.io/v1", "resources": []interface{}{
+			resource("clusterrolebindings", "ClusterRoleBinding", false),
+		}},
+	}
+
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.lock.Lock()
+		api.requests = append(api.requests, kubernetesAPIRequest{Method: r.Method, Path: r.URL.Path, UserAgent: r.UserAgent()})
+		block := api.block != "" && r.URL.Path == api.block
+		api.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if block {
+			<-r.Context().Done()
+			return
+		}
+		if response, ok := discovery[r.URL.Path]; ok {
+			_ = json.NewEncoder(w).Encode(response)
+			return
+		}
+		api.serveObjects(w, r)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (m *fakeKubernetesAPI) serveObjects(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404})
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if object, ok := m.objects[r.URL.Path]; ok {
+			_ = json.NewEncoder(w).Encode(object)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/pods") || strings.HasSuffix(r.URL.Path, "/secrets") {
+			items := []interface{}{}
+			for path, object := range m.objects {
+				if strings.HasPrefix(path, r.URL.Path+"/") {
+					items = append(items, object)
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"kind": "List", "apiVersion": "v1", "metadata": map[string]interface{}{}, "items": items})
+			return
+		}
+		notFound()
+	case http.MethodPost:
+		var object map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		metadata := object["metadata"].(map[string]interface{})
+		metadata["uid"] = uuid.New().String()
+		m.objects[r.URL.Path+"/"+metadata["name"].(string)] = object
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(object)
+	case http.MethodDelete:
+		if _, ok := m.objects[r.URL.Path]; !ok {
+			notFound()
+			return
+		}
+		delete(m.objects, r.URL.Path)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Success"})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *fakeKubernetesAPI) stored() map[string]map[string]interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	objects := map[string]map[string]interface{}{}
+	for path, object := range m.objects {
+		objects[path] = object
+	}
+	return objects
+}
+
+func (m *fakeKubernetesAPI) received() []kubernetesAPIRequest {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]kubernetesAPIRequest{}, m.requests...)
+}
+
+// kubeconfig writes a kubeconfig file pointing to the fake API server
+func (m *fakeKubernetesAPI) kubeconfig(t *testing.T) string {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfig, []byte(fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+  - name: test
+    cluster: {server: "%s"}
+users:
+  - name: tester
+    user: {token: my-token}
+contexts:
+  - name: test
+    context: {cluster: test, user: tester, namespace: production}
+`, m.URL)), 0600))
+	return kubeconfig
+}
+
+func TestKubernetesAPIDetonatorMakesDeclarativeCalls(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	detonator := NewDeclarativeKubernetesAPIDetonator(
+		KubernetesAction{Verb: KubernetesVerbList, Resource: "secrets"},
+		KubernetesAction{Verb: KubernetesVerbCreate, Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata":   map[string]interface{}{"name": "privileged"},
+			"spec":       map[string]interface{}{"containers": []interface{}{map[string]interface{}{"name": "main", "image": "alpine"}}},
+		}},
+		KubernetesAction{Verb: KubernetesVerbGet, Resource: "pods", Name: "privileged"},
+		KubernetesAction{Verb: KubernetesVerbCreate, APIVersion: "rbac.authorization.k8s.io/v1", Resource: "clusterrolebindings", Object: map[string]interface{}{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "ClusterRoleBinding",
+			"metadata":   map[string]interface{}{"name": "admin"},
+		}},
+	)
+	detonator.Kubeconfig = api.kubeconfig(t)
+
+	var created map[string]map[string]interface{}
+	detonator.DetonationFunc = func(*rest.Config, uuid.UUID) error {
+		created = api.stored()
+		return nil
+	}
+	result, err := detonator.DetonateContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, api.URL, result.Target)
+
+	require.Contains(t, created, "/api/v1/namespaces/production/pods/privileged", "the pod should be created in the namespace of the context")
+	require.Contains(t, created, "/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/admin")
+	for _, object := range created {
+		annotations := object["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+		assert.Equal(t, result.DetonationUuid, annotations[DetonationUuidAnnotation])
+	}
+	assert.Empty(t, api.stored(), "the objects created should be deleted")
+
+	var calls, deletions []string
+	for _, request := range api.received() {
+		if request.Method == http.MethodDelete {
+			assert.NotContains(t, request.UserAgent, "threatest_", "deleting objects should not be attributed to the detonation")
+			deletions = append(deletions, request.Path)
+		} else {
+			assert.Equal(t, "threatest_"+result.DetonationUuid, request.UserAgent)
+			calls = append(calls, request.Method+" "+request.Path)
+		}
+	}
+	assert.Subset(t, calls, []string{
+		"GET /api/v1/namespaces/production/secrets",
+		"POST /api/v1/namespaces/production/pods",
+		"GET /api/v1/namespaces/production/pods/privileged",
+		"POST /apis/rbac.authorization.k8s.io/v1/clusterrolebindings",
+	})
+	assert.Equal(t, []string{
+		"/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/admin",
+		"/api/v1/namespaces/production/pods/privileged",
+	}, deletions, "objects should be deleted in reverse order")
+}
+
+func TestKubernetesAPIDetonatorCallsFunction(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	detonator := NewKubernetesAPIDetonator(func(config *rest.Config, detonationUuid uuid.UUID) error {
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+		_, err = client.CoreV1().Secrets("kube-system").List(context.Background(), metav1.ListOptions{})
+		return err
+	})
+	detonator.Kubeconfig = api.kubeconfig(t)
+
+	detonationUuid, err := detonator.Detonate()
+	require.NoError(t, err)
+	requests := api.received()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "/api/v1/namespaces/kube-system/secrets", requests[0].Path)
+	assert.Equal(t, "threatest_"+detonationUuid, requests[0].UserAgent)
+}
+
+func TestKubernetesAPIDetonatorIsInterrupted(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	api.block = "/api/v1/namespaces/production/secrets"
+	detonator := NewDeclarativeKubernetesAPIDetonator(
+		KubernetesAction{Verb: KubernetesVerbCreate, Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata":   map[string]interface{}{"name": "privileged"},
+		}},
+		KubernetesAction{Verb: KubernetesVerbList, Resource: "secrets"},
+	)
+	detonator.Kubeconfig = api.kubeconfig(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := detonator.DetonateContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "Kubernetes API detonation interrupted")
+	assert.Empty(t, api.stored(), "the objects created should be deleted")
+}
+
+func TestKubernetesAPIDetonatorErrors(t *testing.T) {
+	api := newFakeKubernetesAPI(t)
+	run := func(action KubernetesAction) error {
+		detonator := NewDeclarativeKubernetesAPIDetonator(action)
+		detonator.Kubeconfig = api.kubeconfig(t)
+		_, err := detonator.Detonate()
+		return err
+	}
+
+	assert.ErrorContains(t, run(KubernetesAction{Verb: KubernetesVerbGet, Resource: "pods", Name: "missing"}), "Kubernetes API call 1 (get) failed")
+	assert.ErrorContains(t, run(KubernetesAction{Verb: KubernetesVerbList, Resource: "deployments"}), "unknown resource deployments in v1")
+	assert.ErrorContains(t, run(KubernetesAction{Verb: KubernetesVerbCreate, Resource: "pods"}), "no object to create")
+	assert.ErrorContains(t, run(KubernetesAction{Verb: "patch", Resource: "pods"}), "unsupported verb 'patch'")
+	assert.ErrorContains(t, run(KubernetesAction{Verb: KubernetesVerbList}), "no resource defined")
+}
@@ -0,0 +1,340 @@
+package detonators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// debugPodContainer is the name of the container of the ephemeral debug pods
+	debugPodContainer = "threatest"
+	// debugPodLifetime is how long ephemeral debug pods live, in case they are not deleted, e.g. if the run crashes
+	debugPodLifetime = 1 * time.Hour
+	// debugPodStartTimeout is how long to wait for an ephemeral debug pod to be running
+	debugPodStartTimeout = 5 * time.Minute
+)
+
+// KubernetesCommandExecutor runs commands in a pod of a Kubernetes cluster, either in an existing pod selected by
+// namespace, label selector and container, or in an ephemeral debug pod created from an image for each command and
+// deleted afterwards. The default correlation strategy requires bash in the container.
+type KubernetesCommandExecutor struct {
+	// Kubeconfig is the path of the kubeconfig file, defaulting to KUBECONFIG or ~/.kube/config
+	Kubeconfig string
+	// Context is the kubeconfig context to use, defaulting to the current context
+	Context string
+	// Namespace of the pod, defaulting to the namespace of the kubeconfig context
+	Namespace string
+	// LabelSelector selects the pod to execute commands in, the first running one by name
+	LabelSelector string
+	// Container is the container of the pod to execute commands in, defaulting to its first container
+	Container string
+	// Image is the image of the ephemeral debug pods commands are run in, when LabelSelector is not set
+	Image string
+
+	lock       sync.Mutex
+	client     kubernetes.Interface
+	restConfig *rest.Config
+	// exec runs a command in a container of a pod, through the Kubernetes API unless replaced, e.g. in tests
+	exec func(pod *corev1.Pod, container string, command []string, stdout io.Writer, stderr io.Writer) error
+}
+
+// NewKubernetesCommandExecutor creates an executor running commands in an existing pod
+func NewKubernetesCommandExecutor(namespace string, labelSelector string, container string) *KubernetesCommandExecutor {
+	return &KubernetesCommandExecutor{Namespace: namespace, LabelSelector: labelSelector, Container: container}
+}
+
+// NewEphemeralKubernetesCommandExecutor creates an executor running each command in a new debug pod created from
+// the given image
+func NewEphemeralKubernetesCommandExecutor(namespace string, image string) *KubernetesCommandExecutor {
+	return &KubernetesCommandExecutor{Namespace: namespace, Image: image}
+}
+
+// newKubernetesConfig loads the configuration of a kubeconfig context, along with its default namespace. When no
+// kubeconfig is found, the in-cluster configuration is used.
+func newKubernetesConfig(kubeconfig string, kubeContext string) (*rest.Config, string, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext})
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to load kubeconfig: %w", err)
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to load kubeconfig: %w", err)
+	}
+	return restConfig, namespace, nil
+}
+
+func (m *KubernetesCommandExecutor) init() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.client != nil {
+		return nil
+	}
+	restConfig, namespace, err := newKubernetesConfig(m.Kubeconfig, m.Context)
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("unable to create Kubernetes client: %w", err)
+	}
+	if m.Namespace == "" {
+		m.Namespace = namespace
+	}
+	m.client = client
+	m.restConfig = restConfig
+	m.exec = m.execThroughAPI
+	return nil
+}
+
+func (m *KubernetesCommandExecutor) RunCommand(command string) (string, error) {
+	return detonationUuid(m.RunCommandContext(context.Background(), command))
+}
+
+// RunCommandContext runs a command in the pod. When the context is cancelled, the remaining processes of the command
+// are killed, and the ephemeral debug pod is deleted.
+func (m *KubernetesCommandExecutor) RunCommandContext(ctx context.Context, command string) (*DetonationResult, error) {
+	log.Infof("Executing %s", command)
+	if (m.LabelSelector == "") == (m.Image == "") {
+		return nil, errors.New("Kubernetes command executor requires exactly one of a label selector or an image")
+	}
+	if err := m.init(); err != nil {
+		return nil, err
+	}
+	correlationId, err := newDetonationUuid(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := correlationId.String()
+
+	strategy := CorrelationStrategyFromContext(ctx)
+	finalCommand, err := strategy.WrapCommand(command, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to inject detonation UUID in command: %v", err)
+	}
+
+	var pod *corev1.Pod
+	var container string
+	if m.Image != "" {
+		if pod, err = m.createDebugPod(ctx, id); err != nil {
+			return nil, err
+		}
+		defer m.deleteDebugPod(pod)
+		container = debugPodContainer
+	} else {
+		if pod, err = m.selectPod(ctx); err != nil {
+			return nil, err
+		}
+		if container, err = m.selectContainer(pod); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &DetonationResult{DetonationUuid: id, Target: pod.Namespace + "/" + pod.Name}
+	var stdout, stderr cappedBuffer
+	result.StartTime = time.Now()
+	done := make(chan error, 1)
+	go func() { done <- m.exec(pod, container, shellCommand(finalCommand), &stdout, &stderr) }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Exec streams can't be aborted, they end once the processes of the command are killed
+		if err := m.cleanupPodCommand(strategy, pod, container, id); err != nil {
+			log.Warnf("unable to clean up interrupted pod command %s: %v", id, err)
+		}
+		select {
+		case err = <-done:
+		case <-time.After(5 * time.Second):
+			// The output might still be written to concurrently
+			result.EndTime = time.Now()
+			return result, fmt.Errorf("pod command interrupted: %w", ctx.Err())
+		}
+	}
+	result.EndTime = time.Now()
+	result.ExitCode = exitCode(err)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("pod command interrupted: %w", ctx.Err())
+	}
+	// A command exiting with a non-zero code is not an error, its exit code is checked by the detonator running it
+	if err != nil && result.ExitCode == nil {
+		return result, fmt.Errorf("unable to execute command in pod %s: %w", result.Target, err)
+	}
+	return result, nil
+}
+
+// selectPod returns the first running pod matching the label selector, by name
+func (m *KubernetesCommandExecutor) selectPod(ctx context.Context) (*corev1.Pod, error) {
+	pods, err := m.client.CoreV1().Pods(m.Namespace).List(ctx, metav1.ListOptions{LabelSelector: m.LabelSelector})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods in namespace %s: %w", m.Namespace, err)
+	}
+	var running []*corev1.Pod
+	for i, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			running = append(running, &pods.Items[i])
+		}
+	}
+	if len(running) == 0 {
+		return nil, fmt.Errorf("no running pod matches label selector '%s' in namespace %s", m.LabelSelector, m.Namespace)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].Name < running[j].Name })
+	return running[0], nil
+}
+
+// selectContainer returns the container of a pod to execute commands in
+func (m *KubernetesCommandExecutor) selectContainer(pod *corev1.Pod) (string, error) {
+	if m.Container == "" {
+		if len(pod.Spec.Containers) == 0 {
+			return "", fmt.Errorf("pod %s/%s has no container", pod.Namespace, pod.Name)
+		}
+		return pod.Spec.Containers[0].Name, nil
+	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == m.Container {
+			return m.Container, nil
+		}
+	}
+	return "", fmt.Errorf("pod %s/%s has no container named %s", pod.Namespace, pod.Name, m.Container)
+}
+
+// createDebugPod creates a pod from the image of the executor, idling until commands are executed in it, and waits
+// for it to be running
+func (m *KubernetesCommandExecutor) createDebugPod(ctx context.Context, id string) (*corev1.Pod, error) {
+	lifetime := int64(debugPodLifetime.Seconds())
+	gracePeriod := int64(0)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "threatest-" + id,
+			Namespace: m.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "threatest",
+				DetonationUuidLabel:            id,
+			},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds:         &lifetime,
+			TerminationGracePeriodSeconds: &gracePeriod,
+			Containers: []corev1.Container{{
+				Name:    debugPodContainer,
+				Image:   m.Image,
+				Command: []string{"sleep", fmt.Sprint(lifetime)},
+			}},
+		},
+	}
+	created, err := m.client.CoreV1().Pods(m.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create debug pod in namespace %s: %w", m.Namespace, err)
+	}
+	log.Infof("Waiting for debug pod %s/%s to be running", created.Namespace, created.Name)
+	if err := m.waitForDebugPod(ctx, created); err != nil {
+		m.deleteDebugPod(created)
+		return nil, err
+	}
+	return created, nil
+}
+
+// waitForDebugPod waits for a debug pod to be running
+func (m *KubernetesCommandExecutor) waitForDebugPod(ctx context.Context, pod *corev1.Pod) error {
+	ctx, cancel := context.WithTimeout(ctx, debugPodStartTimeout)
+	defer cancel()
+	namespace, name := pod.Namespace, pod.Name
+	for pod.Status.Phase != corev1.PodRunning {
+		if err := debugPodFailure(pod); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("debug pod %s/%s is not running: %w", namespace, name, ctx.Err())
+		case <-time.After(1 * time.Second):
+		}
+		var err error
+		if pod, err = m.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("unable to retrieve debug pod %s/%s: %w", namespace, name, err)
+		}
+	}
+	return nil
+}
+
+// debugPodFailure returns an error if a debug pod won't ever be running, e.g. because its image can't be pulled
+func debugPodFailure(pod *corev1.Pod) error {
+	if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+		return fmt.Errorf("debug pod %s/%s exited: %s", pod.Namespace, pod.Name, pod.Status.Message)
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil {
+			switch waiting.Reason {
+			case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError":
+				return fmt.Errorf("debug pod %s/%s can't start: %s: %s", pod.Namespace, pod.Name, waiting.Reason, waiting.Message)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteDebugPod deletes a debug pod, killing the command if it is still running
+func (m *KubernetesCommandExecutor) deleteDebugPod(pod *corev1.Pod) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := m.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Warnf("unable to delete debug pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+}
+
+// cleanupPodCommand kills the remaining processes of an interrupted command, and removes the files it created
+func (m *KubernetesCommandExecutor) cleanupPodCommand(strategy CorrelationStrategy, pod *corev1.Pod, container string, id string) error {
+	cleanupCommand, err := strategy.CleanupCommand(id)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- m.exec(pod, container, shellCommand(cleanupCommand), io.Discard, io.Discard) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		return errors.New("timed out")
+	}
+}
+
+// execThroughAPI runs a command in a container of a pod, like kubectl exec
+func (m *KubernetesCommandExecutor) execThroughAPI(pod *corev1.Pod, container string, command []string, stdout io.Writer, stderr io.Writer) error {
+	request := m.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(m.restConfig, "POST", request.URL())
+	if err != nil {
+		return err
+	}
+	return executor.Stream(remotecommand.StreamOptions{Stdout: stdout, Stderr: stderr})
+}
@@ -0,0 +1,222 @@
+package detonators
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	kubeexec "k8s.io/client-go/util/exec"
+)
+
+// fakePodExec records the commands executed in pods, since the fake clientset doesn't support exec
+type fakePodExec struct {
+	lock     sync.Mutex
+	commands []podCommand
+	// run simulates running a script, blocking until the command is killed by a cleanup script if it returns block
+	run    func(script string, stdout io.Writer, stderr io.Writer) (err error, block bool)
+	killed chan struct{}
+}
+
+type podCommand struct {
+	Pod       string
+	Container string
+	Script    string
+}
+
+func newFakePodExec() *fakePodExec {
+	return &fakePodExec{
+		killed: make(chan struct{}),
+		run: func(string, io.Writer, io.Writer) (error, bool) {
+			return nil, false
+		},
+	}
+}
+
+func (m *fakePodExec) exec(pod *corev1.Pod, container string, command []string, stdout io.Writer, stderr io.Writer) error {
+	script := command[2]
+	m.lock.Lock()
+	m.commands = append(m.commands, podCommand{Pod: pod.Namespace + "/" + pod.Name, Container: container, Script: script})
+	m.lock.Unlock()
+	if strings.Contains(script, "pgrep") {
+		close(m.killed)
+		return nil
+	}
+	err, block := m.run(script, stdout, stderr)
+	if block {
+		<-m.killed
+		return kubeexec.CodeExitError{Err: errors.New("command terminated with exit code 137"), Code: 137}
+	}
+	return err
+}
+
+func (m *fakePodExec) executed() []podCommand {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]podCommand{}, m.commands...)
+}
+
+func newPod(name string, labels map[string]string, phase corev1.PodPhase, containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "production", Labels: labels},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+	for _, container := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: container})
+	}
+	return pod
+}
+
+func newFakeKubernetesExecutor(executor *KubernetesCommandExecutor, objects ...runtime.Object) (*fake.Clientset, *fakePodExec) {
+	client := fake.NewSimpleClientset(objects...)
+	podExec := newFakePodExec()
+	executor.client = client
+	executor.exec = podExec.exec
+	return client, podExec
+}
+
+func TestKubernetesCommandInExistingPod(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	executor := NewKubernetesCommandExecutor("production", "app=web", "")
+	_, podExec := newFakeKubernetesExecutor(executor,
+		newPod("web-1", web, corev1.PodPending, "nginx"),
+		newPod("web-3", web, corev1.PodRunning, "nginx", "sidecar"),
+		newPod("web-2", web, corev1.PodRunning, "nginx", "sidecar"),
+		newPod("db-1", map[string]string{"app": "db"}, corev1.PodRunning, "postgres"),
+	)
+	podExec.run = func(script string, stdout io.Writer, stderr io.Writer) (error, bool) {
+		_, _ = io.WriteString(stdout, "root")
+		_, _ = io.WriteString(stderr, "oops")
+		return kubeexec.CodeExitError{Err: errors.New("command terminated with exit code 3"), Code: 3}, false
+	}
+
+	result, err := executor.RunCommandContext(context.Background(), "whoami")
+	require.NoError(t, err, "a non-zero exit code should not be an error")
+	assert.Equal(t, "production/web-2", result.Target, "the first running pod matching the selector should be used")
+	require.NotNil(t, result.ExitCode)
+	assert.Equal(t, 3, *result.ExitCode)
+	assert.Equal(t, "root", result.Stdout)
+	assert.Equal(t, "oops", result.Stderr)
+	assert.Equal(t, []podCommand{{Pod: "production/web-2", Container: "nginx", Script: FormatCommand("whoami", result.DetonationUuid)}}, podExec.executed())
+
+	executor.Container = "sidecar"
+	_, err = executor.RunCommandContext(context.Background(), "whoami")
+	require.NoError(t, err)
+	assert.Equal(t, "sidecar", podExec.executed()[1].Container)
+}
+
+func TestKubernetesCommandInDebugPod(t *testing.T) {
+	executor := NewEphemeralKubernetesCommandExecutor("production", "alpine:3.19")
+	client, podExec := newFakeKubernetesExecutor(executor)
+	var created *corev1.Pod
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		// The pod starts right away
+		created = action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		created.Status.Phase = corev1.PodRunning
+		return false, nil, nil
+	})
+
+	detonator := NewCommandDetonator(executor, "whoami")
+	result, err := detonator.DetonateContext(context.Background())
+	require.NoError(t, err)
+
+	require.NotNil(t, created)
+	assert.Equal(t, "production/"+created.Name, result.Target)
+	assert.Equal(t, "alpine:3.19", created.Spec.Containers[0].Image)
+	assert.Equal(t, result.DetonationUuid, created.Labels[DetonationUuidLabel])
+	assert.Equal(t, []podCommand{{Pod: result.Target, Container: "threatest", Script: FormatCommand("whoami", result.DetonationUuid)}}, podExec.executed())
+
+	pods, err := client.CoreV1().Pods("production").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, pods.Items, "the debug pod should be deleted")
+}
+
+func TestKubernetesCommandIsCleanedUpWhenCancelled(t *testing.T) {
+	executor := NewKubernetesCommandExecutor("production", "app=web", "")
+	_, podExec := newFakeKubernetesExecutor(executor, newPod("web-1", map[string]string{"app": "web"}, corev1.PodRunning, "nginx"))
+	podExec.run = func(string, io.Writer, io.Writer) (error, bool) {
+		return nil, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err := executor.RunCommandContext(ctx, "sleep 600")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "pod command interrupted")
+	require.NotNil(t, result.ExitCode)
+	assert.Equal(t, 137, *result.ExitCode)
+
+	cleanupCommand, err := CorrelationStrategyFromContext(ctx).CleanupCommand(result.DetonationUuid)
+	require.NoError(t, err)
+	executed := podExec.executed()
+	require.Len(t, executed, 2)
+	assert.Equal(t, cleanupCommand, executed[1].Script, "the remaining processes should be killed")
+}
+
+func TestKubernetesCommandErrors(t *testing.T) {
+	run := func(executor *KubernetesCommandExecutor, objects ...runtime.Object) error {
+		client, _ := newFakeKubernetesExecutor(executor, objects...)
+		client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{State: corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: "ErrImagePull", Message: "manifest unknown"},
+			}}}
+			return false, nil, nil
+		})
+		_, err := executor.RunCommand("whoami")
+		return err
+	}
+	web := newPod("web-1", map[string]string{"app": "web"}, corev1.PodRunning, "nginx")
+
+	assert.EqualError(t, run(NewKubernetesCommandExecutor("production", "app=db", ""), web), "no running pod matches label selector 'app=db' in namespace production")
+	assert.EqualError(t, run(NewKubernetesCommandExecutor("production", "app=web", "sidecar"), web), "pod production/web-1 has no container named sidecar")
+	assert.ErrorContains(t, run(NewEphemeralKubernetesCommandExecutor("production", "missing:latest")), "can't start: ErrImagePull: manifest unknown")
+	assert.ErrorContains(t, run(&KubernetesCommandExecutor{LabelSelector: "app=web", Image: "alpine"}), "exactly one of a label selector or an image")
+}
+
+func TestKubernetesConfigHonorsContext(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+  - name: staging
+    cluster: {server: "https://staging.example.com"}
+  - name: production
+    cluster: {server: "https://production.example.com"}
+users:
+  - name: tester
+    user: {token: my-token}
+contexts:
+  - name: staging
+    context: {cluster: staging, user: tester}
+  - name: production
+    context: {cluster: production, user: tester, namespace: web}
+`), 0600))
+
+	restConfig, namespace, err := newKubernetesConfig(kubeconfig, "")
+	require.NoError(t, err)
+	assert.Equal(t, "https://staging.example.com", restConfig.Host)
+	assert.Equal(t, "default", namespace)
+
+	restConfig, namespace, err = newKubernetesConfig(kubeconfig, "production")
+	require.NoError(t, err)
+	assert.Equal(t, "https://production.example.com", restConfig.Host)
+	assert.Equal(t, "web", namespace)
+
+	_, _, err = newKubernetesConfig(kubeconfig, "missing")
+	assert.ErrorContains(t, err, "unable to load kubeconfig")
+}
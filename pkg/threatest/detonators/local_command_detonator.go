@@ -1,19 +1,69 @@
 package detonators
 
 import (
-	"github.com/hashicorp/go-uuid"
+	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
-	"os/exec"
+	"os"
+	"time"
 )
 
 type LocalCommandExecutor struct{}
 
 func (m *LocalCommandExecutor) RunCommand(command string) (string, error) {
+	return detonationUuid(m.RunCommandContext(context.Background(), command))
+}
+
+func (m *LocalCommandExecutor) RunCommandContext(ctx context.Context, command string) (*DetonationResult, error) {
 	log.Infof("Executing %s", command)
-	id, _ := uuid.GenerateUUID()
-	_, err := exec.Command("bash", "-c", FormatCommand(command, id)).Output()
+	correlationId, err := newDetonationUuid(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := correlationId.String()
+	result := &DetonationResult{DetonationUuid: id}
+	if hostname, err := os.Hostname(); err == nil {
+		result.Target = hostname
+	}
+
+	strategy := CorrelationStrategyFromContext(ctx)
+	finalCommand, err := strategy.WrapCommand(command, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to inject detonation UUID in command: %v", err)
+	}
+
+	var stdout, stderr cappedBuffer
+	cmd := bashCommand(ctx, finalCommand)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	result.StartTime = time.Now()
+	err = cmd.Run()
+	result.EndTime = time.Now()
+	result.ExitCode = exitCode(err)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	if ctx.Err() != nil {
+		// The command was killed before it could remove the files it created
+		if err := cleanupLocalCommand(strategy, id); err != nil {
+			log.Warnf("unable to clean up interrupted local command %s: %v", id, err)
+		}
+		return result, fmt.Errorf("local command interrupted: %w", ctx.Err())
+	}
+	// A command exiting with a non-zero code is not an error, its exit code is checked by the detonator running it
+	if err != nil && result.ExitCode == nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// cleanupLocalCommand kills the remaining processes of an interrupted command and removes the files it created
+func cleanupLocalCommand(strategy CorrelationStrategy, id string) error {
+	cleanupCommand, err := strategy.CleanupCommand(id)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return id, nil
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return bashCommand(ctx, cleanupCommand).Run()
 }
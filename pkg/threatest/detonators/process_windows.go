@@ -0,0 +1,8 @@
+//go:build windows
+
+package detonators
+
+import "os/exec"
+
+// killProcessGroupOnCancel is a no-op on Windows, where cancelling a command only kills the command itself
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
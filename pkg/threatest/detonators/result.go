@@ -0,0 +1,69 @@
+package detonators
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	kubeexec "k8s.io/client-go/util/exec"
+)
+
+// DetonationResult describes how an attack was detonated, so that a failing scenario can be troubleshot
+type DetonationResult struct {
+	// DetonationUuid is the unique identifier of the detonation, used to correlate alerts with it
+	DetonationUuid string
+	// Target is the host or cloud account the attack was detonated against, when known
+	Target    string
+	StartTime time.Time
+	EndTime   time.Time
+	// ExitCode is the exit code of the process running the attack, for detonators running commands
+	ExitCode *int
+	// Stdout and Stderr hold the output of the process running the attack, truncated to maxCapturedOutput bytes
+	Stdout string
+	Stderr string
+	// AWSRequestIds are the IDs of the AWS API calls made by the detonation, for detonators using the AWS SDK
+	AWSRequestIds []string
+	// Steps holds the result of each step, for multi-step attacks
+	Steps []*DetonationResult
+	// Warnings describe how the attack did not run as expected, when its detonator is configured to only warn about it
+	Warnings []string
+}
+
+// maxCapturedOutput is the maximal size of the output captured from a detonation
+const maxCapturedOutput = 64 * 1024
+
+// cappedBuffer captures the output of a process, discarding anything past maxCapturedOutput bytes
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (m *cappedBuffer) Write(p []byte) (int, error) {
+	if remaining := maxCapturedOutput - m.Len(); remaining > 0 {
+		m.Buffer.Write(p[:min(len(p), remaining)])
+	}
+	// Pretend everything was written, so that the process doesn't fail because of a short write
+	return len(p), nil
+}
+
+// exitCode returns the exit code of a process based on the error returned when running it,
+// or nil if the process didn't exit normally
+func exitCode(err error) *int {
+	code := 0
+	var execError *exec.ExitError
+	var sshError *ssh.ExitError
+	var kubeError kubeexec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &execError) && execError.ExitCode() >= 0:
+		code = execError.ExitCode()
+	case errors.As(err, &sshError):
+		code = sshError.ExitStatus()
+	case errors.As(err, &kubeError) && kubeError.Exited():
+		code = kubeError.ExitStatus()
+	default:
+		return nil
+	}
+	return &code
+}
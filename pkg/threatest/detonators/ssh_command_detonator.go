@@ -1,8 +1,8 @@
 package detonators
 
 import (
+	"context"
 	"fmt"
-	"github.com/hashicorp/go-uuid"
 	"github.com/kevinburke/ssh_config"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
@@ -20,7 +20,16 @@ type SSHCommandExecutor struct {
 	SSHUsername   string
 	SSHKeyFile    string
 	SSHConnection *ssh.Client
-	isInitialized bool
+	// HostKeyPolicy is how the host key of the server is verified, defaulting to StrictHostKeyChecking from ssh_config
+	HostKeyPolicy HostKeyPolicy
+	// HostKeyFingerprints are the SHA256 fingerprints of the accepted host keys, as printed by ssh-keygen -l. When
+	// set, they are used instead of known_hosts and of the host key policy.
+	HostKeyFingerprints []string
+	// KnownHostsFiles defaults to UserKnownHostsFile from ssh_config
+	KnownHostsFiles []string
+	isInitialized   bool
+	// target is the user and address the executor is connected to
+	target string
 }
 
 func NewSSHCommandExecutor(hostname string, username string, keyFile string) (*SSHCommandExecutor, error) {
@@ -31,7 +40,7 @@ func NewSSHCommandExecutor(hostname string, username string, keyFile string) (*S
 	}, nil
 }
 
-func (m *SSHCommandExecutor) init() error {
+func (m *SSHCommandExecutor) init(ctx context.Context) error {
 	var realHostname = m.SSHHostname
 	if hostname := ssh_config.Get(m.SSHHostname, "HostName"); hostname != "" && hostname != m.SSHHostname {
 		realHostname = hostname
@@ -71,17 +80,27 @@ func (m *SSHCommandExecutor) init() error {
 		return fmt.Errorf("unable to parse private key file at %s: %v", sshKey, err)
 	}
 
+	sshAddress := net.JoinHostPort(realHostname, strconv.Itoa(sshPort))
+	verifier, err := m.hostKeyVerifier()
+	if err != nil {
+		return err
+	}
+	hostKeyCallback, hostKeyAlgorithms, err := verifier.clientConfig(sshAddress)
+	if err != nil {
+		return err
+	}
+
 	var config = &ssh.ClientConfig{
-		Config:          ssh.Config{},
-		User:            sshUser,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil }),
-		Timeout:         10 * time.Second,
+		Config:            ssh.Config{},
+		User:              sshUser,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           10 * time.Second,
 	}
 
 	log.Info("Connecting over SSH")
-	sshAddress := net.JoinHostPort(realHostname, strconv.Itoa(sshPort))
-	conn, err := ssh.Dial("tcp", sshAddress, config)
+	conn, err := dialSSH(ctx, sshAddress, config)
 	if err != nil {
 		return fmt.Errorf("unable to establish SSH connection to %s: %v", sshAddress, err)
 	}
@@ -89,19 +108,46 @@ func (m *SSHCommandExecutor) init() error {
 	log.Info("Connection succeeded")
 
 	m.SSHConnection = conn
+	m.target = sshUser + "@" + sshAddress
 	return nil
 }
 
+// dialSSH is the equivalent of ssh.Dial, aborting the connection if the context is cancelled
+func dialSSH(ctx context.Context, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
 func (m *SSHCommandExecutor) RunCommand(command string) (string, error) {
+	return detonationUuid(m.RunCommandContext(context.Background(), command))
+}
+
+// RunCommandContext runs a command over SSH. When the context is cancelled, the remote command is killed
+// and the temporary copy of bash used to run it is removed.
+func (m *SSHCommandExecutor) RunCommandContext(ctx context.Context, command string) (*DetonationResult, error) {
 	if !m.isInitialized {
-		if err := m.init(); err != nil {
-			return "", err
+		if err := m.init(ctx); err != nil {
+			return nil, err
 		}
 		m.isInitialized = true
 	}
 	session, err := m.SSHConnection.NewSession()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer session.Close()
 
@@ -112,17 +158,78 @@ func (m *SSHCommandExecutor) RunCommand(command string) (string, error) {
 	}
 
 	if err := session.RequestPty("xterm", 80, 40, modes); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	id, _ := uuid.GenerateUUID()
-	finalCommand := FormatCommand(command, id)
+	// Since a PTY is allocated, the remote command writes both its standard output and error to stdout
+	var stdout, stderr cappedBuffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	correlationId, err := newDetonationUuid(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := correlationId.String()
+	result := &DetonationResult{DetonationUuid: id, Target: m.target}
+	strategy := CorrelationStrategyFromContext(ctx)
+	finalCommand, err := strategy.WrapCommand(command, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to inject detonation UUID in command: %v", err)
+	}
 	log.Info("Running remote command: " + finalCommand)
-	if err := session.Run(finalCommand); err != nil {
-		return "", err
+	result.StartTime = time.Now()
+	if err := session.Start(finalCommand); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		if err := session.Signal(ssh.SIGKILL); err != nil {
+			log.Debugf("unable to send SIGKILL to remote command: %v", err)
+		}
+		session.Close()
+		select {
+		case err = <-done:
+		case <-time.After(5 * time.Second):
+			// The remote host is unresponsive, the output might still be written to concurrently
+			result.EndTime = time.Now()
+			return result, fmt.Errorf("remote command interrupted: %w", ctx.Err())
+		}
+	}
+	result.EndTime = time.Now()
+	result.ExitCode = exitCode(err)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	if ctx.Err() != nil {
+		if err := m.cleanupRemoteCommand(strategy, id); err != nil {
+			log.Warnf("unable to clean up interrupted remote command %s: %v", id, err)
+		}
+		return result, fmt.Errorf("remote command interrupted: %w", ctx.Err())
 	}
+	// A command exiting with a non-zero code is not an error, its exit code is checked by the detonator running it
+	if err != nil && result.ExitCode == nil {
+		return result, err
+	}
+	return result, nil
+}
 
-	return id, nil
+// cleanupRemoteCommand kills the remaining processes of an interrupted command, and removes the files it created
+func (m *SSHCommandExecutor) cleanupRemoteCommand(strategy CorrelationStrategy, id string) error {
+	cleanupCommand, err := strategy.CleanupCommand(id)
+	if err != nil {
+		return err
+	}
+	session, err := m.SSHConnection.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Run(cleanupCommand)
 }
 
 func resolveSSHKeyPath(path string) (string, error) {
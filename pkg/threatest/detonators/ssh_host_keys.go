@@ -0,0 +1,205 @@
+package detonators
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyPolicy is how SSHCommandExecutor verifies the host key of the SSH server
+type HostKeyPolicy string
+
+const (
+	// HostKeyPolicyDefault follows StrictHostKeyChecking from ssh_config: "accept-new" trusts hosts on first use,
+	// "no" accepts any host key, and other values only accept the host keys in known_hosts
+	HostKeyPolicyDefault HostKeyPolicy = ""
+	// HostKeyPolicyStrict only accepts the host keys in known_hosts
+	HostKeyPolicyStrict HostKeyPolicy = "strict"
+	// HostKeyPolicyTrustOnFirstUse adds the host key of unknown hosts to known_hosts, and rejects host keys that
+	// differ from the known ones
+	HostKeyPolicyTrustOnFirstUse HostKeyPolicy = "trust-on-first-use"
+	// HostKeyPolicyInsecure accepts any host key, leaving the connection open to man-in-the-middle attacks
+	HostKeyPolicyInsecure HostKeyPolicy = "insecure"
+)
+
+// hostKeyVerifier verifies the host key of an SSH server against pinned fingerprints or known_hosts files
+type hostKeyVerifier struct {
+	policy HostKeyPolicy
+	// fingerprints are the SHA256 fingerprints of the accepted host keys. When set, known_hosts files are not used.
+	fingerprints []string
+	// knownHostsFiles are read in order, new host keys are added to the first one
+	knownHostsFiles []string
+	hashKnownHosts  bool
+}
+
+// hostKeyVerifier returns the verifier of the host key of the SSH server, honoring StrictHostKeyChecking,
+// UserKnownHostsFile and HashKnownHosts from ssh_config unless set on the executor
+func (m *SSHCommandExecutor) hostKeyVerifier() (*hostKeyVerifier, error) {
+	verifier := &hostKeyVerifier{
+		policy:          m.HostKeyPolicy,
+		knownHostsFiles: m.KnownHostsFiles,
+		hashKnownHosts:  strings.EqualFold(ssh_config.Get(m.SSHHostname, "HashKnownHosts"), "yes"),
+	}
+	switch verifier.policy {
+	case HostKeyPolicyDefault:
+		switch strings.ToLower(ssh_config.Get(m.SSHHostname, "StrictHostKeyChecking")) {
+		case "accept-new":
+			verifier.policy = HostKeyPolicyTrustOnFirstUse
+		case "no", "off":
+			verifier.policy = HostKeyPolicyInsecure
+		default:
+			// Host keys can't be confirmed interactively, so "ask" is the same as "yes"
+			verifier.policy = HostKeyPolicyStrict
+		}
+	case HostKeyPolicyStrict, HostKeyPolicyTrustOnFirstUse, HostKeyPolicyInsecure:
+	default:
+		return nil, fmt.Errorf("unknown host key policy '%s'", verifier.policy)
+	}
+
+	for _, fingerprint := range m.HostKeyFingerprints {
+		// ssh-keygen doesn't pad fingerprints
+		verifier.fingerprints = append(verifier.fingerprints, strings.TrimRight(fingerprint, "="))
+	}
+
+	if len(verifier.knownHostsFiles) == 0 {
+		for _, file := range strings.Fields(ssh_config.Get(m.SSHHostname, "UserKnownHostsFile")) {
+			if strings.EqualFold(file, "none") {
+				continue
+			}
+			path, err := resolveSSHKeyPath(file)
+			if err != nil {
+				return nil, fmt.Errorf("unable to resolve path of known hosts file %s: %v", file, err)
+			}
+			verifier.knownHostsFiles = append(verifier.knownHostsFiles, path)
+		}
+	}
+	return verifier, nil
+}
+
+// clientConfig returns the host key callback to connect to an SSH server, and the host key algorithms to
+// negotiate so that the server presents a key already known, if any
+func (m *hostKeyVerifier) clientConfig(address string) (ssh.HostKeyCallback, []string, error) {
+	if len(m.fingerprints) > 0 {
+		return m.checkFingerprint, nil, nil
+	}
+	if m.policy == HostKeyPolicyInsecure {
+		return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+			log.Warnf("Not verifying host key %s of %s", ssh.FingerprintSHA256(key), hostname)
+			return nil
+		}, nil, nil
+	}
+
+	knownHosts, err := m.knownHosts()
+	if err != nil {
+		return nil, nil, err
+	}
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := knownHosts(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if err == nil || !errors.As(err, &keyErr) {
+			return err
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) > 0 {
+			known := keyErr.Want[0]
+			return fmt.Errorf("host key %s of %s doesn't match the one in %s:%d, the connection might be intercepted", fingerprint, hostname, known.Filename, known.Line)
+		}
+		if m.policy != HostKeyPolicyTrustOnFirstUse {
+			return fmt.Errorf("host key %s of %s is unknown, add it to known_hosts or pin its fingerprint", fingerprint, hostname)
+		}
+		return m.addKnownHost(hostname, key)
+	}
+	return callback, knownHostKeyAlgorithms(knownHosts, address), nil
+}
+
+func (m *hostKeyVerifier) checkFingerprint(hostname string, _ net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	for _, pinned := range m.fingerprints {
+		if pinned == fingerprint {
+			return nil
+		}
+	}
+	return fmt.Errorf("host key %s of %s doesn't match the pinned fingerprints, the connection might be intercepted", fingerprint, hostname)
+}
+
+// knownHosts returns the host key callback checking the known_hosts files, ignoring the missing ones
+func (m *hostKeyVerifier) knownHosts() (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, file := range m.knownHostsFiles {
+		if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		files = append(files, file)
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known hosts: %v", err)
+	}
+	return callback, nil
+}
+
+// addKnownHost adds the host key of a host seen for the first time to the first known_hosts file
+func (m *hostKeyVerifier) addKnownHost(hostname string, key ssh.PublicKey) error {
+	if len(m.knownHostsFiles) == 0 {
+		return fmt.Errorf("host key %s of %s is unknown, and there is no known hosts file to add it to", ssh.FingerprintSHA256(key), hostname)
+	}
+	file := m.knownHostsFiles[0]
+	host := knownhosts.Normalize(hostname)
+	if m.hashKnownHosts {
+		host = knownhosts.HashHostname(host)
+	}
+	log.Infof("Trusting host key %s of %s on first use, adding it to %s", ssh.FingerprintSHA256(key), hostname, file)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("unable to add host key of %s to %s: %v", hostname, file, err)
+	}
+	knownHostsFile, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to add host key of %s to %s: %v", hostname, file, err)
+	}
+	defer knownHostsFile.Close()
+	if _, err := knownHostsFile.WriteString(knownhosts.Line([]string{host}, key) + "\n"); err != nil {
+		return fmt.Errorf("unable to add host key of %s to %s: %v", hostname, file, err)
+	}
+	return nil
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms of the keys known for an address, or nil if it is unknown
+func knownHostKeyAlgorithms(knownHosts ssh.HostKeyCallback, address string) []string {
+	// No known key has the type of the probe, so the error lists all the known keys of the address
+	err := knownHosts(address, &net.TCPAddr{IP: net.IPv4zero}, probeKey{})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, known.Key.Type())
+	}
+	return algorithms
+}
+
+// probeKey is a public key matching no known host key
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "threatest-probe"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("threatest-probe")
+}
+
+func (probeKey) Verify([]byte, *ssh.Signature) error {
+	return errors.New("probe key can't verify signatures")
+}
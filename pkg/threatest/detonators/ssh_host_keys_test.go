@@ -0,0 +1,133 @@
+package detonators
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var sshServerAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+func newHostKey(t *testing.T, key interface{}) ssh.PublicKey {
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer.PublicKey()
+}
+
+func newEd25519HostKey(t *testing.T) ssh.PublicKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return newHostKey(t, key)
+}
+
+// writeKnownHosts writes a known_hosts file with the given key for web.example.com
+func writeKnownHosts(t *testing.T, key ssh.PublicKey) string {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(file, []byte(knownhosts.Line([]string{"web.example.com"}, key)+"\n"), 0600))
+	return file
+}
+
+func TestHostKeyIsVerifiedAgainstKnownHosts(t *testing.T) {
+	hostKey := newEd25519HostKey(t)
+	verifier := &hostKeyVerifier{policy: HostKeyPolicyStrict, knownHostsFiles: []string{filepath.Join(t.TempDir(), "missing"), writeKnownHosts(t, hostKey)}}
+	callback, algorithms, err := verifier.clientConfig("web.example.com:22")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ssh.KeyAlgoED25519}, algorithms, "the server should present the known key")
+
+	assert.NoError(t, callback("web.example.com:22", sshServerAddr, hostKey))
+	assert.ErrorContains(t, callback("web.example.com:22", sshServerAddr, newEd25519HostKey(t)), "the connection might be intercepted")
+	assert.ErrorContains(t, callback("db.example.com:22", sshServerAddr, hostKey), "host key "+ssh.FingerprintSHA256(hostKey)+" of db.example.com:22 is unknown")
+
+	_, algorithms, err = verifier.clientConfig("db.example.com:22")
+	require.NoError(t, err)
+	assert.Nil(t, algorithms, "any host key algorithm should be negotiated for unknown hosts")
+}
+
+func TestHostKeyIsTrustedOnFirstUse(t *testing.T) {
+	knownHostsFile := filepath.Join(t.TempDir(), ".ssh", "known_hosts")
+	verifier := &hostKeyVerifier{policy: HostKeyPolicyTrustOnFirstUse, knownHostsFiles: []string{knownHostsFile}}
+	hostKey := newEd25519HostKey(t)
+	callback, _, err := verifier.clientConfig("web.example.com:2222")
+	require.NoError(t, err)
+	require.NoError(t, callback("web.example.com:2222", sshServerAddr, hostKey))
+
+	knownHosts, err := os.ReadFile(knownHostsFile)
+	require.NoError(t, err)
+	assert.Equal(t, knownhosts.Line([]string{"[web.example.com]:2222"}, hostKey)+"\n", string(knownHosts))
+
+	// The key is now known
+	callback, algorithms, err := verifier.clientConfig("web.example.com:2222")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ssh.KeyAlgoED25519}, algorithms)
+	assert.NoError(t, callback("web.example.com:2222", sshServerAddr, hostKey))
+	assert.ErrorContains(t, callback("web.example.com:2222", sshServerAddr, newEd25519HostKey(t)), "the connection might be intercepted")
+
+	verifier.hashKnownHosts = true
+	require.NoError(t, callback("db.example.com:22", sshServerAddr, hostKey))
+	knownHosts, err = os.ReadFile(knownHostsFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(knownHosts), "db.example.com", "host names should be hashed")
+	callback, _, err = verifier.clientConfig("db.example.com:22")
+	require.NoError(t, err)
+	assert.NoError(t, callback("db.example.com:22", sshServerAddr, hostKey))
+}
+
+func TestHostKeyIsVerifiedAgainstPinnedFingerprints(t *testing.T) {
+	hostKey := newEd25519HostKey(t)
+	verifier := &hostKeyVerifier{
+		policy:          HostKeyPolicyInsecure,
+		fingerprints:    []string{"SHA256:jEVgo2TDBJdsFH3sXw4FmDGFzC6fJ8BaZzL4a9Rk4Y4", ssh.FingerprintSHA256(hostKey)},
+		knownHostsFiles: []string{writeKnownHosts(t, newEd25519HostKey(t))},
+	}
+	callback, _, err := verifier.clientConfig("web.example.com:22")
+	require.NoError(t, err)
+	assert.NoError(t, callback("web.example.com:22", sshServerAddr, hostKey), "known_hosts should not be used")
+	assert.ErrorContains(t, callback("web.example.com:22", sshServerAddr, newEd25519HostKey(t)), "doesn't match the pinned fingerprints")
+}
+
+func TestHostKeyIsNotVerifiedWhenInsecure(t *testing.T) {
+	verifier := &hostKeyVerifier{policy: HostKeyPolicyInsecure, knownHostsFiles: []string{writeKnownHosts(t, newEd25519HostKey(t))}}
+	callback, _, err := verifier.clientConfig("web.example.com:22")
+	require.NoError(t, err)
+	assert.NoError(t, callback("web.example.com:22", sshServerAddr, newEd25519HostKey(t)))
+}
+
+func TestKnownHostKeyAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(file, []byte(
+		knownhosts.Line([]string{"web.example.com"}, newHostKey(t, rsaKey))+"\n"+
+			knownhosts.Line([]string{"web.example.com"}, newHostKey(t, ecdsaKey))+"\n",
+	), 0600))
+
+	knownHosts, err := knownhosts.New(file)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256}, knownHostKeyAlgorithms(knownHosts, "web.example.com:22"))
+}
+
+func TestHostKeyPolicyIsValidated(t *testing.T) {
+	executor := &SSHCommandExecutor{SSHHostname: "web.example.com", HostKeyPolicy: "ask"}
+	_, err := executor.hostKeyVerifier()
+	assert.EqualError(t, err, "unknown host key policy 'ask'")
+
+	executor = &SSHCommandExecutor{SSHHostname: "web.example.com", HostKeyPolicy: HostKeyPolicyTrustOnFirstUse, HostKeyFingerprints: []string{"SHA256:abc="}, KnownHostsFiles: []string{"/etc/known_hosts"}}
+	verifier, err := executor.hostKeyVerifier()
+	require.NoError(t, err)
+	assert.Equal(t, HostKeyPolicyTrustOnFirstUse, verifier.policy)
+	assert.Equal(t, []string{"SHA256:abc"}, verifier.fingerprints)
+	assert.Equal(t, []string{"/etc/known_hosts"}, verifier.knownHostsFiles)
+}
@@ -1,10 +1,18 @@
 package detonators
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/datadog/stratus-red-team/v2/pkg/stratus"
 	_ "github.com/datadog/stratus-red-team/v2/pkg/stratus/loader"
 	stratusrunner "github.com/datadog/stratus-red-team/v2/pkg/stratus/runner"
+	"github.com/hashicorp/terraform-exec/tfexec"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 func StratusRedTeamTechnique(ttp string) *StratusRedTeamDetonator {
@@ -18,24 +26,124 @@ type StratusRedTeamDetonator struct {
 }
 
 func (m *StratusRedTeamDetonator) Detonate() (string, error) {
+	return detonationUuid(m.DetonateContext(context.Background()))
+}
+
+// DetonateContext detonates the Stratus Red Team technique. When the context is cancelled, Terraform is interrupted
+// and the technique is not detonated if it wasn't already; the prerequisites are cleaned up in any case.
+func (m *StratusRedTeamDetonator) DetonateContext(ctx context.Context) (*DetonationResult, error) {
+	// Stratus Red Team injects the same execution ID in all its detonations, it can't be overridden
+	if detonationUuid, ok := DetonationUuidFromContext(ctx); ok && detonationUuid != m.fixedDetonationUuid() {
+		return nil, fmt.Errorf("Stratus Red Team detonations can only use the execution ID %s, not %s", m.fixedDetonationUuid(), detonationUuid)
+	}
+
 	// detonate a specific stratus red team TTP
 	ttp := m.Technique
 	stratusRunner := stratusrunner.NewRunner(ttp, stratusrunner.StratusRunnerNoForce)
+	stratusRunner.TerraformManager = &contextTerraformManager{
+		ctx:                 ctx,
+		terraformBinaryPath: filepath.Join(stratusRunner.StateManager.GetRootDirectory(), "terraform"),
+		userAgent:           "stratus-red-team_" + stratusRunner.GetUniqueExecutionId(),
+	}
 
 	log.Infof("Detonating '%s' with Stratus Red Team", m.Technique.ID)
 
 	defer stratusRunner.CleanUp()
 
+	result := &DetonationResult{DetonationUuid: stratusRunner.GetUniqueExecutionId(), StartTime: time.Now()}
+	defer func() { result.EndTime = time.Now() }()
+	if ttp.Platform == stratus.AWS {
+		if awsConfig, err := config.LoadDefaultConfig(ctx); err == nil {
+			result.Target = awsAccountId(ctx, awsConfig)
+		}
+	}
+
 	if _, err := stratusRunner.WarmUp(); err != nil {
-		return "", err
+		if ctx.Err() != nil {
+			if ttp.PrerequisitesTerraformCode != nil && stratusRunner.GetState() == stratus.AttackTechniqueStatusCold {
+				// Stratus Red Team only cleans up warm techniques, destroy what was created before the interruption
+				if err := stratusRunner.TerraformManager.TerraformDestroy(stratusRunner.TerraformDir); err != nil {
+					log.Warnf("unable to clean up prerequisites of %s: %v", ttp.ID, err)
+				}
+			}
+			return result, fmt.Errorf("warm-up of %s interrupted: %w", ttp.ID, ctx.Err())
+		}
+		return result, err
+	}
+	if ctx.Err() != nil {
+		return result, fmt.Errorf("detonation of %s interrupted: %w", ttp.ID, ctx.Err())
 	}
 	if err := stratusRunner.Detonate(); err != nil {
-		return "", err
+		return result, err
 	}
 
-	executionId := stratusRunner.GetUniqueExecutionId()
-	log.Infof("Execution ID: %s", executionId)
+	log.Infof("Execution ID: %s", result.DetonationUuid)
+
+	return result, nil
+
+}
 
-	return executionId, nil
+// fixedDetonationUuid returns the execution ID that Stratus Red Team injects in all its detonations
+func (m *StratusRedTeamDetonator) fixedDetonationUuid() string {
+	return (&stratusrunner.Runner{}).GetUniqueExecutionId()
+}
+
+// contextTerraformManager mirrors the Terraform manager of Stratus Red Team, but interrupts Terraform when the
+// context is cancelled. Prerequisites are destroyed regardless of the context, so that cleanup always happens.
+type contextTerraformManager struct {
+	ctx                 context.Context
+	terraformBinaryPath string
+	userAgent           string
+}
 
+// Initialize is a no-op, Terraform is installed by the default manager when creating the Stratus runner
+func (m *contextTerraformManager) Initialize() {}
+
+func (m *contextTerraformManager) TerraformInitAndApply(directory string) (map[string]string, error) {
+	terraform, err := tfexec.NewTerraform(directory, m.terraformBinaryPath)
+	if err != nil {
+		return nil, errors.New("unable to instantiate Terraform: " + err.Error())
+	}
+	if err := terraform.SetAppendUserAgent(m.userAgent); err != nil {
+		return nil, errors.New("unable to configure Terraform: " + err.Error())
+	}
+
+	terraformInitializedFile := filepath.Join(directory, ".terraform-initialized")
+	if _, err := os.Stat(terraformInitializedFile); err != nil {
+		log.Info("Initializing Terraform to spin up technique prerequisites")
+		if err := terraform.Init(m.ctx); err != nil {
+			return nil, errors.New("unable to initialize Terraform: " + err.Error())
+		}
+		if err := os.WriteFile(terraformInitializedFile, nil, 0644); err != nil {
+			return nil, errors.New("unable to initialize Terraform: " + err.Error())
+		}
+	}
+
+	log.Info("Applying Terraform to spin up technique prerequisites")
+	if err := terraform.Apply(m.ctx, tfexec.Refresh(false)); err != nil {
+		return nil, errors.New("unable to apply Terraform: " + err.Error())
+	}
+
+	rawOutputs, err := terraform.Output(m.ctx)
+	if err != nil {
+		return nil, errors.New("unable to retrieve Terraform outputs: " + err.Error())
+	}
+	outputs := make(map[string]string, len(rawOutputs))
+	for outputName, outputRawValue := range rawOutputs {
+		outputValue := string(outputRawValue.Value)
+		// Strip the quotes surrounding the JSON-encoded value
+		if len(outputValue) >= 2 {
+			outputValue = outputValue[1 : len(outputValue)-1]
+		}
+		outputs[outputName] = outputValue
+	}
+	return outputs, nil
+}
+
+func (m *contextTerraformManager) TerraformDestroy(directory string) error {
+	terraform, err := tfexec.NewTerraform(directory, m.terraformBinaryPath)
+	if err != nil {
+		return err
+	}
+	return terraform.Destroy(context.WithoutCancel(m.ctx))
 }
@@ -1,13 +1,27 @@
 package detonators
 
 import (
+	"context"
 	"fmt"
 	"gopkg.in/alessio/shellescape.v1"
+	"os/exec"
+	"time"
 )
 
+// FormatCommand runs a command with a copy of bash named after the detonation UUID, so that the UUID appears in the
+// process tree. The resulting command exits with the exit code of the original command.
 func FormatCommand(rawCommand string, detonationUuid string) string {
 	return fmt.Sprintf(
-		`cp /bin/bash /tmp/%[1]s; (/tmp/%[1]s -c %[2]s || true) && rm /tmp/%[1]s`,
+		`cp /bin/bash /tmp/%[1]s; /tmp/%[1]s -c %[2]s; exit_code=$?; rm /tmp/%[1]s; exit $exit_code`,
 		detonationUuid, shellescape.Quote(rawCommand),
 	)
 }
+
+// bashCommand creates a command running a bash script, killed along with its child processes when the context is cancelled
+func bashCommand(ctx context.Context, script string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "bash", "-c", script)
+	killProcessGroupOnCancel(cmd)
+	// Don't wait forever for output pipes held open by orphaned processes
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
@@ -0,0 +1,61 @@
+package threatest
+
+import (
+	"time"
+
+	"github.com/datadog/threatest/pkg/threatest/matchers"
+)
+
+// Listener is notified of the lifecycle events of a run, e.g. to display progress or emit metrics.
+// Since assertions are polled concurrently, callbacks may be invoked from several goroutines at once.
+type Listener interface {
+	// ScenarioStarted is called before a scenario is detonated
+	ScenarioStarted(scenario *Scenario)
+
+	// ScenarioDetonated is called once a scenario was successfully detonated
+	ScenarioDetonated(scenario *Scenario, detonationUuid string)
+
+	// AssertionPolled is called every time a matcher was queried for an alert
+	AssertionPolled(scenario *Scenario, assertion Assertion, hasAlert bool)
+
+	// AssertionMatched is called when an alert was found for an assertion, after the given time.
+	// For assertions expecting no alert, this means that the assertion failed.
+	AssertionMatched(scenario *Scenario, assertion Assertion, timeToDetect time.Duration)
+
+	// AssertionTimedOut is called when the timeout of an assertion was exceeded without an alert being found.
+	// For assertions expecting no alert, this means that the assertion passed.
+	AssertionTimedOut(scenario *Scenario, assertion Assertion)
+
+	// ScenarioRetrying is called when an attempt of a scenario failed and the scenario is about to be retried
+	ScenarioRetrying(scenario *Scenario, attempt int, result *ScenarioResult)
+
+	// CleanupFinished is called once the alerts generated by a scenario were cleaned up
+	CleanupFinished(scenario *Scenario, detonationUuid string, err error)
+
+	// ScenarioFinished is called with the result of a scenario, whether it succeeded or not
+	ScenarioFinished(scenario *Scenario, result *ScenarioResult)
+}
+
+// NoopListener implements Listener by ignoring all events. It can be embedded in custom listeners
+// that only care about some of the events.
+type NoopListener struct{}
+
+func (NoopListener) ScenarioStarted(*Scenario)                            {}
+func (NoopListener) ScenarioDetonated(*Scenario, string)                  {}
+func (NoopListener) AssertionPolled(*Scenario, Assertion, bool)           {}
+func (NoopListener) AssertionMatched(*Scenario, Assertion, time.Duration) {}
+func (NoopListener) AssertionTimedOut(*Scenario, Assertion)               {}
+func (NoopListener) ScenarioRetrying(*Scenario, int, *ScenarioResult)     {}
+func (NoopListener) CleanupFinished(*Scenario, string, error)             {}
+func (NoopListener) ScenarioFinished(*Scenario, *ScenarioResult)          {}
+
+// CassetteListener reports the detonations of scenarios to a cassette recording or replaying the exchanges of
+// matchers with their backend, so that replayed alerts are correlated with the replayed detonations
+type CassetteListener struct {
+	NoopListener
+	Cassette *matchers.Cassette
+}
+
+func (m *CassetteListener) ScenarioDetonated(scenario *Scenario, detonationUuid string) {
+	m.Cassette.Detonated(scenario.Name, detonationUuid)
+}
@@ -1,6 +1,11 @@
 package matchers
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
 
 // AlertGeneratedMatcher is an interface that every integration should implement to verify whether an expected
 // security alert was created
@@ -14,3 +19,119 @@ type AlertGeneratedMatcher interface {
 	// Cleanup closes the generated alerts of a given detonation on a third-party service
 	Cleanup(ctx context.Context, uuid string) error
 }
+
+// BackendMatcher is implemented by matchers that can tell which backend (e.g. a Datadog org) they query.
+// Since cleaning up a detonation closes all its alerts on a backend, it only needs to happen once per backend
+// and correlator.
+type BackendMatcher interface {
+	AlertGeneratedMatcher
+
+	// Backend returns an identifier of the backend, identical for all matchers querying the same backend
+	Backend() string
+}
+
+// CorrelatingMatcher is implemented by matchers with a configurable alert correlator
+type CorrelatingMatcher interface {
+	// AlertCorrelator returns the correlator of the matcher, or nil for the default UuidCorrelator
+	AlertCorrelator() AlertCorrelator
+}
+
+// CleanupDetonation closes the alerts of a detonation with every matcher, including the ones nested in composite
+// matchers, even if some of them fail. Matchers that would close the same alerts as a previous one are skipped:
+// matchers querying the same backend with the same correlator, as long as it correlates alerts by UUID. Matchers
+// with other correlators only close the alerts matching their own filter, and matchers that don't implement
+// BackendMatcher are always considered distinct.
+func CleanupDetonation(ctx context.Context, matchers []AlertGeneratedMatcher, uuid string) error {
+	var errs []error
+	seenCleanups := map[string]bool{}
+	var visit func(matchers []AlertGeneratedMatcher)
+	visit = func(matchers []AlertGeneratedMatcher) {
+		for _, matcher := range matchers {
+			switch typedMatcher := matcher.(type) {
+			case *AnyOfMatcher:
+				visit(typedMatcher.Matchers)
+				continue
+			case *AllOfMatcher:
+				visit(typedMatcher.Matchers)
+				continue
+			case *OrderedMatcher:
+				typedMatcher.forget(uuid)
+				visit(typedMatcher.Matchers)
+				continue
+			}
+			if key, found := cleanupKey(matcher); found {
+				if seenCleanups[key] {
+					continue
+				}
+				seenCleanups[key] = true
+			}
+			if err := matcher.Cleanup(ctx, uuid); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", matcher.String(), err))
+			}
+		}
+	}
+	visit(matchers)
+	return errors.Join(errs...)
+}
+
+// cleanupKey identifies the alerts closed when cleaning up with a matcher, unless they depend on its filter
+func cleanupKey(matcher AlertGeneratedMatcher) (string, bool) {
+	backendMatcher, ok := matcher.(BackendMatcher)
+	if !ok {
+		return "", false
+	}
+	var correlator AlertCorrelator
+	if correlatingMatcher, ok := matcher.(CorrelatingMatcher); ok {
+		correlator = correlatingMatcher.AlertCorrelator()
+	}
+	if !CorrelatesByUuid(correlator) {
+		return "", false
+	}
+	if correlator == nil {
+		correlator = &UuidCorrelator{}
+	}
+	return fmt.Sprintf("%s %T %v", backendMatcher.Backend(), correlator, correlator), true
+}
+
+// Backends returns the distinct backends queried by matchers implementing BackendMatcher, including the ones
+// nested in composite matchers
+func Backends(matchers []AlertGeneratedMatcher) []string {
+	var backends []string
+	seenBackends := map[string]bool{}
+	var visit func(matchers []AlertGeneratedMatcher)
+	visit = func(matchers []AlertGeneratedMatcher) {
+		for _, matcher := range matchers {
+			switch typedMatcher := matcher.(type) {
+			case *AnyOfMatcher:
+				visit(typedMatcher.Matchers)
+			case *AllOfMatcher:
+				visit(typedMatcher.Matchers)
+			case *OrderedMatcher:
+				visit(typedMatcher.Matchers)
+			case BackendMatcher:
+				if backend := typedMatcher.Backend(); !seenBackends[backend] {
+					seenBackends[backend] = true
+					backends = append(backends, backend)
+				}
+			}
+		}
+	}
+	visit(matchers)
+	return backends
+}
+
+type searchWindowKey struct{}
+
+// WithSearchWindow overrides how far back matchers search for alerts, e.g. to clean up the alerts of a detonation
+// older than the default window of the backend
+func WithSearchWindow(ctx context.Context, window time.Duration) context.Context {
+	return context.WithValue(ctx, searchWindowKey{}, window)
+}
+
+// SearchWindow returns how far back to search for alerts, as set with WithSearchWindow, or the default window
+func SearchWindow(ctx context.Context, defaultWindow time.Duration) time.Duration {
+	if window, ok := ctx.Value(searchWindowKey{}).(time.Duration); ok && window > 0 {
+		return window
+	}
+	return defaultWindow
+}
@@ -0,0 +1,326 @@
+package matchers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/datadog/threatest/pkg/threatest/secret"
+)
+
+// CassetteMode is whether a cassette records the HTTP exchanges of matchers with their backend, or replays them
+type CassetteMode string
+
+const (
+	// CassetteRecord sends requests to the backend, and records them along with their response
+	CassetteRecord CassetteMode = "record"
+	// CassetteReplay answers requests with the recorded responses, without sending them to the backend
+	CassetteReplay CassetteMode = "replay"
+)
+
+// DefaultCassette, when set, records or replays the HTTP exchanges of the Datadog and Elastic matchers created
+// afterwards, including the ones parsed from scenario files
+var DefaultCassette *Cassette
+
+// sensitiveHeaders are the headers holding credentials, which are never written to cassettes
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Dd-Api-Key", "Dd-Application-Key", "X-Api-Key"}
+
+// timestampPattern matches the RFC 3339 timestamps of search windows, which differ between recording and replaying
+var timestampPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
+
+// Cassette records the HTTP exchanges of matchers with their backend to a file, and replays them from that file, e.g.
+// to test scenarios and matcher configurations in CI without credentials. Requests are replayed by method, path and
+// body, in the order they were recorded. Since replayed detonations get new UUIDs, the UUIDs of recorded detonations
+// are replaced in replayed responses with the UUIDs of the detonations of the same scenario, in the order they were
+// detonated, as reported by Detonated.
+type Cassette struct {
+	Path string
+	Mode CassetteMode
+
+	lock sync.Mutex
+	data cassetteFile
+	// replayed is how many times the interactions of each request were replayed
+	replayed map[string]int
+	// detonated is how many detonations of each scenario were replayed
+	detonated map[string]int
+	// replacements maps the UUIDs of recorded detonations to the UUIDs of the replayed ones
+	replacements map[string]string
+}
+
+type cassetteFile struct {
+	// Detonations holds the UUIDs of the detonations of each scenario, in the order they were detonated
+	Detonations  map[string][]string   `json:"detonations"`
+	Interactions []CassetteInteraction `json:"interactions"`
+}
+
+// CassetteInteraction is a request made by a matcher, along with the response of the backend
+type CassetteInteraction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+type CassetteRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+}
+
+type CassetteResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// NewCassette creates a cassette in the given mode. When replaying, the cassette is read from the file right away.
+func NewCassette(path string, mode CassetteMode) (*Cassette, error) {
+	cassette := &Cassette{
+		Path:         path,
+		Mode:         mode,
+		data:         cassetteFile{Detonations: map[string][]string{}, Interactions: []CassetteInteraction{}},
+		replayed:     map[string]int{},
+		detonated:    map[string]int{},
+		replacements: map[string]string{},
+	}
+	switch mode {
+	case CassetteRecord:
+		return cassette, nil
+	case CassetteReplay:
+		rawCassette, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read cassette %s: %w", path, err)
+		}
+		if err := json.Unmarshal(rawCassette, &cassette.data); err != nil {
+			return nil, fmt.Errorf("unable to parse cassette %s: %w", path, err)
+		}
+		return cassette, nil
+	default:
+		return nil, fmt.Errorf("invalid cassette mode '%s', expected '%s' or '%s'", mode, CassetteRecord, CassetteReplay)
+	}
+}
+
+// Replaying returns true if the cassette replays recorded responses, in which case matchers don't need credentials
+func (m *Cassette) Replaying() bool {
+	return m != nil && m.Mode == CassetteReplay
+}
+
+// Transport returns an http.RoundTripper recording the exchanges performed through base, or replaying them.
+// A nil cassette returns base unchanged.
+func (m *Cassette) Transport(base http.RoundTripper) http.RoundTripper {
+	if m == nil {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &cassetteTransport{cassette: m, base: base}
+}
+
+// Detonated tells the cassette about a detonation of a scenario. When recording, the UUID of the detonation is
+// written to the cassette. When replaying, the UUID of the matching recorded detonation is replaced with this one.
+func (m *Cassette) Detonated(scenario string, detonationUuid string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Mode == CassetteRecord {
+		m.data.Detonations[scenario] = append(m.data.Detonations[scenario], detonationUuid)
+		return
+	}
+	recordedUuids := m.data.Detonations[scenario]
+	if i := m.detonated[scenario]; i < len(recordedUuids) {
+		m.replacements[recordedUuids[i]] = detonationUuid
+	}
+	m.detonated[scenario]++
+}
+
+// Save writes the recorded exchanges to the file of the cassette
+func (m *Cassette) Save() error {
+	if m.Mode != CassetteRecord {
+		return nil
+	}
+	m.lock.Lock()
+	rawCassette, err := json.MarshalIndent(m.data, "", "  ")
+	m.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to convert cassette to JSON: %w", err)
+	}
+	if err := os.WriteFile(m.Path, rawCassette, 0600); err != nil {
+		return fmt.Errorf("unable to write cassette %s: %w", m.Path, err)
+	}
+	return nil
+}
+
+type cassetteTransport struct {
+	cassette *Cassette
+	base     http.RoundTripper
+}
+
+func (m *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if m.cassette.Mode == CassetteReplay {
+		return m.cassette.replay(req, body)
+	}
+
+	response, err := m.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cassette.record(req, body, response); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return response, nil
+}
+
+// record adds an exchange to the cassette, without its credentials, and makes the body of the response readable again
+func (m *Cassette) record(req *http.Request, body []byte, response *http.Response) error {
+	responseBody, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	// Responses are recorded decompressed, so that cassettes can be read and edited
+	if strings.EqualFold(response.Header.Get("Content-Encoding"), "gzip") {
+		reader, err := gzip.NewReader(bytes.NewReader(responseBody))
+		if err != nil {
+			return fmt.Errorf("unable to decompress response: %w", err)
+		}
+		if responseBody, err = io.ReadAll(reader); err != nil {
+			return fmt.Errorf("unable to decompress response: %w", err)
+		}
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+		response.ContentLength = int64(len(responseBody))
+		response.Uncompressed = true
+	}
+	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	secrets := headerSecrets(req.Header)
+	interaction := CassetteInteraction{
+		Request: CassetteRequest{
+			Method:  req.Method,
+			URL:     scrubSecrets(req.URL.String(), secrets),
+			Headers: scrubHeaders(req.Header),
+			Body:    scrubSecrets(string(body), secrets),
+		},
+		Response: CassetteResponse{
+			StatusCode: response.StatusCode,
+			Headers:    scrubHeaders(response.Header),
+			Body:       scrubSecrets(string(responseBody), secrets),
+		},
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.data.Interactions = append(m.data.Interactions, interaction)
+	return nil
+}
+
+// replay answers a request with the next recorded response to the same request, repeating the last one once
+// all were replayed, e.g. when alerts are polled more times than when recording
+func (m *Cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+	key := interactionKey(req.Method, req.URL.RequestURI(), string(body))
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var matching []*CassetteInteraction
+	for i := range m.data.Interactions {
+		interaction := &m.data.Interactions[i]
+		if interactionKey(interaction.Request.Method, requestURI(interaction.Request.URL), interaction.Request.Body) == key {
+			matching = append(matching, interaction)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("no response recorded in cassette %s for %s %s", m.Path, req.Method, req.URL.Path)
+	}
+	interaction := matching[min(m.replayed[key], len(matching)-1)]
+	m.replayed[key]++
+
+	responseBody := interaction.Response.Body
+	for recordedUuid, detonationUuid := range m.replacements {
+		responseBody = strings.ReplaceAll(responseBody, recordedUuid, detonationUuid)
+	}
+	header := interaction.Response.Headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Del("Content-Length")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+		StatusCode:    interaction.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(responseBody)),
+		ContentLength: int64(len(responseBody)),
+		Request:       req,
+	}, nil
+}
+
+// interactionKey identifies identical requests, regardless of the host they were sent to and of the search windows
+func interactionKey(method, requestURI, body string) string {
+	return method + " " + requestURI + " " + timestampPattern.ReplaceAllString(body, "<timestamp>")
+}
+
+// requestURI returns the path and query of a recorded URL
+func requestURI(rawURL string) string {
+	request, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return rawURL
+	}
+	return request.URL.RequestURI()
+}
+
+// headerSecrets returns the credentials sent in the headers of a request
+func headerSecrets(header http.Header) []string {
+	var secrets []string
+	for _, name := range sensitiveHeaders {
+		for _, value := range header.Values(name) {
+			// The value of the Authorization header is preceded by its scheme
+			_, credentials, found := strings.Cut(value, " ")
+			if !found {
+				credentials = value
+			}
+			if credentials != "" {
+				secrets = append(secrets, credentials)
+			}
+		}
+	}
+	return secrets
+}
+
+// scrubHeaders returns a copy of headers, with their credentials redacted like secret.Secret redacts them
+func scrubHeaders(header http.Header) http.Header {
+	scrubbed := header.Clone()
+	for _, name := range sensitiveHeaders {
+		if values := scrubbed.Values(name); len(values) > 0 {
+			scrubbed.Set(name, secret.New(values[0]).String())
+		}
+	}
+	return scrubbed
+}
+
+// scrubSecrets redacts the occurrences of the given credentials, e.g. when a backend echoes them
+func scrubSecrets(text string, secrets []string) string {
+	for _, value := range secrets {
+		text = strings.ReplaceAll(text, value, secret.New(value).String())
+	}
+	return text
+}
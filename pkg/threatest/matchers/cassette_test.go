@@ -0,0 +1,131 @@
+package matchers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAlertServer returns a server answering searches with the detonation UUID once polled twice
+func newAlertServer(t *testing.T, detonationUuid string) *httptest.Server {
+	var numSearches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "ApiKey my-secret-key", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/close" {
+			_, _ = fmt.Fprint(w, `{"closed":true}`)
+			return
+		}
+		if atomic.AddInt32(&numSearches, 1) < 2 {
+			_, _ = fmt.Fprint(w, `{"alerts":[]}`)
+			return
+		}
+		// Compressed responses are recorded decompressed
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		_, _ = fmt.Fprintf(writer, `{"alerts":[{"uuid":"%s"}]}`, detonationUuid)
+		_ = writer.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// doRequest sends a request through the transport, authenticated the way backends are
+func doRequest(t *testing.T, transport http.RoundTripper, method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "ApiKey my-secret-key")
+	response, err := (&http.Client{Transport: transport}).Do(req)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response.StatusCode, string(responseBody)
+}
+
+func searchBody(since time.Time) string {
+	return fmt.Sprintf(`{"query":{"range":{"@timestamp":{"gte":"%s"}}}}`, since.UTC().Format(time.RFC3339))
+}
+
+func TestCassetteRecordsAndReplays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	server := newAlertServer(t, "recorded-uuid")
+
+	// Record
+	recorder, err := NewCassette(path, CassetteRecord)
+	require.NoError(t, err)
+	transport := recorder.Transport(nil)
+	recorder.Detonated("my-scenario", "recorded-uuid")
+	_, body := doRequest(t, transport, http.MethodPost, server.URL+"/search", searchBody(time.Now().Add(-time.Hour)))
+	assert.Equal(t, `{"alerts":[]}`, body)
+	_, body = doRequest(t, transport, http.MethodPost, server.URL+"/search", searchBody(time.Now().Add(-time.Hour)))
+	assert.Equal(t, `{"alerts":[{"uuid":"recorded-uuid"}]}`, body, "the response should still be readable once recorded")
+	_, body = doRequest(t, transport, http.MethodPost, server.URL+"/close", `{"id":"alert-1"}`)
+	assert.Equal(t, `{"closed":true}`, body)
+	require.NoError(t, recorder.Save())
+
+	rawCassette, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(rawCassette), "my-secret-key", "credentials should be scrubbed")
+	assert.Contains(t, string(rawCassette), "[REDACTED]")
+
+	// Replay, with another detonation UUID and search window, and without the backend
+	server.Close()
+	player, err := NewCassette(path, CassetteReplay)
+	require.NoError(t, err)
+	transport = player.Transport(nil)
+	player.Detonated("my-scenario", "replayed-uuid")
+	since := time.Now().Add(-2 * time.Hour)
+	_, body = doRequest(t, transport, http.MethodPost, "https://kibana.invalid/search", searchBody(since))
+	assert.Equal(t, `{"alerts":[]}`, body)
+	_, body = doRequest(t, transport, http.MethodPost, "https://kibana.invalid/search", searchBody(since))
+	assert.Equal(t, `{"alerts":[{"uuid":"replayed-uuid"}]}`, body)
+	_, body = doRequest(t, transport, http.MethodPost, "https://kibana.invalid/search", searchBody(since))
+	assert.Equal(t, `{"alerts":[{"uuid":"replayed-uuid"}]}`, body, "the last response should be repeated")
+	statusCode, body := doRequest(t, transport, http.MethodPost, "https://kibana.invalid/close", `{"id":"alert-1"}`)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, `{"closed":true}`, body)
+
+	req, _ := http.NewRequest(http.MethodPost, "https://kibana.invalid/close", strings.NewReader(`{"id":"alert-2"}`))
+	_, err = (&http.Client{Transport: transport}).Do(req)
+	assert.ErrorContains(t, err, "no response recorded in cassette")
+}
+
+func TestCassetteReplaysErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"interactions": [{
+			"request": {"method": "GET", "url": "https://api.datadoghq.com/signals"},
+			"response": {"statusCode": 403, "body": "forbidden"}
+		}]
+	}`), 0600))
+
+	player, err := NewCassette(path, CassetteReplay)
+	require.NoError(t, err)
+	statusCode, body := doRequest(t, player.Transport(nil), http.MethodGet, "https://api.datadoghq.com/signals", "")
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	assert.Equal(t, "forbidden", body)
+}
+
+func TestNewCassette(t *testing.T) {
+	_, err := NewCassette(filepath.Join(t.TempDir(), "missing.json"), CassetteReplay)
+	assert.ErrorContains(t, err, "unable to read cassette")
+
+	_, err = NewCassette("cassette.json", "rewind")
+	assert.EqualError(t, err, "invalid cassette mode 'rewind', expected 'record' or 'replay'")
+
+	var cassette *Cassette
+	assert.False(t, cassette.Replaying())
+	assert.Equal(t, http.DefaultTransport, cassette.Transport(http.DefaultTransport), "a nil cassette should not alter requests")
+}
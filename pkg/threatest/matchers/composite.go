@@ -0,0 +1,189 @@
+package matchers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimestampedMatcher is implemented by matchers that can tell when the alerts of a detonation were generated,
+// which Ordered relies on to verify the order of alerts
+type TimestampedMatcher interface {
+	AlertGeneratedMatcher
+
+	// FirstAlertTime returns when the earliest alert correlated with the given detonation UUID was generated. found is
+	// false if there is no such alert, and the time is zero if the alert exists but its timestamp is unknown.
+	FirstAlertTime(ctx context.Context, uuid string) (timestamp time.Time, found bool, err error)
+}
+
+// AnyOfMatcher passes as soon as one of its matchers finds an alert, e.g. to accept a detection from either of
+// two backends while migrating from one to the other
+type AnyOfMatcher struct {
+	Matchers []AlertGeneratedMatcher
+}
+
+// AnyOf creates a matcher passing as soon as one of the matchers finds an alert
+func AnyOf(matchers ...AlertGeneratedMatcher) *AnyOfMatcher {
+	return &AnyOfMatcher{Matchers: matchers}
+}
+
+// HasExpectedAlert queries every matcher, and only returns an error if none of them found an alert
+func (m *AnyOfMatcher) HasExpectedAlert(ctx context.Context, uuid string) (bool, error) {
+	var errs []error
+	for _, matcher := range m.Matchers {
+		hasAlert, err := matcher.HasExpectedAlert(ctx, uuid)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", matcher.String(), err))
+			continue
+		}
+		if hasAlert {
+			return true, nil
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+func (m *AnyOfMatcher) String() string {
+	return "any of " + describeMatchers(m.Matchers, ", ")
+}
+
+// Cleanup closes the alerts of the detonation for every distinct matcher
+func (m *AnyOfMatcher) Cleanup(ctx context.Context, uuid string) error {
+	return CleanupDetonation(ctx, m.Matchers, uuid)
+}
+
+// AllOfMatcher passes once all its matchers found an alert, e.g. to require a detection from two backends
+type AllOfMatcher struct {
+	Matchers []AlertGeneratedMatcher
+}
+
+// AllOf creates a matcher passing once all the matchers found an alert
+func AllOf(matchers ...AlertGeneratedMatcher) *AllOfMatcher {
+	return &AllOfMatcher{Matchers: matchers}
+}
+
+func (m *AllOfMatcher) HasExpectedAlert(ctx context.Context, uuid string) (bool, error) {
+	for _, matcher := range m.Matchers {
+		hasAlert, err := matcher.HasExpectedAlert(ctx, uuid)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", matcher.String(), err)
+		}
+		if !hasAlert {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *AllOfMatcher) String() string {
+	return "all of " + describeMatchers(m.Matchers, ", ")
+}
+
+// Cleanup closes the alerts of the detonation for every distinct matcher
+func (m *AllOfMatcher) Cleanup(ctx context.Context, uuid string) error {
+	return CleanupDetonation(ctx, m.Matchers, uuid)
+}
+
+// OrderedMatcher passes once all its matchers found an alert, in the order of the matchers, e.g. to verify that
+// an alert on an initial access precedes the alert on the lateral movement that follows it. Alerts are ordered by
+// their timestamp for matchers implementing TimestampedMatcher, and by when they were first found otherwise.
+type OrderedMatcher struct {
+	Matchers []AlertGeneratedMatcher
+
+	lock sync.Mutex
+	// firstSeen holds when each matcher not implementing TimestampedMatcher first found an alert, by detonation UUID
+	firstSeen map[string]map[int]time.Time
+}
+
+// Ordered creates a matcher passing once all the matchers found an alert, in the order of the matchers
+func Ordered(matchers ...AlertGeneratedMatcher) *OrderedMatcher {
+	return &OrderedMatcher{Matchers: matchers}
+}
+
+// ErrAlertsOutOfOrder is returned by OrderedMatcher when an alert precedes the alert of a previous matcher, which
+// waiting for more alerts can't fix
+var ErrAlertsOutOfOrder = errors.New("alerts generated out of order")
+
+// HasExpectedAlert returns true if every matcher found an alert, and no alert precedes the alert of the previous
+// matcher. Every matcher is queried, so that an alert found out of order fails the matcher right away.
+func (m *OrderedMatcher) HasExpectedAlert(ctx context.Context, uuid string) (bool, error) {
+	allFound := true
+	var previous time.Time
+	var previousMatcher AlertGeneratedMatcher
+	for i, matcher := range m.Matchers {
+		timestamp, found, err := m.alertTime(ctx, i, matcher, uuid)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", matcher.String(), err)
+		}
+		if !found {
+			allFound = false
+			continue
+		}
+		if timestamp.Before(previous) {
+			return false, fmt.Errorf("%w: %s was generated before %s", ErrAlertsOutOfOrder, matcher.String(), previousMatcher.String())
+		}
+		previous = timestamp
+		previousMatcher = matcher
+	}
+	return allFound, nil
+}
+
+// alertTime returns when the alert of the i-th matcher was generated, or first found if its timestamp is unknown
+func (m *OrderedMatcher) alertTime(ctx context.Context, i int, matcher AlertGeneratedMatcher, uuid string) (time.Time, bool, error) {
+	if timestampedMatcher, ok := matcher.(TimestampedMatcher); ok {
+		timestamp, found, err := timestampedMatcher.FirstAlertTime(ctx, uuid)
+		if err != nil || !found {
+			return time.Time{}, false, err
+		}
+		if !timestamp.IsZero() {
+			return timestamp, true, nil
+		}
+	} else {
+		hasAlert, err := matcher.HasExpectedAlert(ctx, uuid)
+		if err != nil || !hasAlert {
+			return time.Time{}, false, err
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.firstSeen == nil {
+		m.firstSeen = map[string]map[int]time.Time{}
+	}
+	if m.firstSeen[uuid] == nil {
+		m.firstSeen[uuid] = map[int]time.Time{}
+	}
+	if _, seen := m.firstSeen[uuid][i]; !seen {
+		m.firstSeen[uuid][i] = time.Now()
+	}
+	return m.firstSeen[uuid][i], true, nil
+}
+
+func (m *OrderedMatcher) String() string {
+	return describeMatchers(m.Matchers, ", then ")
+}
+
+// Cleanup closes the alerts of the detonation for every distinct matcher
+func (m *OrderedMatcher) Cleanup(ctx context.Context, uuid string) error {
+	m.forget(uuid)
+	return CleanupDetonation(ctx, m.Matchers, uuid)
+}
+
+// forget discards when the alerts of a detonation were first found
+func (m *OrderedMatcher) forget(uuid string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.firstSeen, uuid)
+}
+
+// describeMatchers returns a textual representation of matchers, joined by a separator
+func describeMatchers(matchers []AlertGeneratedMatcher, separator string) string {
+	descriptions := make([]string, len(matchers))
+	for i, matcher := range matchers {
+		descriptions[i] = matcher.String()
+	}
+	return "(" + strings.Join(descriptions, separator) + ")"
+}
@@ -0,0 +1,175 @@
+package matchers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMatcher is a matcher returning a fixed result, and recording its cleanups
+type fakeMatcher struct {
+	name       string
+	hasAlert   bool
+	err        error
+	cleanupErr error
+	cleanedUp  []string
+}
+
+func (m *fakeMatcher) HasExpectedAlert(context.Context, string) (bool, error) {
+	return m.hasAlert, m.err
+}
+
+func (m *fakeMatcher) String() string {
+	return m.name
+}
+
+func (m *fakeMatcher) Cleanup(_ context.Context, uuid string) error {
+	m.cleanedUp = append(m.cleanedUp, uuid)
+	return m.cleanupErr
+}
+
+// timestampedFakeMatcher is a matcher whose alert was generated at a fixed time
+type timestampedFakeMatcher struct {
+	fakeMatcher
+	timestamp time.Time
+}
+
+func (m *timestampedFakeMatcher) FirstAlertTime(context.Context, string) (time.Time, bool, error) {
+	return m.timestamp, m.hasAlert, m.err
+}
+
+func TestAnyOf(t *testing.T) {
+	found := &fakeMatcher{name: "found", hasAlert: true}
+	missing := &fakeMatcher{name: "missing"}
+	broken := &fakeMatcher{name: "broken", err: errors.New("rate limited")}
+
+	hasAlert, err := AnyOf(missing, found).HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err)
+	assert.True(t, hasAlert)
+
+	hasAlert, err = AnyOf(broken, found).HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err, "an error should be ignored when another matcher found an alert")
+	assert.True(t, hasAlert)
+
+	hasAlert, err = AnyOf(missing, missing).HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err)
+	assert.False(t, hasAlert)
+
+	_, err = AnyOf(missing, broken).HasExpectedAlert(context.Background(), "uid")
+	assert.EqualError(t, err, "broken: rate limited")
+
+	assert.Equal(t, "any of (missing, found)", AnyOf(missing, found).String())
+}
+
+func TestAllOf(t *testing.T) {
+	found := &fakeMatcher{name: "found", hasAlert: true}
+	missing := &fakeMatcher{name: "missing"}
+	broken := &fakeMatcher{name: "broken", err: errors.New("rate limited")}
+
+	hasAlert, err := AllOf(found, found).HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err)
+	assert.True(t, hasAlert)
+
+	hasAlert, err = AllOf(found, missing).HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err)
+	assert.False(t, hasAlert)
+
+	_, err = AllOf(found, broken).HasExpectedAlert(context.Background(), "uid")
+	assert.EqualError(t, err, "broken: rate limited")
+
+	assert.Equal(t, "all of (found, any of (missing, broken))", AllOf(found, AnyOf(missing, broken)).String())
+}
+
+func TestOrdered(t *testing.T) {
+	now := time.Now()
+	first := &timestampedFakeMatcher{fakeMatcher: fakeMatcher{name: "first", hasAlert: true}, timestamp: now.Add(-2 * time.Minute)}
+	second := &timestampedFakeMatcher{fakeMatcher: fakeMatcher{name: "second", hasAlert: true}, timestamp: now.Add(-1 * time.Minute)}
+	pending := &timestampedFakeMatcher{fakeMatcher: fakeMatcher{name: "pending"}}
+
+	hasAlert, err := Ordered(first, second).HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err)
+	assert.True(t, hasAlert)
+
+	_, err = Ordered(second, first).HasExpectedAlert(context.Background(), "uid")
+	assert.ErrorIs(t, err, ErrAlertsOutOfOrder, "alerts generated in the wrong order should fail right away")
+	assert.EqualError(t, err, "alerts generated out of order: first was generated before second")
+
+	_, err = Ordered(second, pending, first).HasExpectedAlert(context.Background(), "uid")
+	assert.ErrorIs(t, err, ErrAlertsOutOfOrder, "an alert still missing should not delay the failure")
+
+	hasAlert, err = Ordered(first, pending).HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err)
+	assert.False(t, hasAlert)
+
+	assert.Equal(t, "(first, then second)", Ordered(first, second).String())
+}
+
+func TestOrderedFallsBackToWhenAlertsWereFound(t *testing.T) {
+	first := &fakeMatcher{name: "first"}
+	second := &fakeMatcher{name: "second", hasAlert: true}
+	matcher := Ordered(first, second)
+
+	// The second alert is found before the first one
+	hasAlert, err := matcher.HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err)
+	assert.False(t, hasAlert)
+	first.hasAlert = true
+	_, err = matcher.HasExpectedAlert(context.Background(), "uid")
+	assert.ErrorIs(t, err, ErrAlertsOutOfOrder, "the second alert was found first")
+
+	// Once cleaned up, the detonation is forgotten
+	require.NoError(t, matcher.Cleanup(context.Background(), "uid"))
+	hasAlert, err = matcher.HasExpectedAlert(context.Background(), "uid")
+	require.NoError(t, err)
+	assert.True(t, hasAlert)
+}
+
+func TestCompositeMatchersCleanUpEveryMatcher(t *testing.T) {
+	first := &fakeMatcher{name: "first", cleanupErr: errors.New("forbidden")}
+	second := &fakeMatcher{name: "second"}
+	third := &fakeMatcher{name: "third"}
+
+	err := AllOf(first, AnyOf(second, Ordered(third))).Cleanup(context.Background(), "uid")
+	assert.EqualError(t, err, "first: forbidden")
+	for _, matcher := range []*fakeMatcher{first, second, third} {
+		assert.Equal(t, []string{"uid"}, matcher.cleanedUp, "%s was not cleaned up", matcher.name)
+	}
+}
+
+// backendFakeMatcher is a matcher querying a named backend
+type backendFakeMatcher struct {
+	fakeMatcher
+	backend string
+}
+
+func (m *backendFakeMatcher) Backend() string {
+	return m.backend
+}
+
+func TestBackendsIncludesNestedMatchers(t *testing.T) {
+	datadog := &backendFakeMatcher{fakeMatcher: fakeMatcher{name: "datadog"}, backend: "datadog"}
+	elastic := &backendFakeMatcher{fakeMatcher: fakeMatcher{name: "elastic"}, backend: "elastic"}
+	other := &fakeMatcher{name: "other"}
+
+	backends := Backends([]AlertGeneratedMatcher{datadog, AnyOf(other, Ordered(datadog, elastic))})
+	assert.Equal(t, []string{"datadog", "elastic"}, backends)
+	assert.Empty(t, Backends([]AlertGeneratedMatcher{other}))
+}
+
+func TestCleanupDetonationCleansUpEveryBackendOnce(t *testing.T) {
+	datadog1 := &backendFakeMatcher{fakeMatcher: fakeMatcher{name: "datadog"}, backend: "datadog"}
+	datadog2 := &backendFakeMatcher{fakeMatcher: fakeMatcher{name: "datadog"}, backend: "datadog"}
+	elastic := &backendFakeMatcher{fakeMatcher: fakeMatcher{name: "elastic", cleanupErr: errors.New("forbidden")}, backend: "elastic"}
+	other := &fakeMatcher{name: "other"}
+
+	err := CleanupDetonation(context.Background(), []AlertGeneratedMatcher{AnyOf(datadog1, Ordered(elastic)), datadog2, elastic, other}, "uid")
+	assert.EqualError(t, err, "elastic: forbidden")
+	assert.Equal(t, []string{"uid"}, datadog1.cleanedUp)
+	assert.Empty(t, datadog2.cleanedUp, "the backend was already cleaned up through a composite matcher")
+	assert.Equal(t, []string{"uid"}, elastic.cleanedUp)
+	assert.Equal(t, []string{"uid"}, other.cleanedUp)
+}
@@ -0,0 +1,189 @@
+package matchers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Detonation describes the detonation that alerts are correlated with
+type Detonation struct {
+	Uuid string
+	// Targets are the hosts or cloud accounts the attack was detonated against, when known
+	Targets []string
+	// Start and End are when the detonation started and ended, when known
+	Start time.Time
+	End   time.Time
+}
+
+// Alert is the backend-agnostic representation of an alert that correlators work on
+type Alert struct {
+	// Document holds the attributes of the alert, as a JSON-like document
+	Document map[string]interface{}
+	// Timestamp is when the alert was generated, when known
+	Timestamp time.Time
+}
+
+// AlertCorrelator decides whether an alert was caused by a detonation
+type AlertCorrelator interface {
+	Correlates(alert Alert, detonation Detonation) bool
+}
+
+// CorrelatesByUuid reports whether a correlator only correlates alerts carrying the detonation UUID, in which case
+// the alerts it correlates can be closed regardless of their rule. A nil correlator stands for the default one.
+func CorrelatesByUuid(correlator AlertCorrelator) bool {
+	switch correlator.(type) {
+	case nil, *UuidCorrelator, *FieldCorrelator, *FieldsContainCorrelator:
+		return true
+	}
+	return false
+}
+
+// UuidCorrelator correlates alerts containing the detonation UUID anywhere in their attributes. This is the default
+// correlator, which can yield false positives when an unrelated field happens to contain the UUID.
+type UuidCorrelator struct{}
+
+func (m *UuidCorrelator) Correlates(alert Alert, detonation Detonation) bool {
+	if detonation.Uuid == "" {
+		return false
+	}
+	buf, _ := json.Marshal(alert.Document)
+	return strings.Contains(string(buf), detonation.Uuid)
+}
+
+// FieldCorrelator correlates alerts whose field at the given dot-separated path is exactly the detonation UUID,
+// or a list containing it
+type FieldCorrelator struct {
+	Field string
+}
+
+func (m *FieldCorrelator) Correlates(alert Alert, detonation Detonation) bool {
+	value, found := LookupField(alert.Document, m.Field)
+	if !found || detonation.Uuid == "" {
+		return false
+	}
+	for _, fieldValue := range fieldValues(value) {
+		if fieldValue == detonation.Uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldsContainCorrelator correlates alerts where at least one of the fields at the given dot-separated paths
+// contains the detonation UUID, e.g. the command line or parent process of the process that triggered the alert
+type FieldsContainCorrelator struct {
+	Fields []string
+}
+
+func (m *FieldsContainCorrelator) Correlates(alert Alert, detonation Detonation) bool {
+	if detonation.Uuid == "" {
+		return false
+	}
+	for _, field := range m.Fields {
+		value, found := LookupField(alert.Document, field)
+		if !found {
+			continue
+		}
+		for _, fieldValue := range fieldValues(value) {
+			if strings.Contains(fieldValue, detonation.Uuid) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EntityCorrelator correlates alerts about the entity (e.g. host or cloud account) an attack was detonated against,
+// generated during the detonation or within a time window after it. It is meant for alerts that don't carry the
+// detonation UUID at all, and can match unrelated alerts about the same entity. When closing the alerts of a
+// detonation, matchers using it only close the alerts matching their own filter, e.g. of their rule.
+type EntityCorrelator struct {
+	// Fields are the dot-separated paths of the fields holding the entity in the alert, e.g. host.name
+	Fields []string
+	// Entities are the names of the entity as they appear in the alert. By default, they are the targets of
+	// the detonation, without the user and port of SSH targets.
+	Entities []string
+	// Window is how long after the end of the detonation alerts are correlated with it
+	Window time.Duration
+}
+
+func (m *EntityCorrelator) Correlates(alert Alert, detonation Detonation) bool {
+	if alert.Timestamp.IsZero() || detonation.Start.IsZero() || detonation.End.IsZero() {
+		return false
+	}
+	if alert.Timestamp.Before(detonation.Start) || alert.Timestamp.After(detonation.End.Add(m.Window)) {
+		return false
+	}
+	entities := m.Entities
+	if len(entities) == 0 {
+		entities = targetEntities(detonation.Targets)
+	}
+	for _, field := range m.Fields {
+		value, found := LookupField(alert.Document, field)
+		if !found {
+			continue
+		}
+		for _, fieldValue := range fieldValues(value) {
+			for _, entity := range entities {
+				if strings.EqualFold(fieldValue, entity) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// targetEntities returns the names of the entities targeted by a detonation, e.g. "10.0.0.12" for "ubuntu@10.0.0.12:22"
+func targetEntities(targets []string) []string {
+	entities := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if i := strings.LastIndex(target, "@"); i >= 0 {
+			target = target[i+1:]
+		}
+		if host, _, err := net.SplitHostPort(target); err == nil {
+			target = host
+		}
+		entities = append(entities, target)
+	}
+	return entities
+}
+
+// fieldValues returns the textual values of a field, which can be a list
+func fieldValues(value interface{}) []string {
+	switch typedValue := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{typedValue}
+	case []interface{}:
+		var values []string
+		for _, item := range typedValue {
+			values = append(values, fieldValues(item)...)
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(typedValue)}
+	}
+}
+
+type detonationKey struct{}
+
+// WithDetonation makes matchers aware of the details of a detonation, such as its targets and timing,
+// for correlators that rely on them
+func WithDetonation(ctx context.Context, detonation Detonation) context.Context {
+	return context.WithValue(ctx, detonationKey{}, detonation)
+}
+
+// DetonationFromContext returns the detonation with the given UUID set with WithDetonation, or a detonation only
+// known by its UUID
+func DetonationFromContext(ctx context.Context, detonationUuid string) Detonation {
+	if detonation, ok := ctx.Value(detonationKey{}).(Detonation); ok && detonation.Uuid == detonationUuid {
+		return detonation
+	}
+	return Detonation{Uuid: detonationUuid}
+}
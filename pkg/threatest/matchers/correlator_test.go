@@ -0,0 +1,115 @@
+package matchers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertCorrelators(t *testing.T) {
+	const uuid = "b6a1e5c4-5b1f-4b9e-9c7e-1f2d3c4b5a69"
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	detonation := Detonation{Uuid: uuid, Targets: []string{"ubuntu@10.0.0.12:22"}, Start: start, End: start.Add(1 * time.Minute)}
+
+	scenarios := []struct {
+		Name       string
+		Correlator AlertCorrelator
+		Alert      Alert
+		Expected   bool
+	}{
+		{
+			Name:       "UUID anywhere",
+			Correlator: &UuidCorrelator{},
+			Alert:      Alert{Document: map[string]interface{}{"message": "ran /tmp/" + uuid}},
+			Expected:   true,
+		},
+		{
+			Name:       "UUID absent",
+			Correlator: &UuidCorrelator{},
+			Alert:      Alert{Document: map[string]interface{}{"message": "ran /tmp/foo"}},
+		},
+		{
+			Name:       "exact field",
+			Correlator: &FieldCorrelator{Field: "process.env.THREATEST_DETONATION_UUID"},
+			Alert:      Alert{Document: map[string]interface{}{"process": map[string]interface{}{"env.THREATEST_DETONATION_UUID": uuid}}},
+			Expected:   true,
+		},
+		{
+			Name:       "exact field in a list",
+			Correlator: &FieldCorrelator{Field: "tags"},
+			Alert:      Alert{Document: map[string]interface{}{"tags": []interface{}{"env:prod", uuid}}},
+			Expected:   true,
+		},
+		{
+			Name:       "field containing the UUID is not an exact match",
+			Correlator: &FieldCorrelator{Field: "process.executable"},
+			Alert:      Alert{Document: map[string]interface{}{"process.executable": "/tmp/" + uuid}},
+		},
+		{
+			Name:       "UUID in an unrelated field",
+			Correlator: &FieldsContainCorrelator{Fields: []string{"process.command_line", "process.parent.executable"}},
+			Alert:      Alert{Document: map[string]interface{}{"network.http.url": "https://example.com/" + uuid}},
+		},
+		{
+			Name:       "UUID in one of the fields",
+			Correlator: &FieldsContainCorrelator{Fields: []string{"process.command_line", "process.parent.executable"}},
+			Alert:      Alert{Document: map[string]interface{}{"process.parent.executable": "/tmp/" + uuid}},
+			Expected:   true,
+		},
+		{
+			Name:       "entity within the time window",
+			Correlator: &EntityCorrelator{Fields: []string{"host.ip"}, Window: 5 * time.Minute},
+			Alert:      Alert{Document: map[string]interface{}{"host.ip": []interface{}{"10.0.0.12"}}, Timestamp: start.Add(4 * time.Minute)},
+			Expected:   true,
+		},
+		{
+			Name:       "entity after the time window",
+			Correlator: &EntityCorrelator{Fields: []string{"host.ip"}, Window: 5 * time.Minute},
+			Alert:      Alert{Document: map[string]interface{}{"host.ip": "10.0.0.12"}, Timestamp: start.Add(10 * time.Minute)},
+		},
+		{
+			Name:       "entity before the detonation",
+			Correlator: &EntityCorrelator{Fields: []string{"host.ip"}, Window: 5 * time.Minute},
+			Alert:      Alert{Document: map[string]interface{}{"host.ip": "10.0.0.12"}, Timestamp: start.Add(-1 * time.Minute)},
+		},
+		{
+			Name:       "other entity",
+			Correlator: &EntityCorrelator{Fields: []string{"host.ip"}, Window: 5 * time.Minute},
+			Alert:      Alert{Document: map[string]interface{}{"host.ip": "10.0.0.13"}, Timestamp: start.Add(1 * time.Minute)},
+		},
+		{
+			Name:       "explicit entity",
+			Correlator: &EntityCorrelator{Fields: []string{"host.name"}, Entities: []string{"web-1"}, Window: 5 * time.Minute},
+			Alert:      Alert{Document: map[string]interface{}{"host": map[string]interface{}{"name": "WEB-1"}}, Timestamp: start.Add(1 * time.Minute)},
+			Expected:   true,
+		},
+		{
+			Name:       "alert without timestamp",
+			Correlator: &EntityCorrelator{Fields: []string{"host.ip"}, Window: 5 * time.Minute},
+			Alert:      Alert{Document: map[string]interface{}{"host.ip": "10.0.0.12"}},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.Name, func(t *testing.T) {
+			assert.Equal(t, scenario.Expected, scenario.Correlator.Correlates(scenario.Alert, detonation))
+		})
+	}
+}
+
+func TestEntityCorrelatorRequiresDetonationTiming(t *testing.T) {
+	correlator := &EntityCorrelator{Fields: []string{"host.name"}, Entities: []string{"web-1"}, Window: 5 * time.Minute}
+	alert := Alert{Document: map[string]interface{}{"host.name": "web-1"}, Timestamp: time.Now()}
+	assert.False(t, correlator.Correlates(alert, Detonation{Uuid: "uuid"}))
+}
+
+func TestDetonationFromContext(t *testing.T) {
+	detonation := Detonation{Uuid: "uuid", Targets: []string{"host"}}
+	ctx := WithDetonation(context.Background(), detonation)
+
+	assert.Equal(t, detonation, DetonationFromContext(ctx, "uuid"))
+	assert.Equal(t, Detonation{Uuid: "other-uuid"}, DetonationFromContext(ctx, "other-uuid"))
+	assert.Equal(t, Detonation{Uuid: "uuid"}, DetonationFromContext(context.Background(), "uuid"))
+}
@@ -0,0 +1,104 @@
+package matchers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CountConstraint is an expectation on the number of distinct alerts correlated with a detonation, e.g. for
+// rules with thresholds or grouping that should generate a precise number of alerts
+type CountConstraint struct {
+	// Min is the minimal number of alerts
+	Min int
+	// Max is the maximal number of alerts, negative meaning no limit
+	Max int
+	// SettlePeriod is how long to keep counting alerts once Min alerts were found, before evaluating the constraint.
+	// When zero, alerts are counted until the timeout of the assertion.
+	SettlePeriod time.Duration
+}
+
+// ExactlyN expects exactly n alerts
+func ExactlyN(n int) CountConstraint {
+	return CountConstraint{Min: n, Max: n}
+}
+
+// AtLeast expects n alerts or more
+func AtLeast(n int) CountConstraint {
+	return CountConstraint{Min: n, Max: -1}
+}
+
+// AtMost expects at least one alert, and no more than n
+func AtMost(n int) CountConstraint {
+	return CountConstraint{Min: 1, Max: n}
+}
+
+// NoDuplicates expects a single alert, e.g. to verify that a rule doesn't generate duplicate alerts for the same attack
+func NoDuplicates() CountConstraint {
+	return AtMost(1)
+}
+
+// WithSettlePeriod returns a copy of the constraint evaluated once the period has elapsed after finding Min alerts,
+// instead of at the timeout of the assertion
+func (m CountConstraint) WithSettlePeriod(settlePeriod time.Duration) CountConstraint {
+	m.SettlePeriod = settlePeriod
+	return m
+}
+
+// Validate returns an error if no number of alerts can satisfy the constraint
+func (m CountConstraint) Validate() error {
+	if m.Min < 1 {
+		return errors.New("the minimal number of alerts must be at least 1")
+	}
+	if m.Max >= 0 && m.Max < m.Min {
+		return fmt.Errorf("the maximal number of alerts (%d) is lower than the minimal one (%d)", m.Max, m.Min)
+	}
+	if m.SettlePeriod < 0 {
+		return errors.New("the settle period cannot be negative")
+	}
+	return nil
+}
+
+// Satisfied returns true if the number of alerts satisfies the constraint
+func (m CountConstraint) Satisfied(count int) bool {
+	return count >= m.Min && !m.Exceeded(count)
+}
+
+// Exceeded returns true if there are more alerts than allowed, in which case more alerts can't satisfy the constraint
+func (m CountConstraint) Exceeded(count int) bool {
+	return m.Max >= 0 && count > m.Max
+}
+
+func (m CountConstraint) String() string {
+	switch {
+	case m.Min == m.Max:
+		return fmt.Sprintf("exactly %d", m.Min)
+	case m.Max < 0:
+		return fmt.Sprintf("at least %d", m.Min)
+	case m.Min == 1:
+		return fmt.Sprintf("at most %d", m.Max)
+	default:
+		return fmt.Sprintf("between %d and %d", m.Min, m.Max)
+	}
+}
+
+// DescribeCount returns a textual representation of a count constraint, to be appended to the description of a matcher
+func DescribeCount(constraint *CountConstraint) string {
+	if constraint == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", constraint)
+}
+
+// CountingMatcher is implemented by matchers that can count the alerts correlated with a detonation, to assert
+// on their number rather than on the existence of a single alert
+type CountingMatcher interface {
+	AlertGeneratedMatcher
+
+	// ExpectedCount returns the constraint on the number of alerts, or nil if a single alert is enough
+	ExpectedCount() *CountConstraint
+
+	// CountAlerts returns the number of distinct alerts correlated with the given detonation UUID
+	CountAlerts(ctx context.Context, uuid string) (int, error)
+}
@@ -0,0 +1,45 @@
+package matchers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountConstraints(t *testing.T) {
+	scenarios := []struct {
+		Constraint  CountConstraint
+		Description string
+		Satisfied   []int
+		Unsatisfied []int
+		Exceeded    []int
+	}{
+		{ExactlyN(2), "exactly 2", []int{2}, []int{0, 1, 3}, []int{3}},
+		{AtLeast(2), "at least 2", []int{2, 3, 100}, []int{0, 1}, nil},
+		{AtMost(3), "at most 3", []int{1, 2, 3}, []int{0, 4}, []int{4}},
+		{NoDuplicates(), "exactly 1", []int{1}, []int{0, 2}, []int{2}},
+		{CountConstraint{Min: 2, Max: 4}, "between 2 and 4", []int{2, 4}, []int{1, 5}, []int{5}},
+	}
+	for _, scenario := range scenarios {
+		assert.NoError(t, scenario.Constraint.Validate())
+		assert.Equal(t, scenario.Description, scenario.Constraint.String())
+		for _, count := range scenario.Satisfied {
+			assert.True(t, scenario.Constraint.Satisfied(count), "%d alerts should satisfy %s", count, scenario.Constraint)
+			assert.False(t, scenario.Constraint.Exceeded(count), "%d alerts should not exceed %s", count, scenario.Constraint)
+		}
+		for _, count := range scenario.Unsatisfied {
+			assert.False(t, scenario.Constraint.Satisfied(count), "%d alerts should not satisfy %s", count, scenario.Constraint)
+		}
+		for _, count := range scenario.Exceeded {
+			assert.True(t, scenario.Constraint.Exceeded(count), "%d alerts should exceed %s", count, scenario.Constraint)
+		}
+	}
+}
+
+func TestCountConstraintValidation(t *testing.T) {
+	assert.ErrorContains(t, ExactlyN(0).Validate(), "must be at least 1")
+	assert.ErrorContains(t, CountConstraint{Min: 3, Max: 2}.Validate(), "lower than the minimal one")
+	assert.ErrorContains(t, AtLeast(1).WithSettlePeriod(-1).Validate(), "cannot be negative")
+	assert.Equal(t, " (exactly 2)", DescribeCount(&CountConstraint{Min: 2, Max: 2}))
+	assert.Equal(t, "", DescribeCount(nil))
+}
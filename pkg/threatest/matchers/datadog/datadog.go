@@ -4,16 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"slices"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadog"
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadogV2"
 	"github.com/aws/smithy-go/ptr"
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/datadog/threatest/pkg/threatest/secret"
 )
 
@@ -21,6 +22,9 @@ const QueryAllOpenSignals = `@workflow.triage.state:open`
 const QueryOpenSignalsByAlertNameAndSeverity = `@workflow.triage.state:open @workflow.rule.name:"%s" %s`
 const QuerySeverity = `status:%s`
 
+// SignalLookbackWindow bounds how far back signals are searched, unless overridden with matchers.WithSearchWindow
+const SignalLookbackWindow = 1 * time.Hour
+
 type DatadogSecuritySignalsAPI interface {
 	SearchSignals(ctx context.Context, query string) ([]datadogV2.SecurityMonitoringSignal, error)
 	CloseSignal(ctx context.Context, id string) error
@@ -31,6 +35,8 @@ type DatadogSecuritySignalsAPIImpl struct {
 	apiKey                secret.Secret
 	appKey                secret.Secret
 	site                  string
+	// httpClient performs the requests not supported by the Datadog API client
+	httpClient *http.Client
 }
 
 func (m *DatadogSecuritySignalsAPIImpl) buildContext(ctx context.Context) context.Context {
@@ -44,24 +50,42 @@ func (m *DatadogSecuritySignalsAPIImpl) buildContext(ctx context.Context) contex
 	return ctx
 }
 
-func (m *DatadogSecuritySignalsAPIImpl) SearchSignals(ctx context.Context, query string) ([]datadogV2.SecurityMonitoringSignal, error) {
-	maxSignals := 1000
-	params := datadogV2.NewSearchSecurityMonitoringSignalsOptionalParameters().WithBody(datadogV2.SecurityMonitoringSignalListRequest{
-		Filter: &datadogV2.SecurityMonitoringSignalListRequestFilter{
-			From:  datadog.PtrTime(time.Now().Add(-1 * time.Hour)), // Signals no older than 1 hour
-			Query: datadog.PtrString(query),
-		},
-		Page: &datadogV2.SecurityMonitoringSignalListRequestPage{Limit: ptr.Int32(int32(maxSignals))},
-		Sort: datadogV2.SECURITYMONITORINGSIGNALSSORT_TIMESTAMP_DESCENDING.Ptr(),
-	})
+// signalsPageSize is the maximum number of signals the Datadog API returns per page
+const signalsPageSize = 1000
 
+// SearchSignals returns all the signals matching a query, following the pages of results
+func (m *DatadogSecuritySignalsAPIImpl) SearchSignals(ctx context.Context, query string) ([]datadogV2.SecurityMonitoringSignal, error) {
+	from := time.Now().Add(-matchers.SearchWindow(ctx, SignalLookbackWindow))
 	ddCtx := m.buildContext(ctx)
-	signals, _, err := m.securityMonitoringAPI.SearchSecurityMonitoringSignals(ddCtx, *params)
+	var allSignals []datadogV2.SecurityMonitoringSignal
+	var cursor *string
+	for {
+		params := datadogV2.NewSearchSecurityMonitoringSignalsOptionalParameters().WithBody(datadogV2.SecurityMonitoringSignalListRequest{
+			Filter: &datadogV2.SecurityMonitoringSignalListRequestFilter{
+				From:  datadog.PtrTime(from),
+				Query: datadog.PtrString(query),
+			},
+			Page: &datadogV2.SecurityMonitoringSignalListRequestPage{Limit: ptr.Int32(signalsPageSize), Cursor: cursor},
+			Sort: datadogV2.SECURITYMONITORINGSIGNALSSORT_TIMESTAMP_DESCENDING.Ptr(),
+		})
+
+		signals, response, err := m.securityMonitoringAPI.SearchSecurityMonitoringSignals(ddCtx, *params)
+		if err != nil && response != nil && response.StatusCode >= http.StatusBadRequest {
+			return nil, &matchers.HTTPStatusError{StatusCode: response.StatusCode, Message: "unable to search for signals (" + err.Error() + ")"}
+		}
+		if err != nil {
+			return nil, err
+		}
+		allSignals = append(allSignals, signals.Data...)
 
-	if len(signals.Data) >= maxSignals {
-		return nil, errors.New("unsupported: more than 1000 open signals") // todo: paginate response
+		cursor = nil
+		if signals.Meta != nil && signals.Meta.Page != nil {
+			cursor = signals.Meta.Page.After
+		}
+		if len(signals.Data) < signalsPageSize || cursor == nil || *cursor == "" {
+			return allSignals, nil
+		}
 	}
-	return signals.Data, err
 }
 
 func (m *DatadogSecuritySignalsAPIImpl) CloseSignal(ctx context.Context, id string) error {
@@ -85,13 +109,13 @@ func (m *DatadogSecuritySignalsAPIImpl) CloseSignal(ctx context.Context, id stri
 	req.Header.Set("DD-API-KEY", m.apiKey.Value())
 	req.Header.Set("DD-APPLICATION-KEY", m.appKey.Value())
 
-	client := &http.Client{}
-	response, err := client.Do(req)
+	response, err := m.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
-	if response.StatusCode != 200 {
-		return errors.New("unable to archive signal, got status code " + strconv.Itoa(response.StatusCode))
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return &matchers.HTTPStatusError{StatusCode: response.StatusCode, Message: "unable to archive signal"}
 	}
 	return nil
 }
@@ -105,39 +129,124 @@ func (m *DatadogAlertGeneratedAssertionBuilder) Cleanup(ctx context.Context, det
 }
 
 func (m *DatadogAlertGeneratedAssertion) HasExpectedAlert(ctx context.Context, detonationUuid string) (bool, error) {
-	query := m.buildDatadogSignalQuery()
-	signals, err := m.SignalsAPI.SearchSignals(ctx, query)
+	signals, err := m.correlatedSignals(ctx, detonationUuid)
 	if err != nil {
-		return false, errors.New("unable to search for Datadog security signal: " + err.Error())
+		return false, err
+	}
+	return len(signals) > 0, nil
+}
+
+// ExpectedCount returns the expected number of signals, or nil if a single signal is enough
+func (m *DatadogAlertGeneratedAssertion) ExpectedCount() *matchers.CountConstraint {
+	return m.Count
+}
+
+// CountAlerts returns the number of distinct signals correlated with the detonation. Since Datadog groups the
+// events of a rule into a single signal, a signal updated with new samples still counts once.
+func (m *DatadogAlertGeneratedAssertion) CountAlerts(ctx context.Context, detonationUuid string) (int, error) {
+	signals, err := m.correlatedSignals(ctx, detonationUuid)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	seenIds := map[string]bool{}
+	for i := range signals {
+		if id := signals[i].GetId(); id == "" || !seenIds[id] {
+			seenIds[id] = true
+			count++
+		}
 	}
+	return count, nil
+}
 
-	if len(signals) == 0 {
-		return false, nil
+// FirstAlertTime returns when the earliest signal correlated with the detonation was generated
+func (m *DatadogAlertGeneratedAssertion) FirstAlertTime(ctx context.Context, detonationUuid string) (time.Time, bool, error) {
+	signals, err := m.correlatedSignals(ctx, detonationUuid)
+	if err != nil || len(signals) == 0 {
+		return time.Time{}, false, err
+	}
+	var firstAlertTime time.Time
+	for i := range signals {
+		timestamp := signalTimestamp(signals[i])
+		if timestamp.IsZero() {
+			continue
+		}
+		if firstAlertTime.IsZero() || timestamp.Before(firstAlertTime) {
+			firstAlertTime = timestamp
+		}
 	}
+	return firstAlertTime, true, nil
+}
 
+// correlatedSignals returns the open signals matching the alert filter that were caused by the detonation
+func (m *DatadogAlertGeneratedAssertion) correlatedSignals(ctx context.Context, detonationUuid string) ([]datadogV2.SecurityMonitoringSignal, error) {
+	for _, predicate := range m.AlertFilter.Attributes {
+		if err := predicate.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid attribute predicate: %v", err)
+		}
+	}
+	signals, err := m.searchSignals(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for Datadog security signal: %w", err)
+	}
+
+	detonation := matchers.DetonationFromContext(ctx, detonationUuid)
+	var correlatedSignals []datadogV2.SecurityMonitoringSignal
 	for i := range signals {
-		if m.signalMatchesExecution(signals[i], detonationUuid) { //TODO low-prio unify naming of "uuid"/"uid"
-			return true, nil
+		if m.signalMatchesExecution(signals[i], detonation) && matchers.MatchesAll(signalDocument(signals[i]), m.AlertFilter.Attributes) { //TODO low-prio unify naming of "uuid"/"uid"
+			correlatedSignals = append(correlatedSignals, signals[i])
 		}
 	}
+	return correlatedSignals, nil
+}
 
-	return false, nil
+// searchSignals returns the open signals matching the alert filter, either by searching for them directly,
+// or by filtering all open signals retrieved through the shared fetcher
+func (m *DatadogAlertGeneratedAssertion) searchSignals(ctx context.Context) ([]datadogV2.SecurityMonitoringSignal, error) {
+	if m.Fetcher == nil {
+		return m.SignalsAPI.SearchSignals(ctx, m.buildDatadogSignalQuery())
+	}
+
+	allSignals, err := m.Fetcher.Fetch(ctx, m.Backend()+" "+QueryAllOpenSignals, func(ctx context.Context) ([]datadogV2.SecurityMonitoringSignal, error) {
+		return m.SignalsAPI.SearchSignals(ctx, QueryAllOpenSignals)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var signals []datadogV2.SecurityMonitoringSignal
+	for i := range allSignals {
+		if m.signalMatchesFilter(allSignals[i]) {
+			signals = append(signals, allSignals[i])
+		}
+	}
+	return signals, nil
 }
 
 func (m *DatadogAlertGeneratedAssertion) String() string {
-	return fmt.Sprintf("Datadog security signal '%s'", m.AlertFilter.RuleName)
+	return fmt.Sprintf("Datadog security signal '%s'%s%s", m.AlertFilter.RuleName, matchers.DescribePredicates(m.AlertFilter.Attributes), matchers.DescribeCount(m.Count))
 }
 
 func (m *DatadogAlertGeneratedAssertion) Cleanup(ctx context.Context, detonationUuid string) error {
-	signals, err := m.SignalsAPI.SearchSignals(ctx, QueryAllOpenSignals)
+	// Correlators that don't rely on the UUID can correlate unrelated signals, so only the signals matching the
+	// filter of the matcher are closed
+	scoped := !matchers.CorrelatesByUuid(m.Correlator)
+	query := QueryAllOpenSignals
+	if scoped {
+		query = m.buildDatadogSignalQuery()
+	}
+	signals, err := m.SignalsAPI.SearchSignals(ctx, query)
 	if err != nil {
-		return errors.New("unable to search for Datadog security monitoring signals: " + err.Error())
+		return fmt.Errorf("unable to search for Datadog security monitoring signals: %w", err)
 	}
 
+	detonation := matchers.DetonationFromContext(ctx, detonationUuid)
 	for i := range signals {
-		if m.signalMatchesExecution(signals[i], detonationUuid) {
+		if scoped && !matchers.MatchesAll(signalDocument(signals[i]), m.AlertFilter.Attributes) {
+			continue
+		}
+		if m.signalMatchesExecution(signals[i], detonation) {
 			if err := m.SignalsAPI.CloseSignal(ctx, *signals[i].Id); err != nil {
-				return errors.New("unable to archive signal " + *signals[i].Id + ": " + err.Error())
+				return fmt.Errorf("unable to archive signal %s: %w", *signals[i].Id, err)
 			}
 		}
 	}
@@ -145,6 +254,19 @@ func (m *DatadogAlertGeneratedAssertion) Cleanup(ctx context.Context, detonation
 	return nil
 }
 
+// AlertCorrelator returns the correlator of the matcher
+func (m *DatadogAlertGeneratedAssertion) AlertCorrelator() matchers.AlertCorrelator {
+	return m.Correlator
+}
+
+// Backend identifies the Datadog org queried by the matcher
+func (m *DatadogAlertGeneratedAssertion) Backend() string {
+	if api, ok := m.SignalsAPI.(*DatadogSecuritySignalsAPIImpl); ok {
+		return fmt.Sprintf("datadog %s %s", api.site, api.apiKey.Fingerprint())
+	}
+	return fmt.Sprintf("datadog %p", m.SignalsAPI)
+}
+
 // TODO: Would probably make more sense to retrieve all open signal and iterate instead of doing 2 pass
 func (m *DatadogAlertGeneratedAssertion) buildDatadogSignalQuery() string {
 	severityQuery := ""
@@ -158,7 +280,70 @@ func (m *DatadogAlertGeneratedAssertion) buildDatadogSignalQuery() string {
 	)
 }
 
-func (m *DatadogAlertGeneratedAssertion) signalMatchesExecution(signal datadogV2.SecurityMonitoringSignal, uid string) bool {
+// signalMatchesFilter locally applies the same filter as the search query built by buildDatadogSignalQuery. Like
+// the search, the rule name matches as a phrase, ignoring case and punctuation, and the severity ignores case.
+func (m *DatadogAlertGeneratedAssertion) signalMatchesFilter(signal datadogV2.SecurityMonitoringSignal) bool {
+	custom := signalCustomAttributes(signal)
+	if ruleName, _ := matchers.LookupField(custom, "workflow.rule.name"); !matchesPhrase(ruleName, m.AlertFilter.RuleName) {
+		return false
+	}
+	if m.AlertFilter.Severity != "" {
+		if severity, _ := matchers.LookupField(custom, "status"); !strings.EqualFold(fmt.Sprint(severity), m.AlertFilter.Severity) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesPhrase reports whether the words of a phrase appear in sequence in a value, the way Datadog matches
+// a quoted phrase against a text attribute
+func matchesPhrase(value interface{}, phrase string) bool {
+	text, isString := value.(string)
+	if !isString {
+		return false
+	}
+	valueWords, phraseWords := words(text), words(phrase)
+	if len(phraseWords) == 0 {
+		return len(valueWords) == 0
+	}
+	for i := 0; i+len(phraseWords) <= len(valueWords); i++ {
+		if slices.Equal(valueWords[i:i+len(phraseWords)], phraseWords) {
+			return true
+		}
+	}
+	return false
+}
+
+// words splits a text into lowercase words, ignoring punctuation
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// signalMatchesExecution reports whether the signal was caused by the detonation, according to the correlator of the matcher
+func (m *DatadogAlertGeneratedAssertion) signalMatchesExecution(signal datadogV2.SecurityMonitoringSignal, detonation matchers.Detonation) bool {
+	alert := matchers.Alert{Document: signalCustomAttributes(signal), Timestamp: signalTimestamp(signal)}
+	correlator := m.Correlator
+	if correlator == nil {
+		correlator = &matchers.UuidCorrelator{}
+	}
+	return correlator.Correlates(alert, detonation)
+}
+
+// signalTimestamp returns when a signal was generated, or the zero time if unknown
+func signalTimestamp(signal datadogV2.SecurityMonitoringSignal) time.Time {
+	if signal.Attributes == nil || signal.Attributes.Timestamp == nil {
+		return time.Time{}
+	}
+	return *signal.Attributes.Timestamp
+}
+
+// signalCustomAttributes returns the custom attributes of a signal, holding its actual content
+func signalCustomAttributes(signal datadogV2.SecurityMonitoringSignal) map[string]interface{} {
+	if signal.Attributes == nil {
+		return nil
+	}
 	custom := signal.Attributes.Custom
 	// The API serializes the custom fields under the JSON key "attributes" (not "custom"),
 	// so the Go client cannot deserialize them into Custom — they land in AdditionalProperties instead.
@@ -170,6 +355,27 @@ func (m *DatadogAlertGeneratedAssertion) signalMatchesExecution(signal datadogV2
 			}
 		}
 	}
-	buf, _ := json.Marshal(custom)
-	return strings.Contains(string(buf), uid)
+	return custom
+}
+
+// signalDocument returns the custom attributes of a signal, along with its tags and message, for predicates to apply to
+func signalDocument(signal datadogV2.SecurityMonitoringSignal) map[string]interface{} {
+	document := map[string]interface{}{}
+	for key, value := range signalCustomAttributes(signal) {
+		document[key] = value
+	}
+	if signal.Attributes == nil {
+		return document
+	}
+	if _, found := document["tags"]; !found && signal.Attributes.Tags != nil {
+		tags := make([]interface{}, len(signal.Attributes.Tags))
+		for i, tag := range signal.Attributes.Tags {
+			tags[i] = tag
+		}
+		document["tags"] = tags
+	}
+	if _, found := document["message"]; !found && signal.Attributes.Message != nil {
+		document["message"] = *signal.Attributes.Message
+	}
+	return document
 }
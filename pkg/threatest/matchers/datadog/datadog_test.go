@@ -2,12 +2,20 @@ package datadog
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadogV2"
 	"github.com/aws/smithy-go/ptr"
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/datadog/threatest/pkg/threatest/matchers/datadog/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -196,7 +204,7 @@ func TestSignalMatchesExecution(t *testing.T) {
 		signal.Attributes = &datadogV2.SecurityMonitoringSignalAttributes{
 			Custom: map[string]interface{}{"foobar": uid},
 		}
-		assert.True(t, matcher.signalMatchesExecution(*signal, uid))
+		assert.True(t, matcher.signalMatchesExecution(*signal, matchers.Detonation{Uuid: uid}))
 	})
 
 	t.Run("matches when UID is in AdditionalProperties[attributes] (actual API response)", func(t *testing.T) {
@@ -206,7 +214,7 @@ func TestSignalMatchesExecution(t *testing.T) {
 				"attributes": map[string]interface{}{"foobar": uid},
 			},
 		}
-		assert.True(t, matcher.signalMatchesExecution(*signal, uid))
+		assert.True(t, matcher.signalMatchesExecution(*signal, matchers.Detonation{Uuid: uid}))
 	})
 
 	t.Run("does not match when UID is absent", func(t *testing.T) {
@@ -216,6 +224,226 @@ func TestSignalMatchesExecution(t *testing.T) {
 				"attributes": map[string]interface{}{"foobar": "other-uid"},
 			},
 		}
-		assert.False(t, matcher.signalMatchesExecution(*signal, uid))
+		assert.False(t, matcher.signalMatchesExecution(*signal, matchers.Detonation{Uuid: uid}))
 	})
 }
+
+func TestBackendIdentifiesDatadogOrg(t *testing.T) {
+	matcher1 := DatadogSecuritySignal("rule 1", WithCredentials("api-key", "app-key", "datadoghq.com"))
+	matcher2 := DatadogSecuritySignal("rule 2", WithCredentials("api-key", "app-key", "datadoghq.com"))
+	otherOrgMatcher := DatadogSecuritySignal("rule 1", WithCredentials("other-api-key", "app-key", "datadoghq.com"))
+	otherSiteMatcher := DatadogSecuritySignal("rule 1", WithCredentials("api-key", "app-key", "datadoghq.eu"))
+
+	assert.Equal(t, matcher1.Backend(), matcher2.Backend())
+	assert.NotEqual(t, matcher1.Backend(), otherOrgMatcher.Backend())
+	assert.NotEqual(t, matcher1.Backend(), otherSiteMatcher.Backend())
+	assert.NotContains(t, matcher1.Backend(), "api-key")
+}
+
+func TestSharedFetcherIssuesASingleSearchForAllMatchers(t *testing.T) {
+	ctx := context.Background()
+	detonationUid := "my-uid"
+
+	ruleSignal := func(id int, ruleName string, severity string, uid string) datadogV2.SecurityMonitoringSignal {
+		signal := *sampleSignal(id)
+		signal.Attributes.Custom["workflow"] = map[string]interface{}{"rule": map[string]interface{}{"name": ruleName}}
+		signal.Attributes.Custom["status"] = severity
+		signal.Attributes.Custom["foobar"] = uid
+		return signal
+	}
+	allOpenSignals := []datadogV2.SecurityMonitoringSignal{
+		ruleSignal(0, "rule 1", "medium", detonationUid),
+		ruleSignal(1, "rule 2", "high", "other-uid"),
+		ruleSignal(2, "rule 3", "low", detonationUid),
+	}
+
+	mockDatadog := &mocks.DatadogSecuritySignalsAPI{}
+	mockDatadog.On("SearchSignals", mock.Anything, QueryAllOpenSignals).Return(allOpenSignals, nil)
+
+	fetcher := matchers.NewSharedFetcher[[]datadogV2.SecurityMonitoringSignal](1 * time.Minute)
+	newMatcher := func(ruleName string, severity string) *DatadogAlertGeneratedAssertion {
+		return &DatadogAlertGeneratedAssertion{
+			SignalsAPI:  mockDatadog,
+			AlertFilter: &DatadogAlertFilter{RuleName: ruleName, Severity: severity},
+			Fetcher:     fetcher,
+		}
+	}
+
+	tests := []struct {
+		Matcher     *DatadogAlertGeneratedAssertion
+		ExpectMatch bool
+	}{
+		{newMatcher("rule 1", ""), true},
+		{newMatcher("rule 1", "medium"), true},
+		{newMatcher("rule 1", "high"), false},
+		{newMatcher("rule 2", ""), false}, // not correlated to the detonation
+		{newMatcher("rule 3", "low"), true},
+		{newMatcher("rule 4", ""), false},
+		{newMatcher("Rule 1", "MEDIUM"), true}, // the search ignores case
+		{newMatcher("rule-3", ""), true},       // and punctuation
+		{newMatcher("rule", ""), true},         // and matches phrases within the rule name
+		{newMatcher("rule 1 2", ""), false},
+	}
+	for _, test := range tests {
+		matches, err := test.Matcher.HasExpectedAlert(ctx, detonationUid)
+		require.Nil(t, err)
+		assert.Equal(t, test.ExpectMatch, matches, "unexpected result for %s", test.Matcher.String())
+	}
+
+	mockDatadog.AssertNumberOfCalls(t, "SearchSignals", 1)
+}
+
+func TestHasExpectedAlertWithAttributes(t *testing.T) {
+	detonationUid := "my-uid"
+	signal := *sampleSignal(0)
+	signal.Attributes.Custom["foobar"] = detonationUid
+	signal.Attributes.Custom["usr"] = map[string]interface{}{"id": "arn:aws:iam::123456789012:user/alice"}
+	signal.Attributes.Tags = []string{"source:cloudtrail", "technique:T1562"}
+
+	mockDatadog := &mocks.DatadogSecuritySignalsAPI{}
+	mockDatadog.On("SearchSignals", mock.Anything, mock.Anything).Return([]datadogV2.SecurityMonitoringSignal{signal}, nil)
+	newMatcher := func(predicates ...matchers.FieldPredicate) *DatadogAlertGeneratedAssertionBuilder {
+		matcher := DatadogSecuritySignal("rule", WithAttributes(predicates...))
+		matcher.SignalsAPI = mockDatadog
+		return matcher
+	}
+
+	tests := []struct {
+		Matcher     *DatadogAlertGeneratedAssertionBuilder
+		ExpectMatch bool
+	}{
+		{newMatcher(matchers.FieldEquals("tags", "technique:T1562")), true},
+		{newMatcher(matchers.FieldEquals("tags", "technique:T1562"), matchers.FieldMatches("usr.id", `^arn:aws:iam::\d+:user/`)), true},
+		{newMatcher(matchers.FieldEquals("tags", "technique:T1078")), false},
+		{newMatcher(matchers.FieldExists("network.client.ip")), false},
+	}
+	for _, test := range tests {
+		matches, err := test.Matcher.HasExpectedAlert(context.Background(), detonationUid)
+		require.NoError(t, err)
+		assert.Equal(t, test.ExpectMatch, matches, "unexpected result for %s", test.Matcher.String())
+	}
+
+	_, err := newMatcher(matchers.FieldMatches("usr.id", "(")).HasExpectedAlert(context.Background(), detonationUid)
+	assert.ErrorContains(t, err, "invalid attribute predicate: invalid regular expression for field usr.id")
+	assert.Equal(t, "Datadog security signal 'rule' with tags equals 'technique:T1562'", newMatcher(matchers.FieldEquals("tags", "technique:T1562")).String())
+}
+
+func TestCountAlertsCountsDistinctSignals(t *testing.T) {
+	detonationUid := "my-uid"
+	var signals []datadogV2.SecurityMonitoringSignal
+	for i := 0; i < 3; i++ {
+		signal := *sampleSignal(i)
+		signal.Attributes.Custom["foobar"] = detonationUid
+		signals = append(signals, signal)
+	}
+	// The same signal returned twice, e.g. when it was updated with new samples between two pages of results
+	signals = append(signals, signals[0], *sampleSignal(3))
+
+	mockDatadog := &mocks.DatadogSecuritySignalsAPI{}
+	mockDatadog.On("SearchSignals", mock.Anything, mock.Anything).Return(signals, nil)
+	matcher := DatadogSecuritySignal("rule", WithCount(matchers.ExactlyN(3)))
+	matcher.SignalsAPI = mockDatadog
+
+	count, err := matcher.CountAlerts(context.Background(), detonationUid)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, &matchers.CountConstraint{Min: 3, Max: 3}, matcher.ExpectedCount())
+	assert.Equal(t, "Datadog security signal 'rule' (exactly 3)", matcher.String())
+	assert.Nil(t, DatadogSecuritySignal("rule").ExpectedCount())
+}
+
+func TestFirstAlertTime(t *testing.T) {
+	detonationUid := "my-uid"
+	now := time.Now().UTC()
+	var signals []datadogV2.SecurityMonitoringSignal
+	for i, timestamp := range []time.Time{now.Add(-1 * time.Minute), now.Add(-3 * time.Minute), {}} {
+		signal := *sampleSignal(i)
+		signal.Attributes.Custom["foobar"] = detonationUid
+		if !timestamp.IsZero() {
+			signal.Attributes.Timestamp = &timestamp
+		}
+		signals = append(signals, signal)
+	}
+
+	mockDatadog := &mocks.DatadogSecuritySignalsAPI{}
+	mockDatadog.On("SearchSignals", mock.Anything, mock.Anything).Return(signals, nil)
+	matcher := DatadogSecuritySignal("rule")
+	matcher.SignalsAPI = mockDatadog
+
+	firstAlertTime, found, err := matcher.FirstAlertTime(context.Background(), detonationUid)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, now.Add(-3*time.Minute), firstAlertTime)
+
+	_, found, err = matcher.FirstAlertTime(context.Background(), "other-uid")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSignalsAPIRecordsAndReplaysCassette(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	fakeDatadog := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		assert.Equal(t, "my-api-key", req.Header.Get("DD-API-KEY"))
+		body := `{"data":[{"id":"1","type":"signal","attributes":{"attributes":{"workflow":{"rule":{"name":"my rule"}},"detonation":"recorded-uuid"}}}]}`
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+
+	// Record the exchanges with Datadog
+	recorder, err := matchers.NewCassette(path, matchers.CassetteRecord)
+	require.NoError(t, err)
+	signalsAPI := newSignalsAPI("my-api-key", "my-app-key", "datadoghq.com").(*DatadogSecuritySignalsAPIImpl)
+	signalsAPI.httpClient.Transport = recorder.Transport(fakeDatadog)
+	recorder.Detonated("my-scenario", "recorded-uuid")
+	hasAlert, err := (&DatadogAlertGeneratedAssertion{SignalsAPI: signalsAPI, AlertFilter: &DatadogAlertFilter{RuleName: "my rule"}}).HasExpectedAlert(context.Background(), "recorded-uuid")
+	require.NoError(t, err)
+	assert.True(t, hasAlert)
+	require.NoError(t, recorder.Save())
+	rawCassette, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(rawCassette), "my-api-key")
+	assert.NotContains(t, string(rawCassette), "my-app-key")
+
+	// Replay them without credentials
+	t.Setenv("DD_API_KEY", "")
+	t.Setenv("DD_APP_KEY", "")
+	player, err := matchers.NewCassette(path, matchers.CassetteReplay)
+	require.NoError(t, err)
+	matchers.DefaultCassette = player
+	t.Cleanup(func() { matchers.DefaultCassette = nil })
+	player.Detonated("my-scenario", "replayed-uuid")
+	hasAlert, err = DatadogSecuritySignal("my rule").HasExpectedAlert(context.Background(), "replayed-uuid")
+	require.NoError(t, err)
+	assert.True(t, hasAlert)
+}
+
+func TestSignalsAPIPaginatesSearch(t *testing.T) {
+	var cursors []string
+	fakeDatadog := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		var request datadogV2.SecurityMonitoringSignalListRequest
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&request))
+		cursors = append(cursors, request.Page.GetCursor())
+		var signals []string
+		numSignals := 1
+		if request.Page.GetCursor() == "" {
+			numSignals = signalsPageSize
+		}
+		for i := 0; i < numSignals; i++ {
+			signals = append(signals, fmt.Sprintf(`{"id":"%s-%d","type":"signal"}`, request.Page.GetCursor(), i))
+		}
+		body := `{"data":[` + strings.Join(signals, ",") + `],"meta":{"page":{"after":"next-page"}}}`
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+
+	signalsAPI := newSignalsAPI("my-api-key", "my-app-key", "datadoghq.com").(*DatadogSecuritySignalsAPIImpl)
+	signalsAPI.httpClient.Transport = fakeDatadog
+	signals, err := signalsAPI.SearchSignals(context.Background(), QueryAllOpenSignals)
+	require.NoError(t, err)
+	assert.Len(t, signals, signalsPageSize+1)
+	assert.Equal(t, []string{"", "next-page"}, cursors)
+}
@@ -1,24 +1,38 @@
 package datadog
 
 import (
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadog"
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadogV2"
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/datadog/threatest/pkg/threatest/secret"
 )
 
 type DatadogAlertFilter struct {
 	RuleName string `yaml:"rule-name"`
 	Severity string
-	// There might be other attributes in the future
+	// Attributes are conditions on the attributes of the signal, such as its tags or custom attributes
+	Attributes []matchers.FieldPredicate
 }
 
 type DatadogAlertGeneratedAssertion struct {
 	SignalsAPI  DatadogSecuritySignalsAPI
 	AlertFilter *DatadogAlertFilter
+	// Fetcher, when set, shares the search for open signals with other matchers querying the same org
+	Fetcher *matchers.SharedFetcher[[]datadogV2.SecurityMonitoringSignal]
+	// Correlator decides whether a signal was caused by a detonation, defaulting to matchers.UuidCorrelator
+	Correlator matchers.AlertCorrelator
+	// Count, when set, expects a number of distinct signals rather than a single one
+	Count *matchers.CountConstraint
 }
 
+// DefaultSharedFetcher shares the searches for open signals of all matchers using WithSharedFetcher,
+// issuing at most one search per Datadog org every 2 seconds
+var DefaultSharedFetcher = matchers.NewSharedFetcher[[]datadogV2.SecurityMonitoringSignal](2 * time.Second)
+
 // DatadogAlertGeneratedAssertionBuilder constructs a DatadogAlertGeneratedAssertion
 // using the builder pattern.
 type DatadogAlertGeneratedAssertionBuilder struct {
@@ -44,6 +58,41 @@ func WithSeverity(severity string) Option {
 	}
 }
 
+// WithAttributes only matches signals whose attributes satisfy every predicate, e.g. to verify that the rule
+// tags its signals with the right MITRE technique. Predicates apply to the custom attributes of the signal,
+// as well as to its "tags" and "message".
+func WithAttributes(predicates ...matchers.FieldPredicate) Option {
+	return func(b *DatadogAlertGeneratedAssertionBuilder) {
+		b.AlertFilter.Attributes = append(b.AlertFilter.Attributes, predicates...)
+	}
+}
+
+// WithSharedFetcher retrieves all open signals through a fetcher shared with other matchers, and filters them
+// locally, instead of searching for the signals of the rule. This reduces the load on the Datadog API when
+// many matchers are waiting for signals at the same time.
+func WithSharedFetcher(fetcher *matchers.SharedFetcher[[]datadogV2.SecurityMonitoringSignal]) Option {
+	return func(b *DatadogAlertGeneratedAssertionBuilder) {
+		b.Fetcher = fetcher
+	}
+}
+
+// WithCorrelator overrides how signals are correlated with a detonation, e.g. to only look for the detonation
+// UUID in specific attributes of the signals
+func WithCorrelator(correlator matchers.AlertCorrelator) Option {
+	return func(b *DatadogAlertGeneratedAssertionBuilder) {
+		b.Correlator = correlator
+	}
+}
+
+// WithCount expects a number of distinct signals for the detonation, e.g. matchers.NoDuplicates() to verify
+// that the rule groups the events of an attack into a single signal. The number of signals is evaluated once
+// the settle period of the constraint, or the timeout of the assertion, has elapsed.
+func WithCount(constraint matchers.CountConstraint) Option {
+	return func(b *DatadogAlertGeneratedAssertionBuilder) {
+		b.Count = &constraint
+	}
+}
+
 func GetDDSite() string {
 	if ddSite, isSet := os.LookupEnv("DD_SITE"); isSet {
 		return ddSite
@@ -53,14 +102,18 @@ func GetDDSite() string {
 
 // newSignalsAPI creates a DatadogSecuritySignalsAPI with explicit credentials.
 func newSignalsAPI(apiKey, appKey, site string) DatadogSecuritySignalsAPI {
+	// Retry the requests rate limited by Datadog, instead of failing the scenario
+	httpClient := &http.Client{Transport: matchers.DefaultCassette.Transport(matchers.NewRetryingTransport(nil))}
 	cfg := datadog.NewConfiguration()
 	cfg.SetUnstableOperationEnabled("SearchSecurityMonitoringSignals", true)
+	cfg.HTTPClient = httpClient
 
 	return &DatadogSecuritySignalsAPIImpl{
 		securityMonitoringAPI: datadogV2.NewSecurityMonitoringApi(datadog.NewAPIClient(cfg)),
 		apiKey:                secret.New(apiKey),
 		appKey:                secret.New(appKey),
 		site:                  site,
+		httpClient:            httpClient,
 	}
 }
 
@@ -12,14 +12,20 @@ import (
 	"strings"
 	"time"
 
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/datadog/threatest/pkg/threatest/secret"
 )
 
 // AlertLookbackWindow bounds how far back alerts are searched, mirroring the
-// Datadog matcher which only considers signals from the past hour.
+// Datadog matcher which only considers signals from the past hour. It can be
+// overridden with matchers.WithSearchWindow.
 const AlertLookbackWindow = 1 * time.Hour
 
-const requestTimeout = 30 * time.Second
+// searchPageSize is the number of alerts retrieved per search request
+const searchPageSize = 1000
+
+// requestTimeout bounds the time spent on a request, including the time spent waiting to retry it when rate limited
+const requestTimeout = 2 * time.Minute
 
 // ElasticSecurityDetectionAlert represents a security detection alert document in Elastic Security.
 type ElasticSecurityDetectionAlert struct {
@@ -30,10 +36,16 @@ type ElasticSecurityDetectionAlert struct {
 
 type elasticSearchResponse struct {
 	Hits struct {
-		Hits []ElasticSecurityDetectionAlert `json:"hits"`
+		Hits []elasticSearchHit `json:"hits"`
 	} `json:"hits"`
 }
 
+// elasticSearchHit is an alert returned by a search, along with the sort values to resume the search after it
+type elasticSearchHit struct {
+	ElasticSecurityDetectionAlert
+	Sort []interface{} `json:"sort"`
+}
+
 type ElasticSecurityDetectionAlertsAPI interface {
 	SearchAlerts(ctx context.Context, query string) ([]ElasticSecurityDetectionAlert, error)
 	CloseAlert(ctx context.Context, id string) error
@@ -43,9 +55,42 @@ type ElasticSecurityDetectionAlertsAPIImpl struct {
 	kibanaURL string
 	apiKey    secret.Secret
 	client    *http.Client
+	// replaying is true when requests are answered by a cassette, which doesn't need credentials
+	replaying bool
 }
 
+// SearchAlerts returns all the alerts matching a query, following the pages of results with search_after
 func (m *ElasticSecurityDetectionAlertsAPIImpl) SearchAlerts(ctx context.Context, query string) ([]ElasticSecurityDetectionAlert, error) {
+	var request map[string]interface{}
+	if err := json.Unmarshal([]byte(query), &request); err != nil {
+		return nil, fmt.Errorf("invalid search query: %w", err)
+	}
+	pageSize, _ := request["size"].(float64)
+
+	var alerts []ElasticSecurityDetectionAlert
+	for {
+		hits, err := m.searchPage(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range hits {
+			alerts = append(alerts, hit.ElasticSecurityDetectionAlert)
+		}
+		if len(hits) == 0 || float64(len(hits)) < pageSize || len(hits[len(hits)-1].Sort) == 0 {
+			return alerts, nil
+		}
+
+		request["search_after"] = hits[len(hits)-1].Sort
+		nextQuery, err := json.Marshal(request)
+		if err != nil {
+			return nil, fmt.Errorf("error building search query: %w", err)
+		}
+		query = string(nextQuery)
+	}
+}
+
+// searchPage returns a single page of the alerts matching a query
+func (m *ElasticSecurityDetectionAlertsAPIImpl) searchPage(ctx context.Context, query string) ([]elasticSearchHit, error) {
 	resp, err := m.doRequest(ctx, http.MethodPost, "/api/detection_engine/signals/search", strings.NewReader(query))
 	if err != nil {
 		return nil, fmt.Errorf("search request failed: %w", err)
@@ -80,8 +125,9 @@ func (m *ElasticSecurityDetectionAlertsAPIImpl) CloseAlert(ctx context.Context,
 
 // doRequest encapsulates the HTTP request logic for Elastic Security alerts API.
 // It validates credentials, builds the URL from kibanaURL + path, and checks for non-OK status codes.
+// Rate limited requests are retried by the transport of the client.
 func (m *ElasticSecurityDetectionAlertsAPIImpl) doRequest(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
-	if m.kibanaURL == "" || m.apiKey.Value() == "" {
+	if !m.replaying && (m.kibanaURL == "" || m.apiKey.Value() == "") {
 		return nil, errors.New("missing Elastic credentials: set the KIBANA_URL or ELASTIC_API_KEY env vars")
 	}
 
@@ -103,7 +149,7 @@ func (m *ElasticSecurityDetectionAlertsAPIImpl) doRequest(ctx context.Context, m
 
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, fmt.Errorf("request to %s failed with status code %d", path, resp.StatusCode)
+		return nil, &matchers.HTTPStatusError{StatusCode: resp.StatusCode, Message: "request to " + path + " failed"}
 	}
 
 	return resp, nil
@@ -118,39 +164,124 @@ func (m *ElasticSecurityAlertGeneratedAssertionBuilder) Cleanup(ctx context.Cont
 }
 
 func (m *ElasticSecurityAlertGeneratedAssertion) HasExpectedAlert(ctx context.Context, detonationUuid string) (bool, error) {
-	query := m.buildElasticAlertQuery()
-	alerts, err := m.AlertsAPI.SearchAlerts(ctx, query)
+	alerts, err := m.correlatedAlerts(ctx, detonationUuid)
 	if err != nil {
-		return false, errors.New("unable to search for Elastic Security alert: " + err.Error())
+		return false, err
 	}
+	return len(alerts) > 0, nil
+}
 
-	if len(alerts) == 0 {
-		return false, nil
+// ExpectedCount returns the expected number of alerts, or nil if a single alert is enough
+func (m *ElasticSecurityAlertGeneratedAssertion) ExpectedCount() *matchers.CountConstraint {
+	return m.Count
+}
+
+// CountAlerts returns the number of distinct alerts correlated with the detonation. Alerts suppressed by the rule
+// are not counted, since Elastic only keeps the alert they were grouped into.
+func (m *ElasticSecurityAlertGeneratedAssertion) CountAlerts(ctx context.Context, detonationUuid string) (int, error) {
+	alerts, err := m.correlatedAlerts(ctx, detonationUuid)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	seenIds := map[string]bool{}
+	for i := range alerts {
+		if id := alerts[i].ID; id == "" || !seenIds[id] {
+			seenIds[id] = true
+			count++
+		}
 	}
+	return count, nil
+}
 
+// FirstAlertTime returns when the earliest alert correlated with the detonation was generated
+func (m *ElasticSecurityAlertGeneratedAssertion) FirstAlertTime(ctx context.Context, detonationUuid string) (time.Time, bool, error) {
+	alerts, err := m.correlatedAlerts(ctx, detonationUuid)
+	if err != nil || len(alerts) == 0 {
+		return time.Time{}, false, err
+	}
+	var firstAlertTime time.Time
 	for i := range alerts {
-		if m.alertMatchesExecution(alerts[i], detonationUuid) {
-			return true, nil
+		timestamp := alertTimestamp(alerts[i])
+		if timestamp.IsZero() {
+			continue
+		}
+		if firstAlertTime.IsZero() || timestamp.Before(firstAlertTime) {
+			firstAlertTime = timestamp
 		}
 	}
+	return firstAlertTime, true, nil
+}
 
-	return false, nil
+// correlatedAlerts returns the open alerts matching the alert filter that were caused by the detonation
+func (m *ElasticSecurityAlertGeneratedAssertion) correlatedAlerts(ctx context.Context, detonationUuid string) ([]ElasticSecurityDetectionAlert, error) {
+	for _, predicate := range m.AlertFilter.Attributes {
+		if err := predicate.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid attribute predicate: %v", err)
+		}
+	}
+	alerts, err := m.searchAlerts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for Elastic Security alert: %w", err)
+	}
+
+	detonation := matchers.DetonationFromContext(ctx, detonationUuid)
+	var correlatedAlerts []ElasticSecurityDetectionAlert
+	for i := range alerts {
+		if m.alertMatchesExecution(alerts[i], detonation) && matchers.MatchesAll(alerts[i].Source, m.AlertFilter.Attributes) {
+			correlatedAlerts = append(correlatedAlerts, alerts[i])
+		}
+	}
+	return correlatedAlerts, nil
+}
+
+// searchAlerts returns the open alerts matching the alert filter, either by searching for them directly,
+// or by filtering all open alerts retrieved through the shared fetcher
+func (m *ElasticSecurityAlertGeneratedAssertion) searchAlerts(ctx context.Context) ([]ElasticSecurityDetectionAlert, error) {
+	if m.Fetcher == nil {
+		return m.AlertsAPI.SearchAlerts(ctx, m.buildElasticAlertQuery(ctx))
+	}
+
+	allAlerts, err := m.Fetcher.Fetch(ctx, m.Backend()+" all open alerts", func(ctx context.Context) ([]ElasticSecurityDetectionAlert, error) {
+		return m.AlertsAPI.SearchAlerts(ctx, buildAllOpenAlertsQuery(ctx))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var alerts []ElasticSecurityDetectionAlert
+	for i := range allAlerts {
+		if m.alertMatchesFilter(allAlerts[i]) {
+			alerts = append(alerts, allAlerts[i])
+		}
+	}
+	return alerts, nil
 }
 
 func (m *ElasticSecurityAlertGeneratedAssertion) String() string {
-	return fmt.Sprintf("Elastic Security alert '%s'", m.AlertFilter.RuleName)
+	return fmt.Sprintf("Elastic Security alert '%s'%s%s", m.AlertFilter.RuleName, matchers.DescribePredicates(m.AlertFilter.Attributes), matchers.DescribeCount(m.Count))
 }
 
 func (m *ElasticSecurityAlertGeneratedAssertion) Cleanup(ctx context.Context, detonationUuid string) error {
-	alerts, err := m.AlertsAPI.SearchAlerts(ctx, buildAllOpenAlertsQuery())
+	// Correlators that don't rely on the UUID can correlate unrelated alerts, so only the alerts matching the
+	// filter of the matcher are closed
+	scoped := !matchers.CorrelatesByUuid(m.Correlator)
+	query := buildAllOpenAlertsQuery(ctx)
+	if scoped {
+		query = m.buildElasticAlertQuery(ctx)
+	}
+	alerts, err := m.AlertsAPI.SearchAlerts(ctx, query)
 	if err != nil {
-		return errors.New("unable to search for Elastic Security alerts: " + err.Error())
+		return fmt.Errorf("unable to search for Elastic Security alerts: %w", err)
 	}
 
+	detonation := matchers.DetonationFromContext(ctx, detonationUuid)
 	for i := range alerts {
-		if m.alertMatchesExecution(alerts[i], detonationUuid) {
+		if scoped && !matchers.MatchesAll(alerts[i].Source, m.AlertFilter.Attributes) {
+			continue
+		}
+		if m.alertMatchesExecution(alerts[i], detonation) {
 			if err := m.AlertsAPI.CloseAlert(ctx, alerts[i].ID); err != nil {
-				return errors.New("unable to close alert " + alerts[i].ID + ": " + err.Error())
+				return fmt.Errorf("unable to close alert %s: %w", alerts[i].ID, err)
 			}
 		}
 	}
@@ -158,9 +289,22 @@ func (m *ElasticSecurityAlertGeneratedAssertion) Cleanup(ctx context.Context, de
 	return nil
 }
 
+// AlertCorrelator returns the correlator of the matcher
+func (m *ElasticSecurityAlertGeneratedAssertion) AlertCorrelator() matchers.AlertCorrelator {
+	return m.Correlator
+}
+
+// Backend identifies the Elastic deployment queried by the matcher
+func (m *ElasticSecurityAlertGeneratedAssertion) Backend() string {
+	if api, ok := m.AlertsAPI.(*ElasticSecurityDetectionAlertsAPIImpl); ok {
+		return fmt.Sprintf("elastic %s %s", api.kibanaURL, api.apiKey.Fingerprint())
+	}
+	return fmt.Sprintf("elastic %p", m.AlertsAPI)
+}
+
 // buildElasticAlertQuery builds a Detection Engine query matching open alerts
 // for the configured rule name (and severity, when set) within the lookback window.
-func (m *ElasticSecurityAlertGeneratedAssertion) buildElasticAlertQuery() string {
+func (m *ElasticSecurityAlertGeneratedAssertion) buildElasticAlertQuery(ctx context.Context) string {
 	must := []map[string]interface{}{
 		{"match_phrase": map[string]interface{}{"kibana.alert.rule.name": m.AlertFilter.RuleName}},
 	}
@@ -169,17 +313,17 @@ func (m *ElasticSecurityAlertGeneratedAssertion) buildElasticAlertQuery() string
 			"match_phrase": map[string]interface{}{"kibana.alert.severity": m.AlertFilter.Severity},
 		})
 	}
-	return buildQuery(must)
+	return buildQuery(ctx, must)
 }
 
 // buildAllOpenAlertsQuery builds a Detection Engine query matching all open
 // alerts within the lookback window, regardless of rule name. It is used during
 // cleanup to find any alert correlated to a detonation.
-func buildAllOpenAlertsQuery() string {
-	return buildQuery(nil)
+func buildAllOpenAlertsQuery(ctx context.Context) string {
+	return buildQuery(ctx, nil)
 }
 
-func buildQuery(must []map[string]interface{}) string {
+func buildQuery(ctx context.Context, must []map[string]interface{}) string {
 	type queryStruct struct {
 		Size  int                      `json:"size"`
 		Query map[string]interface{}   `json:"query"`
@@ -189,7 +333,7 @@ func buildQuery(must []map[string]interface{}) string {
 	boolQuery := map[string]interface{}{
 		"filter": []map[string]interface{}{
 			{"match_phrase": map[string]interface{}{"kibana.alert.workflow_status": "open"}},
-			{"range": map[string]interface{}{"@timestamp": map[string]interface{}{"gte": sinceValue()}}},
+			{"range": map[string]interface{}{"@timestamp": map[string]interface{}{"gte": sinceValue(ctx)}}},
 		},
 		"must_not": []map[string]interface{}{
 			{"exists": map[string]interface{}{"field": "kibana.alert.building_block_type"}},
@@ -199,11 +343,13 @@ func buildQuery(must []map[string]interface{}) string {
 		boolQuery["must"] = must
 	}
 
+	// Results are paginated with search_after, which needs a unique sort order to not skip alerts
 	query := queryStruct{
-		Size:  1000,
+		Size:  searchPageSize,
 		Query: map[string]interface{}{"bool": boolQuery},
 		Sort: []map[string]interface{}{
 			{"@timestamp": map[string]string{"order": "desc"}},
+			{"kibana.alert.uuid": map[string]string{"order": "asc"}},
 		},
 	}
 
@@ -212,13 +358,42 @@ func buildQuery(must []map[string]interface{}) string {
 }
 
 // sinceValue returns the lower bound of the alert search window.
-func sinceValue() string {
-	return time.Now().Add(-AlertLookbackWindow).UTC().Format(time.RFC3339)
+func sinceValue(ctx context.Context) string {
+	return time.Now().Add(-matchers.SearchWindow(ctx, AlertLookbackWindow)).UTC().Format(time.RFC3339)
 }
 
-// alertMatchesExecution reports whether the alert's source document references
-// the detonation UUID, signalling that the alert was caused by this detonation.
-func (m *ElasticSecurityAlertGeneratedAssertion) alertMatchesExecution(alert ElasticSecurityDetectionAlert, uid string) bool {
-	buf, _ := json.Marshal(alert.Source)
-	return strings.Contains(string(buf), uid)
+// alertMatchesFilter locally applies the same filter as the search query built by buildElasticAlertQuery. The rule
+// name and severity are keyword fields, which the search matches exactly as well.
+func (m *ElasticSecurityAlertGeneratedAssertion) alertMatchesFilter(alert ElasticSecurityDetectionAlert) bool {
+	if ruleName, _ := matchers.LookupField(alert.Source, "kibana.alert.rule.name"); ruleName != m.AlertFilter.RuleName {
+		return false
+	}
+	if m.AlertFilter.Severity != "" {
+		if severity, _ := matchers.LookupField(alert.Source, "kibana.alert.severity"); severity != m.AlertFilter.Severity {
+			return false
+		}
+	}
+	return true
+}
+
+// alertMatchesExecution reports whether the alert was caused by the detonation, according to the
+// correlator of the matcher. By default, the alert's source document must reference the detonation UUID.
+func (m *ElasticSecurityAlertGeneratedAssertion) alertMatchesExecution(alert ElasticSecurityDetectionAlert, detonation matchers.Detonation) bool {
+	correlatedAlert := matchers.Alert{Document: alert.Source, Timestamp: alertTimestamp(alert)}
+	correlator := m.Correlator
+	if correlator == nil {
+		correlator = &matchers.UuidCorrelator{}
+	}
+	return correlator.Correlates(correlatedAlert, detonation)
+}
+
+// alertTimestamp returns when an alert was generated, or the zero time if unknown
+func alertTimestamp(alert ElasticSecurityDetectionAlert) time.Time {
+	var timestamp time.Time
+	if value, found := matchers.LookupField(alert.Source, "@timestamp"); found {
+		if value, isString := value.(string); isString {
+			timestamp, _ = time.Parse(time.RFC3339Nano, value)
+		}
+	}
+	return timestamp
 }
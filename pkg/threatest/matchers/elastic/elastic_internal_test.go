@@ -1,9 +1,19 @@
 package elastic
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAlertMatchesExecution(t *testing.T) {
@@ -12,19 +22,19 @@ func TestAlertMatchesExecution(t *testing.T) {
 
 	t.Run("matches when UID is present in the alert source", func(t *testing.T) {
 		alert := ElasticSecurityDetectionAlert{Source: map[string]any{"correlation_id": uid}}
-		assert.True(t, matcher.alertMatchesExecution(alert, uid))
+		assert.True(t, matcher.alertMatchesExecution(alert, matchers.Detonation{Uuid: uid}))
 	})
 
 	t.Run("matches when UID is nested in the alert source", func(t *testing.T) {
 		alert := ElasticSecurityDetectionAlert{Source: map[string]any{
 			"process": map[string]any{"command_line": "curl https://example.com/" + uid},
 		}}
-		assert.True(t, matcher.alertMatchesExecution(alert, uid))
+		assert.True(t, matcher.alertMatchesExecution(alert, matchers.Detonation{Uuid: uid}))
 	})
 
 	t.Run("does not match when UID is absent", func(t *testing.T) {
 		alert := ElasticSecurityDetectionAlert{Source: map[string]any{"correlation_id": "other-uid"}}
-		assert.False(t, matcher.alertMatchesExecution(alert, uid))
+		assert.False(t, matcher.alertMatchesExecution(alert, matchers.Detonation{Uuid: uid}))
 	})
 }
 
@@ -33,7 +43,7 @@ func TestBuildElasticAlertQuery(t *testing.T) {
 		assertion := &ElasticSecurityAlertGeneratedAssertion{
 			AlertFilter: &ElasticSecurityAlertFilter{RuleName: "Test Rule"},
 		}
-		query := assertion.buildElasticAlertQuery()
+		query := assertion.buildElasticAlertQuery(context.Background())
 		assert.Contains(t, query, "Test Rule")
 		assert.Contains(t, query, "kibana.alert.rule.name")
 		assert.NotContains(t, query, "kibana.alert.severity")
@@ -43,14 +53,94 @@ func TestBuildElasticAlertQuery(t *testing.T) {
 		assertion := &ElasticSecurityAlertGeneratedAssertion{
 			AlertFilter: &ElasticSecurityAlertFilter{RuleName: "Test Rule", Severity: "high"},
 		}
-		query := assertion.buildElasticAlertQuery()
+		query := assertion.buildElasticAlertQuery(context.Background())
 		assert.Contains(t, query, "high")
 		assert.Contains(t, query, "kibana.alert.severity")
 	})
 }
 
 func TestBuildAllOpenAlertsQuery(t *testing.T) {
-	query := buildAllOpenAlertsQuery()
+	query := buildAllOpenAlertsQuery(context.Background())
 	assert.NotContains(t, query, "kibana.alert.rule.name")
 	assert.Contains(t, query, "kibana.alert.workflow_status")
 }
+
+func TestBuildQueryHonorsSearchWindow(t *testing.T) {
+	since := time.Now().Add(-24 * time.Hour).UTC().Format("2006-01-02T15")
+	query := buildAllOpenAlertsQuery(matchers.WithSearchWindow(context.Background(), 24*time.Hour))
+	assert.Contains(t, query, `"gte":"`+since)
+	assert.NotContains(t, buildAllOpenAlertsQuery(context.Background()), `"gte":"`+since)
+}
+
+func TestAlertsAPIRetriesRateLimitedRequests(t *testing.T) {
+	var numRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "ApiKey my-key", r.Header.Get("Authorization"))
+		if atomic.AddInt32(&numRequests, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"hits": {"hits": [{"_id": "alert-1", "_source": {"kibana.alert.rule.name": "rule"}}]}}`))
+	}))
+	defer server.Close()
+
+	alerts, err := newAlertsAPI(server.URL, "my-key").SearchAlerts(context.Background(), buildAllOpenAlertsQuery(context.Background()))
+	require.NoError(t, err)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "alert-1", alerts[0].ID)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&numRequests))
+}
+
+func TestAlertsAPIPaginatesSearch(t *testing.T) {
+	var searchAfters []interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&query))
+		searchAfters = append(searchAfters, query["search_after"])
+		if query["search_after"] == nil {
+			_, _ = w.Write([]byte(`{"hits": {"hits": [{"_id": "alert-1", "sort": [3, "a"]}, {"_id": "alert-2", "sort": [2, "b"]}]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"hits": {"hits": [{"_id": "alert-3", "sort": [1, "c"]}]}}`))
+	}))
+	defer server.Close()
+
+	alerts, err := newAlertsAPI(server.URL, "my-key").SearchAlerts(context.Background(), `{"size": 2, "query": {"match_all": {}}}`)
+	require.NoError(t, err)
+	require.Len(t, alerts, 3)
+	assert.Equal(t, "alert-3", alerts[2].ID)
+	assert.Equal(t, []interface{}{nil, []interface{}{float64(2), "b"}}, searchAfters, "the next page should start after the last alert")
+}
+
+func TestAlertsAPIReportsFatalErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	err := newAlertsAPI(server.URL, "my-key").CloseAlert(context.Background(), "alert-1")
+	assert.EqualError(t, err, "close alert request failed: request to /api/detection_engine/signals/status failed: got status code 403")
+	assert.False(t, matchers.IsRetryable(err))
+}
+
+func TestAlertsAPIReplaysCassetteWithoutCredentials(t *testing.T) {
+	ctx := context.Background()
+	interactions, _ := json.Marshal([]matchers.CassetteInteraction{{
+		Request:  matchers.CassetteRequest{Method: http.MethodPost, URL: "https://kibana.example.com/api/detection_engine/signals/search", Body: buildAllOpenAlertsQuery(ctx)},
+		Response: matchers.CassetteResponse{StatusCode: http.StatusOK, Body: `{"hits":{"hits":[{"_id":"alert-1","_source":{"uuid":"recorded-uuid"}}]}}`},
+	}})
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"detonations":{"my-scenario":["recorded-uuid"]},"interactions":`+string(interactions)+`}`), 0600))
+
+	player, err := matchers.NewCassette(path, matchers.CassetteReplay)
+	require.NoError(t, err)
+	matchers.DefaultCassette = player
+	t.Cleanup(func() { matchers.DefaultCassette = nil })
+	player.Detonated("my-scenario", "replayed-uuid")
+
+	alerts, err := newAlertsAPI("", "").SearchAlerts(ctx, buildAllOpenAlertsQuery(ctx))
+	require.NoError(t, err)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "replayed-uuid", alerts[0].Source["uuid"])
+}
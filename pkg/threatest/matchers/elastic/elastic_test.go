@@ -5,7 +5,9 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/datadog/threatest/pkg/threatest/matchers/elastic"
 	"github.com/datadog/threatest/pkg/threatest/matchers/elastic/mocks"
 	"github.com/stretchr/testify/assert"
@@ -104,6 +106,81 @@ func TestHasExpectedAlert(t *testing.T) {
 	}
 }
 
+func TestHasExpectedAlertWithCorrelator(t *testing.T) {
+	start := time.Now()
+	unrelatedAlert := alertWithRule(0)
+	unrelatedAlert.Source["network.http.url"] = "https://example.com/" + detonationUID
+	hostAlert := alertWithRule(1)
+	hostAlert.Source["host.name"] = "web-1"
+	hostAlert.Source["@timestamp"] = start.Add(30 * time.Second).UTC().Format(time.RFC3339Nano)
+
+	mockAPI := mocks.NewElasticSecurityDetectionAlertsAPI(t)
+	mockAPI.On("SearchAlerts", mock.Anything, mock.Anything).Return([]elastic.ElasticSecurityDetectionAlert{unrelatedAlert}, nil).Once()
+	mockAPI.On("SearchAlerts", mock.Anything, mock.Anything).Return([]elastic.ElasticSecurityDetectionAlert{hostAlert}, nil).Once()
+
+	// The UUID appearing in an unrelated field isn't enough
+	matcher := newMatcher(mockAPI)
+	matcher.Correlator = &matchers.FieldsContainCorrelator{Fields: []string{"process.command_line"}}
+	matches, err := matcher.HasExpectedAlert(context.Background(), detonationUID)
+	require.NoError(t, err)
+	assert.False(t, matches)
+
+	// Alerts that don't carry the UUID are correlated with the host of the detonation
+	matcher.Correlator = &matchers.EntityCorrelator{Fields: []string{"host.name"}, Window: 5 * time.Minute}
+	ctx := matchers.WithDetonation(context.Background(), matchers.Detonation{
+		Uuid:    detonationUID,
+		Targets: []string{"web-1"},
+		Start:   start,
+		End:     start.Add(10 * time.Second),
+	})
+	matches, err = matcher.HasExpectedAlert(ctx, detonationUID)
+	require.NoError(t, err)
+	assert.True(t, matches)
+}
+
+func TestHasExpectedAlertWithAttributes(t *testing.T) {
+	alert := alertWithBoth(0, detonationUID)
+	alert.Source["kibana.alert.rule.threat"] = []any{
+		map[string]any{"technique": []any{map[string]any{"id": "T1059", "name": "Command and Scripting Interpreter"}}},
+	}
+	alert.Source["host"] = map[string]any{"name": "web-1"}
+
+	mockAPI := mocks.NewElasticSecurityDetectionAlertsAPI(t)
+	mockAPI.On("SearchAlerts", mock.Anything, mock.Anything).Return([]elastic.ElasticSecurityDetectionAlert{alert}, nil)
+
+	matcher := newMatcher(mockAPI)
+	matcher.AlertFilter.Attributes = []matchers.FieldPredicate{
+		matchers.FieldEquals("kibana.alert.rule.threat.technique.id", "T1059"),
+		matchers.FieldEquals("host.name", "web-1"),
+	}
+	matches, err := matcher.HasExpectedAlert(context.Background(), detonationUID)
+	require.NoError(t, err)
+	assert.True(t, matches)
+
+	matcher.AlertFilter.Attributes = []matchers.FieldPredicate{matchers.FieldEquals("host.name", "web-2")}
+	matches, err = matcher.HasExpectedAlert(context.Background(), detonationUID)
+	require.NoError(t, err)
+	assert.False(t, matches)
+}
+
+func TestCountAlerts(t *testing.T) {
+	alerts := []elastic.ElasticSecurityDetectionAlert{
+		alertWithBoth(0, detonationUID),
+		alertWithBoth(1, detonationUID),
+		alertWithBoth(0, detonationUID),
+		alertWithRule(2),
+	}
+	mockAPI := mocks.NewElasticSecurityDetectionAlertsAPI(t)
+	mockAPI.On("SearchAlerts", mock.Anything, mock.Anything).Return(alerts, nil)
+
+	matcher := newMatcher(mockAPI)
+	matcher.Count = &matchers.CountConstraint{Min: 1, Max: 2}
+	count, err := matcher.CountAlerts(context.Background(), detonationUID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, "Elastic Security alert '"+testRuleName+"' (at most 2)", matcher.String())
+}
+
 func TestCleanup(t *testing.T) {
 	isAllOpenQuery := func(query string) bool { return !strings.Contains(query, testRuleName) }
 
@@ -127,3 +204,79 @@ func TestCleanup(t *testing.T) {
 	mockAPI.AssertNotCalled(t, "CloseAlert", mock.Anything, ruleOnlyAlert.ID)
 	mockAPI.AssertNotCalled(t, "CloseAlert", mock.Anything, unrelatedAlert.ID)
 }
+
+func TestCleanupWithEntityCorrelator(t *testing.T) {
+	start := time.Now()
+	hostAlert := func(alert elastic.ElasticSecurityDetectionAlert) elastic.ElasticSecurityDetectionAlert {
+		alert.Source["host.name"] = "web-1"
+		alert.Source["@timestamp"] = start.Add(30 * time.Second).UTC().Format(time.RFC3339Nano)
+		return alert
+	}
+	ruleAlert := hostAlert(alertWithRule(0))
+	ruleAlert.Source["user.name"] = "deploy"
+	otherAttributeAlert := hostAlert(alertWithRule(1))
+	otherAttributeAlert.Source["user.name"] = "root"
+	otherRuleAlert := hostAlert(sampleAlert(2))
+
+	// Alerts of other rules are about the same host, but must be left open
+	mockAPI := mocks.NewElasticSecurityDetectionAlertsAPI(t)
+	mockAPI.On("SearchAlerts", mock.Anything, mock.MatchedBy(func(query string) bool { return strings.Contains(query, testRuleName) })).
+		Return([]elastic.ElasticSecurityDetectionAlert{ruleAlert, otherAttributeAlert}, nil)
+	mockAPI.On("CloseAlert", mock.Anything, ruleAlert.ID).Return(nil)
+
+	matcher := newMatcher(mockAPI)
+	matcher.Correlator = &matchers.EntityCorrelator{Fields: []string{"host.name"}, Window: 5 * time.Minute}
+	matcher.AlertFilter.Attributes = []matchers.FieldPredicate{matchers.FieldEquals("user.name", "deploy")}
+	ctx := matchers.WithDetonation(context.Background(), matchers.Detonation{
+		Uuid:    detonationUID,
+		Targets: []string{"web-1"},
+		Start:   start,
+		End:     start.Add(10 * time.Second),
+	})
+	require.NoError(t, matcher.Cleanup(ctx, detonationUID))
+
+	mockAPI.AssertCalled(t, "CloseAlert", mock.Anything, ruleAlert.ID)
+	mockAPI.AssertNotCalled(t, "CloseAlert", mock.Anything, otherAttributeAlert.ID)
+	mockAPI.AssertNotCalled(t, "CloseAlert", mock.Anything, otherRuleAlert.ID)
+}
+
+func TestBackendIdentifiesElasticDeployment(t *testing.T) {
+	matcher1 := elastic.ElasticSecurityAlert("rule 1", elastic.WithCredentials("https://kibana.example.com", "api-key"))
+	matcher2 := elastic.ElasticSecurityAlert("rule 2", elastic.WithCredentials("https://kibana.example.com", "api-key"))
+	otherMatcher := elastic.ElasticSecurityAlert("rule 1", elastic.WithCredentials("https://other.example.com", "api-key"))
+
+	assert.Equal(t, matcher1.Backend(), matcher2.Backend())
+	assert.NotEqual(t, matcher1.Backend(), otherMatcher.Backend())
+	assert.NotContains(t, matcher1.Backend(), "api-key")
+}
+
+func TestSharedFetcherIssuesASingleSearchForAllMatchers(t *testing.T) {
+	isAllOpenQuery := func(query string) bool { return !strings.Contains(query, "kibana.alert.rule.name") }
+
+	otherRuleAlert := alertWithBoth(1, detonationUID)
+	otherRuleAlert.Source["kibana.alert.rule.name"] = "other-rule"
+	allAlerts := []elastic.ElasticSecurityDetectionAlert{alertWithRule(0), otherRuleAlert}
+
+	mockAPI := mocks.NewElasticSecurityDetectionAlertsAPI(t)
+	mockAPI.On("SearchAlerts", mock.Anything, mock.MatchedBy(isAllOpenQuery)).Return(allAlerts, nil).Once()
+
+	fetcher := matchers.NewSharedFetcher[[]elastic.ElasticSecurityDetectionAlert](1 * time.Minute)
+	newSharedMatcher := func(ruleName string) elastic.ElasticSecurityAlertGeneratedAssertion {
+		return elastic.ElasticSecurityAlertGeneratedAssertion{
+			AlertsAPI:   mockAPI,
+			AlertFilter: &elastic.ElasticSecurityAlertFilter{RuleName: ruleName},
+			Fetcher:     fetcher,
+		}
+	}
+
+	// The alert of the test rule is not correlated to the detonation
+	testRuleMatcher := newSharedMatcher(testRuleName)
+	matches, err := testRuleMatcher.HasExpectedAlert(context.Background(), detonationUID)
+	require.NoError(t, err)
+	assert.False(t, matches)
+
+	otherRuleMatcher := newSharedMatcher("other-rule")
+	matches, err = otherRuleMatcher.HasExpectedAlert(context.Background(), detonationUID)
+	require.NoError(t, err)
+	assert.True(t, matches)
+}
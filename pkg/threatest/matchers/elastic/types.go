@@ -3,7 +3,9 @@ package elastic
 import (
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/datadog/threatest/pkg/threatest/secret"
 )
 
@@ -11,7 +13,8 @@ import (
 type ElasticSecurityAlertFilter struct {
 	RuleName string `yaml:"rule-name"`
 	Severity string
-	// There might be other attributes in the future
+	// Attributes are conditions on the fields of the alert document, such as its MITRE technique or host
+	Attributes []matchers.FieldPredicate
 }
 
 // ElasticSecurityAlertGeneratedAssertion verifies that an expected Elastic
@@ -19,8 +22,18 @@ type ElasticSecurityAlertFilter struct {
 type ElasticSecurityAlertGeneratedAssertion struct {
 	AlertsAPI   ElasticSecurityDetectionAlertsAPI
 	AlertFilter *ElasticSecurityAlertFilter
+	// Fetcher, when set, shares the search for open alerts with other matchers querying the same deployment
+	Fetcher *matchers.SharedFetcher[[]ElasticSecurityDetectionAlert]
+	// Correlator decides whether an alert was caused by a detonation, defaulting to matchers.UuidCorrelator
+	Correlator matchers.AlertCorrelator
+	// Count, when set, expects a number of distinct alerts rather than a single one
+	Count *matchers.CountConstraint
 }
 
+// DefaultSharedFetcher shares the searches for open alerts of all matchers using WithSharedFetcher,
+// issuing at most one search per Elastic deployment every 2 seconds
+var DefaultSharedFetcher = matchers.NewSharedFetcher[[]ElasticSecurityDetectionAlert](2 * time.Second)
+
 // ElasticSecurityAlertGeneratedAssertionBuilder constructs an
 // ElasticSecurityAlertGeneratedAssertion using the builder pattern.
 type ElasticSecurityAlertGeneratedAssertionBuilder struct {
@@ -46,18 +59,53 @@ func WithSeverity(severity string) Option {
 	}
 }
 
+// WithAttributes only matches alerts whose fields satisfy every predicate, e.g. to verify that the rule
+// maps its alerts to the right MITRE technique (kibana.alert.rule.threat.technique.id)
+func WithAttributes(predicates ...matchers.FieldPredicate) Option {
+	return func(b *ElasticSecurityAlertGeneratedAssertionBuilder) {
+		b.AlertFilter.Attributes = append(b.AlertFilter.Attributes, predicates...)
+	}
+}
+
+// WithSharedFetcher retrieves all open alerts through a fetcher shared with other matchers, and filters them
+// locally, instead of searching for the alerts of the rule. This reduces the load on the Elastic API when
+// many matchers are waiting for alerts at the same time.
+func WithSharedFetcher(fetcher *matchers.SharedFetcher[[]ElasticSecurityDetectionAlert]) Option {
+	return func(b *ElasticSecurityAlertGeneratedAssertionBuilder) {
+		b.Fetcher = fetcher
+	}
+}
+
+// WithCorrelator overrides how alerts are correlated with a detonation, e.g. to only look for the detonation
+// UUID in specific fields of the alerts
+func WithCorrelator(correlator matchers.AlertCorrelator) Option {
+	return func(b *ElasticSecurityAlertGeneratedAssertionBuilder) {
+		b.Correlator = correlator
+	}
+}
+
+// WithCount expects a number of distinct alerts for the detonation, e.g. matchers.ExactlyN(3) for a rule that
+// should alert once per compromised host. The number of alerts is evaluated once the settle period of the
+// constraint, or the timeout of the assertion, has elapsed.
+func WithCount(constraint matchers.CountConstraint) Option {
+	return func(b *ElasticSecurityAlertGeneratedAssertionBuilder) {
+		b.Count = &constraint
+	}
+}
+
 // newAlertsAPI creates an ElasticSecurityDetectionAlertsAPI with explicit credentials.
 func newAlertsAPI(kibanaURL, apiKey string) ElasticSecurityDetectionAlertsAPI {
 	return &ElasticSecurityDetectionAlertsAPIImpl{
 		kibanaURL: kibanaURL,
 		apiKey:    secret.New(apiKey),
-		client:    &http.Client{Timeout: requestTimeout},
+		client:    &http.Client{Timeout: requestTimeout, Transport: matchers.DefaultCassette.Transport(matchers.NewRetryingTransport(nil))},
+		replaying: matchers.DefaultCassette.Replaying(),
 	}
 }
 
 // ElasticSecurityAlert creates a builder for matching Elastic Security
 // detection alerts by rule name. By default, credentials are read from
-// the KIBANA_URL and ELASTIC_API_KEY environment variables. 
+// the KIBANA_URL and ELASTIC_API_KEY environment variables.
 func ElasticSecurityAlert(name string, opts ...Option) *ElasticSecurityAlertGeneratedAssertionBuilder {
 	builder := &ElasticSecurityAlertGeneratedAssertionBuilder{}
 	builder.AlertsAPI = newAlertsAPI(
@@ -0,0 +1,50 @@
+package matchers
+
+import "strings"
+
+// LookupField retrieves the value at a dot-separated path (e.g. "kibana.alert.rule.name") in an alert document.
+// Both nested objects and flattened keys containing dots are supported, as well as a mix of them. When the path
+// goes through a list of objects (e.g. "kibana.alert.rule.threat.technique.id"), the values found in each of them
+// are returned as a list.
+func LookupField(document map[string]interface{}, path string) (interface{}, bool) {
+	if value, found := document[path]; found {
+		return value, true
+	}
+
+	// Try the longest prefixes first, as flattened keys are more specific
+	parts := strings.Split(path, ".")
+	for i := len(parts) - 1; i > 0; i-- {
+		value, found := document[strings.Join(parts[:i], ".")]
+		if !found {
+			continue
+		}
+		if value, found := lookupNestedField(value, strings.Join(parts[i:], ".")); found {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// lookupNestedField retrieves the value at a dot-separated path in an object, or in every object of a list
+func lookupNestedField(value interface{}, path string) (interface{}, bool) {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		return LookupField(typedValue, path)
+	case []interface{}:
+		var values []interface{}
+		for _, item := range typedValue {
+			itemValue, found := lookupNestedField(item, path)
+			if !found {
+				continue
+			}
+			if itemValues, isList := itemValue.([]interface{}); isList {
+				values = append(values, itemValues...)
+			} else {
+				values = append(values, itemValue)
+			}
+		}
+		return values, len(values) > 0
+	default:
+		return nil, false
+	}
+}
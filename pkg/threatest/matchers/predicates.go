@@ -0,0 +1,135 @@
+package matchers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PredicateOperator is how a FieldPredicate compares the value of an attribute
+type PredicateOperator string
+
+const (
+	// PredicateEquals requires the attribute to be equal to the value, or to be a list containing it
+	PredicateEquals PredicateOperator = "equals"
+	// PredicateContains requires the attribute, or one of its elements for lists, to contain the value
+	PredicateContains PredicateOperator = "contains"
+	// PredicateRegex requires the attribute, or one of its elements for lists, to match the regular expression in the value
+	PredicateRegex PredicateOperator = "regex"
+	// PredicateExists requires the attribute to be present, regardless of its value
+	PredicateExists PredicateOperator = "exists"
+)
+
+// FieldPredicate is a condition on an attribute of an alert, e.g. to verify that a detection rule enriches
+// its alerts with the right MITRE technique, tags, or entity
+type FieldPredicate struct {
+	// Field is the dot-separated path of the attribute (e.g. "kibana.alert.rule.threat.technique.id")
+	Field    string
+	Operator PredicateOperator
+	// Value is compared with the attribute, unused by PredicateExists
+	Value string
+}
+
+// FieldEquals requires an attribute to be equal to a value, or to be a list containing it
+func FieldEquals(field string, value string) FieldPredicate {
+	return FieldPredicate{Field: field, Operator: PredicateEquals, Value: value}
+}
+
+// FieldContains requires an attribute, or one of its elements for lists, to contain a value
+func FieldContains(field string, value string) FieldPredicate {
+	return FieldPredicate{Field: field, Operator: PredicateContains, Value: value}
+}
+
+// FieldMatches requires an attribute, or one of its elements for lists, to match a regular expression
+func FieldMatches(field string, regex string) FieldPredicate {
+	return FieldPredicate{Field: field, Operator: PredicateRegex, Value: regex}
+}
+
+// FieldExists requires an attribute to be present
+func FieldExists(field string) FieldPredicate {
+	return FieldPredicate{Field: field, Operator: PredicateExists}
+}
+
+// Validate returns an error if the predicate can't be evaluated
+func (m FieldPredicate) Validate() error {
+	if m.Field == "" {
+		return fmt.Errorf("predicate '%s' has no field", m.Operator)
+	}
+	switch m.Operator {
+	case PredicateEquals, PredicateContains, PredicateExists:
+		return nil
+	case PredicateRegex:
+		if _, err := regexp.Compile(m.Value); err != nil {
+			return fmt.Errorf("invalid regular expression for field %s: %v", m.Field, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown operator '%s' for field %s", m.Operator, m.Field)
+	}
+}
+
+// Matches returns true if the attribute of the alert document satisfies the predicate.
+// Invalid predicates never match.
+func (m FieldPredicate) Matches(document map[string]interface{}) bool {
+	value, found := LookupField(document, m.Field)
+	if !found {
+		return false
+	}
+	if m.Operator == PredicateExists {
+		return true
+	}
+
+	var regex *regexp.Regexp
+	if m.Operator == PredicateRegex {
+		var err error
+		if regex, err = regexp.Compile(m.Value); err != nil {
+			return false
+		}
+	}
+	for _, fieldValue := range fieldValues(value) {
+		switch m.Operator {
+		case PredicateEquals:
+			if fieldValue == m.Value {
+				return true
+			}
+		case PredicateContains:
+			if strings.Contains(fieldValue, m.Value) {
+				return true
+			}
+		case PredicateRegex:
+			if regex.MatchString(fieldValue) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m FieldPredicate) String() string {
+	if m.Operator == PredicateExists {
+		return m.Field + " exists"
+	}
+	return fmt.Sprintf("%s %s '%s'", m.Field, m.Operator, m.Value)
+}
+
+// MatchesAll returns true if the alert document satisfies every predicate
+func MatchesAll(document map[string]interface{}, predicates []FieldPredicate) bool {
+	for _, predicate := range predicates {
+		if !predicate.Matches(document) {
+			return false
+		}
+	}
+	return true
+}
+
+// DescribePredicates returns a textual representation of predicates, to be appended to the description of a matcher
+func DescribePredicates(predicates []FieldPredicate) string {
+	if len(predicates) == 0 {
+		return ""
+	}
+	descriptions := make([]string, len(predicates))
+	for i, predicate := range predicates {
+		descriptions[i] = predicate.String()
+	}
+	return " with " + strings.Join(descriptions, " and ")
+}
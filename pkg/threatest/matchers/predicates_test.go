@@ -0,0 +1,66 @@
+package matchers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldPredicates(t *testing.T) {
+	document := map[string]interface{}{
+		"tags": []interface{}{"source:cloudtrail", "tactic:TA0005-defense-evasion"},
+		"usr":  map[string]interface{}{"id": "arn:aws:iam::123456789012:user/alice"},
+		"kibana.alert.rule.threat": []interface{}{
+			map[string]interface{}{"technique": map[string]interface{}{"id": "T1562"}},
+		},
+		"severity_score": 47,
+		"resolved":       nil,
+	}
+
+	scenarios := []struct {
+		Predicate FieldPredicate
+		Expected  bool
+	}{
+		{FieldEquals("usr.id", "arn:aws:iam::123456789012:user/alice"), true},
+		{FieldEquals("usr.id", "alice"), false},
+		{FieldEquals("tags", "source:cloudtrail"), true},
+		{FieldEquals("severity_score", "47"), true},
+		{FieldContains("usr.id", "user/alice"), true},
+		{FieldContains("tags", "TA0005"), true},
+		{FieldContains("tags", "TA0001"), false},
+		{FieldMatches("usr.id", `^arn:aws:iam::\d{12}:user/`), true},
+		{FieldMatches("usr.id", `^arn:aws:sts::`), false},
+		{FieldMatches("kibana.alert.rule.threat", `T1562`), true},
+		{FieldEquals("kibana.alert.rule.threat.technique.id", "T1562"), true},
+		{FieldEquals("kibana.alert.rule.threat.technique.id", "T1059"), false},
+		{FieldExists("usr.id"), true},
+		{FieldExists("resolved"), true},
+		{FieldExists("usr.name"), false},
+		{FieldEquals("missing", ""), false},
+		{FieldMatches("usr.id", `(`), false},
+	}
+	for _, scenario := range scenarios {
+		assert.Equal(t, scenario.Expected, scenario.Predicate.Matches(document), scenario.Predicate.String())
+	}
+}
+
+func TestFieldPredicateValidation(t *testing.T) {
+	assert.NoError(t, FieldMatches("usr.id", `^arn:`).Validate())
+	assert.NoError(t, FieldExists("usr.id").Validate())
+	assert.ErrorContains(t, FieldMatches("usr.id", `(`).Validate(), "invalid regular expression for field usr.id")
+	assert.EqualError(t, FieldExists("").Validate(), "predicate 'exists' has no field")
+	assert.EqualError(t, FieldPredicate{Field: "usr.id", Operator: "startsWith"}.Validate(), "unknown operator 'startsWith' for field usr.id")
+}
+
+func TestMatchesAll(t *testing.T) {
+	document := map[string]interface{}{"host": map[string]interface{}{"name": "web-1"}, "usr.id": "alice"}
+	assert.True(t, MatchesAll(document, nil))
+	assert.True(t, MatchesAll(document, []FieldPredicate{FieldEquals("host.name", "web-1"), FieldExists("usr.id")}))
+	assert.False(t, MatchesAll(document, []FieldPredicate{FieldEquals("host.name", "web-1"), FieldEquals("usr.id", "bob")}))
+}
+
+func TestDescribePredicates(t *testing.T) {
+	assert.Empty(t, DescribePredicates(nil))
+	assert.Equal(t, " with tags contains 'source:cloudtrail' and usr.id exists",
+		DescribePredicates([]FieldPredicate{FieldContains("tags", "source:cloudtrail"), FieldExists("usr.id")}))
+}
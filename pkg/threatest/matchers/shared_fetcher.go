@@ -0,0 +1,73 @@
+package matchers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// SharedFetcher deduplicates the alert searches of matchers querying the same backend. Within a time bucket,
+// a search identified by a key is issued only once, and its result is shared with every matcher asking for
+// it, including matchers of scenarios running in parallel. Errors are shared with concurrent callers, but not cached.
+type SharedFetcher[T any] struct {
+	bucket  time.Duration
+	lock    sync.Mutex
+	entries map[string]*fetchEntry[T]
+}
+
+type fetchEntry[T any] struct {
+	bucket time.Time
+	done   chan struct{}
+	value  T
+	err    error
+}
+
+// NewSharedFetcher creates a SharedFetcher reusing search results during the given time bucket
+func NewSharedFetcher[T any](bucket time.Duration) *SharedFetcher[T] {
+	return &SharedFetcher[T]{bucket: bucket, entries: map[string]*fetchEntry[T]{}}
+}
+
+// Fetch returns the result of the search identified by the key, calling the fetch function only if
+// the search wasn't already issued during the current time bucket
+func (m *SharedFetcher[T]) Fetch(ctx context.Context, key string, fetch func(ctx context.Context) (T, error)) (T, error) {
+	for {
+		bucket := time.Now().Truncate(m.bucket)
+
+		m.lock.Lock()
+		entry, found := m.entries[key]
+		if !found || !entry.bucket.Equal(bucket) {
+			entry = &fetchEntry[T]{bucket: bucket, done: make(chan struct{})}
+			m.entries[key] = entry
+			m.lock.Unlock()
+			return m.doFetch(ctx, key, entry, fetch)
+		}
+		m.lock.Unlock()
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+
+		// The caller that issued the search gave up on it, try again on our own
+		if errors.Is(entry.err, context.Canceled) && ctx.Err() == nil {
+			continue
+		}
+		return entry.value, entry.err
+	}
+}
+
+func (m *SharedFetcher[T]) doFetch(ctx context.Context, key string, entry *fetchEntry[T], fetch func(ctx context.Context) (T, error)) (T, error) {
+	entry.value, entry.err = fetch(ctx)
+	if entry.err != nil {
+		m.lock.Lock()
+		if m.entries[key] == entry {
+			delete(m.entries, key)
+		}
+		m.lock.Unlock()
+	}
+	close(entry.done)
+	return entry.value, entry.err
+}
@@ -0,0 +1,95 @@
+package matchers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedFetcherDeduplicatesConcurrentSearches(t *testing.T) {
+	fetcher := NewSharedFetcher[[]string](1 * time.Minute)
+	var numFetches atomic.Int32
+	fetch := func(ctx context.Context) ([]string, error) {
+		numFetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return []string{"alert"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alerts, err := fetcher.Fetch(context.Background(), "backend", fetch)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"alert"}, alerts)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), numFetches.Load())
+}
+
+func TestSharedFetcherSearchesAgainInNextBucket(t *testing.T) {
+	fetcher := NewSharedFetcher[int](50 * time.Millisecond)
+	var numFetches atomic.Int32
+	fetch := func(ctx context.Context) (int, error) {
+		return int(numFetches.Add(1)), nil
+	}
+
+	first, _ := fetcher.Fetch(context.Background(), "backend", fetch)
+	time.Sleep(100 * time.Millisecond)
+	second, _ := fetcher.Fetch(context.Background(), "backend", fetch)
+
+	assert.Equal(t, 1, first)
+	assert.Equal(t, 2, second)
+}
+
+func TestSharedFetcherSeparatesKeys(t *testing.T) {
+	fetcher := NewSharedFetcher[string](1 * time.Minute)
+	datadog, _ := fetcher.Fetch(context.Background(), "datadog", func(context.Context) (string, error) { return "datadog", nil })
+	elastic, _ := fetcher.Fetch(context.Background(), "elastic", func(context.Context) (string, error) { return "elastic", nil })
+
+	assert.Equal(t, "datadog", datadog)
+	assert.Equal(t, "elastic", elastic)
+}
+
+func TestSharedFetcherDoesNotCacheErrors(t *testing.T) {
+	fetcher := NewSharedFetcher[string](1 * time.Minute)
+	_, err := fetcher.Fetch(context.Background(), "backend", func(context.Context) (string, error) { return "", errors.New("rate limited") })
+	assert.EqualError(t, err, "rate limited")
+
+	value, err := fetcher.Fetch(context.Background(), "backend", func(context.Context) (string, error) { return "alert", nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "alert", value)
+}
+
+func TestLookupField(t *testing.T) {
+	document := map[string]interface{}{
+		"kibana.alert.rule.name": "flattened",
+		"workflow": map[string]interface{}{
+			"rule": map[string]interface{}{"name": "nested"},
+		},
+		"host": map[string]interface{}{"os.name": "linux"},
+	}
+
+	value, found := LookupField(document, "kibana.alert.rule.name")
+	assert.True(t, found)
+	assert.Equal(t, "flattened", value)
+
+	value, found = LookupField(document, "workflow.rule.name")
+	assert.True(t, found)
+	assert.Equal(t, "nested", value)
+
+	value, found = LookupField(document, "host.os.name")
+	assert.True(t, found)
+	assert.Equal(t, "linux", value)
+
+	_, found = LookupField(document, "workflow.rule.id")
+	assert.False(t, found)
+}
@@ -0,0 +1,160 @@
+package matchers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryingTransport is an http.RoundTripper retrying the requests of matchers to their backend when the backend
+// is rate limiting them or temporarily unavailable. It waits for as long as the backend asks through the
+// Retry-After and X-RateLimit-* headers, and otherwise backs off exponentially with jitter.
+type RetryingTransport struct {
+	// Base performs the requests, defaulting to http.DefaultTransport
+	Base http.RoundTripper
+	// MaxRetries is the maximal number of times a request is retried
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the time to wait before retrying, when the backend doesn't tell
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxWait is the maximal time the backend can ask to wait before retrying, after which the request isn't retried
+	MaxWait time.Duration
+}
+
+// NewRetryingTransport creates a RetryingTransport with defaults suitable for the APIs of detection backends
+func NewRetryingTransport(base http.RoundTripper) *RetryingTransport {
+	return &RetryingTransport{
+		Base:       base,
+		MaxRetries: 5,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+		MaxWait:    time.Minute,
+	}
+}
+
+func (m *RetryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := m.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	// A request with a body can only be retried if the body can be read again
+	canRetry := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		response, err := base.RoundTrip(attemptReq)
+		if !canRetry || attempt >= m.MaxRetries || !isRetryableResponse(req.Context(), response, err) {
+			return response, err
+		}
+		wait, ok := m.retryDelay(response, attempt)
+		if !ok {
+			return response, err
+		}
+		if response != nil {
+			log.Debugf("%s %s returned status code %d, retrying in %s", req.Method, req.URL.Path, response.StatusCode, wait)
+			_, _ = io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		} else {
+			log.Debugf("%s %s failed (%v), retrying in %s", req.Method, req.URL.Path, err, wait)
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying, and false if the backend asks to wait longer than MaxWait
+func (m *RetryingTransport) retryDelay(response *http.Response, attempt int) (time.Duration, bool) {
+	if response != nil {
+		if wait, found := serverRetryDelay(response.Header); found {
+			return wait, wait <= m.MaxWait
+		}
+	}
+
+	backoff := m.MinBackoff << attempt
+	if backoff <= 0 || backoff > m.MaxBackoff {
+		backoff = m.MaxBackoff
+	}
+	// Equal jitter, so that matchers rate limited at the same time don't retry at the same time
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)), true
+}
+
+// serverRetryDelay returns how long the backend asks to wait before retrying, through the standard Retry-After
+// header, or Datadog's X-RateLimit-Reset header once X-RateLimit-Remaining reaches 0
+func serverRetryDelay(header http.Header) (time.Duration, bool) {
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return max(time.Until(date), 0), true
+		}
+	}
+	if header.Get("X-RateLimit-Remaining") == "0" {
+		if seconds, err := strconv.Atoi(header.Get("X-RateLimit-Reset")); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// isRetryableResponse returns true if the request failed in a way that retrying it can fix
+func isRetryableResponse(ctx context.Context, response *http.Response, err error) bool {
+	if err != nil {
+		// Network errors are retried, unless the request isn't needed anymore
+		return ctx.Err() == nil
+	}
+	return IsRetryableStatusCode(response.StatusCode)
+}
+
+// IsRetryableStatusCode returns true if a status code denotes an error that is expected to be transient
+func IsRetryableStatusCode(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// HTTPStatusError is returned by matchers when their backend responded with an unexpected status code
+type HTTPStatusError struct {
+	StatusCode int
+	// Message describes the failed request
+	Message string
+}
+
+func (m *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: got status code %d", m.Message, m.StatusCode)
+}
+
+// Retryable returns true if the error is expected to be transient, e.g. because of rate limiting
+func (m *HTTPStatusError) Retryable() bool {
+	return IsRetryableStatusCode(m.StatusCode)
+}
+
+// IsRetryable returns true if an error returned by a matcher is expected to be transient, in which case the
+// matcher can be queried again later. Other errors, such as invalid credentials, are fatal.
+func IsRetryable(err error) bool {
+	var statusError *HTTPStatusError
+	return errors.As(err, &statusError) && statusError.Retryable()
+}
@@ -0,0 +1,131 @@
+package matchers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTransport returns a transport retrying quickly, for tests
+func newTestTransport() *RetryingTransport {
+	transport := NewRetryingTransport(nil)
+	transport.MinBackoff = time.Millisecond
+	transport.MaxBackoff = 10 * time.Millisecond
+	transport.MaxWait = 5 * time.Second
+	return transport
+}
+
+// newFlakyServer returns a server answering with the given status codes and headers, then with 200
+func newFlakyServer(t *testing.T, numRequests *int32, failures []int, headers http.Header) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(numRequests, 1)) - 1
+		body, _ := io.ReadAll(r.Body)
+		if i < len(failures) {
+			for key, values := range headers {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(failures[i])
+			return
+		}
+		_, _ = fmt.Fprintf(w, "ok %s", body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRetryingTransportRetriesTransientErrors(t *testing.T) {
+	tests := []struct {
+		Name             string
+		Failures         []int
+		Headers          http.Header
+		ExpectedStatus   int
+		ExpectedRequests int32
+	}{
+		{Name: "success", ExpectedStatus: 200, ExpectedRequests: 1},
+		{Name: "rate limited", Failures: []int{429, 429}, ExpectedStatus: 200, ExpectedRequests: 3},
+		{Name: "unavailable", Failures: []int{503, 502, 504, 500}, ExpectedStatus: 200, ExpectedRequests: 5},
+		{Name: "retry-after in seconds", Failures: []int{429}, Headers: http.Header{"Retry-After": {"0"}}, ExpectedStatus: 200, ExpectedRequests: 2},
+		{Name: "datadog rate limit", Failures: []int{429}, Headers: http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"0"}}, ExpectedStatus: 200, ExpectedRequests: 2},
+		{Name: "too many failures", Failures: []int{503, 503, 503, 503, 503, 503, 503}, ExpectedStatus: 503, ExpectedRequests: 6},
+		{Name: "fatal error", Failures: []int{401}, ExpectedStatus: 401, ExpectedRequests: 1},
+		{Name: "retry-after too long", Failures: []int{429}, Headers: http.Header{"Retry-After": {"3600"}}, ExpectedStatus: 429, ExpectedRequests: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var numRequests int32
+			server := newFlakyServer(t, &numRequests, test.Failures, test.Headers)
+			client := &http.Client{Transport: newTestTransport()}
+
+			response, err := client.Post(server.URL, "application/json", strings.NewReader("payload"))
+			require.NoError(t, err)
+			defer response.Body.Close()
+			assert.Equal(t, test.ExpectedStatus, response.StatusCode)
+			assert.Equal(t, test.ExpectedRequests, atomic.LoadInt32(&numRequests))
+			if test.ExpectedStatus == http.StatusOK {
+				body, _ := io.ReadAll(response.Body)
+				assert.Equal(t, "ok payload", string(body), "the body of the request should be sent again when retrying")
+			}
+		})
+	}
+}
+
+func TestRetryingTransportHonorsRetryAfter(t *testing.T) {
+	var numRequests int32
+	server := newFlakyServer(t, &numRequests, []int{429}, http.Header{"Retry-After": {"1"}})
+	client := &http.Client{Transport: newTestTransport()}
+
+	start := time.Now()
+	response, err := client.Get(server.URL)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestRetryingTransportStopsWhenContextIsCancelled(t *testing.T) {
+	var numRequests int32
+	server := newFlakyServer(t, &numRequests, []int{429}, http.Header{"Retry-After": {"3"}})
+	client := &http.Client{Transport: newTestTransport()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	start := time.Now()
+	_, err := client.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryingTransportBacksOffWithJitter(t *testing.T) {
+	transport := NewRetryingTransport(nil)
+	for attempt := 0; attempt < 10; attempt++ {
+		wait, ok := transport.retryDelay(nil, attempt)
+		require.True(t, ok)
+		expected := min(transport.MinBackoff<<attempt, transport.MaxBackoff)
+		assert.GreaterOrEqual(t, wait, expected/2)
+		assert.LessOrEqual(t, wait, expected)
+	}
+
+	header := http.Header{"Retry-After": {time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}}
+	wait, ok := transport.retryDelay(&http.Response{Header: header}, 0)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait, "a date in the past means retrying right away")
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, IsRetryable(fmt.Errorf("unable to search: %w", &HTTPStatusError{StatusCode: 429, Message: "search"})))
+	assert.True(t, IsRetryable(&HTTPStatusError{StatusCode: 503}))
+	assert.False(t, IsRetryable(&HTTPStatusError{StatusCode: 403}))
+	assert.False(t, IsRetryable(io.EOF))
+	assert.EqualError(t, &HTTPStatusError{StatusCode: 403, Message: "unable to archive signal"}, "unable to archive signal: got status code 403")
+}
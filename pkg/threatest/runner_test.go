@@ -1,15 +1,22 @@
 package threatest
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/datadog/threatest/pkg/threatest/detonators"
 	detonatorMocks "github.com/datadog/threatest/pkg/threatest/detonators/mocks"
 	"github.com/datadog/threatest/pkg/threatest/matchers"
 	matcherMocks "github.com/datadog/threatest/pkg/threatest/matchers/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 //TODO nuke interval for tests
@@ -46,10 +53,10 @@ func TestRunnerWorks(t *testing.T) {
 			mockMatcher.On("String").Return("sample")
 			mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
 
-			var assertions []matchers.AlertGeneratedMatcher
-			assertions = []matchers.AlertGeneratedMatcher{}
+			var assertions []Assertion
+			assertions = []Assertion{}
 			if !testCase.HasNoAssertion {
-				assertions = []matchers.AlertGeneratedMatcher{mockMatcher}
+				assertions = []Assertion{{AlertGeneratedMatcher: mockMatcher}}
 			}
 
 			runner := TestRunner{
@@ -98,19 +105,19 @@ func TestRunnerErrorHandling(t *testing.T) {
 			{
 				Name:       "test-scenario1",
 				Detonator:  mockDetonator,
-				Assertions: []matchers.AlertGeneratedMatcher{mockMatcher},
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
 				Timeout:    5 * time.Second,
 			},
 			{
 				Name:       "test-scenario2-error",
 				Detonator:  mockFailingDetonator,
-				Assertions: []matchers.AlertGeneratedMatcher{mockMatcher},
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
 				Timeout:    5 * time.Second,
 			},
 			{
 				Name:       "test-scenario3",
 				Detonator:  mockDetonator,
-				Assertions: []matchers.AlertGeneratedMatcher{mockMatcher},
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
 				Timeout:    5 * time.Second,
 			},
 		},
@@ -123,3 +130,1174 @@ func TestRunnerErrorHandling(t *testing.T) {
 	mockDetonator.AssertNumberOfCalls(t, "Detonate", 2)
 	mockFailingDetonator.AssertNumberOfCalls(t, "Detonate", 1)
 }
+
+func TestRunnerKeepsPollingOnTransientErrors(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	rateLimited := &matchers.HTTPStatusError{StatusCode: 429, Message: "unable to search for signals"}
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, fmt.Errorf("unable to search: %w", rateLimited)).Twice()
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+
+	fatalMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	fatalMatcher.On("String").Return("fatal")
+	fatalMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+	fatalMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, &matchers.HTTPStatusError{StatusCode: 403, Message: "unable to search for signals"})
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{Name: "transient", Detonator: mockDetonator, Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}}, Timeout: 5 * time.Second},
+			{Name: "fatal", Detonator: mockDetonator, Assertions: []Assertion{{AlertGeneratedMatcher: fatalMatcher}}, Timeout: 5 * time.Second},
+		},
+		Interval: 10 * time.Millisecond,
+	}
+	results, _ := runner.RunWithResults(context.Background())
+	require.Len(t, results.Scenarios, 2)
+	assert.NoError(t, results.Scenarios[0].Error)
+	mockMatcher.AssertNumberOfCalls(t, "HasExpectedAlert", 3)
+	assert.Equal(t, ErrorKindMatcher, results.Scenarios[1].ErrorKind)
+	fatalMatcher.AssertNumberOfCalls(t, "HasExpectedAlert", 1)
+}
+
+func TestRunnerPollsAssertionsConcurrently(t *testing.T) {
+	const interval = 200 * time.Millisecond
+
+	for _, numAssertions := range []int{1, 8} {
+		numAssertions := numAssertions
+		t.Run(strconv.Itoa(numAssertions)+" assertions", func(t *testing.T) {
+			t.Parallel()
+			mockDetonator := &detonatorMocks.Detonator{}
+			mockDetonator.On("Detonate").Return("my-uid", nil)
+
+			// Every alert shows up on the second poll
+			var assertions []Assertion
+			for i := 0; i < numAssertions; i++ {
+				mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+				mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil).Once()
+				mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil).Once()
+				mockMatcher.On("String").Return("sample")
+				mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+				assertions = append(assertions, Assertion{AlertGeneratedMatcher: mockMatcher})
+			}
+
+			runner := TestRunner{
+				Scenarios: []*Scenario{
+					{
+						Name:       "test-scenario",
+						Detonator:  mockDetonator,
+						Assertions: assertions,
+						Timeout:    10 * time.Second,
+					},
+				},
+				Interval: interval,
+			}
+
+			start := time.Now()
+			assert.Nil(t, runner.Run())
+
+			// With round-robin polling, this would take at least numAssertions * interval
+			assert.Less(t, time.Since(start), 3*interval, "latency should not scale with the number of assertions")
+			for _, assertion := range assertions {
+				assertion.AlertGeneratedMatcher.(*matcherMocks.AlertGeneratedMatcher).AssertNumberOfCalls(t, "HasExpectedAlert", 2)
+			}
+		})
+	}
+}
+
+func TestRunnerFailsOnlyPendingAssertions(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	passingMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	passingMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	passingMatcher.On("String").Return("passing")
+	passingMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	failingMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	failingMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil)
+	failingMatcher.On("String").Return("failing")
+	failingMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: passingMatcher}, {AlertGeneratedMatcher: failingMatcher}},
+				Timeout:    1 * time.Second,
+			},
+		},
+		Interval: 100 * time.Millisecond,
+	}
+	err := runner.Run()
+	assert.ErrorContains(t, err, "1 assertions did not pass")
+	assert.ErrorContains(t, err, "Did not find failing")
+	assert.NotContains(t, err.Error(), "Did not find passing")
+	passingMatcher.AssertNumberOfCalls(t, "HasExpectedAlert", 1)
+}
+
+func TestRunnerHonorsPerAssertionTimeouts(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	fastMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	fastMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil)
+	fastMatcher.On("String").Return("fast")
+	fastMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	// The slow alert shows up after the fast assertion has timed out, but within its own timeout
+	slowMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	slowMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil).Times(3)
+	slowMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	slowMatcher.On("String").Return("slow")
+	slowMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	builder := &ScenarioBuilder{}
+	builder.Name = "test-scenario"
+	builder.WhenDetonating(mockDetonator).
+		ExpectWithin(fastMatcher, 100*time.Millisecond).
+		ExpectWithin(slowMatcher, 5*time.Second).
+		WithTimeout(1 * time.Millisecond)
+
+	runner := TestRunner{Interval: 100 * time.Millisecond}
+	runner.Add(builder)
+	err := runner.Run()
+	assert.ErrorContains(t, err, "1 assertions did not pass")
+	assert.ErrorContains(t, err, "Did not find fast within 100ms")
+	slowMatcher.AssertNumberOfCalls(t, "HasExpectedAlert", 4)
+}
+
+func TestRunnerNegativeAssertions(t *testing.T) {
+	testCases := []struct {
+		Name                string
+		AlertExistsSequence []bool
+		ExpectError         bool
+		ExpectedNumPolls    int
+	}{
+		{Name: "Alert never exists", AlertExistsSequence: []bool{false}},
+		{Name: "Alert exists from the beginning", AlertExistsSequence: []bool{true}, ExpectError: true, ExpectedNumPolls: 1},
+		{Name: "Alert doesn't exist then exists", AlertExistsSequence: []bool{false, true}, ExpectError: true, ExpectedNumPolls: 2},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Name, func(t *testing.T) {
+			t.Parallel()
+			mockDetonator := &detonatorMocks.Detonator{}
+			mockDetonator.On("Detonate").Return("my-uid", nil)
+
+			mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+			if len(testCase.AlertExistsSequence) == 1 {
+				mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(testCase.AlertExistsSequence[0], nil)
+			} else {
+				for i := range testCase.AlertExistsSequence {
+					mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(testCase.AlertExistsSequence[i], nil).Once()
+				}
+			}
+			mockMatcher.On("String").Return("sample")
+			mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+			builder := &ScenarioBuilder{}
+			builder.Name = "test-scenario"
+			builder.WhenDetonating(mockDetonator).ExpectNoAlert(mockMatcher, 500*time.Millisecond)
+
+			runner := TestRunner{Interval: 100 * time.Millisecond}
+			runner.Add(builder)
+
+			start := time.Now()
+			err := runner.Run()
+			if testCase.ExpectError {
+				assert.ErrorContains(t, err, "Unexpectedly found sample")
+				mockMatcher.AssertNumberOfCalls(t, "HasExpectedAlert", testCase.ExpectedNumPolls)
+			} else {
+				assert.Nil(t, err)
+				assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond, "the runner should poll during the whole observation window")
+			}
+		})
+	}
+}
+
+func TestRunnerRejectsNegativeAssertionWithoutWindow(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher, NoAlert: true}},
+			},
+		},
+	}
+	assert.ErrorContains(t, runner.Run(), "no observation window defined")
+	mockMatcher.AssertNotCalled(t, "HasExpectedAlert", mock.Anything, mock.Anything)
+}
+
+func TestRunnerReturnsStructuredResults(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	mockFailingDetonator := &detonatorMocks.Detonator{}
+	mockFailingDetonator.On("Detonate").Return("", errors.New("foo"))
+
+	passingMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	passingMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	passingMatcher.On("String").Return("passing")
+	passingMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	failingMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	failingMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil)
+	failingMatcher.On("String").Return("failing")
+	failingMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	brokenMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	brokenMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, errors.New("API error"))
+	brokenMatcher.On("String").Return("broken")
+	brokenMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "passing",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: passingMatcher}},
+				Timeout:    1 * time.Second,
+			},
+			{
+				Name:       "failing-assertion",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: passingMatcher}, {AlertGeneratedMatcher: failingMatcher}},
+				Timeout:    200 * time.Millisecond,
+			},
+			{
+				Name:       "failing-detonation",
+				Detonator:  mockFailingDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: passingMatcher}},
+				Timeout:    1 * time.Second,
+			},
+			{
+				Name:       "failing-matcher",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: brokenMatcher}},
+				Timeout:    1 * time.Second,
+			},
+		},
+		Interval: 50 * time.Millisecond,
+	}
+	results, err := runner.RunWithResults(context.Background())
+	assert.Error(t, err, "the error should remain available when scenarios fail")
+	assert.Equal(t, results.Err().Error(), err.Error())
+	assert.False(t, results.Success())
+	assert.Len(t, results.Scenarios, 4)
+
+	passing := results.Scenarios[0]
+	assert.True(t, passing.Success())
+	assert.Empty(t, passing.ErrorKind)
+	assert.Equal(t, "my-uid", passing.DetonationUuid)
+	assert.False(t, passing.DetonationStart.IsZero())
+	assert.False(t, passing.DetonationEnd.Before(passing.DetonationStart))
+	assert.Len(t, passing.Assertions, 1)
+	assert.Equal(t, AssertionPassed, passing.Assertions[0].Status)
+
+	failingAssertion := results.Scenarios[1]
+	assert.False(t, failingAssertion.Success())
+	assert.Equal(t, ErrorKindAssertion, failingAssertion.ErrorKind)
+	assert.Equal(t, AssertionPassed, failingAssertion.Assertions[0].Status)
+	assert.Equal(t, AssertionTimedOut, failingAssertion.Assertions[1].Status)
+
+	failingDetonation := results.Scenarios[2]
+	assert.Equal(t, ErrorKindDetonation, failingDetonation.ErrorKind)
+	assert.EqualError(t, failingDetonation.Error, "foo")
+	assert.Empty(t, failingDetonation.DetonationUuid)
+	assert.Empty(t, failingDetonation.Assertions)
+
+	brokenMatcherScenario := results.Scenarios[3]
+	assert.Equal(t, ErrorKindMatcher, brokenMatcherScenario.ErrorKind)
+	assert.Equal(t, AssertionErrored, brokenMatcherScenario.Assertions[0].Status)
+	assert.EqualError(t, brokenMatcherScenario.Assertions[0].Error, "API error")
+}
+
+func TestRunnerReportsCancelledScenarios(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
+				Timeout:    10 * time.Second,
+			},
+		},
+		Interval: 50 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results, err := runner.RunWithResults(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, ErrorKindCancelled, results.Scenarios[0].ErrorKind)
+	assert.Equal(t, AssertionCancelled, results.Scenarios[0].Assertions[0].Status)
+}
+
+func TestRunnerInterruptsDetonations(t *testing.T) {
+	newHangingDetonator := func() *detonatorMocks.Detonator {
+		mockDetonator := &detonatorMocks.Detonator{}
+		mockDetonator.On("Detonate").After(10*time.Second).Return("my-uid", nil)
+		return mockDetonator
+	}
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("String").Return("sample")
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:              "detonation timing out",
+				Detonator:         newHangingDetonator(),
+				DetonationTimeout: 100 * time.Millisecond,
+				Assertions:        []Assertion{{AlertGeneratedMatcher: mockMatcher}},
+				Timeout:           10 * time.Second,
+			},
+		},
+		Interval: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	results, err := runner.RunWithResults(context.Background())
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, ErrorKindDetonation, results.Scenarios[0].ErrorKind)
+	assert.ErrorContains(t, results.Scenarios[0].Error, "detonation timed out after 100ms")
+
+	runner.Scenarios[0].Detonator = newHangingDetonator()
+	runner.Scenarios[0].DetonationTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	results, err = runner.RunWithResults(ctx)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, ErrorKindCancelled, results.Scenarios[0].ErrorKind)
+	mockMatcher.AssertNotCalled(t, "HasExpectedAlert", mock.Anything, mock.Anything)
+}
+
+// describedDetonator is a detonator reporting a predefined detonation result
+// interruptibleDetonator is a detonator running until its context is cancelled
+type interruptibleDetonator struct{}
+
+func (m *interruptibleDetonator) Detonate() (string, error) {
+	return "", errors.New("not supported")
+}
+
+func (m *interruptibleDetonator) DetonateContext(ctx context.Context) (*detonators.DetonationResult, error) {
+	<-ctx.Done()
+	return &detonators.DetonationResult{DetonationUuid: "interrupted-uid"}, ctx.Err()
+}
+
+func TestRunnerCleansUpInterruptedDetonations(t *testing.T) {
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "interrupted-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{Name: "interrupted", Detonator: &interruptibleDetonator{}, Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}}},
+		},
+		CleanupDelay: time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	results, err := runner.RunWithResults(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, ErrorKindCancelled, results.Scenarios[0].ErrorKind)
+	assert.Equal(t, "interrupted-uid", results.Scenarios[0].DetonationUuid)
+	mockMatcher.AssertCalled(t, "Cleanup", mock.Anything, "interrupted-uid")
+	mockMatcher.AssertNotCalled(t, "HasExpectedAlert", mock.Anything, mock.Anything)
+}
+
+type describedDetonator struct {
+	result *detonators.DetonationResult
+	err    error
+}
+
+func (m *describedDetonator) Detonate() (string, error) {
+	return m.result.DetonationUuid, m.err
+}
+
+func (m *describedDetonator) DetonateContext(context.Context) (*detonators.DetonationResult, error) {
+	return m.result, m.err
+}
+
+func TestRunnerReportsDetonationResults(t *testing.T) {
+	exitCode := 1
+	detonation := &detonators.DetonationResult{DetonationUuid: "my-uid", Target: "my-host", Stdout: "output"}
+	failedDetonation := &detonators.DetonationResult{Target: "my-host", ExitCode: &exitCode, Stderr: "command not found"}
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "detonated",
+				Detonator:  &describedDetonator{result: detonation},
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
+				Timeout:    1 * time.Second,
+			},
+			{
+				Name:       "failed detonation",
+				Detonator:  &describedDetonator{result: failedDetonation, err: errors.New("exit status 1")},
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
+				Timeout:    1 * time.Second,
+			},
+		},
+		Interval: 50 * time.Millisecond,
+	}
+	results, _ := runner.RunWithResults(context.Background())
+	assert.Equal(t, "my-uid", results.Scenarios[0].DetonationUuid)
+	assert.Same(t, detonation, results.Scenarios[0].Detonation)
+	assert.True(t, results.Scenarios[0].Success())
+
+	assert.Equal(t, ErrorKindDetonation, results.Scenarios[1].ErrorKind)
+	assert.Same(t, failedDetonation, results.Scenarios[1].Detonation)
+}
+
+func TestRunnerCleansUpDetonationsWithFailedChecks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("local commands require bash")
+	}
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, mock.Anything).Return(nil)
+
+	// The attack ran, but its output is not the expected one
+	detonator := detonators.NewCommandDetonator(&detonators.LocalCommandExecutor{}, "echo forbidden").
+		WithChecks(detonators.DetonationChecks{ExpectedOutputContains: []string{"created"}})
+	builder := &ScenarioBuilder{}
+	builder.Name = "failed checks"
+	builder.WhenDetonating(detonator).
+		Expect(mockMatcher).
+		WithTimeout(1 * time.Second).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2})
+
+	runner := TestRunner{Interval: 10 * time.Millisecond}
+	runner.Add(builder)
+	results, err := runner.RunWithResults(context.Background())
+	assert.Error(t, err)
+
+	result := results.Scenarios[0]
+	assert.Equal(t, ErrorKindDetonation, result.ErrorKind)
+	require.Len(t, result.Attempts, 2)
+	assert.NotEqual(t, result.Attempts[0].DetonationUuid, result.Attempts[1].DetonationUuid, "the attack should be detonated again")
+	for _, attempt := range result.Attempts {
+		require.NotEmpty(t, attempt.DetonationUuid)
+		mockMatcher.AssertCalled(t, "Cleanup", mock.Anything, attempt.DetonationUuid)
+	}
+	mockMatcher.AssertNotCalled(t, "HasExpectedAlert", mock.Anything, mock.Anything)
+}
+
+func TestRunnerProvidesDetonationToMatchers(t *testing.T) {
+	start := time.Now()
+	detonation := &detonators.DetonationResult{
+		DetonationUuid: "my-uid",
+		StartTime:      start,
+		EndTime:        start.Add(1 * time.Second),
+		Steps: []*detonators.DetonationResult{
+			{DetonationUuid: "my-uid", Target: "host-1"},
+			{DetonationUuid: "my-uid", Target: "123456789012"},
+		},
+	}
+	hasDetonation := mock.MatchedBy(func(ctx context.Context) bool {
+		return assert.ObjectsAreEqual(matchers.Detonation{
+			Uuid:    "my-uid",
+			Targets: []string{"host-1", "123456789012"},
+			Start:   start,
+			End:     start.Add(1 * time.Second),
+		}, matchers.DetonationFromContext(ctx, "my-uid"))
+	})
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", hasDetonation, "my-uid").Return(true, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", hasDetonation, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{{
+			Name:       "detonated",
+			Detonator:  &describedDetonator{result: detonation},
+			Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
+			Timeout:    1 * time.Second,
+		}},
+		Interval: 50 * time.Millisecond,
+	}
+	assert.NoError(t, runner.Run())
+	mockMatcher.AssertExpectations(t)
+}
+
+// correlatedDetonator reports the detonation UUID it is given, as built-in detonators do
+type correlatedDetonator struct {
+	detonationUuids []string
+}
+
+func (m *correlatedDetonator) Detonate() (string, error) {
+	return "", errors.New("not supported")
+}
+
+func (m *correlatedDetonator) DetonateContext(ctx context.Context) (*detonators.DetonationResult, error) {
+	detonationUuid, _ := detonators.DetonationUuidFromContext(ctx)
+	m.detonationUuids = append(m.detonationUuids, detonationUuid)
+	return &detonators.DetonationResult{DetonationUuid: detonationUuid}, nil
+}
+
+func TestRunnerDetonatesAttackChains(t *testing.T) {
+	recon := &correlatedDetonator{}
+	exfiltration := &correlatedDetonator{}
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, mock.Anything).Return(true, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, mock.Anything).Return(nil)
+
+	runner := Threatest()
+	runner.Interval = 50 * time.Millisecond
+	runner.Scenario("attack chain").
+		WhenDetonating(recon).
+		ThenDetonatingAfter(100*time.Millisecond, exfiltration).
+		Expect(mockMatcher)
+
+	results, err := runner.RunWithResults(context.Background())
+	assert.NoError(t, err)
+	detonationUuid := results.Scenarios[0].DetonationUuid
+	assert.NotEmpty(t, detonationUuid)
+	assert.Equal(t, []string{detonationUuid}, recon.detonationUuids)
+	assert.Equal(t, []string{detonationUuid}, exfiltration.detonationUuids)
+	assert.Len(t, results.Scenarios[0].Detonation.Steps, 2)
+	mockMatcher.AssertCalled(t, "HasExpectedAlert", mock.Anything, detonationUuid)
+}
+
+// recordingListener records the lifecycle events it receives
+type recordingListener struct {
+	NoopListener
+	lock   sync.Mutex
+	events []string
+}
+
+func (m *recordingListener) record(event string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.events = append(m.events, event)
+}
+
+func (m *recordingListener) ScenarioStarted(scenario *Scenario) {
+	m.record("started " + scenario.Name)
+}
+
+func (m *recordingListener) ScenarioDetonated(scenario *Scenario, detonationUuid string) {
+	m.record("detonated " + scenario.Name + " " + detonationUuid)
+}
+
+func (m *recordingListener) AssertionPolled(_ *Scenario, assertion Assertion, hasAlert bool) {
+	m.record("polled " + assertion.String() + " " + strconv.FormatBool(hasAlert))
+}
+
+func (m *recordingListener) AssertionMatched(_ *Scenario, assertion Assertion, _ time.Duration) {
+	m.record("matched " + assertion.String())
+}
+
+func (m *recordingListener) AssertionTimedOut(_ *Scenario, assertion Assertion) {
+	m.record("timed out " + assertion.String())
+}
+
+func (m *recordingListener) ScenarioRetrying(scenario *Scenario, attempt int, _ *ScenarioResult) {
+	m.record("retrying " + scenario.Name + " " + strconv.Itoa(attempt))
+}
+
+func (m *recordingListener) CleanupFinished(scenario *Scenario, _ string, err error) {
+	m.record("cleaned up " + scenario.Name + " " + strconv.FormatBool(err == nil))
+}
+
+func (m *recordingListener) ScenarioFinished(scenario *Scenario, result *ScenarioResult) {
+	m.record("finished " + scenario.Name + " " + strconv.FormatBool(result.Success()))
+}
+
+func TestRunnerNotifiesListeners(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil).Once()
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil).Once()
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
+				Timeout:    5 * time.Second,
+			},
+		},
+	}
+	listener := &recordingListener{}
+	runner.AddListener(listener)
+	assert.Nil(t, runner.Run())
+
+	assert.Equal(t, []string{
+		"started test-scenario",
+		"detonated test-scenario my-uid",
+		"polled sample false",
+		"polled sample true",
+		"matched sample",
+		"cleaned up test-scenario true",
+		"finished test-scenario true",
+	}, listener.events)
+}
+
+func TestRunnerNotifiesListenersOfTimeouts(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(errors.New("foo"))
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
+				Timeout:    100 * time.Millisecond,
+			},
+		},
+		Interval: 200 * time.Millisecond,
+	}
+	listener := &recordingListener{}
+	runner.AddListener(listener)
+	assert.Error(t, runner.Run())
+
+	assert.Equal(t, []string{
+		"started test-scenario",
+		"detonated test-scenario my-uid",
+		"polled sample false",
+		"timed out sample",
+		"cleaned up test-scenario false",
+		"finished test-scenario false",
+	}, listener.events)
+}
+
+// backendMatcher is a matcher identifying the backend it queries
+type backendMatcher struct {
+	*matcherMocks.AlertGeneratedMatcher
+	backend string
+}
+
+func (m *backendMatcher) Backend() string {
+	return m.backend
+}
+
+func newBackendMatcher(backend string) *backendMatcher {
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, mock.Anything).Return(true, nil)
+	mockMatcher.On("String").Return(backend)
+	mockMatcher.On("Cleanup", mock.Anything, mock.Anything).Return(nil)
+	return &backendMatcher{AlertGeneratedMatcher: mockMatcher, backend: backend}
+}
+
+func TestRunnerCleansUpEveryDistinctBackend(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	datadogMatcher1 := newBackendMatcher("datadog")
+	datadogMatcher2 := newBackendMatcher("datadog")
+	elasticMatcher := newBackendMatcher("elastic")
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:      "test-scenario",
+				Detonator: mockDetonator,
+				Assertions: []Assertion{
+					{AlertGeneratedMatcher: datadogMatcher1},
+					{AlertGeneratedMatcher: datadogMatcher2},
+					{AlertGeneratedMatcher: elasticMatcher},
+				},
+				Timeout: 1 * time.Second,
+			},
+		},
+	}
+	assert.Nil(t, runner.Run())
+
+	datadogMatcher1.AssertNumberOfCalls(t, "Cleanup", 1)
+	datadogMatcher2.AssertNotCalled(t, "Cleanup", mock.Anything, mock.Anything)
+	elasticMatcher.AssertNumberOfCalls(t, "Cleanup", 1)
+}
+
+func TestRunnerCleansUpCompositeMatchersOncePerBackend(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	datadogMatcher1 := newBackendMatcher("datadog")
+	datadogMatcher2 := newBackendMatcher("datadog")
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:      "test-scenario",
+				Detonator: mockDetonator,
+				Assertions: []Assertion{
+					{AlertGeneratedMatcher: matchers.AnyOf(datadogMatcher1)},
+					{AlertGeneratedMatcher: datadogMatcher2},
+				},
+				Timeout: 1 * time.Second,
+			},
+		},
+	}
+	assert.Nil(t, runner.Run())
+
+	datadogMatcher1.AssertNumberOfCalls(t, "Cleanup", 1)
+	datadogMatcher2.AssertNotCalled(t, "Cleanup", mock.Anything, mock.Anything)
+}
+
+func TestRunnerFailsEarlyOnAlertsOutOfOrder(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	// The second alert is found before the first one
+	firstMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	firstMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil).Once()
+	firstMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	firstMatcher.On("String").Return("first")
+	firstMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+	secondMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	secondMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	secondMatcher.On("String").Return("second")
+	secondMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Interval: 10 * time.Millisecond,
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: matchers.Ordered(firstMatcher, secondMatcher)}},
+				Timeout:    1 * time.Minute,
+			},
+		},
+	}
+	start := time.Now()
+	results, err := runner.RunWithResults(context.Background())
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second, "the scenario should not wait for its timeout")
+
+	result := results.Scenarios[0]
+	assert.Equal(t, ErrorKindAssertion, result.ErrorKind)
+	assert.Equal(t, AssertionOutOfOrder, result.Assertions[0].Status)
+	assert.ErrorIs(t, result.Assertions[0].Error, matchers.ErrAlertsOutOfOrder)
+	assert.Contains(t, result.Error.Error(), "second was generated before first")
+}
+
+// correlatingMatcher is a matcher querying a backend with a given correlator
+type correlatingMatcher struct {
+	*backendMatcher
+	correlator matchers.AlertCorrelator
+}
+
+func (m *correlatingMatcher) AlertCorrelator() matchers.AlertCorrelator {
+	return m.correlator
+}
+
+func TestRunnerCleansUpEveryDistinctCorrelator(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	defaultMatcher := newBackendMatcher("datadog")
+	uuidMatcher := &correlatingMatcher{backendMatcher: newBackendMatcher("datadog"), correlator: &matchers.UuidCorrelator{}}
+	fieldMatcher := &correlatingMatcher{backendMatcher: newBackendMatcher("datadog"), correlator: &matchers.FieldCorrelator{Field: "user"}}
+	entityMatcher1 := &correlatingMatcher{backendMatcher: newBackendMatcher("datadog"), correlator: &matchers.EntityCorrelator{}}
+	entityMatcher2 := &correlatingMatcher{backendMatcher: newBackendMatcher("datadog"), correlator: &matchers.EntityCorrelator{}}
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:      "test-scenario",
+				Detonator: mockDetonator,
+				Assertions: []Assertion{
+					{AlertGeneratedMatcher: defaultMatcher},
+					{AlertGeneratedMatcher: uuidMatcher},
+					{AlertGeneratedMatcher: fieldMatcher},
+					{AlertGeneratedMatcher: entityMatcher1},
+					{AlertGeneratedMatcher: entityMatcher2},
+				},
+				Timeout: 1 * time.Second,
+			},
+		},
+	}
+	assert.Nil(t, runner.Run())
+
+	defaultMatcher.AssertNumberOfCalls(t, "Cleanup", 1)
+	uuidMatcher.AssertNotCalled(t, "Cleanup", mock.Anything, mock.Anything)
+	fieldMatcher.AssertNumberOfCalls(t, "Cleanup", 1)
+	// Matchers with correlators not relying on the UUID only close the alerts matching their own filter
+	entityMatcher1.AssertNumberOfCalls(t, "Cleanup", 1)
+	entityMatcher2.AssertNumberOfCalls(t, "Cleanup", 1)
+}
+
+func TestRunnerWaitsForCleanupDelay(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	var cleanupTime time.Time
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil).Run(func(mock.Arguments) { cleanupTime = time.Now() })
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: mockMatcher}},
+				Timeout:    1 * time.Second,
+			},
+		},
+		CleanupDelay: 300 * time.Millisecond,
+	}
+	start := time.Now()
+	assert.Nil(t, runner.Run())
+	assert.GreaterOrEqual(t, cleanupTime.Sub(start), 300*time.Millisecond)
+}
+
+func TestRunnerFinalCleanupSweep(t *testing.T) {
+	mockDetonator1 := &detonatorMocks.Detonator{}
+	mockDetonator1.On("Detonate").Return("uid-1", nil)
+	mockDetonator2 := &detonatorMocks.Detonator{}
+	mockDetonator2.On("Detonate").Return("uid-2", nil)
+
+	datadogMatcher := newBackendMatcher("datadog")
+	elasticMatcher := newBackendMatcher("elastic")
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario1",
+				Detonator:  mockDetonator1,
+				Assertions: []Assertion{{AlertGeneratedMatcher: datadogMatcher}},
+				Timeout:    1 * time.Second,
+			},
+			{
+				Name:       "test-scenario2",
+				Detonator:  mockDetonator2,
+				Assertions: []Assertion{{AlertGeneratedMatcher: elasticMatcher}},
+				Timeout:    1 * time.Second,
+			},
+		},
+		FinalCleanupSweep: true,
+	}
+	assert.Nil(t, runner.Run())
+
+	// Each detonation is cleaned up once by its scenario, and once again at the end of the run, only by its scenario
+	datadogMatcher.AssertNumberOfCalls(t, "Cleanup", 2)
+	datadogMatcher.AssertNotCalled(t, "Cleanup", mock.Anything, "uid-2")
+	elasticMatcher.AssertNumberOfCalls(t, "Cleanup", 2)
+	elasticMatcher.AssertNotCalled(t, "Cleanup", mock.Anything, "uid-1")
+}
+
+func TestRunnerSweepsScenarioResultsOfOtherRunners(t *testing.T) {
+	start := time.Now()
+	detonation := &detonators.DetonationResult{
+		DetonationUuid: "my-uid",
+		Target:         "host-1",
+		StartTime:      start,
+		EndTime:        start.Add(1 * time.Second),
+	}
+	alert := matchers.Alert{
+		Document:  map[string]interface{}{"host": map[string]interface{}{"name": "host-1"}},
+		Timestamp: start.Add(500 * time.Millisecond),
+	}
+	correlator := &matchers.EntityCorrelator{Fields: []string{"host.name"}}
+
+	var closed []bool
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil).Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		closed = append(closed, correlator.Correlates(alert, matchers.DetonationFromContext(ctx, "my-uid")))
+	})
+	entityMatcher := &correlatingMatcher{
+		backendMatcher: &backendMatcher{AlertGeneratedMatcher: mockMatcher, backend: "datadog"},
+		correlator:     correlator,
+	}
+
+	scenario := &Scenario{
+		Name:       "detonated",
+		Detonator:  &describedDetonator{result: detonation},
+		Assertions: []Assertion{{AlertGeneratedMatcher: entityMatcher}},
+		Timeout:    1 * time.Second,
+	}
+	runner := TestRunner{Scenarios: []*Scenario{scenario}, Interval: 50 * time.Millisecond}
+	results, err := runner.RunWithResults(context.Background())
+	assert.NoError(t, err)
+
+	// A runner that didn't run the scenario still knows the targets and timing of its detonations from the result
+	sweeper := Threatest()
+	assert.NoError(t, sweeper.SweepScenarioResult(context.Background(), scenario, results.Scenarios[0]))
+	assert.Equal(t, []bool{true, true}, closed)
+}
+
+func TestRunnerRetriesByRedetonating(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("uid-1", nil).Once()
+	mockDetonator.On("Detonate").Return("uid-2", nil).Once()
+
+	// The alert of the first detonation is never generated
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "uid-1").Return(false, nil)
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "uid-2").Return(true, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, mock.Anything).Return(nil)
+
+	builder := &ScenarioBuilder{}
+	builder.Name = "test-scenario"
+	builder.WhenDetonating(mockDetonator).
+		Expect(mockMatcher).
+		WithTimeout(100 * time.Millisecond).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Redetonate: true, Backoff: 10 * time.Millisecond})
+
+	runner := TestRunner{Interval: 20 * time.Millisecond}
+	runner.Add(builder)
+	results, err := runner.RunWithResults(context.Background())
+	assert.Nil(t, err)
+
+	result := results.Scenarios[0]
+	assert.True(t, result.Success())
+	assert.True(t, result.Flaky())
+	assert.Equal(t, "uid-2", result.DetonationUuid)
+	assert.Len(t, result.Attempts, 2)
+	assert.Equal(t, ErrorKindAssertion, result.Attempts[0].ErrorKind)
+	assert.Equal(t, "uid-1", result.Attempts[0].DetonationUuid)
+	assert.Equal(t, []string{"uid-1", "uid-2"}, result.DetonationUuids())
+
+	mockDetonator.AssertNumberOfCalls(t, "Detonate", 2)
+	mockMatcher.AssertCalled(t, "Cleanup", mock.Anything, "uid-1")
+	mockMatcher.AssertCalled(t, "Cleanup", mock.Anything, "uid-2")
+}
+
+func TestRunnerRetriesByExtendingWait(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	fastMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	fastMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	fastMatcher.On("String").Return("fast")
+	fastMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	// The slow alert shows up during the second attempt
+	slowMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	slowMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil).Times(3)
+	slowMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(true, nil)
+	slowMatcher.On("String").Return("slow")
+	slowMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	builder := &ScenarioBuilder{}
+	builder.Name = "test-scenario"
+	builder.WhenDetonating(mockDetonator).
+		Expect(fastMatcher).
+		Expect(slowMatcher).
+		WithTimeout(150 * time.Millisecond).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2})
+
+	runner := TestRunner{Interval: 100 * time.Millisecond}
+	runner.Add(builder)
+	results, err := runner.RunWithResults(context.Background())
+	assert.Nil(t, err)
+
+	result := results.Scenarios[0]
+	assert.True(t, result.Flaky())
+	assert.Len(t, result.Attempts, 2)
+	assert.Equal(t, AssertionTimedOut, result.Attempts[0].Assertions[1].Status)
+	assert.Equal(t, AssertionPassed, result.Assertions[0].Status)
+	assert.Equal(t, AssertionPassed, result.Assertions[1].Status)
+	assert.Greater(t, result.Assertions[1].TimeToDetect, result.Assertions[0].TimeToDetect)
+
+	// The attack is detonated only once, and assertions that passed are not polled again
+	mockDetonator.AssertNumberOfCalls(t, "Detonate", 1)
+	fastMatcher.AssertNumberOfCalls(t, "HasExpectedAlert", 1)
+}
+
+func TestRunnerStopsRetryingAfterMaxAttempts(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	builder := &ScenarioBuilder{}
+	builder.Name = "test-scenario"
+	builder.WhenDetonating(mockDetonator).
+		Expect(mockMatcher).
+		WithTimeout(50 * time.Millisecond).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Redetonate: true})
+
+	runner := TestRunner{Interval: 10 * time.Millisecond}
+	runner.Add(builder)
+	listener := &recordingListener{}
+	runner.AddListener(listener)
+	results, err := runner.RunWithResults(context.Background())
+	assert.Error(t, err)
+
+	result := results.Scenarios[0]
+	assert.False(t, result.Success())
+	assert.False(t, result.Flaky())
+	assert.Len(t, result.Attempts, 3)
+	mockDetonator.AssertNumberOfCalls(t, "Detonate", 3)
+	// All attempts share the same UUID, which is cleaned up only once
+	mockMatcher.AssertNumberOfCalls(t, "Cleanup", 1)
+	assert.Contains(t, listener.events, "retrying test-scenario 1")
+	assert.Contains(t, listener.events, "retrying test-scenario 2")
+	assert.NotContains(t, listener.events, "retrying test-scenario 3")
+}
+
+func TestRunnerReportsCancellationDuringRetryBackoff(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("HasExpectedAlert", mock.Anything, "my-uid").Return(false, nil)
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	builder := &ScenarioBuilder{}
+	builder.Name = "test-scenario"
+	builder.WhenDetonating(mockDetonator).
+		Expect(mockMatcher).
+		WithTimeout(50 * time.Millisecond).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: 1 * time.Minute})
+
+	runner := TestRunner{Interval: 10 * time.Millisecond}
+	runner.Add(builder)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	results, err := runner.RunWithResults(ctx)
+	assert.Error(t, err)
+
+	result := results.Scenarios[0]
+	require.Len(t, result.Attempts, 1)
+	assert.Equal(t, ErrorKindAssertion, result.Attempts[0].ErrorKind)
+	assert.Equal(t, ErrorKindCancelled, result.ErrorKind, "the scenario was interrupted while waiting to retry")
+	assert.ErrorIs(t, result.Error, context.DeadlineExceeded)
+}
+
+// countingMatcher is a matcher returning a sequence of alert counts, the last one being repeated
+type countingMatcher struct {
+	*matcherMocks.AlertGeneratedMatcher
+	constraint matchers.CountConstraint
+	counts     []int
+	numPolls   int
+}
+
+func (m *countingMatcher) ExpectedCount() *matchers.CountConstraint {
+	return &m.constraint
+}
+
+func (m *countingMatcher) CountAlerts(context.Context, string) (int, error) {
+	count := m.counts[min(m.numPolls, len(m.counts)-1)]
+	m.numPolls++
+	return count, nil
+}
+
+func TestRunnerAssertsAlertCounts(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		Constraint    matchers.CountConstraint
+		Counts        []int
+		Timeout       time.Duration
+		ExpectedError string
+		// ExpectedMaxDuration is set when the assertion should be evaluated before its timeout
+		ExpectedMaxDuration time.Duration
+	}{
+		{Name: "exact count at timeout", Constraint: matchers.ExactlyN(2), Counts: []int{0, 1, 2}, Timeout: 500 * time.Millisecond},
+		{Name: "missing alerts at timeout", Constraint: matchers.ExactlyN(2), Counts: []int{0, 1}, Timeout: 500 * time.Millisecond, ExpectedError: "Found 1 alerts for sample"},
+		{Name: "no alert at timeout", Constraint: matchers.AtLeast(1), Counts: []int{0}, Timeout: 300 * time.Millisecond, ExpectedError: "Did not find sample within"},
+		{Name: "duplicate alerts", Constraint: matchers.NoDuplicates(), Counts: []int{1, 2}, Timeout: time.Minute, ExpectedError: "Found 2 alerts for sample", ExpectedMaxDuration: 5 * time.Second},
+		{Name: "settled count", Constraint: matchers.AtLeast(2).WithSettlePeriod(200 * time.Millisecond), Counts: []int{0, 2}, Timeout: time.Minute, ExpectedMaxDuration: 5 * time.Second},
+		{Name: "settle period with duplicates", Constraint: matchers.NoDuplicates().WithSettlePeriod(300 * time.Millisecond), Counts: []int{1, 1, 2}, Timeout: time.Minute, ExpectedError: "Found 2 alerts for sample", ExpectedMaxDuration: 5 * time.Second},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Name, func(t *testing.T) {
+			t.Parallel()
+			mockDetonator := &detonatorMocks.Detonator{}
+			mockDetonator.On("Detonate").Return("my-uid", nil)
+
+			mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+			mockMatcher.On("String").Return("sample")
+			mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+			matcher := &countingMatcher{AlertGeneratedMatcher: mockMatcher, constraint: testCase.Constraint, counts: testCase.Counts}
+
+			builder := &ScenarioBuilder{}
+			builder.Name = "test-scenario"
+			builder.WhenDetonating(mockDetonator).ExpectWithin(matcher, testCase.Timeout)
+
+			runner := TestRunner{Interval: 100 * time.Millisecond}
+			runner.Add(builder)
+
+			start := time.Now()
+			results, _ := runner.RunWithResults(context.Background())
+			if testCase.ExpectedError != "" {
+				assert.ErrorContains(t, results.Err(), testCase.ExpectedError)
+			} else {
+				assert.NoError(t, results.Err())
+			}
+			if testCase.ExpectedMaxDuration > 0 {
+				assert.Less(t, time.Since(start), testCase.ExpectedMaxDuration)
+			} else {
+				assert.GreaterOrEqual(t, time.Since(start), testCase.Timeout, "the runner should count alerts until the timeout")
+			}
+			mockMatcher.AssertNotCalled(t, "HasExpectedAlert", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestRunnerRejectsInvalidAlertCounts(t *testing.T) {
+	mockDetonator := &detonatorMocks.Detonator{}
+	mockDetonator.On("Detonate").Return("my-uid", nil)
+
+	mockMatcher := &matcherMocks.AlertGeneratedMatcher{}
+	mockMatcher.On("String").Return("sample")
+	mockMatcher.On("Cleanup", mock.Anything, "my-uid").Return(nil)
+
+	runner := TestRunner{
+		Scenarios: []*Scenario{
+			{
+				Name:       "test-scenario",
+				Detonator:  mockDetonator,
+				Assertions: []Assertion{{AlertGeneratedMatcher: &countingMatcher{AlertGeneratedMatcher: mockMatcher, constraint: matchers.ExactlyN(2), counts: []int{2}}}},
+			},
+		},
+	}
+	assert.ErrorContains(t, runner.Run(), "neither a timeout nor a settle period is defined to count sample")
+}
@@ -7,10 +7,50 @@ import (
 )
 
 type Scenario struct {
-	Name       string
-	Detonator  detonators.Detonator
+	Name      string
+	Detonator detonators.Detonator
+	// DetonationTimeout interrupts the detonation if it takes longer, when set
+	DetonationTimeout time.Duration
+	// Timeout is the default time to wait for assertions that don't define their own
 	Timeout    time.Duration
-	Assertions []matchers.AlertGeneratedMatcher
+	Assertions []Assertion
+	Retry      RetryPolicy
+}
+
+// Assertion is an expectation of a scenario, along with how long to wait for it
+type Assertion struct {
+	matchers.AlertGeneratedMatcher
+	// Timeout overrides the scenario timeout for this assertion, when set
+	Timeout time.Duration
+	// NoAlert inverts the assertion: it passes only if no alert is generated before its timeout,
+	// which then acts as an observation window
+	NoAlert bool
+}
+
+// timeout returns how long to wait for an assertion of the scenario, zero meaning no timeout
+func (m *Scenario) timeout(assertion Assertion) time.Duration {
+	if assertion.Timeout > 0 {
+		return assertion.Timeout
+	}
+	return m.Timeout
+}
+
+// RetryPolicy defines how a failing scenario is retried, e.g. when cloud logs take longer than usual to be ingested
+type RetryPolicy struct {
+	// MaxAttempts is the maximal number of times the scenario is run, including the first attempt
+	MaxAttempts int
+	// Redetonate makes every attempt detonate the attack again. Otherwise, attempts keep waiting for
+	// the alerts of the previous detonation that didn't show up yet
+	Redetonate bool
+	// Backoff is how long to wait between attempts
+	Backoff time.Duration
+}
+
+func (m RetryPolicy) maxAttempts() int {
+	if m.MaxAttempts < 1 {
+		return 1
+	}
+	return m.MaxAttempts
 }
 
 type ScenarioBuilder struct {
@@ -22,21 +62,67 @@ func (m *ScenarioBuilder) WhenDetonating(detonation detonators.Detonator) *Scena
 	return m
 }
 
+// ThenDetonating adds a step to the attack of the scenario, turning it into a multi-step attack.
+// All steps inject the same detonation UUID, so that expectations match alerts triggered by any of them.
+func (m *ScenarioBuilder) ThenDetonating(detonation detonators.Detonator) *ScenarioBuilder {
+	return m.ThenDetonatingAfter(0, detonation)
+}
+
+// ThenDetonatingAfter adds a step to the attack of the scenario, run once the given delay elapsed after the previous step
+func (m *ScenarioBuilder) ThenDetonatingAfter(delay time.Duration, detonation detonators.Detonator) *ScenarioBuilder {
+	chain, ok := m.Detonator.(*detonators.ChainDetonator)
+	if !ok {
+		chain = detonators.NewChainDetonator()
+		if m.Detonator != nil {
+			chain.Steps = append(chain.Steps, detonators.DetonationStep{Detonator: m.Detonator})
+		}
+		m.Detonator = chain
+	}
+	chain.Steps = append(chain.Steps, detonators.DetonationStep{Detonator: detonation, Delay: delay})
+	return m
+}
+
+// WithDetonationTimeout interrupts the detonation of the scenario if it takes longer than the given timeout
+func (m *ScenarioBuilder) WithDetonationTimeout(timeout time.Duration) *ScenarioBuilder {
+	m.DetonationTimeout = timeout
+	return m
+}
+
 func (m *ScenarioBuilder) WithTimeout(timeout time.Duration) *ScenarioBuilder {
 	m.Timeout = timeout
 	return m
 }
 
+// WithRetryPolicy retries the scenario when it fails. Scenarios that pass after being retried are reported as flaky.
+func (m *ScenarioBuilder) WithRetryPolicy(policy RetryPolicy) *ScenarioBuilder {
+	m.Retry = policy
+	return m
+}
+
 func (m *ScenarioBuilder) Expect(assertion matchers.AlertGeneratedMatcher) *ScenarioBuilder {
-	m.Assertions = append(m.Assertions, assertion)
+	m.Assertions = append(m.Assertions, Assertion{AlertGeneratedMatcher: assertion})
+	return m
+}
+
+// ExpectWithin adds an assertion that has to pass within the given timeout, independently of the scenario timeout
+func (m *ScenarioBuilder) ExpectWithin(assertion matchers.AlertGeneratedMatcher, timeout time.Duration) *ScenarioBuilder {
+	m.Assertions = append(m.Assertions, Assertion{AlertGeneratedMatcher: assertion, Timeout: timeout})
+	return m
+}
+
+// ExpectNoAlert adds an assertion that passes only if no alert is generated during the whole observation window
+func (m *ScenarioBuilder) ExpectNoAlert(assertion matchers.AlertGeneratedMatcher, window time.Duration) *ScenarioBuilder {
+	m.Assertions = append(m.Assertions, Assertion{AlertGeneratedMatcher: assertion, Timeout: window, NoAlert: true})
 	return m
 }
 
 func (m *ScenarioBuilder) Build() *Scenario {
 	return &Scenario{
-		Name:       m.Name,
-		Detonator:  m.Detonator,
-		Timeout:    m.Timeout,
-		Assertions: m.Assertions,
+		Name:              m.Name,
+		Detonator:         m.Detonator,
+		DetonationTimeout: m.DetonationTimeout,
+		Timeout:           m.Timeout,
+		Assertions:        m.Assertions,
+		Retry:             m.Retry,
 	}
 }
@@ -3,7 +3,11 @@
 // risking accidental leaks through logs, error messages, or JSON output.
 package secret
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
 
 // Secret holds a sensitive string value. Its String() and MarshalJSON()
 // methods return a redacted placeholder to prevent accidental logging
@@ -27,6 +31,13 @@ func (s Secret) Value() string {
 	return s.value
 }
 
+// Fingerprint returns a short, non-reversible identifier of the secret. It is safe to log
+// and allows telling apart two secrets without revealing them.
+func (s Secret) Fingerprint() string {
+	hash := sha256.Sum256([]byte(s.value))
+	return hex.EncodeToString(hash[:4])
+}
+
 // String returns a redacted placeholder.
 func (s Secret) String() string {
 	return redactedValue
@@ -0,0 +1,291 @@
+package threatest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/datadog/threatest/pkg/threatest/matchers"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// RunState records the detonations of runs, so that the alerts they generated can be cleaned up later on,
+// even if a run crashed before cleaning them up itself
+type RunState struct {
+	Runs []*RunRecord `json:"runs"`
+}
+
+// RunRecord describes a run and the detonations of its scenarios
+type RunRecord struct {
+	RunId     string    `json:"runId"`
+	StartTime time.Time `json:"startTime"`
+	// EndTime is unset while the run is in progress, or if it crashed
+	EndTime *time.Time `json:"endTime,omitempty"`
+	// InputFiles are the files the scenarios of the run were parsed from, to resolve their matchers again
+	InputFiles  []string            `json:"inputFiles,omitempty"`
+	Detonations []*DetonationRecord `json:"detonations"`
+}
+
+// DetonationRecord describes a detonation, and the backends where the alerts it generated are expected
+type DetonationRecord struct {
+	Scenario       string    `json:"scenario"`
+	DetonationUuid string    `json:"detonationUuid"`
+	Targets        []string  `json:"targets,omitempty"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+	// Backends identify the backends queried by the matchers of the scenario, e.g. a Datadog org
+	Backends []string `json:"backends,omitempty"`
+	Matchers []string `json:"matchers,omitempty"`
+	// CleanedUp is true once the run cleaned up the alerts of the detonation. Alerts generated late may remain.
+	CleanedUp bool `json:"isCleanedUp"`
+}
+
+// Detonation returns the detonation described by the record, for matchers correlating alerts with its targets and timing
+func (m *DetonationRecord) Detonation() matchers.Detonation {
+	return matchers.Detonation{
+		Uuid:    m.DetonationUuid,
+		Targets: m.Targets,
+		Start:   m.StartTime,
+		End:     m.EndTime,
+	}
+}
+
+// LoadRunState reads the state persisted to a file, returning an empty state if the file doesn't exist
+func LoadRunState(path string) (*RunState, error) {
+	state := &RunState{Runs: []*RunRecord{}}
+	rawState, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read state file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(rawState, state); err != nil {
+		return nil, fmt.Errorf("unable to parse state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// Save persists the state to a file. The file is replaced atomically, so that it is never left half-written.
+func (m *RunState) Save(path string) error {
+	rawState, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to convert state to JSON: %w", err)
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write state file %s: %w", path, err)
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(rawState); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("unable to write state file %s: %w", path, err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("unable to write state file %s: %w", path, err)
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("unable to write state file %s: %w", path, err)
+	}
+	return nil
+}
+
+// UpdateRunState applies a change to the state persisted to a file, reading it again first so that the
+// records of other runs persisted in the meantime are kept. Concurrent updates, including from other processes
+// sharing the state file, are serialized with a lock on a file next to it.
+func UpdateRunState(path string, update func(state *RunState)) error {
+	unlock, err := lockStateFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := LoadRunState(path)
+	if err != nil {
+		return err
+	}
+	update(state)
+	return state.Save(path)
+}
+
+// lockStateFile takes an exclusive lock on the ".lock" file next to a state file, and returns the function
+// releasing it
+func lockStateFile(path string) (func(), error) {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock state file %s: %w", path, err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to lock state file %s: %w", path, err)
+	}
+	return func() {
+		_ = unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// RemoveDetonations forgets the detonations with the given UUIDs, as well as the runs left without any detonation
+func (m *RunState) RemoveDetonations(detonationUuids []string) {
+	runs := []*RunRecord{}
+	for _, run := range m.Runs {
+		run.Detonations = slices.DeleteFunc(run.Detonations, func(detonation *DetonationRecord) bool {
+			return slices.Contains(detonationUuids, detonation.DetonationUuid)
+		})
+		if len(run.Detonations) > 0 || run.EndTime == nil {
+			runs = append(runs, run)
+		}
+	}
+	m.Runs = runs
+}
+
+// StateListener persists the detonations of a run to a state file as soon as they happen, so that their alerts
+// can be cleaned up even if the run doesn't complete
+type StateListener struct {
+	NoopListener
+	Path string
+
+	lock sync.Mutex
+	run  *RunRecord
+	// attemptStarts holds when the current attempt of each scenario started, until its detonation is recorded
+	attemptStarts map[*Scenario]time.Time
+}
+
+// NewStateListener creates a listener persisting a new run to the given state file
+func NewStateListener(path string, inputFiles []string) (*StateListener, error) {
+	listener := &StateListener{
+		Path: path,
+		run: &RunRecord{
+			RunId:       uuid.NewString(),
+			StartTime:   time.Now(),
+			InputFiles:  inputFiles,
+			Detonations: []*DetonationRecord{},
+		},
+		attemptStarts: map[*Scenario]time.Time{},
+	}
+	return listener, listener.save()
+}
+
+// RunId returns the identifier of the run in the state file
+func (m *StateListener) RunId() string {
+	return m.run.RunId
+}
+
+func (m *StateListener) ScenarioStarted(scenario *Scenario) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.attemptStarts[scenario] = time.Now()
+}
+
+func (m *StateListener) ScenarioRetrying(scenario *Scenario, _ int, _ *ScenarioResult) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.attemptStarts[scenario] = time.Now()
+}
+
+func (m *StateListener) ScenarioDetonated(scenario *Scenario, detonationUuid string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.addDetonation(scenario, detonationUuid, m.attemptStarts[scenario], time.Now())
+	m.saveOrWarn()
+}
+
+func (m *StateListener) CleanupFinished(_ *Scenario, detonationUuid string, err error) {
+	if err != nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if detonation := m.findDetonation(detonationUuid); detonation != nil {
+		detonation.CleanedUp = true
+		m.saveOrWarn()
+	}
+}
+
+// ScenarioFinished records the exact targets and timing of the detonations of the scenario, along with
+// the detonations that weren't reported as successful but may still have generated alerts
+func (m *StateListener) ScenarioFinished(scenario *Scenario, result *ScenarioResult) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.attemptStarts, scenario)
+	for _, attempt := range append(result.Attempts, result) {
+		if attempt.DetonationUuid == "" {
+			continue
+		}
+		detonation := m.findDetonation(attempt.DetonationUuid)
+		if detonation == nil {
+			detonation = m.addDetonation(scenario, attempt.DetonationUuid, attempt.DetonationStart, attempt.DetonationEnd)
+		}
+		if !attempt.DetonationStart.IsZero() {
+			detonation.StartTime = attempt.DetonationStart
+		}
+		if !attempt.DetonationEnd.IsZero() {
+			detonation.EndTime = attempt.DetonationEnd
+		}
+		if attempt.Detonation != nil {
+			detonation.Targets = detonationTargets(attempt.Detonation)
+		}
+	}
+	m.saveOrWarn()
+}
+
+// Close records the end of the run
+func (m *StateListener) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	endTime := time.Now()
+	m.run.EndTime = &endTime
+	return m.save()
+}
+
+func (m *StateListener) addDetonation(scenario *Scenario, detonationUuid string, start time.Time, end time.Time) *DetonationRecord {
+	scenarioMatchers := scenarioMatchers(scenario)
+	descriptions := make([]string, len(scenarioMatchers))
+	for i, matcher := range scenarioMatchers {
+		descriptions[i] = matcher.String()
+	}
+	detonation := &DetonationRecord{
+		Scenario:       scenario.Name,
+		DetonationUuid: detonationUuid,
+		StartTime:      start,
+		EndTime:        end,
+		Backends:       matchers.Backends(scenarioMatchers),
+		Matchers:       descriptions,
+	}
+	m.run.Detonations = append(m.run.Detonations, detonation)
+	return detonation
+}
+
+func (m *StateListener) findDetonation(detonationUuid string) *DetonationRecord {
+	for _, detonation := range m.run.Detonations {
+		if detonation.DetonationUuid == detonationUuid {
+			return detonation
+		}
+	}
+	return nil
+}
+
+// save persists the run, replacing its previous version in the state file
+func (m *StateListener) save() error {
+	return UpdateRunState(m.Path, func(state *RunState) {
+		for i, run := range state.Runs {
+			if run.RunId == m.run.RunId {
+				state.Runs[i] = m.run
+				return
+			}
+		}
+		state.Runs = append(state.Runs, m.run)
+	})
+}
+
+// saveOrWarn persists the run from listener callbacks, which can't fail the run
+func (m *StateListener) saveOrWarn() {
+	if err := m.save(); err != nil {
+		log.Warnf("unable to persist the state of the run: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package threatest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datadog/threatest/pkg/threatest/detonators"
+	"github.com/datadog/threatest/pkg/threatest/matchers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateListenerPersistsDetonations(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	listener, err := NewStateListener(statePath, []string{"/scenarios/my-scenario.yaml"})
+	require.NoError(t, err)
+
+	detonation := &detonators.DetonationResult{DetonationUuid: "my-uid", Target: "my-host"}
+	runner := TestRunner{
+		Scenarios: []*Scenario{{
+			Name:       "my-scenario",
+			Detonator:  &describedDetonator{result: detonation},
+			Assertions: []Assertion{{AlertGeneratedMatcher: newBackendMatcher("datadog")}},
+			Timeout:    1 * time.Second,
+		}},
+		Listeners: []Listener{listener},
+	}
+	require.NoError(t, runner.Run())
+
+	state, err := LoadRunState(statePath)
+	require.NoError(t, err)
+	require.Len(t, state.Runs, 1)
+	run := state.Runs[0]
+	assert.Equal(t, listener.RunId(), run.RunId)
+	assert.Equal(t, []string{"/scenarios/my-scenario.yaml"}, run.InputFiles)
+	assert.Nil(t, run.EndTime, "the run should be in progress until the listener is closed")
+	require.Len(t, run.Detonations, 1)
+	recorded := run.Detonations[0]
+	assert.Equal(t, "my-scenario", recorded.Scenario)
+	assert.Equal(t, "my-uid", recorded.DetonationUuid)
+	assert.Equal(t, []string{"my-host"}, recorded.Targets)
+	assert.Equal(t, []string{"datadog"}, recorded.Backends)
+	assert.Equal(t, []string{"datadog"}, recorded.Matchers)
+	assert.False(t, recorded.StartTime.IsZero())
+	assert.False(t, recorded.EndTime.IsZero())
+	assert.True(t, recorded.CleanedUp)
+
+	require.NoError(t, listener.Close())
+	state, err = LoadRunState(statePath)
+	require.NoError(t, err)
+	assert.NotNil(t, state.Runs[0].EndTime)
+}
+
+func TestStateListenerPersistsDetonationsBeforeScenarioCompletes(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	listener, err := NewStateListener(statePath, nil)
+	require.NoError(t, err)
+	scenario := &Scenario{Name: "my-scenario", Assertions: []Assertion{{AlertGeneratedMatcher: newBackendMatcher("elastic")}}}
+
+	listener.ScenarioStarted(scenario)
+	listener.ScenarioDetonated(scenario, "my-uid")
+
+	// The process may crash at this point, e.g. while waiting for alerts
+	state, err := LoadRunState(statePath)
+	require.NoError(t, err)
+	require.Len(t, state.Runs, 1)
+	require.Len(t, state.Runs[0].Detonations, 1)
+	assert.Equal(t, "my-uid", state.Runs[0].Detonations[0].DetonationUuid)
+	assert.Equal(t, []string{"elastic"}, state.Runs[0].Detonations[0].Backends)
+	assert.False(t, state.Runs[0].Detonations[0].CleanedUp)
+}
+
+func TestStateListenerKeepsOtherRuns(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	first, err := NewStateListener(statePath, nil)
+	require.NoError(t, err)
+	second, err := NewStateListener(statePath, nil)
+	require.NoError(t, err)
+
+	scenario := &Scenario{Name: "my-scenario"}
+	first.ScenarioDetonated(scenario, "first-uid")
+	second.ScenarioDetonated(scenario, "second-uid")
+	require.NoError(t, first.Close())
+
+	state, err := LoadRunState(statePath)
+	require.NoError(t, err)
+	require.Len(t, state.Runs, 2)
+	assert.Equal(t, "first-uid", state.Runs[0].Detonations[0].DetonationUuid)
+	assert.NotNil(t, state.Runs[0].EndTime)
+	assert.Equal(t, "second-uid", state.Runs[1].Detonations[0].DetonationUuid)
+}
+
+func TestUpdateRunStateSerializesConcurrentUpdates(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, UpdateRunState(statePath, func(state *RunState) {
+				state.Runs = append(state.Runs, &RunRecord{RunId: strconv.Itoa(i)})
+			}))
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := LoadRunState(statePath)
+	require.NoError(t, err)
+	assert.Len(t, state.Runs, 20, "no update should be lost")
+}
+
+func TestRunStateRemoveDetonations(t *testing.T) {
+	now := time.Now()
+	state := &RunState{Runs: []*RunRecord{
+		{RunId: "finished", EndTime: &now, Detonations: []*DetonationRecord{{DetonationUuid: "a"}, {DetonationUuid: "b"}}},
+		{RunId: "partially-cleaned", EndTime: &now, Detonations: []*DetonationRecord{{DetonationUuid: "c"}, {DetonationUuid: "d"}}},
+		{RunId: "in-progress", Detonations: []*DetonationRecord{{DetonationUuid: "e"}}},
+	}}
+
+	state.RemoveDetonations([]string{"a", "b", "c", "e"})
+
+	require.Len(t, state.Runs, 2)
+	assert.Equal(t, "partially-cleaned", state.Runs[0].RunId)
+	require.Len(t, state.Runs[0].Detonations, 1)
+	assert.Equal(t, "d", state.Runs[0].Detonations[0].DetonationUuid)
+	assert.Equal(t, "in-progress", state.Runs[1].RunId, "a run in progress should be kept, since it may detonate again")
+	assert.Empty(t, state.Runs[1].Detonations)
+}
+
+func TestLoadRunState(t *testing.T) {
+	state, err := LoadRunState(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	assert.Empty(t, state.Runs)
+
+	invalidPath := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("{"), 0600))
+	_, err = LoadRunState(invalidPath)
+	assert.ErrorContains(t, err, "unable to parse state file")
+}
+
+func TestSweepDetonationsWithRecordedDetonation(t *testing.T) {
+	start := time.Now().Add(-2 * time.Hour)
+	record := &DetonationRecord{DetonationUuid: "my-uid", Targets: []string{"my-host"}, StartTime: start, EndTime: start.Add(time.Minute)}
+
+	var cleanedUp matchers.Detonation
+	matcher := newBackendMatcher("datadog")
+	scenario := &Scenario{Name: "my-scenario", Assertions: []Assertion{{AlertGeneratedMatcher: &detonationAwareMatcher{
+		backendMatcher: matcher,
+		onCleanup: func(ctx context.Context, uuid string) {
+			cleanedUp = matchers.DetonationFromContext(ctx, uuid)
+		},
+	}}}}
+
+	ctx := matchers.WithDetonation(context.Background(), record.Detonation())
+	require.NoError(t, Threatest().SweepDetonations(ctx, scenario, []string{"my-uid"}))
+	assert.Equal(t, record.Detonation(), cleanedUp, "matchers should be aware of the recorded detonation")
+}
+
+// detonationAwareMatcher is a matcher inspecting the context it is cleaned up with
+type detonationAwareMatcher struct {
+	*backendMatcher
+	onCleanup func(ctx context.Context, uuid string)
+}
+
+func (m *detonationAwareMatcher) Cleanup(ctx context.Context, uuid string) error {
+	m.onCleanup(ctx, uuid)
+	return m.backendMatcher.Cleanup(ctx, uuid)
+}